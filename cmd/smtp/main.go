@@ -1,38 +1,47 @@
 // mail receiver and web interface
 // mail is stored in blob storage under the `mail/` prefix
-// webmail is authenticated against blob storage hashes under `bcrypt/<username>` keys
+// webmail, JMAP, POP3 and IMAP are authenticated against blob storage hashes under `bcrypt/<username>` keys
 // credentials can be generated with e.g. `go run . genpass passw0rd`
-// set ENV NO_TLS to disable SSL
+// set ENV CONFIG_FILE to a YAML or TOML file with the settings in config.SMTP; each can also be
+// set with the environment variable named in its `env` tag, e.g. MX_DOMAINS, BLOB_KEY or XSRF_SECRET,
+// which takes precedence over the file. See config/smtp/example.yml.
 
 package main
 
 import (
+	"context"
+	"crypto/tls"
 	"fmt"
-	"log"
+	"log/slog"
+	"net"
+	"net/http"
 	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
 	"time"
 
 	"github.com/buckelij/sif.io/internal/blob"
+	"github.com/buckelij/sif.io/internal/clamd"
+	"github.com/buckelij/sif.io/internal/config"
+	"github.com/buckelij/sif.io/internal/health"
+	"github.com/buckelij/sif.io/internal/imap"
+	"github.com/buckelij/sif.io/internal/jmap"
+	"github.com/buckelij/sif.io/internal/logging"
+	"github.com/buckelij/sif.io/internal/milter"
+	"github.com/buckelij/sif.io/internal/pop3"
+	"github.com/buckelij/sif.io/internal/proxyproto"
 	"github.com/buckelij/sif.io/internal/smtp"
+	"github.com/buckelij/sif.io/internal/ssl"
 	gosmtp "github.com/emersion/go-smtp"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"golang.org/x/crypto/acme/autocert"
 	"golang.org/x/crypto/bcrypt"
 )
 
-var config = struct {
-	MxDomains     string
-	BlobAccount   string
-	BlobContainer string
-	BlobKey       string
-	XsrfSecret    string
-	NoTls         string
-}{
-	MxDomains:     os.Getenv("MX_DOMAINS"),
-	BlobAccount:   os.Getenv("BLOB_ACCOUNT"),
-	BlobContainer: os.Getenv("BLOB_CONTAINER"),
-	BlobKey:       os.Getenv("BLOB_KEY"),
-	XsrfSecret:    os.Getenv("XSRF_SECRET"),
-	NoTls:         os.Getenv("NO_TLS"),
-}
+// cfg is the defaults until main loads the configuration
+var cfg = config.DefaultSMTP()
 
 /*
 EHLO localhost
@@ -47,50 +56,315 @@ func newServer(be *smtp.Backend) *gosmtp.Server {
 
 	s.Addr = be.ListenAddress
 	s.Domain = be.Domain
-	s.ReadTimeout = 10 * time.Second
-	s.WriteTimeout = 10 * time.Second
-	s.MaxMessageBytes = 1024 * 1024 * 5
-	s.MaxRecipients = 500
+	s.ReadTimeout = cfg.ReadTimeout
+	s.WriteTimeout = cfg.WriteTimeout
+	s.MaxMessageBytes = cfg.MaxMessageBytes
+	s.MaxRecipients = cfg.MaxRecipients
+	// 8BITMIME and CHUNKING are always advertised; message data is stored as received
+	s.EnableSMTPUTF8 = true
+	s.EnableBINARYMIME = true
+	s.EnableDSN = true
 
 	return s
 }
 
+// starttlsConfig returns the TLS configuration inbound SMTP offers STARTTLS
+// with, which MTA-STS senders require, or nil without certificates. Senders
+// may not send a server name, so it defaults to Domain.
+func starttlsConfig(certificates *autocert.Manager) *tls.Config {
+	if certificates == nil {
+		return nil
+	}
+	return ssl.DefaultHost(certificates.TLSConfig(), cfg.Domain)
+}
+
+// newLMTPServer returns an LMTP server for an upstream MTA to deliver through.
+// address is a TCP `host:port` or a `unix:/path/to/socket`.
+func newLMTPServer(be *smtp.Backend, address string) *gosmtp.Server {
+	s := newServer(be)
+	s.LMTP = true
+	s.Network = "tcp"
+	s.Addr = address
+	if path, ok := strings.CutPrefix(address, "unix:"); ok {
+		s.Network = "unix"
+		s.Addr = path
+	}
+
+	return s
+}
+
+// newInternalServer returns the internal server for Prometheus scrapes and Kubernetes probes
+func newInternalServer(checker *health.Checker) *http.Server {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	mux.HandleFunc("/healthz", checker.Healthz)
+	mux.HandleFunc("/readyz", checker.Readyz)
+	return &http.Server{Addr: cfg.MetricsAddress, Handler: mux}
+}
+
+// milters returns clients for the configured filters
+func milters() []*milter.Client {
+	clients := []*milter.Client{}
+	for _, address := range cfg.Milters {
+		c := milter.NewClient(address)
+		c.Timeout = cfg.MilterTimeout
+		c.FailOpen = cfg.MilterFailOpen
+		clients = append(clients, c)
+	}
+	return clients
+}
+
+// webhooks returns the configured webhooks
+func webhooks() []smtp.Webhook {
+	hooks := []smtp.Webhook{}
+	for _, u := range cfg.WebhookUrls {
+		hooks = append(hooks, smtp.Webhook{URL: u, Secret: cfg.WebhookSecret})
+	}
+	return hooks
+}
+
+// a mailServer serves a mail access protocol, returning closed after Shutdown
+type mailServer interface {
+	Serve(ln net.Listener) error
+}
+
+// serveMail serves proto, e.g. "pop3", on address, with implicit TLS if tlsConfig is set
+func serveMail(proto string, s mailServer, closed error, address string, proxies []*net.IPNet, tlsConfig *tls.Config) {
+	ln, err := net.Listen("tcp", address)
+	if err != nil {
+		fatal(proto+" listen", "err", err)
+	}
+	if len(proxies) > 0 {
+		ln = proxyproto.NewListener(ln, proxies)
+	}
+	if tlsConfig != nil {
+		ln = tls.NewListener(ln, tlsConfig)
+	}
+	slog.Info("starting "+proto+" server", "addr", address, "tls", tlsConfig != nil)
+	go func() {
+		if err := s.Serve(ln); err != closed {
+			fatal(proto+" server", "err", err)
+		}
+	}()
+}
+
+// fatal logs an error and exits
+func fatal(msg string, args ...any) {
+	slog.Error(msg, args...)
+	os.Exit(1)
+}
+
 func main() {
-	log.Println("starting")
 	if len(os.Args) > 2 && os.Args[1] == "genpass" {
 		v, _ := bcrypt.GenerateFromPassword([]byte(os.Args[2]), bcrypt.DefaultCost)
 		fmt.Println(string(v))
 		return
 	}
 
-	blobClient, err := blob.NewAzureBlobClient(config.BlobAccount, config.BlobContainer, config.BlobKey)
+	var err error
+	if cfg, err = config.LoadSMTP(os.Getenv("CONFIG_FILE")); err != nil {
+		fatal("invalid configuration", "err", err)
+	}
+	slog.SetDefault(logging.New(os.Stderr, cfg.Logging()))
+	slog.Info("starting")
+
+	blobClient, err := blob.NewAzureBlobClient(cfg.BlobAccount, cfg.BlobContainer, cfg.BlobKey)
 	if err != nil {
 		panic("failed to create blob client")
 	}
+	blobClient = blob.Instrument(blobClient)
 	err = blobClient.Put("pingsmtp", []byte("pong"))
 	if err != nil {
-		log.Println("failed to upload ping", err)
+		slog.Warn("failed to upload ping", "err", err)
 	}
 
-	s := newServer(&smtp.Backend{
-		ListenAddress: "0.0.0.0:1025",
-		Domain:        "mx.sif.io",
-		MxDomains:     config.MxDomains,
-		BlobAccount:   config.BlobAccount,
-		BlobContainer: config.BlobContainer,
-		BlobKey:       config.BlobKey,
+	// validated by LoadSMTP
+	proxies, _ := proxyproto.ParseCIDRs(strings.Join(cfg.ProxyTrusted, ","))
+	mailboxQuota := smtp.Quota{Bytes: cfg.QuotaBytes, Messages: cfg.QuotaMessages}
+
+	be := &smtp.Backend{
+		ListenAddress: cfg.ListenAddress,
+		Domain:        cfg.Domain,
+		MxDomains:     strings.Join(cfg.MxDomains, ","),
+		BlobAccount:   cfg.BlobAccount,
+		BlobContainer: cfg.BlobContainer,
+		BlobKey:       cfg.BlobKey,
 		BlobClient:    blobClient,
-	})
-	log.Println("Starting server at", s.Addr)
+		Quota:         mailboxQuota,
+		ScanAction:    smtp.ScanAction(cfg.ClamdAction),
+		Milters:       milters(),
+		Webhooks:      webhooks(),
+		Relay:         cfg.RelayAddress,
+		DedupeWindow:  cfg.DedupeWindow,
+		DedupeAction:  smtp.DedupeAction(cfg.DedupeAction),
+		SRS:           cfg.SRS(),
+		ListSecret:    []byte(cfg.ListSecret),
+		TLSRPTAddress: cfg.TLSRPTAddress,
+	}
+	if cfg.ClamdAddress != "" {
+		be.Scanner = clamd.NewClient(cfg.ClamdAddress)
+	}
+	var certificates *autocert.Manager
+	if !cfg.NoTls {
+		certificates = ssl.NewSSLmanager(blobClient, cfg.CertificateHosts()...)
+	}
+	s := newServer(be)
+	s.TLSConfig = starttlsConfig(certificates)
+	slog.Info("starting server", "addr", s.Addr, "starttls", s.TLSConfig != nil)
+
+	stopOutbound, outboundDone := make(chan struct{}), make(chan struct{})
+	go func() {
+		be.RunOutbound(cfg.OutboundInterval, stopOutbound)
+		close(outboundDone)
+	}()
 
-	xsrfSecret := config.XsrfSecret
-	if xsrfSecret == "" {
-		log.Fatal("XSRF_SECRET not set")
+	var ls *gosmtp.Server
+	if cfg.LmtpAddress != "" {
+		ls = newLMTPServer(be, cfg.LmtpAddress)
+		slog.Info("starting LMTP server", "network", ls.Network, "addr", ls.Addr)
+		go func() {
+			if err := ls.ListenAndServe(); err != nil {
+				fatal("LMTP server", "err", err)
+			}
+		}()
 	}
-	webmailservice := smtp.NewWebMailer(xsrfSecret, blobClient, config.NoTls != "")
+
+	webmailservice := smtp.NewWebMailer(cfg.XsrfSecret, blobClient, cfg.NoTls, mailboxQuota, proxies)
+	webmailservice.Addr = cfg.WebmailAddress
+	// the webmail listener answers the ACME challenges for the MX host too
+	webmailservice.TLSHosts = cfg.CertificateHosts()
+	webmailservice.AdminUser = cfg.AdminUser
+	jmapHandler := jmap.NewHandler(be, blobClient)
+	webmailservice.Handle("/jmap/", jmapHandler)
+	webmailservice.Handle("/.well-known/jmap", jmapHandler)
 	go webmailservice.ListenAndServeWebmail()
 
-	if err := s.ListenAndServe(); err != nil {
-		log.Fatal(err)
+	var mailTLS *tls.Config
+	if certificates != nil && len(cfg.TLSHosts) > 0 {
+		mailTLS = ssl.DefaultHost(certificates.TLSConfig(), cfg.TLSHosts[0])
+	}
+	var popServer *pop3.Server
+	if cfg.Pop3Address != "" || cfg.Pop3sAddress != "" {
+		popServer = pop3.NewServer(be, mailTLS)
+		if cfg.Pop3Address != "" {
+			serveMail("pop3", popServer, pop3.ErrServerClosed, cfg.Pop3Address, proxies, nil)
+		}
+		if cfg.Pop3sAddress != "" {
+			serveMail("pop3s", popServer, pop3.ErrServerClosed, cfg.Pop3sAddress, proxies, mailTLS)
+		}
+	}
+	var imapServer *imap.Server
+	if cfg.ImapAddress != "" || cfg.ImapsAddress != "" {
+		imapServer = imap.NewServer(be, mailTLS)
+		if cfg.ImapAddress != "" {
+			serveMail("imap", imapServer, imap.ErrServerClosed, cfg.ImapAddress, proxies, nil)
+		}
+		if cfg.ImapsAddress != "" {
+			serveMail("imaps", imapServer, imap.ErrServerClosed, cfg.ImapsAddress, proxies, mailTLS)
+		}
+	}
+
+	ln, err := net.Listen("tcp", s.Addr)
+	if err != nil {
+		fatal("smtp listen", "err", err)
+	}
+	if len(proxies) > 0 {
+		ln = proxyproto.NewListener(ln, proxies)
+	}
+	go func() {
+		if err := s.Serve(ln); err != nil {
+			fatal("smtp server", "err", err)
+		}
+	}()
+
+	checker := health.NewChecker()
+	checker.AddReady("blob", health.Blob(blobClient, "pingsmtp"))
+	checker.AddLive("smtp", health.Listener(s.Addr))
+	if ls != nil {
+		checker.AddLive("lmtp", health.Listener(cfg.LmtpAddress))
+	}
+	checker.AddLive("webmail", webmailservice.Listening)
+	if cfg.Pop3Address != "" {
+		checker.AddLive("pop3", health.Listener(cfg.Pop3Address))
+	}
+	if cfg.Pop3sAddress != "" {
+		checker.AddLive("pop3s", health.Listener(cfg.Pop3sAddress))
+	}
+	if cfg.ImapAddress != "" {
+		checker.AddLive("imap", health.Listener(cfg.ImapAddress))
+	}
+	if cfg.ImapsAddress != "" {
+		checker.AddLive("imaps", health.Listener(cfg.ImapsAddress))
+	}
+	if !cfg.NoTls {
+		cache := ssl.SSLblobCache{BlobClient: blobClient}
+		for _, host := range cfg.CertificateHosts() {
+			checker.AddOptional("certificate "+host, func(ctx context.Context) error {
+				return ssl.CertificateValid(ctx, cache, host)
+			})
+		}
+	}
+	is := newInternalServer(checker)
+	slog.Info("starting internal server", "addr", is.Addr)
+	go func() {
+		if err := is.ListenAndServe(); err != http.ErrServerClosed {
+			fatal("internal server", "err", err)
+		}
+	}()
+	checker.SetReady(true)
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	<-ctx.Done()
+	slog.Info("shutting down")
+	checker.SetReady(false)
+	// give readiness probes a period to take us out of the load balancer
+	time.Sleep(cfg.ShutdownDelay)
+
+	// stop accepting, let sessions finish, then wait for the uploads they started
+	ctx, cancel := context.WithTimeout(context.Background(), cfg.ShutdownTimeout)
+	defer cancel()
+	servers := []*gosmtp.Server{s}
+	if ls != nil {
+		servers = append(servers, ls)
+	}
+	var wg sync.WaitGroup
+	for _, srv := range servers {
+		wg.Go(func() {
+			if err := srv.Shutdown(ctx); err != nil {
+				slog.Warn("smtp shutdown", "err", err)
+				srv.Close()
+			}
+		})
+	}
+	wg.Go(func() {
+		if err := webmailservice.Shutdown(ctx); err != nil {
+			slog.Warn("webmail shutdown", "err", err)
+		}
+	})
+	if popServer != nil {
+		wg.Go(func() {
+			if err := popServer.Shutdown(ctx); err != nil {
+				slog.Warn("pop3 shutdown", "err", err)
+			}
+		})
+	}
+	if imapServer != nil {
+		wg.Go(func() {
+			if err := imapServer.Shutdown(ctx); err != nil {
+				slog.Warn("imap shutdown", "err", err)
+			}
+		})
+	}
+	wg.Wait()
+	close(stopOutbound)
+	select {
+	case <-outboundDone:
+	case <-ctx.Done():
+	}
+	if err := be.Drain(ctx); err != nil {
+		slog.Warn("background deliveries not finished", "err", err)
 	}
+	is.Shutdown(ctx)
+	slog.Info("stopped")
 }
@@ -1,32 +1,93 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/pem"
 	"fmt"
+	"io"
+	"log/slog"
+	"math/big"
 	"net"
 	"net/smtp"
+	"net/textproto"
+	"path/filepath"
+	"slices"
 	"strings"
 	"sync"
 	"testing"
+	"time"
 
+	"github.com/buckelij/sif.io/internal/blob"
+	"github.com/buckelij/sif.io/internal/logging"
+	"github.com/buckelij/sif.io/internal/milter"
 	sifsmtp "github.com/buckelij/sif.io/internal/smtp"
+	"github.com/buckelij/sif.io/internal/ssl"
+	gosmtp "github.com/emersion/go-smtp"
 )
 
 type TestBlobClient struct {
 	wg       sync.WaitGroup // create a wait group, this will allow you to block later
-	uploaded []string
-	gets     [][]byte // stub values to be returned
+	mu       sync.Mutex
+	uploaded []string // mail/ keys, each one calls wg.Done
+	stored   [][]byte
+	blobs    map[string][]byte // everything Put, returned by Get
+	gets     [][]byte          // stub values to be returned
 }
 
 func (c *TestBlobClient) Put(oid string, data []byte) error {
-	c.uploaded = append(c.uploaded, oid)
-	c.wg.Done()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.blobs == nil {
+		c.blobs = map[string][]byte{}
+	}
+	c.blobs[oid] = data
+	if strings.HasPrefix(oid, "mail/") {
+		c.uploaded = append(c.uploaded, oid)
+		c.stored = append(c.stored, data)
+		c.wg.Done()
+	}
 	return nil
 }
 
 func (c *TestBlobClient) Get(oid string) ([]byte, error) {
-	v := c.gets[0]
-	c.gets = c.gets[1:]
-	return v, nil
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.gets) > 0 {
+		v := c.gets[0]
+		c.gets = c.gets[1:]
+		return v, nil
+	}
+	if v, ok := c.blobs[oid]; ok {
+		return v, nil
+	}
+	return nil, blob.ErrNotFound
+}
+
+func (c *TestBlobClient) Delete(oid string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.blobs, oid)
+	return nil
+}
+
+func (c *TestBlobClient) List(prefix string) ([]string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	names := []string{}
+	for name := range c.blobs {
+		if strings.HasPrefix(name, prefix) {
+			names = append(names, name)
+		}
+	}
+	slices.Sort(names)
+	return names, nil
 }
 
 func (c *TestBlobClient) ListMail() ([]string, error) {
@@ -72,3 +133,447 @@ func TestStoresMail(t *testing.T) {
 		t.Error("mail did not store with expected blob prefix")
 	}
 }
+
+func TestLMTPDeliversPerRecipient(t *testing.T) {
+	testBlobClient := &TestBlobClient{}
+	s := newLMTPServer(&sifsmtp.Backend{
+		Domain:     "mx.sif.io",
+		MxDomains:  "sif.io",
+		BlobClient: testBlobClient,
+	}, "unix:"+filepath.Join(t.TempDir(), "lmtp.sock"))
+	if s.Network != "unix" {
+		t.Fatalf("unexpected network %q", s.Network)
+	}
+
+	l, err := net.Listen(s.Network, s.Addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.Serve(l)
+	defer s.Close()
+
+	testBlobClient.wg.Add(1)
+
+	conn, err := net.Dial(s.Network, s.Addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := gosmtp.NewClientLMTP(conn)
+	c.Mail("sender@example.org", nil)
+	c.Rcpt("recipient@sif.io", nil)
+	c.Rcpt("someone@example.org", nil)
+	wc, _ := c.Data()
+	fmt.Fprintf(wc, "This is the email body")
+	statuses, err := wc.CloseWithLMTPResponse()
+	if err == nil {
+		t.Error("expected an error for the non-local recipient")
+	}
+	if _, ok := statuses["recipient@sif.io"]; !ok {
+		t.Errorf("no status for local recipient: %v", statuses)
+	}
+	c.Quit()
+
+	testBlobClient.wg.Wait()
+
+	if len(testBlobClient.uploaded) != 1 {
+		t.Error("mail did not store")
+	}
+}
+
+// LMTP statuses are keyed by recipients as they were given, which may not be
+// normalized
+func TestLMTPMixedCaseRecipient(t *testing.T) {
+	testBlobClient := &TestBlobClient{}
+	s := newLMTPServer(&sifsmtp.Backend{
+		Domain:     "mx.sif.io",
+		MxDomains:  "sif.io",
+		BlobClient: testBlobClient,
+	}, "unix:"+filepath.Join(t.TempDir(), "lmtp.sock"))
+	l, err := net.Listen(s.Network, s.Addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.Serve(l)
+	defer s.Close()
+
+	testBlobClient.wg.Add(2)
+
+	conn, err := net.Dial(s.Network, s.Addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := gosmtp.NewClientLMTP(conn)
+	c.Mail("sender@example.org", nil)
+	c.Rcpt("Recipient@SIF.IO", nil)
+	c.Rcpt("other@sif.io.", nil)
+	wc, _ := c.Data()
+	fmt.Fprintf(wc, "This is the email body")
+	statuses, err := wc.CloseWithLMTPResponse()
+	if err != nil {
+		t.Fatalf("unexpected error %v %v", err, statuses)
+	}
+	c.Quit()
+
+	testBlobClient.wg.Wait()
+
+	if len(testBlobClient.uploaded) != 2 {
+		t.Errorf("mail did not store: %v", testBlobClient.uploaded)
+	}
+}
+
+func TestStoresUTF8BinaryMailByteExact(t *testing.T) {
+	testBlobClient := &TestBlobClient{}
+	s := newServer(&sifsmtp.Backend{
+		Domain:     "mx.sif.io",
+		MxDomains:  "bücher.example",
+		BlobClient: testBlobClient,
+	})
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.Serve(l)
+	defer s.Close()
+
+	testBlobClient.wg.Add(1)
+
+	body := "Subject: caf\xe9\r\n\r\n\x00\xff\xfe bytes \xc3\xa9\r\n.\r\n"
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	tc := textproto.NewConn(conn)
+	expect := func(code int) {
+		t.Helper()
+		if _, msg, err := tc.ReadResponse(code); err != nil {
+			t.Fatal(msg, err)
+		}
+	}
+	expect(220)
+	tc.PrintfLine("EHLO localhost")
+	_, caps, _ := tc.ReadResponse(250)
+	for _, ext := range []string{"8BITMIME", "CHUNKING", "SMTPUTF8", "BINARYMIME"} {
+		if !strings.Contains(caps, ext) {
+			t.Errorf("%s not advertised", ext)
+		}
+	}
+	tc.PrintfLine("MAIL FROM:<sénder@example.org> SMTPUTF8 BODY=BINARYMIME")
+	expect(250)
+	tc.PrintfLine("RCPT TO:<josé@BÜCHER.example>")
+	expect(250)
+	tc.PrintfLine("BDAT %d LAST", len(body))
+	tc.W.WriteString(body)
+	tc.W.Flush()
+	expect(250)
+	tc.PrintfLine("QUIT")
+	expect(221)
+
+	testBlobClient.wg.Wait()
+
+	if len(testBlobClient.uploaded) != 1 {
+		t.Fatal("mail did not store")
+	}
+	if !strings.HasPrefix(testBlobClient.uploaded[0], "mail/xn--bcher-kva.example/") {
+		t.Errorf("unexpected blob key %s", testBlobClient.uploaded[0])
+	}
+	if string(testBlobClient.stored[0]) != body {
+		t.Errorf("body not stored byte-exact: %q", testBlobClient.stored[0])
+	}
+}
+
+func TestRejectsUTF8AddressWithoutSMTPUTF8(t *testing.T) {
+	s := newServer(&sifsmtp.Backend{MxDomains: "sif.io", BlobClient: &TestBlobClient{}})
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.Serve(l)
+	defer s.Close()
+
+	tc, err := textproto.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tc.Close()
+	tc.ReadResponse(220)
+	tc.PrintfLine("EHLO localhost")
+	tc.ReadResponse(250)
+	tc.PrintfLine("MAIL FROM:<sender@example.org>")
+	tc.ReadResponse(250)
+	tc.PrintfLine("RCPT TO:<josé@sif.io>")
+	if code, msg, _ := tc.ReadResponse(250); code != 553 {
+		t.Errorf("expected 553, got %d %s", code, msg)
+	}
+}
+
+func TestOffersSTARTTLS(t *testing.T) {
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		DNSNames:     []string{"mx.sif.io"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(90 * 24 * time.Hour),
+	}
+	der, _ := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	keyDER, _ := x509.MarshalECPrivateKey(key)
+	cached := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+	cached = append(cached, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})...)
+	testBlobClient := &TestBlobClient{blobs: map[string][]byte{"certs/mx.sif.io": cached}}
+
+	be := &sifsmtp.Backend{Domain: "mx.sif.io", MxDomains: "sif.io", BlobClient: testBlobClient}
+	s := newServer(be)
+	s.TLSConfig = starttlsConfig(ssl.NewSSLmanager(testBlobClient, "mx.sif.io"))
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.Serve(l)
+	defer s.Close()
+
+	c, err := smtp.Dial(l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if ok, _ := c.Extension("STARTTLS"); !ok {
+		t.Fatal("EHLO doesn't advertise STARTTLS")
+	}
+	// senders often don't send a server name
+	if err := c.StartTLS(&tls.Config{InsecureSkipVerify: true}); err != nil {
+		t.Fatal(err)
+	}
+	if state, _ := c.TLSConnectionState(); state.PeerCertificates[0].DNSNames[0] != "mx.sif.io" {
+		t.Errorf("unexpected certificate %v", state.PeerCertificates[0].DNSNames)
+	}
+	if starttlsConfig(nil) != nil {
+		t.Error("STARTTLS offered without certificates")
+	}
+}
+
+func TestEnforcesMailboxQuota(t *testing.T) {
+	testBlobClient := &TestBlobClient{}
+	s := newServer(&sifsmtp.Backend{
+		MxDomains:  "sif.io",
+		BlobClient: testBlobClient,
+		Quota:      sifsmtp.Quota{Bytes: 30, Messages: 1},
+	})
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.Serve(l)
+	defer s.Close()
+
+	c, _ := smtp.Dial(l.Addr().String())
+	c.Mail("sender@example.org")
+	c.Rcpt("recipient@sif.io")
+	wc, _ := c.Data()
+	fmt.Fprintf(wc, "This email body is over thirty bytes")
+	if err := wc.Close(); err == nil || !strings.Contains(err.Error(), "5.2.2") {
+		t.Errorf("expected 552 at DATA, got %v", err)
+	}
+	c.Quit()
+
+	idx := &sifsmtp.MailboxIndex{}
+	idx.Add("mail/sif.io/earlier", 10)
+	idx.Save(testBlobClient, "recipient")
+
+	c, _ = smtp.Dial(l.Addr().String())
+	defer c.Close()
+	c.Mail("sender@example.org")
+	if err := c.Rcpt("recipient@sif.io"); err == nil || !strings.Contains(err.Error(), "4.2.2") {
+		t.Errorf("expected 452 at RCPT, got %v", err)
+	}
+}
+
+func TestMilterFailOpenAndClosed(t *testing.T) {
+	unreachable := milter.NewClient("unix:" + filepath.Join(t.TempDir(), "missing.sock"))
+	for _, failOpen := range []bool{false, true} {
+		unreachable.FailOpen = failOpen
+		s := newServer(&sifsmtp.Backend{
+			MxDomains:  "sif.io",
+			BlobClient: &TestBlobClient{},
+			Milters:    []*milter.Client{unreachable},
+		})
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		go s.Serve(l)
+
+		c, _ := smtp.Dial(l.Addr().String())
+		err = c.Hello("localhost")
+		if failOpen && err != nil {
+			t.Errorf("fail open filter rejected session: %v", err)
+		}
+		if !failOpen && (err == nil || !strings.Contains(err.Error(), "4.7.1")) {
+			t.Errorf("expected fail closed filter to tempfail, got %v", err)
+		}
+		c.Close()
+		s.Close()
+	}
+}
+
+// discardingFilter is a milter that lets every stage through and then asks
+// for the message to be discarded
+func discardingFilter(l net.Listener) {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			defer conn.Close()
+			write := func(code byte, data []byte) {
+				pkt := binary.BigEndian.AppendUint32(nil, uint32(len(data)+1))
+				conn.Write(append(append(pkt, code), data...))
+			}
+			for {
+				size := make([]byte, 4)
+				if _, err := io.ReadFull(conn, size); err != nil {
+					return
+				}
+				pkt := make([]byte, binary.BigEndian.Uint32(size))
+				io.ReadFull(conn, pkt)
+				switch pkt[0] {
+				case 'O': // negotiate version 6, no actions and every stage
+					write('O', []byte{0, 0, 0, 6, 0, 0, 0, 0, 0, 0, 0, 0})
+				case 'E': // end of message
+					write('d', nil)
+				case 'A':
+				case 'Q':
+					return
+				default:
+					write('c', nil)
+				}
+			}
+		}()
+	}
+}
+
+func TestLMTPMilterDiscard(t *testing.T) {
+	sock := filepath.Join(t.TempDir(), "milter.sock")
+	ml, err := net.Listen("unix", sock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ml.Close()
+	go discardingFilter(ml)
+
+	testBlobClient := &TestBlobClient{}
+	s := newLMTPServer(&sifsmtp.Backend{
+		Domain:     "mx.sif.io",
+		MxDomains:  "sif.io",
+		BlobClient: testBlobClient,
+		Milters:    []*milter.Client{milter.NewClient("unix:" + sock)},
+	}, "unix:"+filepath.Join(t.TempDir(), "lmtp.sock"))
+	l, err := net.Listen(s.Network, s.Addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.Serve(l)
+	defer s.Close()
+
+	conn, err := net.Dial(s.Network, s.Addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := gosmtp.NewClientLMTP(conn)
+	c.Mail("sender@example.org", nil)
+	c.Rcpt("recipient@sif.io", nil)
+	c.Rcpt("Other@sif.io", nil)
+	wc, _ := c.Data()
+	fmt.Fprintf(wc, "Subject: spam\r\n\r\nThis is the email body")
+	statuses, err := wc.CloseWithLMTPResponse()
+	if err != nil {
+		t.Fatalf("unexpected error %v %v", err, statuses)
+	}
+	c.Quit()
+
+	testBlobClient.mu.Lock()
+	defer testBlobClient.mu.Unlock()
+	if len(testBlobClient.uploaded) != 0 {
+		t.Errorf("discarded mail was stored: %v", testBlobClient.uploaded)
+	}
+}
+
+func TestShutdownDrainsDeliveries(t *testing.T) {
+	testBlobClient := &TestBlobClient{}
+	be := &sifsmtp.Backend{
+		Domain:     "mx.sif.io",
+		MxDomains:  "sif.io",
+		BlobClient: testBlobClient,
+	}
+	s := newServer(be)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.Serve(l)
+
+	testBlobClient.wg.Add(1)
+	c, err := smtp.Dial(l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Mail("sender@example.org")
+	c.Rcpt("recipient@sif.io")
+	wc, _ := c.Data()
+	fmt.Fprintf(wc, "This is the email body")
+	wc.Close()
+	c.Quit()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := s.Shutdown(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := be.Drain(ctx); err != nil {
+		t.Fatal(err)
+	}
+	testBlobClient.mu.Lock()
+	defer testBlobClient.mu.Unlock()
+	if len(testBlobClient.uploaded) != 1 {
+		t.Error("mail not stored before shutdown returned")
+	}
+	if _, err := net.Dial("tcp", l.Addr().String()); err == nil {
+		t.Error("still accepting after shutdown")
+	}
+}
+
+func TestDoesNotLogBodies(t *testing.T) {
+	var logs bytes.Buffer
+	defer slog.SetDefault(slog.Default())
+	slog.SetDefault(logging.New(&logs, logging.Options{}))
+
+	testBlobClient := &TestBlobClient{}
+	s := newServer(&sifsmtp.Backend{
+		Domain:     "mx.sif.io",
+		MxDomains:  "sif.io",
+		BlobClient: testBlobClient,
+	})
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.Serve(l)
+	defer s.Close()
+
+	testBlobClient.wg.Add(1)
+	c, _ := smtp.Dial(l.Addr().String())
+	c.Mail("sender@example.org")
+	c.Rcpt("recipient@sif.io")
+	wc, _ := c.Data()
+	fmt.Fprintf(wc, "Subject: private\r\n\r\nThis is the secret email body")
+	wc.Close()
+	c.Quit()
+	testBlobClient.wg.Wait()
+
+	if strings.Contains(logs.String(), "secret email body") {
+		t.Errorf("message body logged: %v", logs.String())
+	}
+	if !strings.Contains(logs.String(), "session=") || !strings.Contains(logs.String(), "key=mail/sif.io") {
+		t.Errorf("expected session and key in logs: %v", logs.String())
+	}
+}
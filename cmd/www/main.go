@@ -1,57 +1,140 @@
+// set ENV CONFIG_FILE to a YAML or TOML file with the settings in config.WWW; each can also be
+// set with the environment variable named in its `env` tag, e.g. MX_DOMAINS or MTA_STS_MODE,
+// which takes precedence over the file
+
 package main
 
 import (
-	"log"
+	"context"
+	"log/slog"
+	"net"
 	"net/http"
 	"net/url"
 	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
 	"github.com/buckelij/sif.io/internal/blob"
+	"github.com/buckelij/sif.io/internal/config"
+	"github.com/buckelij/sif.io/internal/health"
+	"github.com/buckelij/sif.io/internal/logging"
 	"github.com/buckelij/sif.io/internal/ssl"
 	"github.com/buckelij/sif.io/internal/www"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
-var config = struct {
-	BlobAccount   string
-	BlobContainer string
-	BlobKey       string
-	NoTls         string
-}{
-	BlobAccount:   os.Getenv("BLOB_ACCOUNT"),
-	BlobContainer: os.Getenv("BLOB_CONTAINER"),
-	BlobKey:       os.Getenv("BLOB_KEY"),
-	NoTls:         os.Getenv("NO_TLS"),
+// fatal logs an error and exits
+func fatal(msg string, args ...any) {
+	slog.Error(msg, args...)
+	os.Exit(1)
 }
 
 func main() {
-	log.Println("starting")
+	cfg, err := config.LoadWWW(os.Getenv("CONFIG_FILE"))
+	if err != nil {
+		fatal("invalid configuration", "err", err)
+	}
+	slog.SetDefault(logging.New(os.Stderr, cfg.Logging()))
+	slog.Info("starting")
 
 	redirMux := http.NewServeMux()
 	redirMux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
 		targetUrl := url.URL{Scheme: "https", Host: r.Host, Path: r.URL.Path}
 		http.Redirect(w, r, targetUrl.String(), http.StatusMovedPermanently)
 	})
-	go func() { log.Println(http.ListenAndServe(":8080", redirMux)) }()
-	log.Println("started redirect listener")
+	redir := &http.Server{Addr: cfg.RedirectAddress, Handler: redirMux}
+	var redirServing health.Serving
+	if redirLn, err := net.Listen("tcp", redir.Addr); err != nil {
+		slog.Error("redirect listen", "err", err)
+	} else {
+		redirServing.Set(true)
+		go func() {
+			defer redirServing.Set(false)
+			if err := redir.Serve(redirLn); err != http.ErrServerClosed {
+				slog.Error("redirect server", "err", err)
+			}
+		}()
+	}
+	slog.Info("started redirect listener")
 
 	http.HandleFunc("/", www.Index(www.IndexHtml))
 	http.HandleFunc("/resume", www.Page(www.ResumeHtml))
 	http.HandleFunc("/linkedin", www.Redirect("https://www.linkedin.com/in/buckelij"))
-	if config.NoTls != "" {
-		log.Fatal(http.ListenAndServe(":8443", nil))
-	} else {
-		blobClient, err := blob.NewAzureBlobClient(config.BlobAccount, config.BlobContainer, config.BlobKey)
+
+	http.HandleFunc("/.well-known/mta-sts.txt", www.MtaSts(www.MtaStsPolicy(cfg.MtaStsMode, cfg.MtaStsMx, cfg.MtaStsMaxAge)))
+	checker := health.NewChecker()
+	s := &http.Server{Addr: cfg.ListenAddress}
+	if !cfg.NoTls {
+		blobClient, err := blob.NewAzureBlobClient(cfg.BlobAccount, cfg.BlobContainer, cfg.BlobKey)
 		if err != nil {
 			panic("failed to create blob client")
 		}
+		blobClient = blob.Instrument(blobClient)
 		err = blobClient.Put("pingwww", []byte("pong"))
 		if err != nil {
-			log.Println("failed to upload ping", err)
+			slog.Warn("failed to upload ping", "err", err)
+		}
+		hosts := append(cfg.TLSHosts, cfg.MtaStsHosts()...)
+		s.TLSConfig = ssl.NewSSLmanager(blobClient, hosts...).TLSConfig()
+
+		checker.AddReady("blob", health.Blob(blobClient, "pingwww"))
+		cache := ssl.SSLblobCache{BlobClient: blobClient}
+		for _, host := range hosts {
+			checker.AddOptional("certificate "+host, func(ctx context.Context) error {
+				return ssl.CertificateValid(ctx, cache, host)
+			})
 		}
-		s := &http.Server{
-			Addr:      ":8443",
-			TLSConfig: ssl.NewSSLmanager(blobClient).TLSConfig(),
+	}
+	ln, err := net.Listen("tcp", s.Addr)
+	if err != nil {
+		fatal("www listen", "err", err)
+	}
+	var serving health.Serving
+	serving.Set(true)
+	go func() {
+		defer serving.Set(false)
+		var err error
+		if s.TLSConfig == nil {
+			err = s.Serve(ln)
+		} else {
+			err = s.ServeTLS(ln, "", "")
+		}
+		if err != http.ErrServerClosed {
+			fatal("www server", "err", err)
+		}
+	}()
+	checker.AddLive("www", serving.Check)
+	checker.AddLive("redirect", redirServing.Check)
+
+	internalMux := http.NewServeMux()
+	internalMux.Handle("/metrics", promhttp.Handler())
+	internalMux.HandleFunc("/healthz", checker.Healthz)
+	internalMux.HandleFunc("/readyz", checker.Readyz)
+	is := &http.Server{Addr: cfg.MetricsAddress, Handler: internalMux}
+	go func() {
+		if err := is.ListenAndServe(); err != http.ErrServerClosed {
+			fatal("internal server", "err", err)
 		}
-		log.Fatal(s.ListenAndServeTLS("", ""))
+	}()
+	checker.SetReady(true)
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	<-ctx.Done()
+	slog.Info("shutting down")
+	checker.SetReady(false)
+	// give readiness probes a period to take us out of the load balancer
+	time.Sleep(cfg.ShutdownDelay)
+
+	ctx, cancel := context.WithTimeout(context.Background(), cfg.ShutdownTimeout)
+	defer cancel()
+	if err := redir.Shutdown(ctx); err != nil {
+		slog.Warn("redirect shutdown", "err", err)
+	}
+	if err := s.Shutdown(ctx); err != nil {
+		slog.Warn("shutdown", "err", err)
 	}
+	is.Shutdown(ctx)
+	slog.Info("stopped")
 }
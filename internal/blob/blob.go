@@ -3,15 +3,22 @@ package blob
 import (
 	"bytes"
 	"context"
+	"errors"
 	"fmt"
-	"log"
+	"log/slog"
 
 	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/bloberror"
 )
 
+// ErrNotFound is returned by Get when there is no blob with that name
+var ErrNotFound = errors.New("blob not found")
+
 type BlobClient interface {
 	Put(string, []byte) error
 	Get(string) ([]byte, error)
+	Delete(string) error
+	List(prefix string) ([]string, error)
 	ListMail() ([]string, error)
 }
 
@@ -36,13 +43,16 @@ func NewAzureBlobClient(account string, container string, key string) (BlobClien
 func (c *azureBlobClient) Put(oid string, data []byte) error {
 	_, err := c.client.UploadBuffer(context.TODO(), c.container, oid, data, &azblob.UploadBufferOptions{})
 	if err != nil {
-		log.Println("failed to upload")
+		slog.Error("failed to upload", "key", oid, "err", err)
 	}
 	return err
 }
 
 func (c *azureBlobClient) Get(oid string) ([]byte, error) {
 	s, err := c.client.DownloadStream(context.TODO(), c.container, oid, &azblob.DownloadStreamOptions{})
+	if bloberror.HasCode(err, bloberror.BlobNotFound) {
+		return []byte{}, ErrNotFound
+	}
 	if err != nil {
 		return []byte{}, err
 	}
@@ -56,6 +66,30 @@ func (c *azureBlobClient) Get(oid string) ([]byte, error) {
 	return b.Bytes(), err
 }
 
+func (c *azureBlobClient) Delete(oid string) error {
+	_, err := c.client.DeleteBlob(context.TODO(), c.container, oid, &azblob.DeleteBlobOptions{})
+	if bloberror.HasCode(err, bloberror.BlobNotFound) {
+		return ErrNotFound
+	}
+	return err
+}
+
+// Lists the names of all blobs starting with prefix
+func (c *azureBlobClient) List(prefix string) ([]string, error) {
+	lister := c.client.NewListBlobsFlatPager(c.container, &azblob.ListBlobsFlatOptions{Prefix: &prefix})
+	blobs := []string{}
+	for lister.More() {
+		page, err := lister.NextPage(context.TODO())
+		if err != nil {
+			return []string{}, err
+		}
+		for _, blob := range page.Segment.BlobItems {
+			blobs = append(blobs, *blob.Name)
+		}
+	}
+	return blobs, nil
+}
+
 // Lists all mail blobs, which won't be too many right :|
 func (c *azureBlobClient) ListMail() ([]string, error) {
 	prefix := "mail/"
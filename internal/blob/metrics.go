@@ -0,0 +1,72 @@
+package blob
+
+import (
+	"errors"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	opDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "sifio_blob_operation_duration_seconds",
+		Help:    "Blob storage operation latency.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"op"})
+	opErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "sifio_blob_operation_errors_total",
+		Help: "Blob storage operations that failed, not counting missing blobs.",
+	}, []string{"op"})
+)
+
+type instrumentedClient struct {
+	BlobClient
+}
+
+// Instrument records the latency and errors of each operation on c
+func Instrument(c BlobClient) BlobClient {
+	return instrumentedClient{c}
+}
+
+func observe(op string, start time.Time, err error) {
+	opDuration.WithLabelValues(op).Observe(time.Since(start).Seconds())
+	if err != nil && !errors.Is(err, ErrNotFound) {
+		opErrors.WithLabelValues(op).Inc()
+	}
+}
+
+func (c instrumentedClient) Put(oid string, data []byte) error {
+	start := time.Now()
+	err := c.BlobClient.Put(oid, data)
+	observe("put", start, err)
+	return err
+}
+
+func (c instrumentedClient) Get(oid string) ([]byte, error) {
+	start := time.Now()
+	b, err := c.BlobClient.Get(oid)
+	observe("get", start, err)
+	return b, err
+}
+
+func (c instrumentedClient) Delete(oid string) error {
+	start := time.Now()
+	err := c.BlobClient.Delete(oid)
+	observe("delete", start, err)
+	return err
+}
+
+func (c instrumentedClient) List(prefix string) ([]string, error) {
+	start := time.Now()
+	names, err := c.BlobClient.List(prefix)
+	observe("list", start, err)
+	return names, err
+}
+
+func (c instrumentedClient) ListMail() ([]string, error) {
+	start := time.Now()
+	names, err := c.BlobClient.ListMail()
+	observe("list", start, err)
+	return names, err
+}
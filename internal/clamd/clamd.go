@@ -0,0 +1,88 @@
+// clamd client for the INSTREAM protocol
+// see https://docs.clamav.net/manual/Usage/Scanning.html#clamd
+package clamd
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+)
+
+// chunkSize must stay under clamd's StreamMaxLength chunks; 64k is conventional
+const chunkSize = 64 * 1024
+
+type Client struct {
+	Network string
+	Address string
+	Timeout time.Duration
+}
+
+// A Result is the verdict for a scanned stream
+type Result struct {
+	Infected  bool
+	Signature string
+}
+
+// NewClient returns a client for a clamd at a TCP `host:port` or a `unix:/path/to/socket`
+func NewClient(address string) *Client {
+	c := &Client{Network: "tcp", Address: address, Timeout: 30 * time.Second}
+	if path, ok := strings.CutPrefix(address, "unix:"); ok {
+		c.Network = "unix"
+		c.Address = path
+	}
+	return c
+}
+
+// Scan streams data to clamd with INSTREAM and returns its verdict
+func (c *Client) Scan(data []byte) (Result, error) {
+	conn, err := net.DialTimeout(c.Network, c.Address, c.Timeout)
+	if err != nil {
+		return Result{}, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(c.Timeout))
+
+	w := bufio.NewWriter(conn)
+	w.WriteString("zINSTREAM\x00")
+	size := make([]byte, 4)
+	for len(data) > 0 {
+		n := min(len(data), chunkSize)
+		binary.BigEndian.PutUint32(size, uint32(n))
+		w.Write(size)
+		w.Write(data[:n])
+		data = data[n:]
+	}
+	w.Write([]byte{0, 0, 0, 0})
+	if err := w.Flush(); err != nil {
+		return Result{}, err
+	}
+
+	reply, err := bufio.NewReader(conn).ReadString(0)
+	if err != nil && reply == "" {
+		return Result{}, err
+	}
+	return parseReply(reply)
+}
+
+// parseReply parses `stream: OK`, `stream: <signature> FOUND` or `<message> ERROR`
+func parseReply(reply string) (Result, error) {
+	reply = strings.TrimSpace(strings.TrimRight(reply, "\x00"))
+	switch {
+	case strings.HasSuffix(reply, "ERROR"):
+		return Result{}, fmt.Errorf("clamd: %s", reply)
+	case strings.HasSuffix(reply, " FOUND"):
+		sig := strings.TrimSuffix(reply, " FOUND")
+		if i := strings.Index(sig, ": "); i >= 0 {
+			sig = sig[i+2:]
+		}
+		return Result{Infected: true, Signature: sig}, nil
+	case strings.HasSuffix(reply, "OK"):
+		return Result{}, nil
+	default:
+		return Result{}, errors.New("clamd: unexpected reply " + reply)
+	}
+}
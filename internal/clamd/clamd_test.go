@@ -0,0 +1,78 @@
+package clamd
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"path/filepath"
+	"testing"
+)
+
+// fakeClamd answers INSTREAM requests, reporting streams containing "EICAR" as infected
+func fakeClamd(t *testing.T, l net.Listener) {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			defer conn.Close()
+			r := bufio.NewReader(conn)
+			if cmd, _ := r.ReadString(0); cmd != "zINSTREAM\x00" {
+				conn.Write([]byte("UNKNOWN COMMAND\x00"))
+				return
+			}
+			b := bytes.Buffer{}
+			size := make([]byte, 4)
+			for {
+				if _, err := io.ReadFull(r, size); err != nil {
+					return
+				}
+				n := binary.BigEndian.Uint32(size)
+				if n == 0 {
+					break
+				}
+				io.CopyN(&b, r, int64(n))
+			}
+			if bytes.Contains(b.Bytes(), []byte("EICAR")) {
+				conn.Write([]byte("stream: Eicar-Test-Signature FOUND\x00"))
+			} else {
+				conn.Write([]byte("stream: OK\x00"))
+			}
+		}()
+	}
+}
+
+func TestScan(t *testing.T) {
+	sock := filepath.Join(t.TempDir(), "clamd.sock")
+	l, err := net.Listen("unix", sock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go fakeClamd(t, l)
+
+	c := NewClient("unix:" + sock)
+	res, err := c.Scan(bytes.Repeat([]byte("clean "), chunkSize))
+	if err != nil || res.Infected {
+		t.Errorf("clean stream: %+v %v", res, err)
+	}
+	res, err = c.Scan([]byte("X5O!P%@AP[4\\PZX54(P^)7CC)7}$EICAR-STANDARD-ANTIVIRUS-TEST-FILE!$H+H*"))
+	if err != nil || !res.Infected || res.Signature != "Eicar-Test-Signature" {
+		t.Errorf("infected stream: %+v %v", res, err)
+	}
+}
+
+func TestParseReply(t *testing.T) {
+	if _, err := parseReply("INSTREAM size limit exceeded. ERROR\x00"); err == nil {
+		t.Error("expected error reply to error")
+	}
+	if _, err := parseReply("garbage"); err == nil {
+		t.Error("expected unexpected reply to error")
+	}
+	if c := NewClient("127.0.0.1:3310"); c.Network != "tcp" || c.Address != "127.0.0.1:3310" {
+		t.Errorf("unexpected tcp client %+v", c)
+	}
+}
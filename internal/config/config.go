@@ -0,0 +1,161 @@
+// configuration for the smtp and www binaries, loaded from a YAML or TOML
+// file with environment variable overrides and validated at startup
+package config
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"go.yaml.in/yaml/v3"
+	"golang.org/x/net/idna"
+)
+
+// load reads the file at path, if any, into cfg and then applies the
+// environment variables named by its `env` tags
+func load(path string, cfg any) error {
+	if path != "" {
+		b, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		switch strings.ToLower(filepath.Ext(path)) {
+		case ".yaml", ".yml":
+			dec := yaml.NewDecoder(bytes.NewReader(b))
+			dec.KnownFields(true)
+			if err := dec.Decode(cfg); err != nil && !errors.Is(err, io.EOF) {
+				return fmt.Errorf("%s: %w", path, err)
+			}
+		case ".toml":
+			md, err := toml.Decode(string(b), cfg)
+			if err != nil {
+				return fmt.Errorf("%s: %w", path, err)
+			}
+			if undecoded := md.Undecoded(); len(undecoded) > 0 {
+				return fmt.Errorf("%s: unknown keys %v", path, undecoded)
+			}
+		default:
+			return fmt.Errorf("%s: config file must be .yaml, .yml or .toml", path)
+		}
+	}
+	return applyEnv(reflect.ValueOf(cfg).Elem())
+}
+
+// applyEnv sets each field with an `env` tag from that variable, if it is set
+func applyEnv(v reflect.Value) error {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		name := t.Field(i).Tag.Get("env")
+		if name == "" {
+			continue
+		}
+		s, ok := os.LookupEnv(name)
+		if !ok || s == "" {
+			continue
+		}
+		if err := setField(v.Field(i), s); err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+	}
+	return nil
+}
+
+func setField(f reflect.Value, s string) error {
+	switch f.Interface().(type) {
+	case time.Duration:
+		d, err := time.ParseDuration(s)
+		if err != nil {
+			return err
+		}
+		f.SetInt(int64(d))
+		return nil
+	case []string:
+		f.Set(reflect.ValueOf(splitList(s)))
+		return nil
+	}
+	switch f.Kind() {
+	case reflect.String:
+		f.SetString(s)
+	case reflect.Bool:
+		// before configuration files any value enabled a flag, e.g. NO_TLS=yes,
+		// so only values ParseBool reads as false disable one
+		b, err := strconv.ParseBool(s)
+		f.SetBool(b || err != nil)
+	case reflect.Int, reflect.Int64:
+		n, err := strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			return err
+		}
+		f.SetInt(n)
+	default:
+		return fmt.Errorf("unsupported type %v", f.Type())
+	}
+	return nil
+}
+
+// splitList splits a comma separated list, dropping blanks
+func splitList(s string) []string {
+	list := []string{}
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
+
+// errs collects validation failures so they can all be reported at once
+type errs []error
+
+func (e *errs) add(format string, args ...any) {
+	*e = append(*e, fmt.Errorf(format, args...))
+}
+
+func (e errs) err() error {
+	return errors.Join(e...)
+}
+
+// checkDomain adds an error unless name is a valid host name
+func (e *errs) checkDomain(field, name string) {
+	if name == "" {
+		e.add("%s: missing domain", field)
+		return
+	}
+	if _, err := idna.Registration.ToASCII(strings.TrimSuffix(name, ".")); err != nil || !strings.Contains(name, ".") {
+		e.add("%s: invalid domain %q", field, name)
+	}
+}
+
+// checkAddress adds an error unless address is a `host:port`, or a
+// `unix:/path` when unix is allowed
+func (e *errs) checkAddress(field, address string, unix bool) {
+	if path, ok := strings.CutPrefix(address, "unix:"); ok && unix {
+		if !filepath.IsAbs(path) {
+			e.add("%s: unix socket path must be absolute", field)
+		}
+		return
+	}
+	if _, port, err := net.SplitHostPort(address); err != nil {
+		e.add("%s: %v", field, err)
+	} else if n, err := strconv.Atoi(port); err != nil || n < 0 || n > 65535 {
+		e.add("%s: invalid port %q", field, port)
+	}
+}
+
+func (e *errs) checkOneOf(field, value string, allowed ...string) {
+	for _, a := range allowed {
+		if value == a {
+			return
+		}
+	}
+	e.add("%s: %q is not one of %v", field, value, allowed)
+}
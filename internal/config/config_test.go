@@ -0,0 +1,254 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// required are the settings DefaultSMTP can't supply
+var required = map[string]string{
+	"MX_DOMAINS":     "sif.io",
+	"BLOB_ACCOUNT":   "account",
+	"BLOB_CONTAINER": "container",
+	"BLOB_KEY":       "key",
+	"XSRF_SECRET":    "0123456789abcdef",
+}
+
+func setRequired(t *testing.T) {
+	for k, v := range required {
+		t.Setenv(k, v)
+	}
+}
+
+func writeFile(t *testing.T, name, content string) string {
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadSMTPDefaults(t *testing.T) {
+	setRequired(t)
+	cfg, err := LoadSMTP("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.ListenAddress != "0.0.0.0:1025" || cfg.ReadTimeout != 10*time.Second || cfg.MaxRecipients != 500 {
+		t.Errorf("unexpected defaults %+v", cfg)
+	}
+	if len(cfg.MxDomains) != 1 || cfg.MxDomains[0] != "sif.io" {
+		t.Errorf("expected mx_domains from env, got %v", cfg.MxDomains)
+	}
+}
+
+func TestLoadSMTPYAML(t *testing.T) {
+	setRequired(t)
+	path := writeFile(t, "smtp.yml", `
+domain: mx.example.com
+mx_domains: [example.com, example.org]
+read_timeout: 30s
+max_message_bytes: 1048576
+milters: ["127.0.0.1:8891", "unix:/run/milter.sock"]
+log_format: json
+`)
+	t.Setenv("MX_DOMAINS", "")
+	cfg, err := LoadSMTP(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Domain != "mx.example.com" || cfg.ReadTimeout != 30*time.Second || cfg.MaxMessageBytes != 1048576 {
+		t.Errorf("file not applied: %+v", cfg)
+	}
+	if strings.Join(cfg.MxDomains, ",") != "example.com,example.org" || len(cfg.Milters) != 2 {
+		t.Errorf("lists not applied: %v %v", cfg.MxDomains, cfg.Milters)
+	}
+	if !cfg.Logging().JSON {
+		t.Error("expected JSON logging")
+	}
+}
+
+func TestLoadSMTPTOML(t *testing.T) {
+	setRequired(t)
+	path := writeFile(t, "smtp.toml", `
+domain = "mx.example.com"
+outbound_interval = "5m"
+no_tls = true
+`)
+	cfg, err := LoadSMTP(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Domain != "mx.example.com" || cfg.OutboundInterval != 5*time.Minute || !cfg.NoTls {
+		t.Errorf("file not applied: %+v", cfg)
+	}
+}
+
+func TestEnvOverridesFile(t *testing.T) {
+	setRequired(t)
+	path := writeFile(t, "smtp.yml", "domain: mx.example.com\nmax_recipients: 10\nmilter_fail_open: false\n")
+	t.Setenv("SMTP_DOMAIN", "mx.example.net")
+	t.Setenv("SMTP_MAX_RECIPIENTS", "20")
+	t.Setenv("MILTER_FAIL_OPEN", "true")
+	t.Setenv("MX_DOMAINS", "a.example, b.example ,")
+	cfg, err := LoadSMTP(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Domain != "mx.example.net" || cfg.MaxRecipients != 20 || !cfg.MilterFailOpen {
+		t.Errorf("env did not override file: %+v", cfg)
+	}
+	if strings.Join(cfg.MxDomains, ",") != "a.example,b.example" {
+		t.Errorf("expected trimmed list, got %q", cfg.MxDomains)
+	}
+}
+
+func TestLoadErrors(t *testing.T) {
+	setRequired(t)
+	tests := []struct {
+		name, file, content, env, value, want string
+	}{
+		{"unknown yaml key", "smtp.yml", "domian: mx.example.com\n", "", "", "domian"},
+		{"unknown toml key", "smtp.toml", "domian = \"mx.example.com\"\n", "", "", "domian"},
+		{"extension", "smtp.json", "{}", "", "", ".toml"},
+		{"bad duration", "", "", "SMTP_READ_TIMEOUT", "10", "SMTP_READ_TIMEOUT"},
+		{"bad int", "", "", "SMTP_MAX_RECIPIENTS", "many", "SMTP_MAX_RECIPIENTS"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := ""
+			if tt.file != "" {
+				path = writeFile(t, tt.file, tt.content)
+			}
+			if tt.env != "" {
+				t.Setenv(tt.env, tt.value)
+			}
+			_, err := LoadSMTP(path)
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("expected error mentioning %q, got %v", tt.want, err)
+			}
+		})
+	}
+}
+
+func TestValidateSMTP(t *testing.T) {
+	tests := []struct {
+		name string
+		edit func(*SMTP)
+		want string
+	}{
+		{"short xsrf secret", func(c *SMTP) { c.XsrfSecret = "secret" }, "xsrf_secret"},
+		{"no mx domains", func(c *SMTP) { c.MxDomains = nil }, "mx_domains"},
+		{"bad domain", func(c *SMTP) { c.Domain = "mx_example" }, "domain"},
+		{"bad address", func(c *SMTP) { c.ListenAddress = "1025" }, "listen_address"},
+		{"bad port", func(c *SMTP) { c.WebmailAddress = ":99999" }, "webmail_address"},
+		{"relative socket", func(c *SMTP) { c.LmtpAddress = "unix:lmtp.sock" }, "lmtp_address"},
+		{"bad action", func(c *SMTP) { c.ClamdAction = "ignore" }, "clamd_action"},
+		{"webhook secret", func(c *SMTP) { c.WebhookUrls = []string{"https://example.com/hook"} }, "webhook_secret"},
+		{"bad cidr", func(c *SMTP) { c.ProxyTrusted = []string{"10.0.0.0/99"} }, "proxy_protocol_trusted"},
+		{"bad log level", func(c *SMTP) { c.LogLevel = "loud" }, "log"},
+		{"short srs secret", func(c *SMTP) { c.SRSSecret = "secret" }, "srs_secret"},
+		{"short list secret", func(c *SMTP) { c.ListSecret = "secret" }, "list_secret"},
+		{"tlsrpt address", func(c *SMTP) { c.TLSRPTAddress = "sif.io" }, "tlsrpt_address"},
+		{"srs domain not ours", func(c *SMTP) { c.SRSSecret, c.SRSDomain = "0123456789abcdef", "example.com" }, "srs_domain"},
+		{"bad pop3 address", func(c *SMTP) { c.Pop3Address = "110" }, "pop3_address"},
+		{"pop3s without tls", func(c *SMTP) { c.Pop3sAddress, c.NoTls = ":995", true }, "pop3s_address"},
+		{"bad imap address", func(c *SMTP) { c.ImapAddress = "143" }, "imap_address"},
+		{"imaps without tls", func(c *SMTP) { c.ImapsAddress, c.NoTls = ":993", true }, "imaps_address"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := DefaultSMTP()
+			c.MxDomains = []string{"sif.io"}
+			c.BlobAccount, c.BlobContainer, c.BlobKey = "account", "container", "key"
+			c.XsrfSecret = "0123456789abcdef"
+			if err := c.Validate(); err != nil {
+				t.Fatalf("valid config rejected: %v", err)
+			}
+			tt.edit(c)
+			err := c.Validate()
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("expected error mentioning %q, got %v", tt.want, err)
+			}
+		})
+	}
+}
+
+func TestSRS(t *testing.T) {
+	c := DefaultSMTP()
+	if c.SRS() != nil {
+		t.Error("expected forwarding off without a secret")
+	}
+	c.SRSSecret = "0123456789abcdef"
+	if r := c.SRS(); r == nil || r.Domain != "mx.sif.io" {
+		t.Errorf("expected the SRS domain to default to domain, got %+v", r)
+	}
+}
+
+func TestCertificateHosts(t *testing.T) {
+	cfg := DefaultSMTP()
+	if hosts := strings.Join(cfg.CertificateHosts(), ","); hosts != "www.sif.io,webmail.sif.io,mx.sif.io" {
+		t.Errorf("unexpected hosts %v", hosts)
+	}
+	cfg.TLSHosts = []string{"mx.sif.io"}
+	if hosts := strings.Join(cfg.CertificateHosts(), ","); hosts != "mx.sif.io" {
+		t.Errorf("unexpected hosts %v", hosts)
+	}
+}
+
+func TestValidateReportsEverything(t *testing.T) {
+	c := DefaultSMTP()
+	err := c.Validate()
+	if err == nil {
+		t.Fatal("expected errors")
+	}
+	for _, want := range []string{"mx_domains", "blob_account", "xsrf_secret"} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("expected %q in %v", want, err)
+		}
+	}
+}
+
+func TestLoadWWW(t *testing.T) {
+	t.Setenv("NO_TLS", "1")
+	t.Setenv("MX_DOMAINS", "sif.io,example.com")
+	path := writeFile(t, "www.toml", "mta_sts_mode = \"testing\"\nmta_sts_mx = [\"*.mx.example.com\"]\n")
+	cfg, err := LoadWWW(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.MtaStsMode != "testing" || cfg.MtaStsMx[0] != "*.mx.example.com" {
+		t.Errorf("file not applied: %+v", cfg)
+	}
+	if hosts := strings.Join(cfg.MtaStsHosts(), ","); hosts != "mta-sts.sif.io,mta-sts.example.com" {
+		t.Errorf("unexpected hosts %q", hosts)
+	}
+
+	t.Setenv("NO_TLS", "yes")
+	if cfg, err := LoadWWW(path); err != nil || !cfg.NoTls {
+		t.Errorf("any value should enable a flag: %v", err)
+	}
+
+	for _, off := range []string{"", "false", "0"} {
+		t.Setenv("NO_TLS", off)
+		if _, err := LoadWWW(path); err == nil || !strings.Contains(err.Error(), "blob") {
+			t.Errorf("NO_TLS=%q: expected blob credentials to be required with TLS, got %v", off, err)
+		}
+	}
+}
+
+func TestExamples(t *testing.T) {
+	for _, k := range []string{"MX_DOMAINS", "BLOB_ACCOUNT", "BLOB_CONTAINER", "BLOB_KEY", "XSRF_SECRET"} {
+		t.Setenv(k, required[k])
+	}
+	if _, err := LoadSMTP("../../config/smtp/example.yml"); err != nil {
+		t.Errorf("smtp example: %v", err)
+	}
+	t.Setenv("NO_TLS", "true")
+	if _, err := LoadWWW("../../config/www/example.toml"); err != nil {
+		t.Errorf("www example: %v", err)
+	}
+}
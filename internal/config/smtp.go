@@ -0,0 +1,253 @@
+package config
+
+import (
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/buckelij/sif.io/internal/logging"
+	"github.com/buckelij/sif.io/internal/proxyproto"
+	"github.com/buckelij/sif.io/internal/srs"
+)
+
+// SMTP configures cmd/smtp: the SMTP and LMTP servers, webmail and delivery
+type SMTP struct {
+	Domain          string        `yaml:"domain" toml:"domain" env:"SMTP_DOMAIN"` // our name in greetings and DSNs
+	ListenAddress   string        `yaml:"listen_address" toml:"listen_address" env:"SMTP_LISTEN_ADDRESS"`
+	LmtpAddress     string        `yaml:"lmtp_address" toml:"lmtp_address" env:"LMTP_ADDRESS"` // `host:port` or `unix:/path`, empty disables LMTP
+	MxDomains       []string      `yaml:"mx_domains" toml:"mx_domains" env:"MX_DOMAINS"`       // domains we accept mail for, and their subdomains
+	ReadTimeout     time.Duration `yaml:"read_timeout" toml:"read_timeout" env:"SMTP_READ_TIMEOUT"`
+	WriteTimeout    time.Duration `yaml:"write_timeout" toml:"write_timeout" env:"SMTP_WRITE_TIMEOUT"`
+	MaxMessageBytes int64         `yaml:"max_message_bytes" toml:"max_message_bytes" env:"SMTP_MAX_MESSAGE_BYTES"`
+	MaxRecipients   int           `yaml:"max_recipients" toml:"max_recipients" env:"SMTP_MAX_RECIPIENTS"`
+
+	BlobAccount   string `yaml:"blob_account" toml:"blob_account" env:"BLOB_ACCOUNT"`
+	BlobContainer string `yaml:"blob_container" toml:"blob_container" env:"BLOB_CONTAINER"`
+	BlobKey       string `yaml:"blob_key" toml:"blob_key" env:"BLOB_KEY"`
+
+	WebmailAddress string   `yaml:"webmail_address" toml:"webmail_address" env:"WEBMAIL_ADDRESS"`
+	XsrfSecret     string   `yaml:"xsrf_secret" toml:"xsrf_secret" env:"XSRF_SECRET"`
+	NoTls          bool     `yaml:"no_tls" toml:"no_tls" env:"NO_TLS"`
+	TLSHosts       []string `yaml:"tls_hosts" toml:"tls_hosts" env:"TLS_HOSTS"`    // hosts autocert may get certificates for
+	AdminUser      string   `yaml:"admin_user" toml:"admin_user" env:"ADMIN_USER"` // webmail user who may see TLS reports
+
+	Pop3Address  string `yaml:"pop3_address" toml:"pop3_address" env:"POP3_ADDRESS"`    // POP3 with STLS, empty disables it
+	Pop3sAddress string `yaml:"pop3s_address" toml:"pop3s_address" env:"POP3S_ADDRESS"` // POP3 with implicit TLS, empty disables it
+	ImapAddress  string `yaml:"imap_address" toml:"imap_address" env:"IMAP_ADDRESS"`    // IMAP with STARTTLS, empty disables it
+	ImapsAddress string `yaml:"imaps_address" toml:"imaps_address" env:"IMAPS_ADDRESS"` // IMAP with implicit TLS, empty disables it
+
+	QuotaBytes    int64 `yaml:"mailbox_quota_bytes" toml:"mailbox_quota_bytes" env:"MAILBOX_QUOTA_BYTES"`
+	QuotaMessages int   `yaml:"mailbox_quota_messages" toml:"mailbox_quota_messages" env:"MAILBOX_QUOTA_MESSAGES"`
+
+	ClamdAddress   string        `yaml:"clamd_address" toml:"clamd_address" env:"CLAMD_ADDRESS"`
+	ClamdAction    string        `yaml:"clamd_action" toml:"clamd_action" env:"CLAMD_ACTION"`
+	Milters        []string      `yaml:"milters" toml:"milters" env:"MILTERS"`
+	MilterTimeout  time.Duration `yaml:"milter_timeout" toml:"milter_timeout" env:"MILTER_TIMEOUT"`
+	MilterFailOpen bool          `yaml:"milter_fail_open" toml:"milter_fail_open" env:"MILTER_FAIL_OPEN"`
+
+	WebhookUrls      []string      `yaml:"webhook_urls" toml:"webhook_urls" env:"WEBHOOK_URLS"`
+	WebhookSecret    string        `yaml:"webhook_secret" toml:"webhook_secret" env:"WEBHOOK_SECRET"`
+	RelayAddress     string        `yaml:"relay_address" toml:"relay_address" env:"RELAY_ADDRESS"`
+	OutboundInterval time.Duration `yaml:"outbound_interval" toml:"outbound_interval" env:"OUTBOUND_INTERVAL"`
+	DedupeWindow     time.Duration `yaml:"dedupe_window" toml:"dedupe_window" env:"DEDUPE_WINDOW"`
+	DedupeAction     string        `yaml:"dedupe_action" toml:"dedupe_action" env:"DEDUPE_ACTION"`
+	SRSSecret        string        `yaml:"srs_secret" toml:"srs_secret" env:"SRS_SECRET"`             // enables forwarding
+	SRSDomain        string        `yaml:"srs_domain" toml:"srs_domain" env:"SRS_DOMAIN"`             // domain of rewritten senders, Domain if empty
+	ListSecret       string        `yaml:"list_secret" toml:"list_secret" env:"LIST_SECRET"`          // enables mailing list bounce handling and subscription commands
+	TLSRPTAddress    string        `yaml:"tlsrpt_address" toml:"tlsrpt_address" env:"TLSRPT_ADDRESS"` // rua of our TLS-RPT record, empty ignores TLS reports
+
+	ProxyTrusted     []string      `yaml:"proxy_protocol_trusted" toml:"proxy_protocol_trusted" env:"PROXY_PROTOCOL_TRUSTED"`
+	MetricsAddress   string        `yaml:"metrics_address" toml:"metrics_address" env:"METRICS_ADDRESS"`
+	ShutdownDelay    time.Duration `yaml:"shutdown_delay" toml:"shutdown_delay" env:"SHUTDOWN_DELAY"` // time for readiness probes to see us draining
+	ShutdownTimeout  time.Duration `yaml:"shutdown_timeout" toml:"shutdown_timeout" env:"SHUTDOWN_TIMEOUT"`
+	LogLevel         string        `yaml:"log_level" toml:"log_level" env:"LOG_LEVEL"`
+	LogFormat        string        `yaml:"log_format" toml:"log_format" env:"LOG_FORMAT"`
+	LogHashAddresses bool          `yaml:"log_hash_addresses" toml:"log_hash_addresses" env:"LOG_HASH_ADDRESSES"`
+}
+
+// DefaultSMTP returns the defaults, which are what production used before
+// configuration files
+func DefaultSMTP() *SMTP {
+	return &SMTP{
+		Domain:           "mx.sif.io",
+		ListenAddress:    "0.0.0.0:1025",
+		ReadTimeout:      10 * time.Second,
+		WriteTimeout:     10 * time.Second,
+		MaxMessageBytes:  5 * 1024 * 1024,
+		MaxRecipients:    500,
+		WebmailAddress:   "0.0.0.0:8443",
+		TLSHosts:         []string{"www.sif.io", "webmail.sif.io"},
+		ClamdAction:      "reject",
+		MilterTimeout:    10 * time.Second,
+		OutboundInterval: time.Minute,
+		DedupeAction:     "drop",
+		MetricsAddress:   "0.0.0.0:9090",
+		// one 5s readiness period, then draining, leave a margin in
+		// Kubernetes' default 30s termination grace period
+		ShutdownDelay:   5 * time.Second,
+		ShutdownTimeout: 20 * time.Second,
+		LogLevel:        "info",
+		LogFormat:       "text",
+	}
+}
+
+// LoadSMTP loads the defaults, then the file at path if it isn't empty, then
+// the environment, and validates the result
+func LoadSMTP(path string) (*SMTP, error) {
+	cfg := DefaultSMTP()
+	if err := load(path, cfg); err != nil {
+		return nil, err
+	}
+	return cfg, cfg.Validate()
+}
+
+// minXsrfSecret is the shortest XSRF_SECRET accepted; it keys the session
+// and form token HMACs
+const minXsrfSecret = 16
+
+// minSRSSecret is the shortest SRS_SECRET accepted; it keys the hashes that
+// stop forged bounces being relayed through us
+const minSRSSecret = 16
+
+// minListSecret is the shortest LIST_SECRET accepted; it keys the hashes in
+// mailing list bounce addresses and subscription confirmations
+const minListSecret = 16
+
+// Validate reports every invalid setting, not just the first
+func (c *SMTP) Validate() error {
+	var e errs
+	e.checkDomain("domain", c.Domain)
+	e.checkAddress("listen_address", c.ListenAddress, false)
+	if c.LmtpAddress != "" {
+		e.checkAddress("lmtp_address", c.LmtpAddress, true)
+	}
+	if len(c.MxDomains) == 0 {
+		e.add("mx_domains: at least one domain is required")
+	}
+	for _, d := range c.MxDomains {
+		e.checkDomain("mx_domains", d)
+	}
+	if c.ReadTimeout <= 0 || c.WriteTimeout <= 0 {
+		e.add("read_timeout and write_timeout must be positive")
+	}
+	if c.MaxMessageBytes <= 0 || c.MaxRecipients <= 0 {
+		e.add("max_message_bytes and max_recipients must be positive")
+	}
+	if c.BlobAccount == "" || c.BlobContainer == "" || c.BlobKey == "" {
+		e.add("blob_account, blob_container and blob_key are required")
+	}
+	e.checkAddress("webmail_address", c.WebmailAddress, false)
+	if len(c.XsrfSecret) < minXsrfSecret {
+		e.add("xsrf_secret: must be at least %d characters", minXsrfSecret)
+	}
+	for _, h := range c.TLSHosts {
+		e.checkDomain("tls_hosts", h)
+	}
+	if c.Pop3Address != "" {
+		e.checkAddress("pop3_address", c.Pop3Address, false)
+	}
+	if c.Pop3sAddress != "" {
+		e.checkAddress("pop3s_address", c.Pop3sAddress, false)
+		if c.NoTls || len(c.TLSHosts) == 0 {
+			e.add("pop3s_address: needs TLS and tls_hosts")
+		}
+	}
+	if c.ImapAddress != "" {
+		e.checkAddress("imap_address", c.ImapAddress, false)
+	}
+	if c.ImapsAddress != "" {
+		e.checkAddress("imaps_address", c.ImapsAddress, false)
+		if c.NoTls || len(c.TLSHosts) == 0 {
+			e.add("imaps_address: needs TLS and tls_hosts")
+		}
+	}
+	if c.QuotaBytes < 0 || c.QuotaMessages < 0 {
+		e.add("mailbox quotas can't be negative")
+	}
+	if c.ClamdAddress != "" {
+		e.checkAddress("clamd_address", c.ClamdAddress, true)
+	}
+	e.checkOneOf("clamd_action", c.ClamdAction, "reject", "quarantine", "tag")
+	for _, m := range c.Milters {
+		e.checkAddress("milters", m, true)
+	}
+	if c.MilterTimeout <= 0 {
+		e.add("milter_timeout must be positive")
+	}
+	if len(c.WebhookUrls) > 0 && c.WebhookSecret == "" {
+		e.add("webhook_secret: required with webhook_urls")
+	}
+	if c.RelayAddress != "" {
+		e.checkAddress("relay_address", c.RelayAddress, false)
+	}
+	if c.OutboundInterval <= 0 {
+		e.add("outbound_interval must be positive")
+	}
+	if c.DedupeWindow < 0 {
+		e.add("dedupe_window can't be negative")
+	}
+	e.checkOneOf("dedupe_action", c.DedupeAction, "drop", "link")
+	if c.SRSSecret != "" && len(c.SRSSecret) < minSRSSecret {
+		e.add("srs_secret: must be at least %d characters", minSRSSecret)
+	}
+	if c.ListSecret != "" && len(c.ListSecret) < minListSecret {
+		e.add("list_secret: must be at least %d characters", minListSecret)
+	}
+	if c.SRSDomain != "" {
+		e.checkDomain("srs_domain", c.SRSDomain)
+	}
+	if c.TLSRPTAddress != "" {
+		if i := strings.LastIndex(c.TLSRPTAddress, "@"); i <= 0 {
+			e.add("tlsrpt_address: must be an email address")
+		} else {
+			e.checkDomain("tlsrpt_address", c.TLSRPTAddress[i+1:])
+		}
+	}
+	if d := c.srsDomain(); c.SRSSecret != "" && !slices.ContainsFunc(c.MxDomains, func(mx string) bool {
+		return strings.EqualFold(d, mx) || strings.HasSuffix(strings.ToLower(d), "."+strings.ToLower(mx))
+	}) {
+		e.add("srs_domain: %q must be in mx_domains to receive bounces", d)
+	}
+	if _, err := proxyproto.ParseCIDRs(strings.Join(c.ProxyTrusted, ",")); err != nil {
+		e.add("proxy_protocol_trusted: %v", err)
+	}
+	e.checkAddress("metrics_address", c.MetricsAddress, false)
+	if c.ShutdownDelay < 0 {
+		e.add("shutdown_delay can't be negative")
+	}
+	if _, err := logging.ParseOptions(c.LogLevel, c.LogFormat, c.LogHashAddresses); err != nil {
+		e.add("log: %v", err)
+	}
+	return e.err()
+}
+
+// srsDomain is the domain forwarded mail is sent from
+func (c *SMTP) srsDomain() string {
+	if c.SRSDomain != "" {
+		return c.SRSDomain
+	}
+	return c.Domain
+}
+
+// SRS returns the rewriter for forwarded mail, or nil if forwarding is off
+func (c *SMTP) SRS() *srs.Rewriter {
+	if c.SRSSecret == "" {
+		return nil
+	}
+	return srs.NewRewriter(c.SRSSecret, c.srsDomain())
+}
+
+// CertificateHosts returns the hosts to get certificates for: TLSHosts and
+// Domain, the MX host STARTTLS answers as for MTA-STS senders
+func (c *SMTP) CertificateHosts() []string {
+	if slices.Contains(c.TLSHosts, c.Domain) {
+		return c.TLSHosts
+	}
+	return append(slices.Clone(c.TLSHosts), c.Domain)
+}
+
+// Logging returns the options for logging.New
+func (c *SMTP) Logging() logging.Options {
+	o, _ := logging.ParseOptions(c.LogLevel, c.LogFormat, c.LogHashAddresses)
+	return o
+}
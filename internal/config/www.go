@@ -0,0 +1,106 @@
+package config
+
+import (
+	"strings"
+	"time"
+
+	"github.com/buckelij/sif.io/internal/logging"
+)
+
+// WWW configures cmd/www: the web site, its redirect listener and MTA-STS policy
+type WWW struct {
+	ListenAddress   string   `yaml:"listen_address" toml:"listen_address" env:"WWW_LISTEN_ADDRESS"`
+	RedirectAddress string   `yaml:"redirect_address" toml:"redirect_address" env:"REDIRECT_ADDRESS"` // plain HTTP, redirected to https
+	NoTls           bool     `yaml:"no_tls" toml:"no_tls" env:"NO_TLS"`
+	TLSHosts        []string `yaml:"tls_hosts" toml:"tls_hosts" env:"TLS_HOSTS"` // hosts autocert may get certificates for, besides `mta-sts.<mx domain>`
+
+	BlobAccount   string `yaml:"blob_account" toml:"blob_account" env:"BLOB_ACCOUNT"`
+	BlobContainer string `yaml:"blob_container" toml:"blob_container" env:"BLOB_CONTAINER"`
+	BlobKey       string `yaml:"blob_key" toml:"blob_key" env:"BLOB_KEY"`
+
+	MxDomains    []string `yaml:"mx_domains" toml:"mx_domains" env:"MX_DOMAINS"` // an MTA-STS policy is served from `mta-sts.<domain>` for each
+	MtaStsMx     []string `yaml:"mta_sts_mx" toml:"mta_sts_mx" env:"MTA_STS_MX"`
+	MtaStsMode   string   `yaml:"mta_sts_mode" toml:"mta_sts_mode" env:"MTA_STS_MODE"`
+	MtaStsMaxAge int      `yaml:"mta_sts_max_age" toml:"mta_sts_max_age" env:"MTA_STS_MAX_AGE"` // seconds
+
+	MetricsAddress  string        `yaml:"metrics_address" toml:"metrics_address" env:"METRICS_ADDRESS"`
+	ShutdownDelay   time.Duration `yaml:"shutdown_delay" toml:"shutdown_delay" env:"SHUTDOWN_DELAY"` // time for readiness probes to see us draining
+	ShutdownTimeout time.Duration `yaml:"shutdown_timeout" toml:"shutdown_timeout" env:"SHUTDOWN_TIMEOUT"`
+	LogLevel        string        `yaml:"log_level" toml:"log_level" env:"LOG_LEVEL"`
+	LogFormat       string        `yaml:"log_format" toml:"log_format" env:"LOG_FORMAT"`
+}
+
+// DefaultWWW returns the defaults, which are what production used before
+// configuration files
+func DefaultWWW() *WWW {
+	return &WWW{
+		ListenAddress:   ":8443",
+		RedirectAddress: ":8080",
+		TLSHosts:        []string{"www.sif.io", "webmail.sif.io"},
+		MtaStsMx:        []string{"mx.sif.io"},
+		MtaStsMode:      "enforce",
+		MtaStsMaxAge:    604800,
+		MetricsAddress:  "0.0.0.0:9090",
+		ShutdownDelay:   5 * time.Second,
+		ShutdownTimeout: 20 * time.Second,
+		LogLevel:        "info",
+		LogFormat:       "text",
+	}
+}
+
+// LoadWWW loads the defaults, then the file at path if it isn't empty, then
+// the environment, and validates the result
+func LoadWWW(path string) (*WWW, error) {
+	cfg := DefaultWWW()
+	if err := load(path, cfg); err != nil {
+		return nil, err
+	}
+	return cfg, cfg.Validate()
+}
+
+// Validate reports every invalid setting, not just the first
+func (c *WWW) Validate() error {
+	var e errs
+	e.checkAddress("listen_address", c.ListenAddress, false)
+	e.checkAddress("redirect_address", c.RedirectAddress, false)
+	if !c.NoTls && (c.BlobAccount == "" || c.BlobContainer == "" || c.BlobKey == "") {
+		e.add("blob_account, blob_container and blob_key are required for TLS")
+	}
+	for _, h := range c.TLSHosts {
+		e.checkDomain("tls_hosts", h)
+	}
+	for _, d := range c.MxDomains {
+		e.checkDomain("mx_domains", d)
+	}
+	for _, mx := range c.MtaStsMx {
+		// RFC 8461 allows a wildcard in the leftmost label
+		e.checkDomain("mta_sts_mx", strings.TrimPrefix(mx, "*."))
+	}
+	e.checkOneOf("mta_sts_mode", c.MtaStsMode, "enforce", "testing", "none")
+	if c.MtaStsMaxAge <= 0 || c.MtaStsMaxAge > 31557600 {
+		e.add("mta_sts_max_age: must be between 1 and 31557600 seconds")
+	}
+	e.checkAddress("metrics_address", c.MetricsAddress, false)
+	if c.ShutdownDelay < 0 {
+		e.add("shutdown_delay can't be negative")
+	}
+	if _, err := logging.ParseOptions(c.LogLevel, c.LogFormat, false); err != nil {
+		e.add("log: %v", err)
+	}
+	return e.err()
+}
+
+// MtaStsHosts returns the `mta-sts.<domain>` host for each MX domain
+func (c *WWW) MtaStsHosts() []string {
+	hosts := []string{}
+	for _, d := range c.MxDomains {
+		hosts = append(hosts, "mta-sts."+d)
+	}
+	return hosts
+}
+
+// Logging returns the options for logging.New
+func (c *WWW) Logging() logging.Options {
+	o, _ := logging.ParseOptions(c.LogLevel, c.LogFormat, false)
+	return o
+}
@@ -0,0 +1,162 @@
+// liveness and readiness handlers for Kubernetes probes
+package health
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/buckelij/sif.io/internal/blob"
+)
+
+// A Check returns an error when a dependency is unavailable
+type Check func(ctx context.Context) error
+
+type check struct {
+	name     string
+	check    Check
+	required bool
+}
+
+// A Checker serves /healthz and /readyz. Liveness only runs the live checks,
+// so a blob outage doesn't get the pod restarted; readiness runs them all and
+// fails until SetReady(true) and again once shutdown starts.
+type Checker struct {
+	Timeout time.Duration
+
+	mu     sync.Mutex
+	live   []check
+	checks []check
+	ready  atomic.Bool
+}
+
+func NewChecker() *Checker {
+	return &Checker{Timeout: 5 * time.Second}
+}
+
+// AddLive adds a check to both liveness and readiness
+func (c *Checker) AddLive(name string, f Check) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.live = append(c.live, check{name, f, true})
+	c.checks = append(c.checks, check{name, f, true})
+}
+
+// AddReady adds a check that must pass for readiness
+func (c *Checker) AddReady(name string, f Check) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.checks = append(c.checks, check{name, f, true})
+}
+
+// AddOptional adds a check that is reported by readiness but doesn't fail it,
+// e.g. certificates, which can't be issued until traffic arrives
+func (c *Checker) AddOptional(name string, f Check) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.checks = append(c.checks, check{name, f, false})
+}
+
+// SetReady marks the process as ready to take traffic, or draining
+func (c *Checker) SetReady(ready bool) {
+	c.ready.Store(ready)
+}
+
+func (c *Checker) Healthz(w http.ResponseWriter, req *http.Request) {
+	c.mu.Lock()
+	checks := c.live
+	c.mu.Unlock()
+	c.serve(w, req, checks, true)
+}
+
+func (c *Checker) Readyz(w http.ResponseWriter, req *http.Request) {
+	c.mu.Lock()
+	checks := c.checks
+	c.mu.Unlock()
+	c.serve(w, req, checks, c.ready.Load())
+}
+
+// serve runs checks and writes a line per check, failing with 503 if a
+// required check fails or ready is false
+func (c *Checker) serve(w http.ResponseWriter, req *http.Request, checks []check, ready bool) {
+	ctx, cancel := context.WithTimeout(req.Context(), c.Timeout)
+	defer cancel()
+	ok := ready
+	body := ""
+	if !ready {
+		body += "ready: not ready\n"
+	}
+	for _, ch := range checks {
+		if err := ch.check(ctx); err != nil {
+			body += fmt.Sprintf("%s: %v\n", ch.name, err)
+			ok = ok && !ch.required
+		} else {
+			body += ch.name + ": ok\n"
+		}
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	if !ok {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	fmt.Fprint(w, body)
+}
+
+// Blob checks blob storage is reachable by reading key; a missing blob is fine
+func Blob(c blob.BlobClient, key string) Check {
+	return func(ctx context.Context) error {
+		done := make(chan error, 1)
+		go func() {
+			_, err := c.Get(key)
+			done <- err
+		}()
+		select {
+		case err := <-done:
+			if err != nil && !errors.Is(err, blob.ErrNotFound) {
+				return err
+			}
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// Listener checks something is accepting connections at a TCP `host:port`
+// or a `unix:/path/to/socket`
+func Listener(address string) Check {
+	network := "tcp"
+	if path, ok := strings.CutPrefix(address, "unix:"); ok {
+		network, address = "unix", path
+	}
+	return func(ctx context.Context) error {
+		conn, err := (&net.Dialer{}).DialContext(ctx, network, address)
+		if err != nil {
+			return err
+		}
+		return conn.Close()
+	}
+}
+
+// Serving tracks whether a server's listener is open, for servers where
+// dialing would be noisy, like TLS handshake errors in the http.Server log
+type Serving struct {
+	up atomic.Bool
+}
+
+func (s *Serving) Set(up bool) {
+	s.up.Store(up)
+}
+
+func (s *Serving) Check(ctx context.Context) error {
+	if !s.up.Load() {
+		return errors.New("not listening")
+	}
+	return nil
+}
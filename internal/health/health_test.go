@@ -0,0 +1,88 @@
+package health
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/buckelij/sif.io/internal/blob"
+)
+
+type stubBlobClient struct {
+	blob.BlobClient
+	err error
+}
+
+func (c stubBlobClient) Get(string) ([]byte, error) {
+	return nil, c.err
+}
+
+func get(h http.HandlerFunc) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	h(w, httptest.NewRequest("GET", "/", nil))
+	return w
+}
+
+func TestReadiness(t *testing.T) {
+	c := NewChecker()
+	var serving Serving
+	c.AddLive("listener", serving.Check)
+	c.AddReady("blob", Blob(stubBlobClient{err: blob.ErrNotFound}, "ping"))
+	c.AddOptional("certificate", func(context.Context) error { return errors.New("no certificate") })
+
+	if w := get(c.Readyz); w.Code != http.StatusServiceUnavailable {
+		t.Errorf("ready before SetReady: %v", w.Code)
+	}
+	serving.Set(true)
+	c.SetReady(true)
+	w := get(c.Readyz)
+	if w.Code != http.StatusOK {
+		t.Errorf("not ready: %v %v", w.Code, w.Body)
+	}
+	if !strings.Contains(w.Body.String(), "certificate: no certificate") {
+		t.Errorf("optional check not reported: %v", w.Body)
+	}
+
+	c.SetReady(false)
+	if w := get(c.Readyz); w.Code != http.StatusServiceUnavailable {
+		t.Errorf("ready while draining: %v", w.Code)
+	}
+	if w := get(c.Healthz); w.Code != http.StatusOK {
+		t.Errorf("not live while draining: %v %v", w.Code, w.Body)
+	}
+	serving.Set(false)
+	if w := get(c.Healthz); w.Code != http.StatusServiceUnavailable {
+		t.Errorf("live without listener: %v", w.Code)
+	}
+}
+
+func TestBlobCheck(t *testing.T) {
+	c := NewChecker()
+	c.AddReady("blob", Blob(stubBlobClient{err: errors.New("connection refused")}, "ping"))
+	c.SetReady(true)
+	if w := get(c.Readyz); w.Code != http.StatusServiceUnavailable || !strings.Contains(w.Body.String(), "connection refused") {
+		t.Errorf("unexpected %v %v", w.Code, w.Body)
+	}
+	if w := get(c.Healthz); w.Code != http.StatusOK {
+		t.Errorf("blob outage failed liveness: %v", w.Code)
+	}
+}
+
+func TestListener(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	check := Listener(ln.Addr().String())
+	if err := check(context.Background()); err != nil {
+		t.Error(err)
+	}
+	ln.Close()
+	if err := check(context.Background()); err == nil {
+		t.Error("closed listener passed")
+	}
+}
@@ -0,0 +1,319 @@
+package imap
+
+import (
+	"bufio"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/buckelij/sif.io/internal/smtp"
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/backend"
+	"github.com/emersion/go-imap/commands"
+	"github.com/emersion/go-imap/server"
+)
+
+// The extension replaces go-imap's handlers for the commands that report
+// changes, so that sessions are told about other sessions' and deliveries'
+// changes, and adds the UIDPLUS response codes.
+type extension struct {
+	server *Server
+	// go-imap refuses to enable extensions with their own IDLE or MOVE, which
+	// it only implements for backends that push updates, so the handlers are
+	// only given out once enabled
+	enabled bool
+}
+
+func (ext *extension) Capabilities(c server.Conn) []string {
+	return []string{"UIDPLUS"}
+}
+
+func (ext *extension) Command(name string) server.HandlerFactory {
+	switch name {
+	case "NOOP":
+		return func() server.Handler { return &noop{} }
+	case "CHECK":
+		return func() server.Handler { return &check{} }
+	case "SELECT":
+		return func() server.Handler { return &selectMailbox{} }
+	case "EXAMINE":
+		return func() server.Handler {
+			return &selectMailbox{Select: server.Select{Select: commands.Select{ReadOnly: true}}}
+		}
+	case "APPEND":
+		return func() server.Handler { return &appendMessage{} }
+	case "COPY":
+		return func() server.Handler { return &copyMessages{} }
+	case "EXPUNGE":
+		return func() server.Handler { return &expunge{} }
+	case "MOVE":
+		if ext.enabled {
+			return func() server.Handler { return &move{} }
+		}
+	case "IDLE":
+		if ext.enabled {
+			return func() server.Handler { return &idle{poll: ext.server.IdlePoll} }
+		}
+	}
+	return nil
+}
+
+// NewConn counts sessions
+func (ext *extension) NewConn(c server.Conn) server.Conn {
+	sessionsTotal.Inc()
+	return c
+}
+
+// selected returns the session's selected mailbox
+func selected(conn server.Conn) (*mailbox, error) {
+	m, ok := conn.Context().Mailbox.(*mailbox)
+	if !ok {
+		return nil, server.ErrNoMailboxSelected
+	}
+	return m, nil
+}
+
+// writable returns the session's selected mailbox, unless it's read-only
+func writable(conn server.Conn) (*mailbox, error) {
+	m, err := selected(conn)
+	if err == nil && m.readOnly {
+		return nil, server.ErrMailboxReadOnly
+	}
+	return m, err
+}
+
+type noop struct {
+	commands.Noop
+}
+
+func (cmd *noop) Handle(conn server.Conn) error {
+	if m, err := selected(conn); err == nil {
+		return m.poll(conn)
+	}
+	return nil
+}
+
+type check struct {
+	commands.Check
+}
+
+func (cmd *check) Handle(conn server.Conn) error {
+	m, err := selected(conn)
+	if err != nil {
+		return err
+	}
+	return m.poll(conn)
+}
+
+// selectMailbox is go-imap's SELECT and EXAMINE, also telling the mailbox
+// whether it's read-only so fetching doesn't set \Seen
+type selectMailbox struct {
+	server.Select
+}
+
+func (cmd *selectMailbox) Handle(conn server.Conn) error {
+	err := cmd.Select.Handle(conn)
+	if m, ok := conn.Context().Mailbox.(*mailbox); ok {
+		m.readOnly = conn.Context().MailboxReadOnly
+	}
+	return err
+}
+
+type appendMessage struct {
+	commands.Append
+}
+
+func (cmd *appendMessage) Handle(conn server.Conn) error {
+	u, ok := conn.Context().User.(*user)
+	if !ok {
+		return server.ErrNotAuthenticated
+	}
+	uidValidity, uid, err := u.append(cmd.Mailbox, cmd.Flags, cmd.Date, cmd.Message)
+	switch {
+	case errors.Is(err, backend.ErrNoSuchMailbox):
+		return server.ErrStatusResp(&imap.StatusResp{Type: imap.StatusRespNo, Code: imap.CodeTryCreate, Info: err.Error()})
+	case errors.Is(err, smtp.ErrQuotaExceeded):
+		return server.ErrStatusResp(&imap.StatusResp{Type: imap.StatusRespNo, Code: "OVERQUOTA", Info: "Mailbox is full"})
+	case err != nil:
+		return err
+	}
+	if m, err := selected(conn); err == nil && m.name == cmd.Mailbox {
+		if err := m.poll(conn); err != nil {
+			return err
+		}
+	}
+	return server.ErrStatusResp(&imap.StatusResp{
+		Type:      imap.StatusRespOk,
+		Code:      "APPENDUID",
+		Arguments: []interface{}{uidValidity, uid},
+		Info:      "APPEND completed",
+	})
+}
+
+// copyResp returns the COPYUID response code for copied messages
+func copyResp(uidValidity uint32, src, dst []uint32, info string) *imap.StatusResp {
+	if len(src) == 0 {
+		return &imap.StatusResp{Type: imap.StatusRespOk, Info: info}
+	}
+	srcSet, dstSet := &imap.SeqSet{}, &imap.SeqSet{}
+	srcSet.AddNum(src...)
+	dstSet.AddNum(dst...)
+	return &imap.StatusResp{
+		Type:      imap.StatusRespOk,
+		Code:      "COPYUID",
+		Arguments: []interface{}{uidValidity, srcSet, dstSet},
+		Info:      info,
+	}
+}
+
+// copyError returns the response for a failed COPY or MOVE
+func copyError(err error) error {
+	if errors.Is(err, backend.ErrNoSuchMailbox) {
+		return server.ErrStatusResp(&imap.StatusResp{Type: imap.StatusRespNo, Code: imap.CodeTryCreate, Info: err.Error()})
+	}
+	return err
+}
+
+type copyMessages struct {
+	commands.Copy
+}
+
+func (cmd *copyMessages) handle(uid bool, conn server.Conn) error {
+	m, err := selected(conn)
+	if err != nil {
+		return err
+	}
+	uidValidity, src, dst, err := m.copy(uid, cmd.SeqSet, cmd.Mailbox, false)
+	if err != nil {
+		return copyError(err)
+	}
+	return server.ErrStatusResp(copyResp(uidValidity, src, dst, "COPY completed"))
+}
+
+func (cmd *copyMessages) Handle(conn server.Conn) error {
+	return cmd.handle(false, conn)
+}
+
+func (cmd *copyMessages) UidHandle(conn server.Conn) error {
+	return cmd.handle(true, conn)
+}
+
+// move is RFC 6851's MOVE: COPYUID comes untagged before the EXPUNGEs
+type move struct {
+	commands.Move
+}
+
+func (cmd *move) handle(uid bool, conn server.Conn) error {
+	m, err := writable(conn)
+	if err != nil {
+		return err
+	}
+	uidValidity, src, dst, err := m.copy(uid, cmd.SeqSet, cmd.Mailbox, true)
+	if err != nil {
+		return copyError(err)
+	}
+	if len(src) > 0 {
+		if err := conn.WriteResp(copyResp(uidValidity, src, dst, "Moved")); err != nil {
+			return err
+		}
+	}
+	moved := map[uint32]bool{}
+	for _, u := range src {
+		moved[u] = true
+	}
+	return writeExpunge(conn, m.forget(moved))
+}
+
+func (cmd *move) Handle(conn server.Conn) error {
+	return cmd.handle(false, conn)
+}
+
+func (cmd *move) UidHandle(conn server.Conn) error {
+	return cmd.handle(true, conn)
+}
+
+// expunge is EXPUNGE, and UIDPLUS's UID EXPUNGE of a set of UIDs
+type expunge struct {
+	uids *imap.SeqSet
+}
+
+func (cmd *expunge) Parse(fields []interface{}) error {
+	if len(fields) == 0 {
+		return nil
+	}
+	set, ok := fields[0].(string)
+	if !ok {
+		return errors.New("Invalid sequence set")
+	}
+	uids, err := imap.ParseSeqSet(set)
+	cmd.uids = uids
+	return err
+}
+
+func (cmd *expunge) Handle(conn server.Conn) error {
+	m, err := writable(conn)
+	if err != nil {
+		return err
+	}
+	seqs, err := m.expunge(nil)
+	if err != nil {
+		return err
+	}
+	return writeExpunge(conn, seqs)
+}
+
+func (cmd *expunge) UidHandle(conn server.Conn) error {
+	if cmd.uids == nil {
+		return errors.New("UID EXPUNGE needs a set of UIDs")
+	}
+	m, err := writable(conn)
+	if err != nil {
+		return err
+	}
+	seqs, err := m.expunge(cmd.uids)
+	if err != nil {
+		return err
+	}
+	return writeExpunge(conn, seqs)
+}
+
+// idle is RFC 2177's IDLE. Without pushed updates the selected mailbox is
+// polled until the client sends DONE.
+type idle struct {
+	commands.Idle
+	poll time.Duration
+}
+
+func (cmd *idle) Handle(conn server.Conn) error {
+	if err := conn.WriteResp(&imap.ContinuationReq{Info: "idling"}); err != nil {
+		return err
+	}
+	done := make(chan error, 1)
+	go func() {
+		scanner := bufio.NewScanner(conn)
+		scanner.Scan()
+		switch {
+		case scanner.Err() != nil:
+			done <- scanner.Err()
+		case !strings.EqualFold(scanner.Text(), "DONE"):
+			done <- errors.New("Expected DONE")
+		default:
+			done <- nil
+		}
+	}()
+
+	ticker := time.NewTicker(cmd.poll)
+	defer ticker.Stop()
+	for {
+		select {
+		case err := <-done:
+			return err
+		case <-ticker.C:
+			if m, err := selected(conn); err == nil {
+				if err := m.poll(conn); err != nil {
+					return err
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,211 @@
+// IMAP server for mail clients, RFC 3501, with the IDLE (RFC 2177), MOVE
+// (RFC 6851) and UIDPLUS (RFC 4315) extensions. Folders, UIDs and flags are
+// kept in the mailbox index next to the stored messages.
+package imap
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"log/slog"
+	"net"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/buckelij/sif.io/internal/smtp"
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/backend"
+	"github.com/emersion/go-imap/server"
+	"github.com/google/uuid"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	sessionsTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "sifio_imap_sessions_total",
+		Help: "IMAP sessions started.",
+	})
+	loginsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "sifio_imap_logins_total",
+		Help: "IMAP login attempts, by result.",
+	}, []string{"result"})
+)
+
+// Delimiter separates the levels of folder names
+const Delimiter = "/"
+
+// A Store is the mail storage sessions use, e.g. an *smtp.Backend
+type Store interface {
+	Authenticate(user, password string) bool
+	MailboxIndex(mailbox string) (*smtp.MailboxIndex, error)
+	UpdateMailbox(mailbox string, f func(idx *smtp.MailboxIndex) error) error
+	AppendMessage(mailbox, folder string, flags []string, received time.Time, data []byte) (uidValidity, uid uint32, err error)
+	ReadMessage(key string) ([]byte, error)
+}
+
+var _ Store = &smtp.Backend{}
+
+// A Server serves IMAP on the listeners passed to Serve. Connections that are
+// already TLS, e.g. from a tls.NewListener on port 993, are implicit TLS.
+type Server struct {
+	Store    Store
+	IdlePoll time.Duration // how often an idling client is told about changes
+
+	imap    *server.Server
+	mu      sync.Mutex
+	closing bool
+}
+
+var ErrServerClosed = errors.New("imap: server closed")
+
+// NewServer returns a server for store. tlsConfig is for STARTTLS; logins are
+// refused before TLS unless it is nil.
+func NewServer(store Store, tlsConfig *tls.Config) *Server {
+	s := &Server{Store: store, IdlePoll: 15 * time.Second}
+	s.imap = server.New(&imapBackend{server: s})
+	s.imap.TLSConfig = tlsConfig
+	s.imap.AllowInsecureAuth = tlsConfig == nil
+	s.imap.AutoLogout = server.MinAutoLogout
+	s.imap.ErrorLog = slog.NewLogLogger(slog.Default().Handler(), slog.LevelWarn)
+	ext := &extension{server: s}
+	s.imap.Enable(ext)
+	ext.enabled = true
+	return s
+}
+
+// Serve accepts connections on ln until Shutdown, returning ErrServerClosed
+func (s *Server) Serve(ln net.Listener) error {
+	s.mu.Lock()
+	closing := s.closing
+	s.mu.Unlock()
+	if closing {
+		return ErrServerClosed
+	}
+	err := s.imap.Serve(ln)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closing {
+		return ErrServerClosed
+	}
+	return err
+}
+
+// Shutdown stops accepting connections and closes sessions. IMAP clients
+// stay connected while idle, so sessions aren't waited for; clients
+// reconnect and resynchronize from the mailbox index.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.mu.Lock()
+	s.closing = true
+	s.mu.Unlock()
+	return s.imap.Close()
+}
+
+// imapBackend authenticates users for go-imap
+type imapBackend struct {
+	server *Server
+}
+
+func (b *imapBackend) Login(info *imap.ConnInfo, username, password string) (backend.User, error) {
+	log := slog.With("session", uuid.NewString(), "remote", remoteIP(info.RemoteAddr), "proto", "imap")
+	if !b.server.Store.Authenticate(username, password) {
+		loginsTotal.WithLabelValues("failure").Inc()
+		log.Warn("login failed", "user", username)
+		return nil, backend.ErrInvalidCredentials
+	}
+	loginsTotal.WithLabelValues("success").Inc()
+	log.Info("login", "user", username)
+	return &user{store: b.server.Store, name: username, log: log.With("user", username)}, nil
+}
+
+func remoteIP(addr net.Addr) string {
+	if addr == nil {
+		return ""
+	}
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return addr.String()
+	}
+	return host
+}
+
+// A user is an authenticated session's mailbox; the user name is the mailbox name
+type user struct {
+	store Store
+	name  string
+	log   *slog.Logger
+}
+
+func (u *user) Username() string {
+	return u.name
+}
+
+func (u *user) ListMailboxes(subscribed bool) ([]backend.Mailbox, error) {
+	idx, err := u.store.MailboxIndex(u.name)
+	if err != nil {
+		return nil, err
+	}
+	mailboxes := []backend.Mailbox{}
+	for _, f := range idx.Folders {
+		// INBOX is always subscribed
+		if subscribed && !f.Subscribed && f.Name != smtp.InboxFolder {
+			continue
+		}
+		attrs := []string{imap.HasNoChildrenAttr}
+		if slices.ContainsFunc(idx.Folders, func(c smtp.Folder) bool { return strings.HasPrefix(c.Name, f.Name+Delimiter) }) {
+			attrs = []string{imap.HasChildrenAttr}
+		}
+		mailboxes = append(mailboxes, &mailbox{user: u, name: f.Name, attrs: attrs})
+	}
+	return mailboxes, nil
+}
+
+func (u *user) GetMailbox(name string) (backend.Mailbox, error) {
+	idx, err := u.store.MailboxIndex(u.name)
+	if err != nil {
+		return nil, err
+	}
+	f := idx.Folder(name)
+	if f == nil {
+		return nil, backend.ErrNoSuchMailbox
+	}
+	m := &mailbox{user: u, name: f.Name, uidValidity: f.UIDValidity, uidNext: f.UIDNext, flags: map[uint32][]string{}}
+	for _, e := range idx.FolderMessages(f.Name) {
+		m.uids = append(m.uids, e.ImapUID)
+		m.flags[e.ImapUID] = sortedFlags(e.Flags)
+	}
+	return m, nil
+}
+
+func (u *user) CreateMailbox(name string) error {
+	return u.update(func(idx *smtp.MailboxIndex) error { return idx.CreateFolder(name) })
+}
+
+func (u *user) DeleteMailbox(name string) error {
+	return u.update(func(idx *smtp.MailboxIndex) error { return idx.DeleteFolder(name) })
+}
+
+func (u *user) RenameMailbox(existingName, newName string) error {
+	return u.update(func(idx *smtp.MailboxIndex) error { return idx.RenameFolder(existingName, newName) })
+}
+
+func (u *user) Logout() error {
+	return nil
+}
+
+// update changes the user's mailbox index, returning go-imap's errors for
+// missing and existing folders so clients get the usual responses
+func (u *user) update(f func(idx *smtp.MailboxIndex) error) error {
+	err := u.store.UpdateMailbox(u.name, f)
+	switch {
+	case errors.Is(err, smtp.ErrNoSuchFolder):
+		return backend.ErrNoSuchMailbox
+	case errors.Is(err, smtp.ErrFolderExists):
+		return backend.ErrMailboxAlreadyExists
+	case err != nil && !errors.Is(err, smtp.ErrInboxFolder):
+		u.log.Error("failed to update mailbox", "err", err)
+	}
+	return err
+}
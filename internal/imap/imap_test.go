@@ -0,0 +1,277 @@
+package imap
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/textproto"
+	"regexp"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/buckelij/sif.io/internal/smtp"
+)
+
+type testStore struct {
+	mu   sync.Mutex
+	idx  smtp.MailboxIndex
+	data map[string][]byte
+	next int
+}
+
+func (s *testStore) Authenticate(user, password string) bool {
+	return user == "me" && password == "passw0rd"
+}
+
+// MailboxIndex returns a copy, as the index is loaded afresh from storage
+func (s *testStore) MailboxIndex(mailbox string) (*smtp.MailboxIndex, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.idx.AssignUIDs()
+	b, _ := json.Marshal(s.idx)
+	idx := &smtp.MailboxIndex{}
+	return idx, json.Unmarshal(b, idx)
+}
+
+func (s *testStore) UpdateMailbox(mailbox string, f func(idx *smtp.MailboxIndex) error) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.idx.AssignUIDs()
+	return f(&s.idx)
+}
+
+func (s *testStore) AppendMessage(mailbox, folder string, flags []string, received time.Time, data []byte) (uint32, uint32, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.idx.AssignUIDs()
+	f := s.idx.Folder(folder)
+	if f == nil {
+		return 0, 0, smtp.ErrNoSuchFolder
+	}
+	uid, err := s.idx.AddToFolder(folder, s.put(data), int64(len(data)), flags, received)
+	return f.UIDValidity, uid, err
+}
+
+func (s *testStore) ReadMessage(key string) ([]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if d, ok := s.data[key]; ok {
+		return d, nil
+	}
+	return nil, errors.New("not found")
+}
+
+func (s *testStore) put(data []byte) string {
+	s.next++
+	key := fmt.Sprintf("mail/sif.io/%d", s.next)
+	s.data[key] = data
+	return key
+}
+
+// deliver adds a message to INBOX as the SMTP server does
+func (s *testStore) deliver(data string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.idx.Add(s.put([]byte(data)), int64(len(data)))
+}
+
+func newTestStore() *testStore {
+	s := &testStore{data: map[string][]byte{}}
+	s.deliver("From: eli@sif.io\r\nSubject: one\r\n\r\nfirst message\r\n")
+	s.deliver("From: bob@sif.io\r\nSubject: two\r\n\r\nsecond message\r\n")
+	return s
+}
+
+// client is a test IMAP client
+type client struct {
+	t    *testing.T
+	conn net.Conn
+	text *textproto.Conn
+	tag  int
+}
+
+func dial(t *testing.T, s *Server) *client {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.Serve(ln)
+	t.Cleanup(func() { s.Shutdown(t.Context()) })
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := &client{t: t, conn: conn, text: textproto.NewConn(conn)}
+	c.expect("* OK")
+	return c
+}
+
+func login(t *testing.T, s *Server) *client {
+	c := dial(t, s)
+	if reply := c.cmd("LOGIN me passw0rd"); !strings.HasPrefix(reply[len(reply)-1], "OK") {
+		t.Fatalf("login: %v", reply)
+	}
+	return c
+}
+
+// cmd sends a tagged command and returns the untagged responses and the
+// tagged status, without the tag
+func (c *client) cmd(line string) []string {
+	c.t.Helper()
+	c.tag++
+	tag := fmt.Sprintf("a%d", c.tag)
+	c.text.PrintfLine("%s %s", tag, line)
+	return c.until(tag + " ")
+}
+
+// until reads responses up to one starting with prefix, which is removed
+func (c *client) until(prefix string) []string {
+	c.t.Helper()
+	replies := []string{}
+	for {
+		reply, err := c.text.ReadLine()
+		if err != nil {
+			c.t.Fatalf("reading %q: %v after %q", prefix, err, replies)
+		}
+		if rest, ok := strings.CutPrefix(reply, prefix); ok {
+			return append(replies, rest)
+		}
+		replies = append(replies, reply)
+	}
+}
+
+func (c *client) expect(prefix string) string {
+	c.t.Helper()
+	reply, err := c.text.ReadLine()
+	if err != nil || !strings.HasPrefix(reply, prefix) {
+		c.t.Fatalf("expected %q, got %q %v", prefix, reply, err)
+	}
+	return reply
+}
+
+func has(replies []string, pattern string) bool {
+	re := regexp.MustCompile(pattern)
+	for _, r := range replies {
+		if re.MatchString(r) {
+			return true
+		}
+	}
+	return false
+}
+
+func TestSession(t *testing.T) {
+	store := newTestStore()
+	c := dial(t, NewServer(store, nil))
+	if reply := c.cmd("LOGIN me wrong"); !strings.HasPrefix(reply[0], "NO") {
+		t.Errorf("bad password accepted: %v", reply)
+	}
+	if reply := c.cmd("LOGIN me passw0rd"); !strings.HasPrefix(reply[0], "OK") {
+		t.Fatalf("login: %v", reply)
+	}
+	if reply := c.cmd("CAPABILITY"); !has(reply, `UIDPLUS`) || !has(reply, `IDLE`) || !has(reply, `MOVE`) {
+		t.Errorf("unexpected capabilities %v", reply)
+	}
+
+	reply := c.cmd("SELECT INBOX")
+	validity := regexp.MustCompile(`UIDVALIDITY (\d+)`).FindStringSubmatch(strings.Join(reply, "\n"))
+	if !has(reply, `^\* 2 EXISTS`) || !has(reply, `UIDNEXT 3`) || validity == nil || !has(reply, `^OK \[READ-WRITE\]`) {
+		t.Fatalf("SELECT: %v", reply)
+	}
+	if reply := c.cmd("FETCH 1:* (UID FLAGS RFC822.SIZE)"); !has(reply, `^\* 2 FETCH \(UID 2 FLAGS \(\) RFC822.SIZE 50\)`) {
+		t.Errorf("FETCH: %v", reply)
+	}
+	if reply := c.cmd("FETCH 1 BODY[HEADER.FIELDS (SUBJECT)]"); !has(reply, `BODY\[HEADER.FIELDS \(SUBJECT\)\] \{16\}`) || !has(reply, `FLAGS \(\\Seen\)`) {
+		t.Errorf("expected the message marked seen: %v", reply)
+	}
+	if reply := c.cmd("UID SEARCH UNSEEN SUBJECT two"); !has(reply, `^\* SEARCH 2$`) {
+		t.Errorf("SEARCH: %v", reply)
+	}
+
+	if reply := c.cmd("COPY 1 Archive"); !strings.HasPrefix(reply[0], "NO [TRYCREATE]") {
+		t.Errorf("COPY to a missing folder: %v", reply)
+	}
+	c.cmd("CREATE Archive")
+	if reply := c.cmd("COPY 1:2 Archive"); !has(reply, `^OK \[COPYUID \d+ 1:2 1:2\]`) {
+		t.Errorf("COPY: %v", reply)
+	}
+	reply = c.cmd("UID MOVE 2 Archive")
+	if !has(reply, `^\* OK \[COPYUID \d+ 2 3\]`) || !has(reply, `^\* 2 EXPUNGE`) || !has(reply, `^OK`) {
+		t.Errorf("MOVE: %v", reply)
+	}
+
+	c.text.PrintfLine("a100 APPEND INBOX (\\Flagged) {20+}\r\nSubject: new\r\n\r\nhi\r\n")
+	if reply := c.until("a100 "); !has(reply, `^\* 2 EXISTS`) || !has(reply, `^OK \[APPENDUID `+validity[1]+` 3\]`) {
+		t.Errorf("APPEND: %v", reply)
+	}
+	c.cmd("STORE 1 +FLAGS.SILENT (\\Deleted)")
+	if reply := c.cmd("EXPUNGE"); !has(reply, `^\* 1 EXPUNGE`) {
+		t.Errorf("EXPUNGE: %v", reply)
+	}
+	if reply := c.cmd("UID FETCH 1:* FLAGS"); len(reply) != 2 || !has(reply, `^\* 1 FETCH \(FLAGS \(\\Flagged\) UID 3\)`) {
+		t.Errorf("expected only the appended message: %v", reply)
+	}
+
+	idx, _ := store.MailboxIndex("me")
+	if archived := idx.FolderMessages("Archive"); len(archived) != 3 {
+		t.Errorf("expected 3 messages archived, got %+v", archived)
+	}
+	if reply := c.cmd("LIST \"\" *"); !has(reply, `^\* LIST \(\\HasNoChildren\) "/" "Archive"`) {
+		t.Errorf("LIST: %v", reply)
+	}
+}
+
+func TestExamine(t *testing.T) {
+	store := newTestStore()
+	c := login(t, NewServer(store, nil))
+	if reply := c.cmd("EXAMINE INBOX"); !has(reply, `^OK \[READ-ONLY\]`) {
+		t.Fatalf("EXAMINE: %v", reply)
+	}
+	c.cmd("FETCH 1 BODY[]")
+	if reply := c.cmd("EXPUNGE"); !strings.HasPrefix(reply[0], "NO") {
+		t.Errorf("EXPUNGE allowed read-only: %v", reply)
+	}
+	idx, _ := store.MailboxIndex("me")
+	if e := idx.Entry(smtp.InboxFolder, 1); len(e.Flags) != 0 {
+		t.Errorf("expected no \\Seen read-only, got %v", e.Flags)
+	}
+}
+
+func TestIdle(t *testing.T) {
+	store := newTestStore()
+	s := NewServer(store, nil)
+	s.IdlePoll = 10 * time.Millisecond
+	c := login(t, s)
+	c.cmd("SELECT INBOX")
+
+	c.text.PrintfLine("a100 IDLE")
+	c.expect("+ ")
+	store.deliver("Subject: three\r\n\r\nthird\r\n")
+	c.expect("* 3 EXISTS")
+	store.UpdateMailbox("me", func(idx *smtp.MailboxIndex) error {
+		idx.Entry(smtp.InboxFolder, 2).Flags = []string{`\Seen`}
+		idx.Expunge(func(e smtp.IndexEntry) bool { return e.ImapUID == 1 })
+		return nil
+	})
+	c.expect("* 1 EXPUNGE")
+	if reply := c.expect("* 1 FETCH"); !strings.Contains(reply, `\Seen`) {
+		t.Errorf("expected new flags, got %s", reply)
+	}
+	c.text.PrintfLine("DONE")
+	if reply := c.until("a100 "); !strings.HasPrefix(reply[0], "OK") {
+		t.Errorf("IDLE: %v", reply)
+	}
+
+	// a deleted folder ends the session
+	c.cmd("CREATE Old")
+	c.cmd("SELECT Old")
+	store.UpdateMailbox("me", func(idx *smtp.MailboxIndex) error { return idx.DeleteFolder("Old") })
+	c.text.PrintfLine("a200 NOOP")
+	c.expect("* BYE")
+	if _, err := bufio.NewReader(c.conn).ReadByte(); err == nil {
+		t.Error("expected the connection closed")
+	}
+}
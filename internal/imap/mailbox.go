@@ -0,0 +1,619 @@
+package imap
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net/mail"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/buckelij/sif.io/internal/smtp"
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/backend"
+	"github.com/emersion/go-imap/responses"
+	"github.com/emersion/go-imap/server"
+)
+
+// systemFlags are the flags of RFC 3501 that are kept; \Recent isn't
+var systemFlags = []string{imap.AnsweredFlag, imap.FlaggedFlag, imap.DeletedFlag, imap.SeenFlag, imap.DraftFlag}
+
+// A mailbox is a folder as one session sees it. Sequence numbers only change
+// when the session is told, so the session keeps its own view of the
+// folder's UIDs and flags, which poll brings up to date.
+type mailbox struct {
+	user     *user
+	name     string
+	attrs    []string // for LIST
+	readOnly bool     // opened with EXAMINE
+
+	uidValidity uint32
+	uidNext     uint32
+	uids        []uint32            // by sequence number
+	flags       map[uint32][]string // as the session last saw them, sorted
+}
+
+func (m *mailbox) Name() string {
+	return m.name
+}
+
+func (m *mailbox) Info() (*imap.MailboxInfo, error) {
+	return &imap.MailboxInfo{Attributes: m.attrs, Delimiter: Delimiter, Name: m.name}, nil
+}
+
+func (m *mailbox) Status(items []imap.StatusItem) (*imap.MailboxStatus, error) {
+	status := imap.NewMailboxStatus(m.name, items)
+	status.Flags = systemFlags
+	status.PermanentFlags = append(slices.Clone(systemFlags), `\*`)
+	unseen := uint32(0)
+	for i, uid := range m.uids {
+		if !slices.Contains(m.flags[uid], imap.SeenFlag) {
+			if unseen == 0 {
+				status.UnseenSeqNum = uint32(i + 1)
+			}
+			unseen++
+		}
+	}
+	for _, item := range items {
+		switch item {
+		case imap.StatusMessages:
+			status.Messages = uint32(len(m.uids))
+		case imap.StatusRecent:
+			status.Recent = 0
+		case imap.StatusUnseen:
+			status.Unseen = unseen
+		case imap.StatusUidNext:
+			status.UidNext = m.uidNext
+		case imap.StatusUidValidity:
+			status.UidValidity = m.uidValidity
+		}
+	}
+	return status, nil
+}
+
+func (m *mailbox) SetSubscribed(subscribed bool) error {
+	return m.user.update(func(idx *smtp.MailboxIndex) error {
+		f := idx.Folder(m.name)
+		if f == nil {
+			return smtp.ErrNoSuchFolder
+		}
+		f.Subscribed = subscribed
+		return nil
+	})
+}
+
+func (m *mailbox) Check() error {
+	return nil
+}
+
+// seqNums returns the sequence numbers of the session's messages in set,
+// which is of UIDs if uid is set
+func (m *mailbox) seqNums(uid bool, set *imap.SeqSet) []uint32 {
+	if len(m.uids) == 0 {
+		return nil
+	}
+	seqs := []uint32{}
+	if uid {
+		set = resolve(set, m.uids[len(m.uids)-1])
+		for i, u := range m.uids {
+			if set.Contains(u) {
+				seqs = append(seqs, uint32(i+1))
+			}
+		}
+		return seqs
+	}
+	set = resolve(set, uint32(len(m.uids)))
+	for i := range m.uids {
+		if set.Contains(uint32(i + 1)) {
+			seqs = append(seqs, uint32(i+1))
+		}
+	}
+	return seqs
+}
+
+// resolve replaces `*` in set with last, the largest number in use
+func resolve(set *imap.SeqSet, last uint32) *imap.SeqSet {
+	if set == nil || !set.Dynamic() {
+		return set
+	}
+	resolved := &imap.SeqSet{}
+	for _, s := range set.Set {
+		if s.Start == 0 {
+			s.Start = last
+		}
+		if s.Stop == 0 {
+			s.Stop = last
+		}
+		resolved.AddRange(min(s.Start, s.Stop), max(s.Start, s.Stop))
+	}
+	return resolved
+}
+
+// messages returns the folder's messages by UID, with linked sizes resolved
+func (m *mailbox) messages(idx *smtp.MailboxIndex) map[uint32]smtp.IndexEntry {
+	entries := map[uint32]smtp.IndexEntry{}
+	for _, e := range idx.FolderMessages(m.name) {
+		entries[e.ImapUID] = e
+	}
+	return entries
+}
+
+func (m *mailbox) ListMessages(uid bool, seqset *imap.SeqSet, items []imap.FetchItem, ch chan<- *imap.Message) error {
+	defer close(ch)
+	seqs := m.seqNums(uid, seqset)
+	// fetching a body without PEEK marks it seen
+	seen := false
+	for _, item := range items {
+		if section, err := imap.ParseBodySectionName(item); err == nil && !section.Peek {
+			seen = !m.readOnly
+		}
+	}
+	marked := map[uint32]bool{}
+	var idx *smtp.MailboxIndex
+	var err error
+	if seen {
+		err = m.user.update(func(locked *smtp.MailboxIndex) error {
+			idx = locked
+			for _, seq := range seqs {
+				e := idx.Entry(m.name, m.uids[seq-1])
+				if e != nil && !slices.Contains(e.Flags, imap.SeenFlag) {
+					e.Flags = append(e.Flags, imap.SeenFlag)
+					marked[e.ImapUID] = true
+				}
+			}
+			return nil
+		})
+	} else {
+		idx, err = m.user.store.MailboxIndex(m.user.name)
+	}
+	if err != nil {
+		return err
+	}
+
+	entries := m.messages(idx)
+	for _, seq := range seqs {
+		e, ok := entries[m.uids[seq-1]]
+		if !ok {
+			// expunged by another session, which poll will report
+			continue
+		}
+		msg, err := m.fetch(seq, e, items)
+		if err != nil {
+			m.user.log.Error("failed to fetch", "key", e.Key, "err", err)
+			continue
+		}
+		if marked[e.ImapUID] {
+			msg.Items[imap.FetchFlags] = nil
+			msg.Flags = e.Flags
+		}
+		if _, ok := msg.Items[imap.FetchFlags]; ok {
+			m.flags[e.ImapUID] = sortedFlags(e.Flags)
+		}
+		ch <- msg
+	}
+	return nil
+}
+
+// fetch returns the items of a message, reading it only if they need it
+func (m *mailbox) fetch(seq uint32, e smtp.IndexEntry, items []imap.FetchItem) (*imap.Message, error) {
+	msg := imap.NewMessage(seq, items)
+	var p *part
+	parsed := func() (*part, error) {
+		if p != nil {
+			return p, nil
+		}
+		data, err := m.user.store.ReadMessage(e.Key)
+		if err != nil {
+			return nil, err
+		}
+		p = parseMessage(data)
+		return p, nil
+	}
+	for _, item := range items {
+		switch item {
+		case imap.FetchFlags:
+			msg.Flags = e.Flags
+		case imap.FetchInternalDate:
+			msg.InternalDate = e.Received
+		case imap.FetchRFC822Size:
+			msg.Size = uint32(e.Size)
+		case imap.FetchUid:
+			msg.Uid = e.ImapUID
+		case imap.FetchEnvelope:
+			p, err := parsed()
+			if err != nil {
+				return nil, err
+			}
+			msg.Envelope = envelope(p.fields)
+		case imap.FetchBody, imap.FetchBodyStructure:
+			p, err := parsed()
+			if err != nil {
+				return nil, err
+			}
+			msg.BodyStructure = p.bodyStructure(item == imap.FetchBodyStructure)
+		default:
+			section, err := imap.ParseBodySectionName(item)
+			if err != nil {
+				delete(msg.Items, item)
+				continue
+			}
+			p, err := parsed()
+			if err != nil {
+				return nil, err
+			}
+			msg.Body[section] = bytes.NewReader(section.ExtractPartial(p.section(section)))
+		}
+	}
+	return msg, nil
+}
+
+func (m *mailbox) SearchMessages(uid bool, criteria *imap.SearchCriteria) ([]uint32, error) {
+	idx, err := m.user.store.MailboxIndex(m.user.name)
+	if err != nil {
+		return nil, err
+	}
+	entries := m.messages(idx)
+	ids := []uint32{}
+	for i, u := range m.uids {
+		e, ok := entries[u]
+		if !ok {
+			continue
+		}
+		s := &search{mailbox: m, seq: uint32(i + 1), entry: e}
+		if !s.match(criteria) {
+			continue
+		}
+		if uid {
+			ids = append(ids, u)
+		} else {
+			ids = append(ids, s.seq)
+		}
+	}
+	return ids, nil
+}
+
+func (m *mailbox) CreateMessage(flags []string, date time.Time, body imap.Literal) error {
+	_, _, err := m.user.append(m.name, flags, date, body)
+	return err
+}
+
+// append stores a message in folder, returning its UIDVALIDITY and UID
+func (u *user) append(folder string, flags []string, date time.Time, body imap.Literal) (uidValidity, uid uint32, err error) {
+	data, err := io.ReadAll(body)
+	if err != nil {
+		return 0, 0, err
+	}
+	if date.IsZero() {
+		date = time.Now()
+	}
+	flags = slices.DeleteFunc(slices.Clone(flags), func(f string) bool { return f == imap.RecentFlag })
+	uidValidity, uid, err = u.store.AppendMessage(u.name, folder, flags, date, data)
+	if errors.Is(err, smtp.ErrNoSuchFolder) {
+		err = backend.ErrNoSuchMailbox
+	}
+	return uidValidity, uid, err
+}
+
+func (m *mailbox) UpdateMessagesFlags(uid bool, seqset *imap.SeqSet, op imap.FlagsOp, flags []string) error {
+	flags = slices.DeleteFunc(slices.Clone(flags), func(f string) bool { return f == imap.RecentFlag })
+	seqs := m.seqNums(uid, seqset)
+	updated := map[uint32][]string{}
+	err := m.user.update(func(idx *smtp.MailboxIndex) error {
+		for _, seq := range seqs {
+			e := idx.Entry(m.name, m.uids[seq-1])
+			if e == nil {
+				continue
+			}
+			e.Flags = updateFlags(e.Flags, op, flags)
+			updated[e.ImapUID] = e.Flags
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	// the session knows of its own changes, and is sent them unless .SILENT
+	for uid, f := range updated {
+		m.flags[uid] = sortedFlags(f)
+	}
+	return nil
+}
+
+func updateFlags(current []string, op imap.FlagsOp, flags []string) []string {
+	switch op {
+	case imap.SetFlags:
+		current = nil
+		fallthrough
+	case imap.AddFlags:
+		for _, f := range flags {
+			if !slices.Contains(current, f) {
+				current = append(current, f)
+			}
+		}
+	case imap.RemoveFlags:
+		current = slices.DeleteFunc(current, func(f string) bool { return slices.Contains(flags, f) })
+	}
+	return current
+}
+
+func sortedFlags(flags []string) []string {
+	flags = slices.Clone(flags)
+	slices.Sort(flags)
+	return flags
+}
+
+func (m *mailbox) CopyMessages(uid bool, seqset *imap.SeqSet, dest string) error {
+	_, _, _, err := m.copy(uid, seqset, dest, false)
+	return err
+}
+
+// copy copies or moves messages to dest, returning dest's UIDVALIDITY, the
+// UIDs copied and their UIDs in dest. Moved messages leave the session's
+// view; the caller reports them expunged.
+func (m *mailbox) copy(uid bool, seqset *imap.SeqSet, dest string, move bool) (uidValidity uint32, src, dst []uint32, err error) {
+	uids := []uint32{}
+	for _, seq := range m.seqNums(uid, seqset) {
+		uids = append(uids, m.uids[seq-1])
+	}
+	err = m.user.update(func(idx *smtp.MailboxIndex) error {
+		d := idx.Folder(dest)
+		if d == nil {
+			return smtp.ErrNoSuchFolder
+		}
+		uidValidity = d.UIDValidity
+		if move {
+			src, dst, err = idx.Move(m.name, uids, dest)
+		} else {
+			src, dst, err = idx.Copy(m.name, uids, dest)
+		}
+		return err
+	})
+	return uidValidity, src, dst, err
+}
+
+func (m *mailbox) Expunge() error {
+	_, err := m.expunge(nil)
+	return err
+}
+
+// expunge removes the session's messages flagged \Deleted, only those with
+// UIDs in uids if it's set, and returns their sequence numbers, last first
+// so each is correct as it's reported
+func (m *mailbox) expunge(uids *imap.SeqSet) ([]uint32, error) {
+	if uids != nil && len(m.uids) > 0 {
+		uids = resolve(uids, m.uids[len(m.uids)-1])
+	}
+	candidates := map[uint32]bool{}
+	for _, u := range m.uids {
+		candidates[u] = uids == nil || uids.Contains(u)
+	}
+	removed := map[uint32]bool{}
+	err := m.user.update(func(idx *smtp.MailboxIndex) error {
+		for _, e := range idx.Expunge(func(e smtp.IndexEntry) bool {
+			return e.InFolder(m.name) && candidates[e.ImapUID] && slices.Contains(e.Flags, imap.DeletedFlag)
+		}) {
+			removed[e.ImapUID] = true
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return m.forget(removed), nil
+}
+
+// forget removes uids from the session's view, returning their sequence
+// numbers, last first
+func (m *mailbox) forget(uids map[uint32]bool) []uint32 {
+	seqs := []uint32{}
+	for i := len(m.uids) - 1; i >= 0; i-- {
+		if uids[m.uids[i]] {
+			seqs = append(seqs, uint32(i+1))
+			delete(m.flags, m.uids[i])
+			m.uids = slices.Delete(m.uids, i, i+1)
+		}
+	}
+	return seqs
+}
+
+// poll tells the session about changes to the folder since it last looked:
+// EXPUNGE for messages that have gone, FETCH for changed flags and EXISTS
+// for new messages
+func (m *mailbox) poll(conn server.Conn) error {
+	idx, err := m.user.store.MailboxIndex(m.user.name)
+	if err != nil {
+		return err
+	}
+	f := idx.Folder(m.name)
+	if f == nil || f.UIDValidity != m.uidValidity {
+		// the session's UIDs mean nothing now
+		conn.WriteResp(&imap.StatusResp{Type: imap.StatusRespBye, Info: "Folder deleted"})
+		return conn.Close()
+	}
+	entries := m.messages(idx)
+
+	gone := map[uint32]bool{}
+	for _, u := range m.uids {
+		if _, ok := entries[u]; !ok {
+			gone[u] = true
+		}
+	}
+	if err := writeExpunge(conn, m.forget(gone)); err != nil {
+		return err
+	}
+
+	changed := []*imap.Message{}
+	for i, u := range m.uids {
+		flags := sortedFlags(entries[u].Flags)
+		if slices.Equal(flags, m.flags[u]) {
+			continue
+		}
+		m.flags[u] = flags
+		msg := imap.NewMessage(uint32(i+1), []imap.FetchItem{imap.FetchFlags, imap.FetchUid})
+		msg.Flags, msg.Uid = flags, u
+		changed = append(changed, msg)
+	}
+	if len(changed) > 0 {
+		ch := make(chan *imap.Message, len(changed))
+		for _, msg := range changed {
+			ch <- msg
+		}
+		close(ch)
+		if err := conn.WriteResp(&responses.Fetch{Messages: ch}); err != nil {
+			return err
+		}
+	}
+
+	last := uint32(0)
+	if len(m.uids) > 0 {
+		last = m.uids[len(m.uids)-1]
+	}
+	added := false
+	for _, e := range idx.FolderMessages(m.name) {
+		if e.ImapUID > last {
+			m.uids = append(m.uids, e.ImapUID)
+			m.flags[e.ImapUID] = sortedFlags(e.Flags)
+			added = true
+		}
+	}
+	m.uidNext = f.UIDNext
+	if !added {
+		return nil
+	}
+	status := imap.NewMailboxStatus(m.name, []imap.StatusItem{imap.StatusMessages})
+	status.Messages = uint32(len(m.uids))
+	return conn.WriteResp(&responses.Select{Mailbox: status})
+}
+
+// writeExpunge reports expunged sequence numbers, which must be last first
+func writeExpunge(conn server.Conn, seqs []uint32) error {
+	if len(seqs) == 0 {
+		return nil
+	}
+	ch := make(chan uint32, len(seqs))
+	for _, seq := range seqs {
+		ch <- seq
+	}
+	close(ch)
+	return conn.WriteResp(&responses.Expunge{SeqNums: ch})
+}
+
+// a search matches one message against SEARCH criteria
+type search struct {
+	mailbox *mailbox
+	seq     uint32
+	entry   smtp.IndexEntry
+	part    *part // read when criteria need the message
+	failed  bool
+}
+
+func (s *search) parsed() *part {
+	if s.part == nil && !s.failed {
+		data, err := s.mailbox.user.store.ReadMessage(s.entry.Key)
+		if err != nil {
+			s.mailbox.user.log.Error("failed to read for search", "key", s.entry.Key, "err", err)
+			s.failed = true
+			return nil
+		}
+		s.part = parseMessage(data)
+	}
+	return s.part
+}
+
+func (s *search) match(c *imap.SearchCriteria) bool {
+	if c.SeqNum != nil && !resolve(c.SeqNum, uint32(len(s.mailbox.uids))).Contains(s.seq) {
+		return false
+	}
+	if c.Uid != nil && !resolve(c.Uid, s.mailbox.uids[len(s.mailbox.uids)-1]).Contains(s.entry.ImapUID) {
+		return false
+	}
+	received := day(s.entry.Received)
+	if !c.Since.IsZero() && received.Before(day(c.Since)) {
+		return false
+	}
+	if !c.Before.IsZero() && !received.Before(day(c.Before)) {
+		return false
+	}
+	for _, f := range c.WithFlags {
+		if !slices.Contains(s.entry.Flags, f) {
+			return false
+		}
+	}
+	for _, f := range c.WithoutFlags {
+		if slices.Contains(s.entry.Flags, f) {
+			return false
+		}
+	}
+	if c.Larger > 0 && s.entry.Size <= int64(c.Larger) {
+		return false
+	}
+	if c.Smaller > 0 && s.entry.Size >= int64(c.Smaller) {
+		return false
+	}
+
+	if !c.SentSince.IsZero() || !c.SentBefore.IsZero() || len(c.Header) > 0 || len(c.Body) > 0 || len(c.Text) > 0 {
+		p := s.parsed()
+		if p == nil {
+			return false
+		}
+		if !c.SentSince.IsZero() || !c.SentBefore.IsZero() {
+			sent, err := envelopeDate(p)
+			if err != nil || (!c.SentSince.IsZero() && sent.Before(day(c.SentSince))) || (!c.SentBefore.IsZero() && !sent.Before(day(c.SentBefore))) {
+				return false
+			}
+		}
+		for key, values := range c.Header {
+			for _, want := range values {
+				got, ok := p.fields[key]
+				if !ok || !slices.ContainsFunc(got, func(v string) bool { return contains(decodeHeader(v), want) }) {
+					return false
+				}
+			}
+		}
+		for _, want := range c.Body {
+			if !contains(p.text(), want) {
+				return false
+			}
+		}
+		for _, want := range c.Text {
+			if !contains(string(p.header), want) && !contains(p.text(), want) {
+				return false
+			}
+		}
+	}
+
+	for _, not := range c.Not {
+		if s.match(not) {
+			return false
+		}
+	}
+	for _, or := range c.Or {
+		if !s.match(or[0]) && !s.match(or[1]) {
+			return false
+		}
+	}
+	return true
+}
+
+// day truncates t to its date, as SEARCH compares dates only
+func day(t time.Time) time.Time {
+	return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+}
+
+func envelopeDate(p *part) (time.Time, error) {
+	t, err := mail.ParseDate(p.fields.Get("Date"))
+	return day(t), err
+}
+
+func decodeHeader(v string) string {
+	if d, err := wordDecoder.DecodeHeader(v); err == nil {
+		return d
+	}
+	return v
+}
+
+// contains is SEARCH's case-insensitive substring match
+func contains(s, substr string) bool {
+	return strings.Contains(strings.ToLower(s), strings.ToLower(substr))
+}
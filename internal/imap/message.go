@@ -0,0 +1,254 @@
+package imap
+
+import (
+	"bytes"
+	"maps"
+	"mime"
+	"net/mail"
+	"net/textproto"
+	"slices"
+	"strings"
+
+	"github.com/buckelij/sif.io/internal/smtp"
+	"github.com/emersion/go-imap"
+)
+
+// A part is a node of a message's MIME structure as IMAP describes it. IMAP
+// sizes and sections are octets of the stored message, so parts keep the raw
+// bytes smtp.ParseMimePart slices from it.
+type part struct {
+	header   []byte // raw, including the blank line that ends it
+	body     []byte
+	fields   textproto.MIMEHeader
+	mimeType string // e.g. "text"
+	subType  string // e.g. "plain"
+	params   map[string]string
+	parts    []*part // of a multipart
+	message  *part   // the message a message/rfc822 part encloses
+	parsed   *smtp.MimePart
+}
+
+// parseMessage returns the MIME structure of a message
+func parseMessage(data []byte) *part {
+	return newPart(smtp.ParseMimePart(data))
+}
+
+// newPart converts a parsed part and those below it
+func newPart(mp *smtp.MimePart) *part {
+	p := &part{header: mp.RawHeader, body: mp.RawBody, fields: mp.Header, params: maps.Clone(mp.Params), parsed: mp}
+	p.mimeType, p.subType, _ = strings.Cut(mp.MediaType, "/")
+	if p.mimeType == "text" && p.params["charset"] == "" {
+		p.params["charset"] = "us-ascii"
+	}
+	for _, c := range mp.Parts {
+		p.parts = append(p.parts, newPart(c))
+	}
+	if mp.Message != nil {
+		p.message = newPart(mp.Message)
+	}
+	return p
+}
+
+// lines counts the lines of b, including an unterminated last line
+func lines(b []byte) uint32 {
+	n := bytes.Count(b, []byte("\n"))
+	if len(b) > 0 && b[len(b)-1] != '\n' {
+		n++
+	}
+	return uint32(n)
+}
+
+// bodyStructure returns the part's BODYSTRUCTURE, or BODY if not extended
+func (p *part) bodyStructure(extended bool) *imap.BodyStructure {
+	bs := &imap.BodyStructure{
+		MIMEType:    p.mimeType,
+		MIMESubType: p.subType,
+		Params:      p.params,
+		Extended:    extended,
+	}
+	if p.parts != nil {
+		for _, c := range p.parts {
+			bs.Parts = append(bs.Parts, c.bodyStructure(extended))
+		}
+	} else {
+		bs.Id = p.fields.Get("Content-Id")
+		bs.Description = p.fields.Get("Content-Description")
+		bs.Encoding = strings.ToUpper(p.fields.Get("Content-Transfer-Encoding"))
+		if bs.Encoding == "" {
+			bs.Encoding = "7BIT"
+		}
+		bs.Size = uint32(len(p.body))
+		if p.mimeType == "text" {
+			bs.Lines = lines(p.body)
+		}
+		if p.message != nil {
+			bs.Envelope = envelope(p.message.fields)
+			bs.BodyStructure = p.message.bodyStructure(extended)
+			bs.Lines = lines(p.body)
+		}
+	}
+	if extended {
+		if d, params, err := mime.ParseMediaType(p.fields.Get("Content-Disposition")); err == nil {
+			bs.Disposition, bs.DispositionParams = d, params
+		}
+		if l := p.fields.Get("Content-Language"); l != "" {
+			for _, lang := range strings.Split(l, ",") {
+				bs.Language = append(bs.Language, strings.TrimSpace(lang))
+			}
+		}
+		if l := p.fields.Get("Content-Location"); l != "" {
+			bs.Location = []string{l}
+		}
+		bs.MD5 = p.fields.Get("Content-Md5")
+	}
+	return bs
+}
+
+var wordDecoder = &mime.WordDecoder{CharsetReader: smtp.CharsetReader}
+
+// envelope returns the ENVELOPE of a message's header
+func envelope(h textproto.MIMEHeader) *imap.Envelope {
+	subject, err := wordDecoder.DecodeHeader(h.Get("Subject"))
+	if err != nil {
+		subject = h.Get("Subject")
+	}
+	e := &imap.Envelope{
+		Subject:   subject,
+		From:      addressList(h.Get("From")),
+		Sender:    addressList(h.Get("Sender")),
+		ReplyTo:   addressList(h.Get("Reply-To")),
+		To:        addressList(h.Get("To")),
+		Cc:        addressList(h.Get("Cc")),
+		Bcc:       addressList(h.Get("Bcc")),
+		InReplyTo: h.Get("In-Reply-To"),
+		MessageId: h.Get("Message-Id"),
+	}
+	e.Date, _ = mail.ParseDate(h.Get("Date"))
+	// RFC 3501 has the server default these to From
+	if len(e.Sender) == 0 {
+		e.Sender = e.From
+	}
+	if len(e.ReplyTo) == 0 {
+		e.ReplyTo = e.From
+	}
+	return e
+}
+
+func addressList(v string) []*imap.Address {
+	if v == "" {
+		return nil
+	}
+	list, err := (&mail.AddressParser{WordDecoder: wordDecoder}).ParseList(v)
+	if err != nil {
+		return nil
+	}
+	addrs := []*imap.Address{}
+	for _, a := range list {
+		local, domain := a.Address, ""
+		if i := strings.LastIndex(a.Address, "@"); i >= 0 {
+			local, domain = a.Address[:i], a.Address[i+1:]
+		}
+		addrs = append(addrs, &imap.Address{PersonalName: a.Name, MailboxName: local, HostName: domain})
+	}
+	return addrs
+}
+
+// section returns the octets of a FETCH BODY[section], or nil if the message
+// has no such part
+func (p *part) section(s *imap.BodySectionName) []byte {
+	cur := p
+	for i, n := range s.Path {
+		// numbers after a message/rfc822 part are parts of its message
+		if i > 0 && cur.message != nil {
+			cur = cur.message
+		}
+		switch {
+		case cur.parts != nil && n >= 1 && n <= len(cur.parts):
+			cur = cur.parts[n-1]
+		case cur.parts == nil && n == 1:
+			// a single part message is its own part 1
+		default:
+			return nil
+		}
+	}
+
+	// HEADER and TEXT of a part are those of the message it encloses
+	msg := cur
+	if len(s.Path) > 0 {
+		msg = cur.message
+	}
+	switch s.Specifier {
+	case imap.EntireSpecifier:
+		if len(s.Path) == 0 {
+			return append(slices.Clip(cur.header), cur.body...)
+		}
+		return cur.body
+	case imap.MIMESpecifier:
+		if len(s.Path) == 0 {
+			return nil
+		}
+		return cur.header
+	case imap.HeaderSpecifier:
+		if msg == nil {
+			return nil
+		}
+		if s.Fields != nil {
+			return headerFields(msg.header, s.Fields, s.NotFields)
+		}
+		return msg.header
+	case imap.TextSpecifier:
+		if msg == nil {
+			return nil
+		}
+		return msg.body
+	}
+	return nil
+}
+
+// headerFields returns the fields of a raw header that are, or with not
+// aren't, among names, followed by the blank line
+func headerFields(header []byte, names []string, not bool) []byte {
+	b := bytes.Buffer{}
+	keep := false
+	for _, line := range bytes.SplitAfter(header, []byte("\n")) {
+		if len(bytes.TrimRight(line, "\r\n")) == 0 {
+			break
+		}
+		// continuation lines go with their field
+		if line[0] != ' ' && line[0] != '\t' {
+			name, _, _ := bytes.Cut(line, []byte(":"))
+			keep = not
+			for _, n := range names {
+				if strings.EqualFold(strings.TrimSpace(string(name)), n) {
+					keep = !not
+					break
+				}
+			}
+		}
+		if keep {
+			b.Write(line)
+		}
+	}
+	b.WriteString("\r\n")
+	return b.Bytes()
+}
+
+// text returns the decoded text parts of the part, for SEARCH
+func (p *part) text() string {
+	switch {
+	case p.parts != nil:
+		b := strings.Builder{}
+		for _, c := range p.parts {
+			b.WriteString(c.text())
+		}
+		return b.String()
+	case p.message != nil:
+		return p.message.text()
+	case p.mimeType == "text":
+		if b, err := p.parsed.Body(); err == nil {
+			return string(b)
+		}
+		return string(p.body)
+	}
+	return ""
+}
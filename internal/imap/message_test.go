@@ -0,0 +1,120 @@
+package imap
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/emersion/go-imap"
+)
+
+const multipartMessage = "From: Eli <eli@sif.io>\r\n" +
+	"To: me@sif.io, =?utf-8?q?B=C3=B8b?= <bob@sif.io>\r\n" +
+	"Subject: =?utf-8?q?h=C3=A9llo?=\r\n" +
+	"Date: Wed, 1 Jul 2026 10:00:00 +0000\r\n" +
+	"Message-Id: <1@sif.io>\r\n" +
+	"Content-Type: multipart/mixed; boundary=b\r\n" +
+	"\r\n" +
+	"preamble\r\n" +
+	"--b\r\n" +
+	"Content-Type: text/plain; charset=utf-8\r\n" +
+	"\r\n" +
+	"hello\r\nworld\r\n" +
+	"--b\r\n" +
+	"Content-Type: message/rfc822\r\n" +
+	"\r\n" +
+	"Subject: inner\r\n" +
+	"\r\n" +
+	"inner body\r\n" +
+	"--b\r\n" +
+	"Content-Type: application/pdf; name=a.pdf\r\n" +
+	"Content-Transfer-Encoding: base64\r\n" +
+	"Content-Disposition: attachment; filename=a.pdf\r\n" +
+	"\r\n" +
+	"aGVsbG8=\r\n" +
+	"--b--\r\n"
+
+func section(t *testing.T, p *part, name string) string {
+	s, err := imap.ParseBodySectionName(imap.FetchItem(name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(p.section(s))
+}
+
+func TestBodyStructure(t *testing.T) {
+	bs := parseMessage([]byte(multipartMessage)).bodyStructure(true)
+	if bs.MIMEType != "multipart" || bs.MIMESubType != "mixed" || len(bs.Parts) != 3 {
+		t.Fatalf("unexpected structure %+v", bs)
+	}
+	text := bs.Parts[0]
+	if text.Params["charset"] != "utf-8" || text.Encoding != "7BIT" || text.Size != 12 || text.Lines != 2 {
+		t.Errorf("unexpected text part %+v", text)
+	}
+	inner := bs.Parts[1]
+	if inner.Envelope == nil || inner.Envelope.Subject != "inner" || inner.BodyStructure.MIMEType != "text" {
+		t.Errorf("unexpected message part %+v", inner)
+	}
+	pdf := bs.Parts[2]
+	if pdf.Encoding != "BASE64" || pdf.Disposition != "attachment" || pdf.DispositionParams["filename"] != "a.pdf" {
+		t.Errorf("unexpected attachment %+v", pdf)
+	}
+
+	// a message without a Content-Type is text
+	plain := parseMessage([]byte("Subject: hi\r\n\r\nhi\r\n")).bodyStructure(false)
+	if plain.MIMEType != "text" || plain.Params["charset"] != "us-ascii" || plain.Lines != 1 {
+		t.Errorf("unexpected plain structure %+v", plain)
+	}
+}
+
+func TestSection(t *testing.T) {
+	p := parseMessage([]byte(multipartMessage))
+	tests := []struct {
+		name string
+		want string
+	}{
+		{"BODY[]", multipartMessage},
+		{"BODY[1]", "hello\r\nworld"},
+		{"BODY[1.MIME]", "Content-Type: text/plain; charset=utf-8\r\n\r\n"},
+		{"BODY[2.HEADER]", "Subject: inner\r\n\r\n"},
+		{"BODY[2.TEXT]", "inner body"},
+		{"BODY[2.1]", "inner body"},
+		{"BODY[3]", "aGVsbG8="},
+		{"BODY[4]", ""},
+		{"BODY[HEADER.FIELDS (subject message-id)]", "Subject: =?utf-8?q?h=C3=A9llo?=\r\nMessage-Id: <1@sif.io>\r\n\r\n"},
+		{"BODY[TEXT]<0.8>", "preamble"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s, _ := imap.ParseBodySectionName(imap.FetchItem(test.name))
+			if got := string(s.ExtractPartial(p.section(s))); got != test.want {
+				t.Errorf("got %q, want %q", got, test.want)
+			}
+		})
+	}
+	if got := section(t, p, "BODY[HEADER.FIELDS.NOT (from to subject date content-type)]"); got != "Message-Id: <1@sif.io>\r\n\r\n" {
+		t.Errorf("unexpected HEADER.FIELDS.NOT %q", got)
+	}
+	if text := p.text(); !strings.Contains(text, "hello") || !strings.Contains(text, "inner body") || strings.Contains(text, "aGVsbG8") {
+		t.Errorf("unexpected text %q", text)
+	}
+}
+
+func TestEnvelope(t *testing.T) {
+	e := envelope(parseMessage([]byte(multipartMessage)).fields)
+	if e.Subject != "héllo" || e.MessageId != "<1@sif.io>" || e.Date.Day() != 1 {
+		t.Errorf("unexpected envelope %+v", e)
+	}
+	if len(e.To) != 2 || e.To[1].PersonalName != "Bøb" || e.To[1].HostName != "sif.io" {
+		t.Errorf("unexpected To %+v", e.To)
+	}
+	if len(e.Sender) != 1 || e.Sender[0].MailboxName != "eli" || len(e.ReplyTo) != 1 {
+		t.Errorf("expected Sender and Reply-To from From, got %+v %+v", e.Sender, e.ReplyTo)
+	}
+}
+
+func TestTextCharset(t *testing.T) {
+	p := parseMessage([]byte("Content-Type: text/plain; charset=iso-8859-1\r\nContent-Transfer-Encoding: quoted-printable\r\n\r\ncaf=E9 cr=E8me\r\n"))
+	if text := p.text(); !strings.Contains(text, "café crème") {
+		t.Errorf("unexpected text %q", text)
+	}
+}
@@ -0,0 +1,397 @@
+package jmap
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/google/uuid"
+)
+
+// A request is a JMAP API request, RFC 8620 section 3.3
+type request struct {
+	Using       []string          `json:"using"`
+	MethodCalls []invocation      `json:"methodCalls"`
+	CreatedIDs  map[string]string `json:"createdIds,omitempty"`
+}
+
+type response struct {
+	MethodResponses []invocation      `json:"methodResponses"`
+	CreatedIDs      map[string]string `json:"createdIds,omitempty"`
+	SessionState    string            `json:"sessionState"`
+}
+
+// An invocation is a method call or response, a [name, arguments, call id] array
+type invocation struct {
+	Name   string
+	Args   json.RawMessage
+	CallID string
+}
+
+func (inv *invocation) UnmarshalJSON(b []byte) error {
+	var raw []json.RawMessage
+	if err := json.Unmarshal(b, &raw); err != nil || len(raw) != 3 {
+		return errors.New("an invocation is a 3 element array")
+	}
+	if err := json.Unmarshal(raw[0], &inv.Name); err != nil {
+		return err
+	}
+	inv.Args = raw[1]
+	return json.Unmarshal(raw[2], &inv.CallID)
+}
+
+func (inv invocation) MarshalJSON() ([]byte, error) {
+	return json.Marshal([]any{inv.Name, inv.Args, inv.CallID})
+}
+
+// A methodError is returned as an "error" response, RFC 8620 section 3.6.2
+type methodError struct {
+	Type        string `json:"type"`
+	Description string `json:"description,omitempty"`
+}
+
+func (e *methodError) Error() string {
+	return e.Type + ": " + e.Description
+}
+
+func invalidArguments(format string, args ...any) error {
+	return &methodError{Type: "invalidArguments", Description: fmt.Sprintf(format, args...)}
+}
+
+var (
+	errAccountNotFound        = &methodError{Type: "accountNotFound"}
+	errCannotCalculateChanges = &methodError{Type: "cannotCalculateChanges"}
+	errStateMismatch          = &methodError{Type: "stateMismatch"}
+	errRequestTooLarge        = &methodError{Type: "requestTooLarge"}
+	errAnchorNotFound         = &methodError{Type: "anchorNotFound"}
+	errServerFail             = &methodError{Type: "serverFail"}
+)
+
+// A setError is why one object of a /set wasn't changed, RFC 8620 section 5.3
+type setError struct {
+	Type        string   `json:"type"`
+	Description string   `json:"description,omitempty"`
+	Properties  []string `json:"properties,omitempty"`
+}
+
+func (e *setError) Error() string {
+	return e.Type + ": " + e.Description
+}
+
+func invalidProperties(description string, properties ...string) *setError {
+	return &setError{Type: "invalidProperties", Description: description, Properties: properties}
+}
+
+var errNotFound = &setError{Type: "notFound"}
+
+// problem writes a request level error, RFC 8620 section 3.6.1
+func problem(w http.ResponseWriter, status int, typ, detail string) {
+	w.Header().Set("Content-Type", "application/problem+json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]any{"type": "urn:ietf:params:jmap:error:" + typ, "status": status, "detail": detail})
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		slog.Warn("jmap response", "err", err)
+	}
+}
+
+// A method handles one method call with its arguments, returning the
+// response arguments. Methods that respond more than once, e.g. with an
+// implicit Email/set, add their own responses to the call.
+type method struct {
+	capability string
+	handle     func(c *call, args json.RawMessage) (any, error)
+}
+
+var methods map[string]method
+
+func init() {
+	methods = map[string]method{
+		"Core/echo":             {capCore, func(c *call, args json.RawMessage) (any, error) { return args, nil }},
+		"Mailbox/get":           {capMail, (*call).mailboxGet},
+		"Mailbox/changes":       {capMail, (*call).mailboxChanges},
+		"Mailbox/query":         {capMail, (*call).mailboxQuery},
+		"Mailbox/queryChanges":  {capMail, (*call).queryChanges},
+		"Mailbox/set":           {capMail, (*call).mailboxSet},
+		"Thread/get":            {capMail, (*call).threadGet},
+		"Thread/changes":        {capMail, (*call).threadChanges},
+		"Email/get":             {capMail, (*call).emailGet},
+		"Email/changes":         {capMail, (*call).emailChanges},
+		"Email/query":           {capMail, (*call).emailQuery},
+		"Email/queryChanges":    {capMail, (*call).queryChanges},
+		"Email/set":             {capMail, (*call).emailSet},
+		"Email/import":          {capMail, (*call).emailImport},
+		"Identity/get":          {capSubmission, (*call).identityGet},
+		"Identity/changes":      {capSubmission, (*call).identityChanges},
+		"EmailSubmission/get":   {capSubmission, (*call).submissionGet},
+		"EmailSubmission/set":   {capSubmission, (*call).submissionSet},
+		"EmailSubmission/query": {capSubmission, (*call).submissionQuery},
+	}
+}
+
+// A call is the state of one API request as its method calls are made
+type call struct {
+	h         *Handler
+	user      string
+	log       *slog.Logger
+	using     []string
+	created   map[string]string // creation ids to the ids they were given
+	responses []invocation
+	callID    string // of the method being called
+	implicit  []invocation
+}
+
+func (h *Handler) apiHandler(w http.ResponseWriter, req *http.Request, user string) {
+	if !strings.HasPrefix(req.Header.Get("Content-Type"), "application/json") {
+		problem(w, http.StatusBadRequest, "notJSON", "the content type must be application/json")
+		return
+	}
+	body, err := io.ReadAll(http.MaxBytesReader(w, req.Body, maxSizeRequest))
+	if err != nil {
+		problem(w, http.StatusRequestEntityTooLarge, "limit", "maxSizeRequest")
+		return
+	}
+	if !json.Valid(body) {
+		problem(w, http.StatusBadRequest, "notJSON", "the request isn't valid JSON")
+		return
+	}
+	r := request{}
+	if err := json.Unmarshal(body, &r); err != nil || r.Using == nil || r.MethodCalls == nil {
+		problem(w, http.StatusBadRequest, "notRequest", "the request isn't a JMAP Request object")
+		return
+	}
+	for _, u := range r.Using {
+		if u != capCore && u != capMail && u != capSubmission {
+			problem(w, http.StatusBadRequest, "unknownCapability", u)
+			return
+		}
+	}
+	if len(r.MethodCalls) > maxCallsInRequest {
+		problem(w, http.StatusBadRequest, "limit", "maxCallsInRequest")
+		return
+	}
+
+	c := &call{h: h, user: user, using: r.Using, created: map[string]string{}}
+	c.log = slog.With("session", uuid.NewString(), "remote", req.RemoteAddr, "proto", "jmap", "user", user)
+	for id, created := range r.CreatedIDs {
+		c.created[id] = created
+	}
+	for _, inv := range r.MethodCalls {
+		c.invoke(inv)
+	}
+	res := response{MethodResponses: c.responses, SessionState: sessionState(user)}
+	if r.CreatedIDs != nil {
+		res.CreatedIDs = c.created
+	}
+	writeJSON(w, http.StatusOK, res)
+}
+
+// invoke calls a method, adding its response or error to the call's responses
+func (c *call) invoke(inv invocation) {
+	c.callID = inv.CallID
+	m, ok := methods[inv.Name]
+	if !ok || !slices.Contains(c.using, m.capability) {
+		c.respondError(inv.Name, &methodError{Type: "unknownMethod"})
+		return
+	}
+	args, err := c.resolveReferences(inv.Args)
+	if err != nil {
+		c.respondError(inv.Name, err)
+		return
+	}
+	res, err := m.handle(c, args)
+	if err != nil {
+		c.respondError(inv.Name, err)
+		return
+	}
+	methodCalls.WithLabelValues(inv.Name, "success").Inc()
+	c.respond(inv.Name, res)
+	for _, i := range c.implicit {
+		c.responses = append(c.responses, i)
+	}
+	c.implicit = nil
+}
+
+// then adds a response to follow that of the method being called, as
+// EmailSubmission/set does with the Email/set it implies
+func (c *call) then(name string, args any) {
+	if me, ok := args.(*methodError); ok {
+		b, _ := json.Marshal(me)
+		c.implicit = append(c.implicit, invocation{Name: "error", Args: b, CallID: c.callID})
+		return
+	}
+	b, err := json.Marshal(args)
+	if err != nil {
+		c.log.Error("jmap response", "method", name, "err", err)
+		return
+	}
+	c.implicit = append(c.implicit, invocation{Name: name, Args: b, CallID: c.callID})
+}
+
+func (c *call) respond(name string, args any) {
+	b, err := json.Marshal(args)
+	if err != nil {
+		c.respondError(name, err)
+		return
+	}
+	c.responses = append(c.responses, invocation{Name: name, Args: b, CallID: c.callID})
+}
+
+func (c *call) respondError(name string, err error) {
+	var me *methodError
+	if !errors.As(err, &me) {
+		c.log.Error("jmap method failed", "method", name, "err", err)
+		me = errServerFail
+	}
+	methodCalls.WithLabelValues(name, me.Type).Inc()
+	b, _ := json.Marshal(me)
+	c.responses = append(c.responses, invocation{Name: "error", Args: b, CallID: c.callID})
+}
+
+// resultReference points into an earlier response, RFC 8620 section 3.7
+type resultReference struct {
+	ResultOf string `json:"resultOf"`
+	Name     string `json:"name"`
+	Path     string `json:"path"`
+}
+
+// resolveReferences replaces `#` arguments with the values they refer to
+func (c *call) resolveReferences(raw json.RawMessage) (json.RawMessage, error) {
+	args := map[string]json.RawMessage{}
+	if err := json.Unmarshal(raw, &args); err != nil {
+		return nil, invalidArguments("arguments must be an object")
+	}
+	changed := false
+	for name, v := range args {
+		plain, ok := strings.CutPrefix(name, "#")
+		if !ok {
+			continue
+		}
+		if _, ok := args[plain]; ok {
+			return nil, invalidArguments("both %s and #%s given", plain, plain)
+		}
+		ref := resultReference{}
+		if err := json.Unmarshal(v, &ref); err != nil {
+			return nil, &methodError{Type: "invalidResultReference", Description: err.Error()}
+		}
+		value, err := c.evaluate(ref)
+		if err != nil {
+			return nil, &methodError{Type: "invalidResultReference", Description: err.Error()}
+		}
+		b, err := json.Marshal(value)
+		if err != nil {
+			return nil, err
+		}
+		delete(args, name)
+		args[plain] = b
+		changed = true
+	}
+	if !changed {
+		return raw, nil
+	}
+	return json.Marshal(args)
+}
+
+func (c *call) evaluate(ref resultReference) (any, error) {
+	for _, r := range c.responses {
+		if r.CallID != ref.ResultOf {
+			continue
+		}
+		if r.Name != ref.Name {
+			return nil, fmt.Errorf("%s is a %s response, not %s", ref.ResultOf, r.Name, ref.Name)
+		}
+		var v any
+		if err := json.Unmarshal(r.Args, &v); err != nil {
+			return nil, err
+		}
+		return pointer(v, ref.Path)
+	}
+	return nil, fmt.Errorf("no response for %s", ref.ResultOf)
+}
+
+// pointer evaluates a JSON Pointer, RFC 6901, where `*` maps the rest of the
+// path over an array, flattening arrays it results in
+func pointer(v any, path string) (any, error) {
+	if path == "" {
+		return v, nil
+	}
+	rest, ok := strings.CutPrefix(path, "/")
+	if !ok {
+		return nil, fmt.Errorf("invalid path %q", path)
+	}
+	token, rest, more := strings.Cut(rest, "/")
+	if more {
+		rest = "/" + rest
+	}
+	token = strings.ReplaceAll(strings.ReplaceAll(token, "~1", "/"), "~0", "~")
+	switch v := v.(type) {
+	case []any:
+		if token == "*" {
+			out := []any{}
+			for _, e := range v {
+				r, err := pointer(e, rest)
+				if err != nil {
+					return nil, err
+				}
+				if a, ok := r.([]any); ok {
+					out = append(out, a...)
+				} else {
+					out = append(out, r)
+				}
+			}
+			return out, nil
+		}
+		i, err := strconv.Atoi(token)
+		if err != nil || i < 0 || i >= len(v) {
+			return nil, fmt.Errorf("no element %q", token)
+		}
+		return pointer(v[i], rest)
+	case map[string]any:
+		e, ok := v[token]
+		if !ok {
+			return nil, fmt.Errorf("no member %q", token)
+		}
+		return pointer(e, rest)
+	}
+	return nil, fmt.Errorf("can't evaluate %q", path)
+}
+
+// id returns the id for a creation id reference, `#` followed by the
+// creation id, or id itself
+func (c *call) id(id string) string {
+	if ref, ok := strings.CutPrefix(id, "#"); ok {
+		if created, ok := c.created[ref]; ok {
+			return created
+		}
+	}
+	return id
+}
+
+// decode unmarshals method arguments strictly, so misspelled arguments are
+// reported rather than ignored, and checks the account
+func (c *call) decode(args json.RawMessage, v any, accountID *string) error {
+	d := json.NewDecoder(bytes.NewReader(args))
+	d.DisallowUnknownFields()
+	if err := d.Decode(v); err != nil {
+		if me := (&methodError{}); errors.As(err, &me) {
+			return me
+		}
+		return invalidArguments("%v", err)
+	}
+	if *accountID != c.user {
+		return errAccountNotFound
+	}
+	return nil
+}
@@ -0,0 +1,180 @@
+package jmap
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"mime"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/buckelij/sif.io/internal/blob"
+	"github.com/google/uuid"
+)
+
+// uploads are deleted after this long, by the next upload to the account
+const uploadLifetime = 24 * time.Hour
+
+// Blob ids say where a blob is: "B" and the key of a stored message, "P" and
+// a part of one, or "U" and the key of an upload. Keys are only read once
+// they're checked to belong to the account.
+
+func messageBlobID(key string) string {
+	return "B" + base64.RawURLEncoding.EncodeToString([]byte(key))
+}
+
+func partBlobID(key, partID string) string {
+	return "P" + strings.ReplaceAll(partID, ".", "x") + "_" + base64.RawURLEncoding.EncodeToString([]byte(key))
+}
+
+func uploadBlobID(key string) string {
+	return "U" + base64.RawURLEncoding.EncodeToString([]byte(key))
+}
+
+func uploadPrefix(account string) string {
+	return "upload/" + url.QueryEscape(account) + "/"
+}
+
+var errNoSuchBlob = errors.New("no such blob")
+
+// blob returns the content of a blob of the account
+func (c *call) blob(id string) ([]byte, error) {
+	return c.h.blob(c.user, id)
+}
+
+func (h *Handler) blob(account, id string) ([]byte, error) {
+	if len(id) < 2 {
+		return nil, errNoSuchBlob
+	}
+	kind, rest := id[0], id[1:]
+	partID := ""
+	if kind == 'P' {
+		p, encoded, ok := strings.Cut(rest, "_")
+		if !ok {
+			return nil, errNoSuchBlob
+		}
+		partID, rest = strings.ReplaceAll(p, "x", "."), encoded
+	}
+	b, err := base64.RawURLEncoding.DecodeString(rest)
+	if err != nil {
+		return nil, errNoSuchBlob
+	}
+	key := string(b)
+
+	switch kind {
+	case 'U':
+		if !strings.HasPrefix(key, uploadPrefix(account)) {
+			return nil, errNoSuchBlob
+		}
+		data, err := h.Blobs.Get(key)
+		if errors.Is(err, blob.ErrNotFound) {
+			return nil, errNoSuchBlob
+		}
+		return data, err
+	case 'B', 'P':
+		idx, err := h.Store.MailboxIndex(account)
+		if err != nil {
+			return nil, err
+		}
+		found := false
+		for _, e := range idx.Messages {
+			found = found || e.Key == key
+		}
+		if !found {
+			return nil, errNoSuchBlob
+		}
+		data, err := h.Store.ReadMessage(key)
+		if err != nil || kind == 'B' {
+			return data, err
+		}
+		p := parseMessage(data).find(partID)
+		if p == nil || p.subParts != nil {
+			return nil, errNoSuchBlob
+		}
+		return p.decoded(), nil
+	}
+	return nil, errNoSuchBlob
+}
+
+func (h *Handler) uploadHandler(w http.ResponseWriter, req *http.Request, user string) {
+	if req.PathValue("accountId") != user {
+		problem(w, http.StatusNotFound, "accountNotFound", "")
+		return
+	}
+	data, err := io.ReadAll(http.MaxBytesReader(w, req.Body, h.MaxUploadSize))
+	if err != nil {
+		problem(w, http.StatusRequestEntityTooLarge, "limit", "maxSizeUpload")
+		return
+	}
+	h.pruneUploads(user)
+	key := fmt.Sprintf("%s%d-%s", uploadPrefix(user), time.Now().UnixNano(), uuid.NewString())
+	if err := h.Blobs.Put(key, data); err != nil {
+		slog.Error("jmap upload failed", "user", user, "err", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	typ := req.Header.Get("Content-Type")
+	if typ == "" {
+		typ = "application/octet-stream"
+	}
+	writeJSON(w, http.StatusCreated, map[string]any{
+		"accountId": user,
+		"blobId":    uploadBlobID(key),
+		"type":      typ,
+		"size":      len(data),
+	})
+}
+
+// pruneUploads deletes the account's uploads that are past their lifetime.
+// Uploads are named for the time they were made.
+func (h *Handler) pruneUploads(account string) {
+	keys, err := h.Blobs.List(uploadPrefix(account))
+	if err != nil {
+		slog.Warn("failed to list uploads", "user", account, "err", err)
+		return
+	}
+	for _, key := range keys {
+		stamp, _, _ := strings.Cut(strings.TrimPrefix(key, uploadPrefix(account)), "-")
+		nanos, err := strconv.ParseInt(stamp, 10, 64)
+		if err != nil || time.Since(time.Unix(0, nanos)) < uploadLifetime {
+			continue
+		}
+		if err := h.Blobs.Delete(key); err != nil {
+			slog.Warn("failed to delete upload", "key", key, "err", err)
+		}
+	}
+}
+
+func (h *Handler) downloadHandler(w http.ResponseWriter, req *http.Request, user string) {
+	if req.PathValue("accountId") != user {
+		http.NotFound(w, req)
+		return
+	}
+	data, err := h.blob(user, req.PathValue("blobId"))
+	if errors.Is(err, errNoSuchBlob) {
+		http.NotFound(w, req)
+		return
+	}
+	if err != nil {
+		slog.Error("jmap download failed", "user", user, "err", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	typ := req.URL.Query().Get("accept")
+	if _, _, err := mime.ParseMediaType(typ); err != nil {
+		typ = "application/octet-stream"
+	}
+	w.Header().Set("Content-Type", typ)
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": req.PathValue("name")}))
+	// blobs never change
+	w.Header().Set("Cache-Control", "private, immutable, max-age=31536000")
+	// an HTML attachment mustn't run as the webmail site
+	w.Header().Set("Content-Security-Policy", "sandbox")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Write(data)
+}
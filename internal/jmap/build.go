@@ -0,0 +1,320 @@
+package jmap
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/mail"
+	"net/textproto"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// emailCreate is an Email to create with Email/set, RFC 8621 section 4.6.
+// Its body is given as textBody, htmlBody and attachments; bodyStructure
+// isn't supported.
+type emailCreate struct {
+	MailboxIDs map[string]bool `json:"mailboxIds"`
+	Keywords   map[string]bool `json:"keywords"`
+	ReceivedAt *time.Time      `json:"receivedAt"`
+
+	MessageID  []string       `json:"messageId"`
+	InReplyTo  []string       `json:"inReplyTo"`
+	References []string       `json:"references"`
+	Sender     []emailAddress `json:"sender"`
+	From       []emailAddress `json:"from"`
+	To         []emailAddress `json:"to"`
+	Cc         []emailAddress `json:"cc"`
+	Bcc        []emailAddress `json:"bcc"`
+	ReplyTo    []emailAddress `json:"replyTo"`
+	Subject    *string        `json:"subject"`
+	SentAt     *time.Time     `json:"sentAt"`
+	Headers    []emailHeader  `json:"headers"`
+
+	BodyValues  map[string]createValue `json:"bodyValues"`
+	TextBody    []createPart           `json:"textBody"`
+	HTMLBody    []createPart           `json:"htmlBody"`
+	Attachments []createPart           `json:"attachments"`
+}
+
+type createValue struct {
+	Value             string `json:"value"`
+	IsEncodingProblem bool   `json:"isEncodingProblem"`
+	IsTruncated       bool   `json:"isTruncated"`
+}
+
+// createPart is an EmailBodyPart to create, with its content in bodyValues
+// by partId, or in a blob
+type createPart struct {
+	PartID      *string       `json:"partId"`
+	BlobID      *string       `json:"blobId"`
+	Type        string        `json:"type"`
+	Charset     *string       `json:"charset"`
+	Name        *string       `json:"name"`
+	Disposition *string       `json:"disposition"`
+	Cid         *string       `json:"cid"`
+	Language    []string      `json:"language"`
+	Location    *string       `json:"location"`
+	Headers     []emailHeader `json:"headers"`
+}
+
+// buildMessage writes the RFC 5322 message for an Email/set create
+func (c *call) buildMessage(ec *emailCreate) ([]byte, error) {
+	if len(ec.MailboxIDs) == 0 {
+		return nil, invalidProperties("an email must be in a mailbox", "mailboxIds")
+	}
+	if len(ec.TextBody) > 1 || len(ec.HTMLBody) > 1 {
+		return nil, invalidProperties("only one textBody and htmlBody part are supported", "textBody", "htmlBody")
+	}
+	for _, p := range ec.TextBody {
+		if p.Type != "" && p.Type != "text/plain" {
+			return nil, invalidProperties("textBody must be text/plain", "textBody")
+		}
+	}
+	for _, p := range ec.HTMLBody {
+		if p.Type != "" && p.Type != "text/html" {
+			return nil, invalidProperties("htmlBody must be text/html", "htmlBody")
+		}
+	}
+	for _, v := range ec.BodyValues {
+		if v.IsEncodingProblem || v.IsTruncated {
+			return nil, invalidProperties("bodyValues can't be truncated or have encoding problems", "bodyValues")
+		}
+	}
+
+	fields := map[string]string{}
+	order := []string{}
+	injected := false
+	set := func(name, value string) {
+		if value == "" {
+			return
+		}
+		injected = injected || strings.ContainsAny(name+value, "\r\n")
+		if _, ok := fields[name]; !ok {
+			order = append(order, name)
+		}
+		fields[name] = value
+	}
+	sentAt := time.Now()
+	if ec.SentAt != nil {
+		sentAt = *ec.SentAt
+	}
+	set("Date", sentAt.Format(time.RFC1123Z))
+	set("From", formatAddresses(ec.From))
+	set("Sender", formatAddresses(ec.Sender))
+	set("Reply-To", formatAddresses(ec.ReplyTo))
+	set("To", formatAddresses(ec.To))
+	set("Cc", formatAddresses(ec.Cc))
+	set("Bcc", formatAddresses(ec.Bcc))
+	if ec.Subject != nil {
+		set("Subject", mime.QEncoding.Encode("utf-8", *ec.Subject))
+	}
+	messageID := ec.MessageID
+	if messageID == nil {
+		domain := "localhost"
+		if len(ec.From) > 0 {
+			if i := strings.LastIndex(ec.From[0].Email, "@"); i >= 0 {
+				domain = ec.From[0].Email[i+1:]
+			}
+		}
+		messageID = []string{uuid.NewString() + "@" + domain}
+	}
+	set("Message-ID", formatMessageIDs(messageID))
+	set("In-Reply-To", formatMessageIDs(ec.InReplyTo))
+	set("References", formatMessageIDs(ec.References))
+	for _, f := range ec.Headers {
+		if strings.EqualFold(f.Name, "Content-Type") || strings.EqualFold(f.Name, "Content-Transfer-Encoding") {
+			return nil, invalidProperties("the content headers follow from the body", "headers")
+		}
+		set(textproto.CanonicalMIMEHeaderKey(f.Name), strings.TrimSpace(f.Value))
+	}
+	set("MIME-Version", "1.0")
+	if injected {
+		return nil, invalidProperties("header values can't contain line breaks")
+	}
+
+	body, err := c.buildBody(ec)
+	if err != nil {
+		return nil, err
+	}
+	b := bytes.Buffer{}
+	for _, name := range order {
+		fmt.Fprintf(&b, "%s: %s\r\n", name, fields[name])
+	}
+	b.Write(body)
+	return b.Bytes(), nil
+}
+
+// buildBody writes the content headers and body: text, html or both as
+// alternatives, in a mixed multipart with any attachments
+func (c *call) buildBody(ec *emailCreate) ([]byte, error) {
+	parts := [][]byte{}
+	for _, p := range append(ec.TextBody, ec.HTMLBody...) {
+		b, err := c.buildPart(ec, p)
+		if err != nil {
+			return nil, err
+		}
+		parts = append(parts, b)
+	}
+	var body []byte
+	switch len(parts) {
+	case 0:
+		body = []byte("Content-Type: text/plain; charset=utf-8\r\n\r\n")
+	case 1:
+		body = parts[0]
+	default:
+		body = multipartBody("alternative", parts)
+	}
+	if len(ec.Attachments) == 0 {
+		return body, nil
+	}
+	parts = [][]byte{body}
+	for _, p := range ec.Attachments {
+		b, err := c.buildPart(ec, p)
+		if err != nil {
+			return nil, err
+		}
+		parts = append(parts, b)
+	}
+	return multipartBody("mixed", parts), nil
+}
+
+// buildPart writes a part's header and body. Text from bodyValues is
+// quoted-printable UTF-8 and blobs are base64.
+func (c *call) buildPart(ec *emailCreate, p createPart) ([]byte, error) {
+	h := []string{}
+	var data []byte
+	switch {
+	case p.PartID != nil && p.BlobID == nil:
+		v, ok := ec.BodyValues[*p.PartID]
+		if !ok {
+			return nil, invalidProperties("no bodyValue for part "+*p.PartID, "bodyValues")
+		}
+		typ := p.Type
+		if typ == "" {
+			typ = "text/plain"
+		}
+		if p.Charset != nil && !strings.EqualFold(*p.Charset, "utf-8") {
+			return nil, invalidProperties("text is always utf-8", "charset")
+		}
+		ct := mime.FormatMediaType(typ, map[string]string{"charset": "utf-8"})
+		if !strings.HasPrefix(ct, "text/") {
+			return nil, invalidProperties("invalid type "+typ, "textBody", "htmlBody")
+		}
+		h = append(h, "Content-Type: "+ct, "Content-Transfer-Encoding: quoted-printable")
+		b := bytes.Buffer{}
+		w := quotedprintable.NewWriter(&b)
+		w.Write([]byte(strings.ReplaceAll(strings.ReplaceAll(v.Value, "\r\n", "\n"), "\n", "\r\n")))
+		w.Close()
+		data = b.Bytes()
+	case p.BlobID != nil && p.PartID == nil:
+		content, err := c.blob(c.id(*p.BlobID))
+		if errors.Is(err, errNoSuchBlob) {
+			return nil, &setError{Type: "blobNotFound", Description: *p.BlobID}
+		}
+		if err != nil {
+			return nil, err
+		}
+		typ := p.Type
+		if typ == "" {
+			typ = "application/octet-stream"
+		}
+		params := map[string]string{}
+		if p.Charset != nil {
+			params["charset"] = *p.Charset
+		}
+		if p.Name != nil {
+			params["name"] = *p.Name
+		}
+		ct := mime.FormatMediaType(typ, params)
+		if ct == "" {
+			return nil, invalidProperties("invalid type "+typ, "attachments")
+		}
+		h = append(h, "Content-Type: "+ct, "Content-Transfer-Encoding: base64")
+		disposition := "attachment"
+		if p.Disposition != nil {
+			disposition = *p.Disposition
+		}
+		dparams := map[string]string{}
+		if p.Name != nil {
+			dparams["filename"] = *p.Name
+		}
+		if d := mime.FormatMediaType(disposition, dparams); d != "" {
+			h = append(h, "Content-Disposition: "+d)
+		}
+		data = base64Lines(content)
+	default:
+		return nil, invalidProperties("a part needs one of partId or blobId", "textBody", "htmlBody", "attachments")
+	}
+	if p.Cid != nil {
+		h = append(h, "Content-ID: <"+*p.Cid+">")
+	}
+	if p.Language != nil {
+		h = append(h, "Content-Language: "+strings.Join(p.Language, ", "))
+	}
+	if p.Location != nil {
+		h = append(h, "Content-Location: "+*p.Location)
+	}
+	for _, f := range p.Headers {
+		h = append(h, textproto.CanonicalMIMEHeaderKey(f.Name)+": "+strings.TrimSpace(f.Value))
+	}
+	for _, field := range h {
+		if strings.ContainsAny(field, "\r\n") {
+			return nil, invalidProperties("header values can't contain line breaks", "headers")
+		}
+	}
+	return append([]byte(strings.Join(h, "\r\n")+"\r\n\r\n"), data...), nil
+}
+
+// multipartBody writes the content header and body of a multipart of parts,
+// each of which has its own header
+func multipartBody(subtype string, parts [][]byte) []byte {
+	boundary := multipart.NewWriter(nil).Boundary()
+	b := bytes.Buffer{}
+	fmt.Fprintf(&b, "Content-Type: multipart/%s; boundary=%q\r\n\r\n", subtype, boundary)
+	for _, p := range parts {
+		fmt.Fprintf(&b, "--%s\r\n", boundary)
+		b.Write(p)
+		b.WriteString("\r\n")
+	}
+	fmt.Fprintf(&b, "--%s--\r\n", boundary)
+	return b.Bytes()
+}
+
+// base64Lines encodes data in lines of 76 characters, RFC 2045 section 6.8
+func base64Lines(data []byte) []byte {
+	encoded := base64.StdEncoding.EncodeToString(data)
+	b := bytes.Buffer{}
+	for len(encoded) > 76 {
+		b.WriteString(encoded[:76] + "\r\n")
+		encoded = encoded[76:]
+	}
+	b.WriteString(encoded)
+	return b.Bytes()
+}
+
+func formatAddresses(addrs []emailAddress) string {
+	list := []string{}
+	for _, a := range addrs {
+		ma := mail.Address{Address: a.Email}
+		if a.Name != nil {
+			ma.Name = *a.Name
+		}
+		list = append(list, ma.String())
+	}
+	return strings.Join(list, ", ")
+}
+
+func formatMessageIDs(ids []string) string {
+	list := []string{}
+	for _, id := range ids {
+		list = append(list, "<"+id+">")
+	}
+	return strings.Join(list, " ")
+}
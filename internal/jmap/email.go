@@ -0,0 +1,985 @@
+package jmap
+
+import (
+	"encoding/json"
+	"errors"
+	"maps"
+	"net/mail"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/buckelij/sif.io/internal/smtp"
+)
+
+var emailProperties = []string{
+	"id", "blobId", "threadId", "mailboxIds", "keywords", "size", "receivedAt",
+	"messageId", "inReplyTo", "references", "sender", "from", "to", "cc", "bcc",
+	"replyTo", "subject", "sentAt", "hasAttachment", "preview",
+	"bodyValues", "textBody", "htmlBody", "attachments",
+}
+
+// emailBodyProperties are those of the message's MIME structure, which need it read
+var emailBodyProperties = []string{"headers", "bodyStructure", "bodyValues", "textBody", "htmlBody", "attachments"}
+
+var defaultBodyProperties = []string{"partId", "blobId", "size", "name", "type", "charset", "disposition", "cid", "language", "location"}
+
+var bodyPartProperties = append(slices.Clone(defaultBodyProperties), "headers", "subParts")
+
+type emailGetArgs struct {
+	getArgs
+	BodyProperties      *[]string `json:"bodyProperties"`
+	FetchTextBodyValues bool      `json:"fetchTextBodyValues"`
+	FetchHTMLBodyValues bool      `json:"fetchHTMLBodyValues"`
+	FetchAllBodyValues  bool      `json:"fetchAllBodyValues"`
+	MaxBodyValueBytes   int       `json:"maxBodyValueBytes"`
+}
+
+func (c *call) emailGet(args json.RawMessage) (any, error) {
+	a := emailGetArgs{}
+	if err := c.decode(args, &a, &a.AccountID); err != nil {
+		return nil, err
+	}
+	if a.Properties != nil {
+		for _, p := range *a.Properties {
+			if _, err := parseHeaderProperty(p); !slices.Contains(emailProperties, p) && !slices.Contains(emailBodyProperties, p) && err != nil {
+				return nil, invalidArguments("unknown property %s", p)
+			}
+		}
+	}
+	if a.BodyProperties != nil {
+		for _, p := range *a.BodyProperties {
+			if _, err := parseHeaderProperty(p); !slices.Contains(bodyPartProperties, p) && err != nil {
+				return nil, invalidArguments("unknown body property %s", p)
+			}
+		}
+	}
+	if a.MaxBodyValueBytes < 0 {
+		return nil, invalidArguments("maxBodyValueBytes must not be negative")
+	}
+	v, err := c.loadView()
+	if err != nil {
+		return nil, err
+	}
+	ids := []string{}
+	if a.IDs != nil {
+		ids = *a.IDs
+	} else {
+		for _, m := range v.sortedEmails() {
+			ids = append(ids, m.id)
+		}
+	}
+	if len(ids) > maxObjectsInGet {
+		return nil, errRequestTooLarge
+	}
+	res := &getResponse{AccountID: c.user, State: v.state("Email"), List: []map[string]any{}, NotFound: []string{}}
+	for _, id := range ids {
+		m := v.emails[c.id(id)]
+		if m == nil {
+			res.NotFound = append(res.NotFound, id)
+			continue
+		}
+		o, err := v.emailObject(m, &a)
+		if err != nil {
+			return nil, err
+		}
+		res.List = append(res.List, o)
+	}
+	return res, nil
+}
+
+// emailObject returns the properties of an Email that a get asks for,
+// RFC 8621 section 4.1
+func (v *view) emailObject(m *email, a *emailGetArgs) (map[string]any, error) {
+	props := emailProperties
+	if a.Properties != nil {
+		props = *a.Properties
+	}
+	o := map[string]any{"id": m.id}
+	var s *summary
+	var p *bodyPart
+	for _, prop := range props {
+		switch prop {
+		case "id":
+		case "blobId":
+			o[prop] = messageBlobID(m.key)
+		case "threadId":
+			o[prop] = v.thread(m)
+		case "mailboxIds":
+			o[prop] = m.mailboxIDs
+		case "keywords":
+			o[prop] = keywords(m)
+		case "size":
+			o[prop] = m.size
+		case "receivedAt":
+			o[prop] = m.received.UTC().Format(time.RFC3339)
+		case "messageId", "inReplyTo", "references", "sender", "from", "to", "cc", "bcc", "replyTo", "subject", "sentAt", "hasAttachment", "preview":
+			if s == nil {
+				s = v.summaryOf(m)
+			}
+			o[prop] = s.property(prop)
+		default:
+			if p == nil {
+				data, err := v.c.h.Store.ReadMessage(m.key)
+				if err != nil {
+					return nil, err
+				}
+				p = parseMessage(data)
+			}
+			o[prop] = bodyProperty(p, m.key, prop, a)
+		}
+	}
+	return o, nil
+}
+
+// property returns a header property of an Email, or null if the message
+// doesn't have the field
+func (s *summary) property(prop string) any {
+	switch prop {
+	case "messageId":
+		return nullableList(s.messageID)
+	case "inReplyTo":
+		return nullableList(s.inReplyTo)
+	case "references":
+		return nullableList(s.references)
+	case "sender":
+		return nullableList(s.sender)
+	case "from":
+		return nullableList(s.from)
+	case "to":
+		return nullableList(s.to)
+	case "cc":
+		return nullableList(s.cc)
+	case "bcc":
+		return nullableList(s.bcc)
+	case "replyTo":
+		return nullableList(s.replyTo)
+	case "subject":
+		return s.subject
+	case "sentAt":
+		if s.sentAt == nil {
+			return nil
+		}
+		return s.sentAt.Format(time.RFC3339)
+	case "hasAttachment":
+		return s.hasAttachment
+	case "preview":
+		return s.preview
+	}
+	return nil
+}
+
+func nullableList[T any](list []T) any {
+	if list == nil {
+		return nil
+	}
+	return list
+}
+
+// bodyProperty returns a property of an Email that needs its MIME structure
+func bodyProperty(p *bodyPart, key, prop string, a *emailGetArgs) any {
+	bodyProps := defaultBodyProperties
+	if a.BodyProperties != nil {
+		bodyProps = *a.BodyProperties
+	}
+	list := func(parts []*bodyPart) []map[string]any {
+		l := []map[string]any{}
+		for _, part := range parts {
+			l = append(l, part.properties(key, bodyProps))
+		}
+		return l
+	}
+	textBody, htmlBody, attachments := p.structure()
+	switch prop {
+	case "headers":
+		return headers(p.header)
+	case "bodyStructure":
+		return p.properties(key, append(slices.Clone(bodyProps), "subParts"))
+	case "textBody":
+		return list(textBody)
+	case "htmlBody":
+		return list(htmlBody)
+	case "attachments":
+		return list(attachments)
+	case "bodyValues":
+		values := map[string]any{}
+		add := func(parts []*bodyPart) {
+			for _, part := range parts {
+				if strings.HasPrefix(part.mediaType, "text/") {
+					values[part.partID] = bodyValue(part, a.MaxBodyValueBytes)
+				}
+			}
+		}
+		if a.FetchTextBodyValues || a.FetchAllBodyValues {
+			add(textBody)
+		}
+		if a.FetchHTMLBodyValues || a.FetchAllBodyValues {
+			add(htmlBody)
+		}
+		if a.FetchAllBodyValues {
+			add(attachments)
+		}
+		return values
+	}
+	v, _ := headerProperty(p.header, prop)
+	return v
+}
+
+// bodyValue is an EmailBodyValue, truncated to maxBytes if that's set
+func bodyValue(p *bodyPart, maxBytes int) map[string]any {
+	text, problem := p.text()
+	truncated := false
+	if maxBytes > 0 && len(text) > maxBytes {
+		text, truncated = text[:maxBytes], true
+		text = strings.ToValidUTF8(text, "")
+	}
+	return map[string]any{"value": text, "isEncodingProblem": problem, "isTruncated": truncated}
+}
+
+// A headerForm is how to parse header:Name:form properties, RFC 8621 section 4.1.2
+type headerForm struct {
+	name string
+	form string
+	all  bool
+}
+
+func parseHeaderProperty(prop string) (headerForm, error) {
+	parts := strings.Split(prop, ":")
+	if len(parts) < 2 || len(parts) > 4 || parts[0] != "header" || parts[1] == "" {
+		return headerForm{}, errors.New("not a header property")
+	}
+	h := headerForm{name: parts[1], form: "asRaw"}
+	rest := parts[2:]
+	if len(rest) > 0 && rest[len(rest)-1] == "all" {
+		h.all, rest = true, rest[:len(rest)-1]
+	}
+	if len(rest) == 1 {
+		h.form = rest[0]
+	} else if len(rest) > 1 {
+		return headerForm{}, errors.New("not a header property")
+	}
+	switch h.form {
+	case "asRaw", "asText", "asAddresses", "asGroupedAddresses", "asMessageIds", "asDate", "asURLs":
+		return h, nil
+	}
+	return headerForm{}, errors.New("unknown header form " + h.form)
+}
+
+// headerProperty returns the value of a header:Name:form property of a raw header
+func headerProperty(header []byte, prop string) (any, bool) {
+	h, err := parseHeaderProperty(prop)
+	if err != nil {
+		return nil, false
+	}
+	values := []any{}
+	for _, f := range headers(header) {
+		if strings.EqualFold(f.Name, h.name) {
+			values = append(values, h.parse(f.Value))
+		}
+	}
+	if h.all {
+		return values, true
+	}
+	if len(values) == 0 {
+		return nil, true
+	}
+	return values[len(values)-1], true
+}
+
+func (h headerForm) parse(raw string) any {
+	switch h.form {
+	case "asText":
+		return strings.TrimSpace(decodeHeader(raw))
+	case "asAddresses":
+		return nullableList(addresses(raw))
+	case "asGroupedAddresses":
+		return []map[string]any{{"name": nil, "addresses": addresses(raw)}}
+	case "asMessageIds":
+		return nullableList(messageIDs(raw))
+	case "asDate":
+		t, err := mail.ParseDate(strings.TrimSpace(raw))
+		if err != nil {
+			return nil
+		}
+		return t.Format(time.RFC3339)
+	case "asURLs":
+		urls := []string{}
+		for _, u := range strings.Split(raw, ",") {
+			if u = strings.TrimSpace(u); strings.HasPrefix(u, "<") && strings.HasSuffix(u, ">") {
+				urls = append(urls, strings.Trim(u, "<>"))
+			}
+		}
+		return nullableList(urls)
+	}
+	return raw
+}
+
+func (c *call) emailChanges(args json.RawMessage) (any, error) {
+	v, err := c.loadView()
+	if err != nil {
+		return nil, err
+	}
+	return c.changes(args, "Email", v.versions("Email"))
+}
+
+// emailCondition is an Email/query FilterCondition, RFC 8621 section 4.4.1
+type emailCondition struct {
+	InMailbox               *string    `json:"inMailbox"`
+	InMailboxOtherThan      []string   `json:"inMailboxOtherThan"`
+	Before                  *time.Time `json:"before"`
+	After                   *time.Time `json:"after"`
+	MinSize                 *int64     `json:"minSize"`
+	MaxSize                 *int64     `json:"maxSize"`
+	AllInThreadHaveKeyword  *string    `json:"allInThreadHaveKeyword"`
+	SomeInThreadHaveKeyword *string    `json:"someInThreadHaveKeyword"`
+	NoneInThreadHaveKeyword *string    `json:"noneInThreadHaveKeyword"`
+	HasKeyword              *string    `json:"hasKeyword"`
+	NotKeyword              *string    `json:"notKeyword"`
+	HasAttachment           *bool      `json:"hasAttachment"`
+	Text                    *string    `json:"text"`
+	From                    *string    `json:"from"`
+	To                      *string    `json:"to"`
+	Cc                      *string    `json:"cc"`
+	Bcc                     *string    `json:"bcc"`
+	Subject                 *string    `json:"subject"`
+	Body                    *string    `json:"body"`
+	Header                  []string   `json:"header"`
+}
+
+// a match checks one email against Email/query filter conditions, reading
+// the message only for conditions that need it
+type match struct {
+	v    *view
+	m    *email
+	part *bodyPart
+}
+
+func (q *match) parsed() *bodyPart {
+	if q.part == nil {
+		data, err := q.v.c.h.Store.ReadMessage(q.m.key)
+		if err != nil {
+			q.v.c.log.Error("failed to read for query", "key", q.m.key, "err", err)
+			data = nil
+		}
+		q.part = parseMessage(data)
+	}
+	return q.part
+}
+
+// body returns the message's text, for body and text conditions
+func (q *match) body() string {
+	textBody, htmlBody, _ := q.parsed().structure()
+	b := strings.Builder{}
+	for _, p := range append(textBody, htmlBody...) {
+		if strings.HasPrefix(p.mediaType, "text/") {
+			text, _ := p.text()
+			b.WriteString(text)
+			b.WriteString("\n")
+		}
+	}
+	return b.String()
+}
+
+func addressText(addrs []emailAddress) string {
+	parts := []string{}
+	for _, a := range addrs {
+		if a.Name != nil {
+			parts = append(parts, *a.Name)
+		}
+		parts = append(parts, a.Email)
+	}
+	return strings.Join(parts, " ")
+}
+
+func (q *match) matches(ec *emailCondition) bool {
+	m, v := q.m, q.v
+	kw := keywords(m)
+	thread := func(k string) (some, every bool) {
+		every = true
+		for _, e := range v.threadEmails(v.thread(m)) {
+			has := keywords(e)[k]
+			some, every = some || has, every && has
+		}
+		return some, every
+	}
+	switch {
+	case ec.InMailbox != nil && !m.mailboxIDs[v.c.id(*ec.InMailbox)]:
+		return false
+	case ec.Before != nil && !m.received.Before(*ec.Before):
+		return false
+	case ec.After != nil && m.received.Before(*ec.After):
+		return false
+	case ec.MinSize != nil && m.size < *ec.MinSize:
+		return false
+	case ec.MaxSize != nil && m.size >= *ec.MaxSize:
+		return false
+	case ec.HasKeyword != nil && !kw[strings.ToLower(*ec.HasKeyword)]:
+		return false
+	case ec.NotKeyword != nil && kw[strings.ToLower(*ec.NotKeyword)]:
+		return false
+	}
+	if ec.InMailboxOtherThan != nil {
+		other := false
+		for id := range m.mailboxIDs {
+			other = other || !slices.ContainsFunc(ec.InMailboxOtherThan, func(x string) bool { return v.c.id(x) == id })
+		}
+		if !other {
+			return false
+		}
+	}
+	if ec.AllInThreadHaveKeyword != nil {
+		if _, every := thread(strings.ToLower(*ec.AllInThreadHaveKeyword)); !every {
+			return false
+		}
+	}
+	if ec.SomeInThreadHaveKeyword != nil {
+		if some, _ := thread(strings.ToLower(*ec.SomeInThreadHaveKeyword)); !some {
+			return false
+		}
+	}
+	if ec.NoneInThreadHaveKeyword != nil {
+		if some, _ := thread(strings.ToLower(*ec.NoneInThreadHaveKeyword)); some {
+			return false
+		}
+	}
+
+	if ec.HasAttachment != nil || ec.From != nil || ec.To != nil || ec.Cc != nil || ec.Bcc != nil || ec.Subject != nil || ec.Text != nil {
+		s := v.summaryOf(m)
+		switch {
+		case ec.HasAttachment != nil && *ec.HasAttachment != s.hasAttachment:
+			return false
+		case ec.From != nil && !contains(addressText(s.from), *ec.From):
+			return false
+		case ec.To != nil && !contains(addressText(s.to), *ec.To):
+			return false
+		case ec.Cc != nil && !contains(addressText(s.cc), *ec.Cc):
+			return false
+		case ec.Bcc != nil && !contains(addressText(s.bcc), *ec.Bcc):
+			return false
+		case ec.Subject != nil && !contains(s.subject, *ec.Subject):
+			return false
+		}
+		if ec.Text != nil {
+			text := strings.Join([]string{addressText(s.from), addressText(s.to), addressText(s.cc), addressText(s.bcc), s.subject}, " ")
+			if !contains(text, *ec.Text) && !contains(q.body(), *ec.Text) {
+				return false
+			}
+		}
+	}
+	if ec.Body != nil && !contains(q.body(), *ec.Body) {
+		return false
+	}
+	if len(ec.Header) > 0 {
+		found := false
+		for _, f := range headers(q.parsed().header) {
+			if strings.EqualFold(f.Name, ec.Header[0]) && (len(ec.Header) == 1 || contains(decodeHeader(f.Value), ec.Header[1])) {
+				found = true
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+var emailSorts = []string{"receivedAt", "sentAt", "size", "from", "to", "subject", "hasKeyword", "allInThreadHaveKeyword", "someInThreadHaveKeyword"}
+
+func (c *call) emailQuery(args json.RawMessage) (any, error) {
+	a := queryArgs[emailCondition]{}
+	if err := c.decode(args, &a, &a.AccountID); err != nil {
+		return nil, err
+	}
+	for _, s := range a.Sort {
+		if !slices.Contains(emailSorts, s.Property) {
+			return nil, &methodError{Type: "unsupportedSort", Description: s.Property}
+		}
+		if strings.HasSuffix(s.Property, "eyword") && s.Keyword == "" {
+			return nil, invalidArguments("%s sorts need a keyword", s.Property)
+		}
+	}
+	if len(a.Sort) == 0 {
+		descending := false
+		a.Sort = []comparator{{Property: "receivedAt", IsAscending: &descending}}
+	}
+	v, err := c.loadView()
+	if err != nil {
+		return nil, err
+	}
+	emails := []*email{}
+	for _, m := range v.sortedEmails() {
+		q := &match{v: v, m: m}
+		if a.Filter.matches(q.matches) {
+			emails = append(emails, m)
+		}
+	}
+	slices.SortStableFunc(emails, func(x, y *email) int {
+		for _, s := range a.Sort {
+			r := v.compare(x, y, s)
+			if !s.ascending() {
+				r = -r
+			}
+			if r != 0 {
+				return r
+			}
+		}
+		return 0
+	})
+	ids := []string{}
+	seen := map[string]bool{}
+	for _, m := range emails {
+		if a.CollapseThreads {
+			t := v.thread(m)
+			if seen[t] {
+				continue
+			}
+			seen[t] = true
+		}
+		ids = append(ids, m.id)
+	}
+	return window(ids, &a, v.state("Email"))
+}
+
+// compare orders two emails by one sort criterion
+func (v *view) compare(x, y *email, s comparator) int {
+	hasKeyword := func(m *email) int {
+		if keywords(m)[strings.ToLower(s.Keyword)] {
+			return 1
+		}
+		return 0
+	}
+	inThread := func(m *email, all bool) int {
+		n := 0
+		thread := v.threadEmails(v.thread(m))
+		for _, e := range thread {
+			if keywords(e)[strings.ToLower(s.Keyword)] {
+				n++
+			}
+		}
+		if (all && n == len(thread)) || (!all && n > 0) {
+			return 1
+		}
+		return 0
+	}
+	switch s.Property {
+	case "receivedAt":
+		return x.received.Compare(y.received)
+	case "size":
+		return int(x.size - y.size)
+	case "hasKeyword":
+		return hasKeyword(x) - hasKeyword(y)
+	case "allInThreadHaveKeyword":
+		return inThread(x, true) - inThread(y, true)
+	case "someInThreadHaveKeyword":
+		return inThread(x, false) - inThread(y, false)
+	}
+	sx, sy := v.summaryOf(x), v.summaryOf(y)
+	switch s.Property {
+	case "sentAt":
+		tx, ty := x.received, y.received
+		if sx.sentAt != nil {
+			tx = *sx.sentAt
+		}
+		if sy.sentAt != nil {
+			ty = *sy.sentAt
+		}
+		return tx.Compare(ty)
+	case "from":
+		return strings.Compare(strings.ToLower(firstAddress(sx.from)), strings.ToLower(firstAddress(sy.from)))
+	case "to":
+		return strings.Compare(strings.ToLower(firstAddress(sx.to)), strings.ToLower(firstAddress(sy.to)))
+	case "subject":
+		return strings.Compare(strings.ToLower(baseSubject(sx.subject)), strings.ToLower(baseSubject(sy.subject)))
+	}
+	return 0
+}
+
+// firstAddress sorts by the name, or address if there isn't one, of the
+// first address, RFC 8621 section 4.4.2
+func firstAddress(addrs []emailAddress) string {
+	if len(addrs) == 0 {
+		return ""
+	}
+	if addrs[0].Name != nil {
+		return *addrs[0].Name
+	}
+	return addrs[0].Email
+}
+
+// baseSubject removes reply and forward prefixes, roughly RFC 5256 section 2.1
+func baseSubject(s string) string {
+	for {
+		t := strings.TrimSpace(s)
+		lower := strings.ToLower(t)
+		trimmed := false
+		for _, prefix := range []string{"re:", "fw:", "fwd:"} {
+			if strings.HasPrefix(lower, prefix) {
+				t, trimmed = t[len(prefix):], true
+			}
+		}
+		if !trimmed {
+			return t
+		}
+		s = t
+	}
+}
+
+func (c *call) emailSet(args json.RawMessage) (any, error) {
+	a := setArgs{}
+	if err := c.decode(args, &a, &a.AccountID); err != nil {
+		return nil, err
+	}
+	if a.size() > maxObjectsInSet {
+		return nil, errRequestTooLarge
+	}
+	return c.setEmails(&a)
+}
+
+// setEmails creates, updates and destroys emails, as Email/set does and
+// an EmailSubmission/set can on success
+func (c *call) setEmails(a *setArgs) (*setResponse, error) {
+	v, err := c.loadView()
+	if err != nil {
+		return nil, err
+	}
+	res := newSetResponse(c.user, v.state("Email"))
+	if a.IfInState != nil && *a.IfInState != res.OldState {
+		return nil, errStateMismatch
+	}
+
+	// stored messages are added outside the index lock
+	for cid, raw := range sortedCreates(a.Create) {
+		ec := emailCreate{}
+		if err := strictUnmarshal(raw, &ec); err != nil {
+			res.NotCreated[cid] = invalidProperties(err.Error())
+			continue
+		}
+		data, err := c.buildMessage(&ec)
+		if err != nil {
+			res.NotCreated[cid] = result(err)
+			continue
+		}
+		created, err := c.store(v, data, ec.MailboxIDs, ec.Keywords, ec.ReceivedAt)
+		if err != nil {
+			res.NotCreated[cid] = result(err)
+			continue
+		}
+		c.created[cid] = created["id"].(string)
+		res.Created[cid] = created
+	}
+
+	if len(a.Update) > 0 || len(a.Destroy) > 0 {
+		err = v.update(func(idx *smtp.MailboxIndex) error {
+			for id, patch := range a.Update {
+				if err := v.updateEmail(idx, c.id(id), patch); err != nil {
+					res.NotUpdated[id] = result(err)
+					continue
+				}
+				res.Updated[id] = nil
+			}
+			for _, id := range a.Destroy {
+				m := v.emails[c.id(id)]
+				if m == nil {
+					res.NotDestroyed[id] = errNotFound
+					continue
+				}
+				idx.Expunge(func(e smtp.IndexEntry) bool { return e.Key == m.key })
+				v.load(idx)
+				res.Destroyed = append(res.Destroyed, id)
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	} else if v, err = c.loadView(); err != nil {
+		return nil, err
+	}
+	for _, created := range res.Created {
+		if m := v.emails[created["id"].(string)]; m != nil {
+			created["threadId"] = v.thread(m)
+		}
+	}
+	res.NewState = v.state("Email")
+	return res, nil
+}
+
+// store appends a message to the first of mailboxIDs and copies it to the
+// rest, returning the created Email's server-set properties
+func (c *call) store(v *view, data []byte, mailboxIDs map[string]bool, keywords map[string]bool, receivedAt *time.Time) (map[string]any, error) {
+	folders := []string{}
+	for _, id := range sortedKeys(mailboxIDs) {
+		m := v.mailbox(c.id(id))
+		if m == nil {
+			return nil, invalidProperties("no such mailbox "+id, "mailboxIds")
+		}
+		folders = append(folders, m.folder.Name)
+	}
+	if len(folders) == 0 {
+		return nil, invalidProperties("an email must be in a mailbox", "mailboxIds")
+	}
+	flags := []string{}
+	for k, ok := range keywords {
+		if !ok || !validKeyword(k) {
+			return nil, invalidProperties("invalid keyword "+k, "keywords")
+		}
+		flags = append(flags, flag(strings.ToLower(k)))
+	}
+	received := time.Now()
+	if receivedAt != nil {
+		received = *receivedAt
+	}
+	_, uid, err := c.h.Store.AppendMessage(c.user, folders[0], flags, received, data)
+	if errors.Is(err, smtp.ErrQuotaExceeded) {
+		return nil, &setError{Type: "overQuota"}
+	}
+	if err != nil {
+		return nil, err
+	}
+	var key string
+	err = c.h.Store.UpdateMailbox(c.user, func(idx *smtp.MailboxIndex) error {
+		e := idx.Entry(folders[0], uid)
+		if e == nil {
+			return errors.New("appended message is gone")
+		}
+		key = e.Key
+		for _, f := range folders[1:] {
+			if _, _, err := idx.Copy(folders[0], []uint32{uid}, f); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return map[string]any{"id": emailID(key), "blobId": messageBlobID(key), "size": len(data)}, nil
+}
+
+// updateEmail applies an Email/set patch, which can change its keywords and
+// mailboxes, RFC 8621 section 4.6
+func (v *view) updateEmail(idx *smtp.MailboxIndex, id string, patch map[string]json.RawMessage) error {
+	m := v.emails[id]
+	if m == nil {
+		return errNotFound
+	}
+	kw, mailboxes := keywords(m), maps.Clone(m.mailboxIDs)
+	for path, raw := range patch {
+		switch {
+		case path == "keywords":
+			kw = map[string]bool{}
+			if err := json.Unmarshal(raw, &kw); err != nil {
+				return invalidProperties(err.Error(), path)
+			}
+		case path == "mailboxIds":
+			mailboxes = map[string]bool{}
+			if err := json.Unmarshal(raw, &mailboxes); err != nil {
+				return invalidProperties(err.Error(), path)
+			}
+		case strings.HasPrefix(path, "keywords/"):
+			set, err := patchValue(raw)
+			if err != nil {
+				return invalidProperties(err.Error(), path)
+			}
+			kw[strings.ToLower(strings.TrimPrefix(path, "keywords/"))] = set
+		case strings.HasPrefix(path, "mailboxIds/"):
+			set, err := patchValue(raw)
+			if err != nil {
+				return invalidProperties(err.Error(), path)
+			}
+			mailboxes[v.c.id(strings.TrimPrefix(path, "mailboxIds/"))] = set
+		default:
+			return invalidProperties("only keywords and mailboxIds can be changed", path)
+		}
+	}
+
+	flags := []string{}
+	for k, set := range kw {
+		if !set {
+			continue
+		}
+		if !validKeyword(k) {
+			return invalidProperties("invalid keyword "+k, "keywords")
+		}
+		flags = append(flags, flag(strings.ToLower(k)))
+	}
+	slices.Sort(flags)
+	dest := map[string]bool{}
+	for id, set := range mailboxes {
+		if !set {
+			continue
+		}
+		mb := v.mailbox(v.c.id(id))
+		if mb == nil {
+			return invalidProperties("no such mailbox "+id, "mailboxIds")
+		}
+		dest[mb.folder.Name] = true
+	}
+	if len(dest) == 0 {
+		return invalidProperties("an email must be in a mailbox", "mailboxIds")
+	}
+
+	// copy to new mailboxes before leaving old ones, so the stored message
+	// is always referred to
+	src := m.entries[0]
+	for folder := range dest {
+		if !slices.ContainsFunc(m.entries, func(e smtp.IndexEntry) bool { return e.InFolder(folder) }) {
+			if _, _, err := idx.Copy(src.Folder, []uint32{src.ImapUID}, folder); err != nil {
+				return err
+			}
+		}
+	}
+	idx.Expunge(func(e smtp.IndexEntry) bool {
+		if e.Key != m.key {
+			return false
+		}
+		for folder := range dest {
+			if e.InFolder(folder) {
+				return false
+			}
+		}
+		return true
+	})
+	for i := range idx.Messages {
+		e := &idx.Messages[i]
+		if e.Key != m.key {
+			continue
+		}
+		// \Deleted has no keyword, so is kept as it is
+		kept := slices.DeleteFunc(slices.Clone(e.Flags), func(f string) bool { return keyword(f) != "" })
+		e.Flags = append(kept, flags...)
+	}
+	v.load(idx)
+	return nil
+}
+
+// patchValue is the value of a patch setting one keyword or mailbox: true
+// to set it, or null to remove it
+func patchValue(raw json.RawMessage) (bool, error) {
+	if string(raw) == "null" {
+		return false, nil
+	}
+	set := false
+	if err := json.Unmarshal(raw, &set); err != nil || !set {
+		return false, errors.New("must be true or null")
+	}
+	return true, nil
+}
+
+// emailImportArgs are the arguments of Email/import, RFC 8621 section 4.8
+type emailImportArgs struct {
+	AccountID string                 `json:"accountId"`
+	IfInState *string                `json:"ifInState"`
+	Emails    map[string]emailImport `json:"emails"`
+}
+
+type emailImport struct {
+	BlobID     string          `json:"blobId"`
+	MailboxIDs map[string]bool `json:"mailboxIds"`
+	Keywords   map[string]bool `json:"keywords"`
+	ReceivedAt *time.Time      `json:"receivedAt"`
+}
+
+func (c *call) emailImport(args json.RawMessage) (any, error) {
+	a := emailImportArgs{}
+	if err := c.decode(args, &a, &a.AccountID); err != nil {
+		return nil, err
+	}
+	if len(a.Emails) > maxObjectsInSet {
+		return nil, errRequestTooLarge
+	}
+	v, err := c.loadView()
+	if err != nil {
+		return nil, err
+	}
+	res := newSetResponse(c.user, v.state("Email"))
+	if a.IfInState != nil && *a.IfInState != res.OldState {
+		return nil, errStateMismatch
+	}
+	cids := []string{}
+	for cid := range a.Emails {
+		cids = append(cids, cid)
+	}
+	slices.Sort(cids)
+	for _, cid := range cids {
+		imp := a.Emails[cid]
+		data, err := c.blob(imp.BlobID)
+		if errors.Is(err, errNoSuchBlob) {
+			res.NotCreated[cid] = &setError{Type: "blobNotFound", Description: imp.BlobID}
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		created, err := c.store(v, data, imp.MailboxIDs, imp.Keywords, imp.ReceivedAt)
+		if err != nil {
+			res.NotCreated[cid] = result(err)
+			continue
+		}
+		c.created[cid] = created["id"].(string)
+		res.Created[cid] = created
+	}
+	if v, err = c.loadView(); err != nil {
+		return nil, err
+	}
+	for _, created := range res.Created {
+		if m := v.emails[created["id"].(string)]; m != nil {
+			created["threadId"] = v.thread(m)
+		}
+	}
+	res.NewState = v.state("Email")
+	return struct {
+		AccountID  string                    `json:"accountId"`
+		OldState   string                    `json:"oldState"`
+		NewState   string                    `json:"newState"`
+		Created    map[string]map[string]any `json:"created"`
+		NotCreated map[string]*setError      `json:"notCreated"`
+	}{res.AccountID, res.OldState, res.NewState, res.Created, res.NotCreated}, nil
+}
+
+func (c *call) threadGet(args json.RawMessage) (any, error) {
+	a := getArgs{}
+	if err := c.decode(args, &a, &a.AccountID); err != nil {
+		return nil, err
+	}
+	if err := checkProperties(a.Properties, []string{"id", "emailIds"}); err != nil {
+		return nil, err
+	}
+	v, err := c.loadView()
+	if err != nil {
+		return nil, err
+	}
+	ids := []string{}
+	if a.IDs != nil {
+		ids = *a.IDs
+	} else {
+		for id := range v.versions("Thread") {
+			ids = append(ids, id)
+		}
+	}
+	if len(ids) > maxObjectsInGet {
+		return nil, errRequestTooLarge
+	}
+	res := &getResponse{AccountID: c.user, State: v.state("Thread"), List: []map[string]any{}, NotFound: []string{}}
+	for _, id := range ids {
+		emails := v.threadEmails(id)
+		if len(emails) == 0 {
+			res.NotFound = append(res.NotFound, id)
+			continue
+		}
+		emailIDs := []string{}
+		for _, m := range emails {
+			emailIDs = append(emailIDs, m.id)
+		}
+		res.List = append(res.List, pick(map[string]any{"id": id, "emailIds": emailIDs}, a.Properties, []string{"emailIds"}))
+	}
+	return res, nil
+}
+
+func (c *call) threadChanges(args json.RawMessage) (any, error) {
+	v, err := c.loadView()
+	if err != nil {
+		return nil, err
+	}
+	return c.changes(args, "Thread", v.versions("Thread"))
+}
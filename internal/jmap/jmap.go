@@ -0,0 +1,175 @@
+// JMAP for mail, RFC 8620 and RFC 8621, for scripts and clients that speak
+// JSON over HTTP rather than IMAP. An account is a mailbox: its JMAP
+// Mailboxes are the IMAP folders of the mailbox index and its Emails the
+// stored messages, so JMAP, IMAP and POP3 clients see the same mail.
+package jmap
+
+import (
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/buckelij/sif.io/internal/blob"
+	"github.com/buckelij/sif.io/internal/smtp"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var methodCalls = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "sifio_jmap_method_calls_total",
+	Help: "JMAP method calls, by method and result.",
+}, []string{"method", "result"})
+
+// capabilities of RFC 8620 and RFC 8621
+const (
+	capCore       = "urn:ietf:params:jmap:core"
+	capMail       = "urn:ietf:params:jmap:mail"
+	capSubmission = "urn:ietf:params:jmap:submission"
+)
+
+// limits advertised in the session resource
+const (
+	maxSizeRequest    = 10 << 20
+	maxCallsInRequest = 64
+	maxObjectsInGet   = 1000
+	maxObjectsInSet   = 1000
+)
+
+// A Store is the mail storage JMAP serves, e.g. an *smtp.Backend
+type Store interface {
+	Authenticate(user, password string) bool
+	MailboxIndex(mailbox string) (*smtp.MailboxIndex, error)
+	UpdateMailbox(mailbox string, f func(idx *smtp.MailboxIndex) error) error
+	AppendMessage(mailbox, folder string, flags []string, received time.Time, data []byte) (uidValidity, uid uint32, err error)
+	ReadMessage(key string) ([]byte, error)
+	Addresses(mailbox string) []string
+	Submit(mailbox, from string, to []string, data []byte) error
+}
+
+var _ Store = &smtp.Backend{}
+
+// A Handler serves the JMAP session resource, API, and blob upload and
+// download under /jmap/, and /.well-known/jmap. Clients authenticate with
+// HTTP Basic; the user name is the account id.
+type Handler struct {
+	Store         Store
+	Blobs         blob.BlobClient // uploads are kept under `upload/<account>/` for a day
+	MaxUploadSize int64
+
+	mux    *http.ServeMux
+	states *stateCache
+
+	mu        sync.Mutex
+	summaries map[string]*summary // by stored message key, which never changes
+}
+
+// NewHandler returns a JMAP handler for store, uploading to blobs
+func NewHandler(store Store, blobs blob.BlobClient) *Handler {
+	h := &Handler{
+		Store:         store,
+		Blobs:         blobs,
+		MaxUploadSize: 50 << 20,
+		mux:           http.NewServeMux(),
+		states:        &stateCache{},
+		summaries:     map[string]*summary{},
+	}
+	h.mux.HandleFunc("GET /.well-known/jmap", func(w http.ResponseWriter, req *http.Request) {
+		http.Redirect(w, req, "/jmap/session", http.StatusTemporaryRedirect)
+	})
+	h.mux.HandleFunc("GET /jmap/session", h.authenticated(h.sessionHandler))
+	h.mux.HandleFunc("POST /jmap/api", h.authenticated(h.apiHandler))
+	h.mux.HandleFunc("POST /jmap/upload/{accountId}/", h.authenticated(h.uploadHandler))
+	h.mux.HandleFunc("GET /jmap/download/{accountId}/{blobId}/{name}", h.authenticated(h.downloadHandler))
+	return h
+}
+
+func (h *Handler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	h.mux.ServeHTTP(w, req)
+}
+
+// authenticated checks HTTP Basic credentials and passes on the user
+func (h *Handler) authenticated(next func(w http.ResponseWriter, req *http.Request, user string)) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		user, password, ok := req.BasicAuth()
+		if !ok || !h.Store.Authenticate(user, password) {
+			if ok {
+				slog.Warn("jmap login failed", "user", user, "remote", req.RemoteAddr)
+			}
+			w.Header().Set("WWW-Authenticate", `Basic realm="jmap", charset="UTF-8"`)
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next(w, req, user)
+	}
+}
+
+// session is the JMAP Session resource, RFC 8620 section 2
+type session struct {
+	Capabilities    map[string]any     `json:"capabilities"`
+	Accounts        map[string]account `json:"accounts"`
+	PrimaryAccounts map[string]string  `json:"primaryAccounts"`
+	Username        string             `json:"username"`
+	APIURL          string             `json:"apiUrl"`
+	DownloadURL     string             `json:"downloadUrl"`
+	UploadURL       string             `json:"uploadUrl"`
+	EventSourceURL  string             `json:"eventSourceUrl"`
+	State           string             `json:"state"`
+}
+
+type account struct {
+	Name                string         `json:"name"`
+	IsPersonal          bool           `json:"isPersonal"`
+	IsReadOnly          bool           `json:"isReadOnly"`
+	AccountCapabilities map[string]any `json:"accountCapabilities"`
+}
+
+func (h *Handler) sessionHandler(w http.ResponseWriter, req *http.Request, user string) {
+	base := "https://" + req.Host
+	if req.TLS == nil {
+		base = "http://" + req.Host
+	}
+	s := session{
+		Capabilities: map[string]any{
+			capCore: map[string]any{
+				"maxSizeUpload":         h.MaxUploadSize,
+				"maxConcurrentUpload":   4,
+				"maxSizeRequest":        maxSizeRequest,
+				"maxConcurrentRequests": 4,
+				"maxCallsInRequest":     maxCallsInRequest,
+				"maxObjectsInGet":       maxObjectsInGet,
+				"maxObjectsInSet":       maxObjectsInSet,
+				"collationAlgorithms":   []string{"i;ascii-casemap"},
+			},
+			capMail:       map[string]any{},
+			capSubmission: map[string]any{},
+		},
+		Accounts: map[string]account{user: {
+			Name:       user,
+			IsPersonal: true,
+			AccountCapabilities: map[string]any{
+				capMail: map[string]any{
+					"maxMailboxesPerEmail":       nil,
+					"maxMailboxDepth":            nil,
+					"maxSizeMailboxName":         255,
+					"maxSizeAttachmentsPerEmail": h.MaxUploadSize,
+					"emailQuerySortOptions":      []string{"receivedAt", "sentAt", "size", "from", "to", "subject", "hasKeyword"},
+					"mayCreateTopLevelMailbox":   true,
+				},
+				capSubmission: map[string]any{
+					"maxDelayedSend":       0,
+					"submissionExtensions": map[string][]string{},
+				},
+			},
+		}},
+		PrimaryAccounts: map[string]string{capMail: user, capSubmission: user},
+		Username:        user,
+		APIURL:          base + "/jmap/api",
+		DownloadURL:     base + "/jmap/download/{accountId}/{blobId}/{name}?accept={type}",
+		UploadURL:       base + "/jmap/upload/{accountId}/",
+		// push isn't supported; clients poll with /changes
+		EventSourceURL: base + "/jmap/eventsource",
+		State:          sessionState(user),
+	}
+	writeJSON(w, http.StatusOK, s)
+}
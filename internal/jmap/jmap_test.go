@@ -0,0 +1,461 @@
+package jmap
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/buckelij/sif.io/internal/blob"
+	"github.com/buckelij/sif.io/internal/smtp"
+)
+
+type testStore struct {
+	mu        sync.Mutex
+	idx       smtp.MailboxIndex
+	data      map[string][]byte
+	next      int
+	submitted []submitted
+}
+
+type submitted struct {
+	from string
+	to   []string
+	data string
+}
+
+func (s *testStore) Authenticate(user, password string) bool {
+	return user == "me" && password == "passw0rd"
+}
+
+// MailboxIndex returns a copy, as the index is loaded afresh from storage
+func (s *testStore) MailboxIndex(mailbox string) (*smtp.MailboxIndex, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.idx.AssignUIDs()
+	b, _ := json.Marshal(s.idx)
+	idx := &smtp.MailboxIndex{}
+	return idx, json.Unmarshal(b, idx)
+}
+
+func (s *testStore) UpdateMailbox(mailbox string, f func(idx *smtp.MailboxIndex) error) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.idx.AssignUIDs()
+	return f(&s.idx)
+}
+
+func (s *testStore) AppendMessage(mailbox, folder string, flags []string, received time.Time, data []byte) (uint32, uint32, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.idx.AssignUIDs()
+	f := s.idx.Folder(folder)
+	if f == nil {
+		return 0, 0, smtp.ErrNoSuchFolder
+	}
+	uid, err := s.idx.AddToFolder(folder, s.put(data), int64(len(data)), flags, received)
+	return f.UIDValidity, uid, err
+}
+
+func (s *testStore) ReadMessage(key string) ([]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if d, ok := s.data[key]; ok {
+		return d, nil
+	}
+	return nil, errors.New("not found")
+}
+
+func (s *testStore) Addresses(mailbox string) []string {
+	return []string{mailbox + "@sif.io"}
+}
+
+func (s *testStore) Submit(mailbox, from string, to []string, data []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if from != mailbox+"@sif.io" {
+		return smtp.ErrSenderNotAllowed
+	}
+	s.submitted = append(s.submitted, submitted{from, to, string(data)})
+	return nil
+}
+
+func (s *testStore) put(data []byte) string {
+	s.next++
+	key := fmt.Sprintf("mail/sif.io/%d", s.next)
+	s.data[key] = data
+	return key
+}
+
+// deliver adds a message to INBOX as the SMTP server does
+func (s *testStore) deliver(data string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.idx.Add(s.put([]byte(data)), int64(len(data)))
+}
+
+func newTestStore() *testStore {
+	s := &testStore{data: map[string][]byte{}}
+	s.deliver("From: Eli <eli@sif.io>\r\nTo: me@sif.io\r\nSubject: one\r\nMessage-ID: <1@sif.io>\r\n\r\nfirst message\r\n")
+	s.deliver("From: bob@sif.io\r\nTo: me@sif.io\r\nSubject: Re: one\r\nIn-Reply-To: <1@sif.io>\r\n\r\nsecond message\r\n")
+	return s
+}
+
+type memBlobs struct {
+	mu    sync.Mutex
+	blobs map[string][]byte
+}
+
+func (c *memBlobs) Put(key string, data []byte) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.blobs[key] = data
+	return nil
+}
+
+func (c *memBlobs) Get(key string) ([]byte, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if v, ok := c.blobs[key]; ok {
+		return v, nil
+	}
+	return nil, blob.ErrNotFound
+}
+
+func (c *memBlobs) Delete(key string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.blobs, key)
+	return nil
+}
+
+func (c *memBlobs) List(prefix string) ([]string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	keys := []string{}
+	for key := range c.blobs {
+		if strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+	}
+	return keys, nil
+}
+
+func (c *memBlobs) ListMail() ([]string, error) {
+	return c.List("mail/")
+}
+
+// methodResponse is a method response
+type methodResponse struct {
+	name string
+	args map[string]any
+}
+
+func newTestHandler() (*Handler, *testStore) {
+	s := newTestStore()
+	return NewHandler(s, &memBlobs{blobs: map[string][]byte{}}), s
+}
+
+func do(h *Handler, method, path string, body []byte) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, path, bytes.NewReader(body))
+	req.SetBasicAuth("me", "passw0rd")
+	req.Header.Set("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	return w
+}
+
+// api makes a request of method calls, each a name and arguments, with
+// call ids "0", "1", ...
+func api(t *testing.T, h *Handler, calls ...any) []methodResponse {
+	t.Helper()
+	methodCalls := []any{}
+	for i := 0; i < len(calls); i += 2 {
+		methodCalls = append(methodCalls, []any{calls[i], calls[i+1], fmt.Sprint(i / 2)})
+	}
+	body, _ := json.Marshal(map[string]any{
+		"using":       []string{capCore, capMail, capSubmission},
+		"methodCalls": methodCalls,
+	})
+	w := do(h, "POST", "/jmap/api", body)
+	if w.Code != http.StatusOK {
+		t.Fatalf("api: %d %s", w.Code, w.Body)
+	}
+	res := struct {
+		MethodResponses [][]json.RawMessage `json:"methodResponses"`
+	}{}
+	if err := json.Unmarshal(w.Body.Bytes(), &res); err != nil {
+		t.Fatal(err)
+	}
+	results := []methodResponse{}
+	for _, r := range res.MethodResponses {
+		out := methodResponse{args: map[string]any{}}
+		json.Unmarshal(r[0], &out.name)
+		json.Unmarshal(r[1], &out.args)
+		results = append(results, out)
+	}
+	return results
+}
+
+func list(r methodResponse) []map[string]any {
+	out := []map[string]any{}
+	for _, o := range r.args["list"].([]any) {
+		out = append(out, o.(map[string]any))
+	}
+	return out
+}
+
+func TestSession(t *testing.T) {
+	h, _ := newTestHandler()
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", "/jmap/session", nil))
+	if w.Code != http.StatusUnauthorized || w.Header().Get("WWW-Authenticate") == "" {
+		t.Errorf("unauthenticated session: %d", w.Code)
+	}
+	w = do(h, "GET", "/jmap/session", nil)
+	s := session{}
+	if err := json.Unmarshal(w.Body.Bytes(), &s); err != nil || s.PrimaryAccounts[capMail] != "me" || s.APIURL != "http://example.com/jmap/api" {
+		t.Errorf("unexpected session %s", w.Body)
+	}
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", "/.well-known/jmap", nil))
+	if w.Code != http.StatusTemporaryRedirect || w.Header().Get("Location") != "/jmap/session" {
+		t.Errorf("well-known: %d %v", w.Code, w.Header())
+	}
+}
+
+func TestRequestErrors(t *testing.T) {
+	h, _ := newTestHandler()
+	w := do(h, "POST", "/jmap/api", []byte(`{"using": ["urn:example"], "methodCalls": []}`))
+	if w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), "unknownCapability") {
+		t.Errorf("unknown capability: %d %s", w.Code, w.Body)
+	}
+	res := api(t, h, "Mailbox/nope", map[string]any{}, "Mailbox/get", map[string]any{"accountId": "you"})
+	if res[0].name != "error" || res[0].args["type"] != "unknownMethod" {
+		t.Errorf("unknown method: %+v", res[0])
+	}
+	if res[1].name != "error" || res[1].args["type"] != "accountNotFound" {
+		t.Errorf("other account: %+v", res[1])
+	}
+}
+
+func TestMailboxes(t *testing.T) {
+	h, _ := newTestHandler()
+	res := api(t, h,
+		"Mailbox/set", map[string]any{"accountId": "me", "create": map[string]any{
+			"a": map[string]any{"name": "Archive"},
+			"b": map[string]any{"name": "2026", "parentId": "#a"},
+		}},
+		"Mailbox/get", map[string]any{"accountId": "me"},
+	)
+	if created := res[0].args["created"].(map[string]any); len(created) != 2 {
+		t.Fatalf("create: %+v", res[0].args)
+	}
+	byName := map[string]map[string]any{}
+	for _, m := range list(res[1]) {
+		byName[m["name"].(string)] = m
+	}
+	if m := byName["Inbox"]; m == nil && byName["INBOX"] == nil {
+		t.Fatalf("no inbox in %v", byName)
+	}
+	for _, m := range byName {
+		if m["role"] == "inbox" && m["totalEmails"] != 2.0 {
+			t.Errorf("unexpected inbox %v", m)
+		}
+	}
+	if byName["2026"]["parentId"] != byName["Archive"]["id"] || byName["Archive"]["role"] != "archive" {
+		t.Errorf("unexpected tree %v", byName)
+	}
+
+	res = api(t, h, "Mailbox/set", map[string]any{"accountId": "me", "destroy": []string{byName["Archive"]["id"].(string)}})
+	if e := res[0].args["notDestroyed"].(map[string]any); len(e) != 1 {
+		t.Errorf("destroyed a mailbox with a child: %v", res[0].args)
+	}
+}
+
+func TestEmails(t *testing.T) {
+	h, _ := newTestHandler()
+	res := api(t, h,
+		"Email/query", map[string]any{"accountId": "me", "sort": []any{map[string]any{"property": "receivedAt", "isAscending": true}}},
+		"Email/get", map[string]any{
+			"accountId":           "me",
+			"#ids":                map[string]any{"resultOf": "0", "name": "Email/query", "path": "/ids"},
+			"properties":          []string{"subject", "from", "threadId", "preview", "textBody", "bodyValues", "mailboxIds"},
+			"fetchTextBodyValues": true,
+		},
+	)
+	ids := res[0].args["ids"].([]any)
+	if len(ids) != 2 {
+		t.Fatalf("query: %+v", res[0].args)
+	}
+	emails := list(res[1])
+	if len(emails) != 2 || emails[0]["subject"] != "one" || emails[1]["subject"] != "Re: one" {
+		t.Fatalf("get: %+v", res[1].args)
+	}
+	if emails[0]["threadId"] != emails[1]["threadId"] {
+		t.Errorf("reply isn't in the same thread: %v %v", emails[0]["threadId"], emails[1]["threadId"])
+	}
+	if from := emails[0]["from"].([]any)[0].(map[string]any); from["name"] != "Eli" || from["email"] != "eli@sif.io" {
+		t.Errorf("unexpected from %v", from)
+	}
+	values := emails[0]["bodyValues"].(map[string]any)
+	if v := values["1"].(map[string]any); v["value"] != "first message\n" {
+		t.Errorf("unexpected body values %v", values)
+	}
+
+	// flag and move the first email, then ask what changed
+	state := res[1].args["state"].(string)
+	res = api(t, h,
+		"Mailbox/set", map[string]any{"accountId": "me", "create": map[string]any{"a": map[string]any{"name": "Archive"}}},
+		"Email/set", map[string]any{"accountId": "me", "update": map[string]any{
+			ids[0].(string): map[string]any{"keywords/$flagged": true, "mailboxIds": map[string]bool{"#a": true}},
+		}},
+		"Email/changes", map[string]any{"accountId": "me", "sinceState": state},
+		"Email/query", map[string]any{"accountId": "me", "filter": map[string]any{"hasKeyword": "$flagged"}},
+	)
+	if updated := res[1].args["updated"].(map[string]any); len(updated) != 1 {
+		t.Fatalf("update: %+v", res[1].args)
+	}
+	if changed := res[2].args["updated"].([]any); len(changed) != 1 || changed[0] != ids[0] {
+		t.Errorf("changes: %+v", res[2].args)
+	}
+	if flagged := res[3].args["ids"].([]any); len(flagged) != 1 || flagged[0] != ids[0] {
+		t.Errorf("hasKeyword: %+v", res[3].args)
+	}
+	res = api(t, h, "Mailbox/get", map[string]any{"accountId": "me"})
+	for _, m := range list(res[0]) {
+		if m["totalEmails"] != 1.0 {
+			t.Errorf("email wasn't moved: %v", m)
+		}
+	}
+
+	res = api(t, h, "Email/set", map[string]any{"accountId": "me", "destroy": ids})
+	if destroyed := res[0].args["destroyed"].([]any); len(destroyed) != 2 {
+		t.Errorf("destroy: %+v", res[0].args)
+	}
+}
+
+func TestCreateAndSubmit(t *testing.T) {
+	h, s := newTestHandler()
+	w := do(h, "POST", "/jmap/upload/me/", []byte("%PDF"))
+	upload := map[string]any{}
+	if err := json.Unmarshal(w.Body.Bytes(), &upload); w.Code != http.StatusCreated || err != nil {
+		t.Fatalf("upload: %d %s", w.Code, w.Body)
+	}
+	if w := do(h, "POST", "/jmap/upload/you/", []byte("x")); w.Code != http.StatusNotFound {
+		t.Errorf("upload to another account: %d", w.Code)
+	}
+
+	res := api(t, h,
+		"Mailbox/set", map[string]any{"accountId": "me", "create": map[string]any{"sent": map[string]any{"name": "Sent"}}},
+		"Email/set", map[string]any{"accountId": "me", "create": map[string]any{"draft": map[string]any{
+			"mailboxIds": map[string]bool{"#sent": true},
+			"keywords":   map[string]bool{"$draft": true},
+			"from":       []any{map[string]any{"email": "me@sif.io"}},
+			"to":         []any{map[string]any{"name": "Bob", "email": "bob@example.com"}},
+			"bcc":        []any{map[string]any{"email": "secret@example.com"}},
+			"subject":    "héllo",
+			"bodyValues": map[string]any{"t": map[string]any{"value": "hi there"}},
+			"textBody":   []any{map[string]any{"partId": "t", "type": "text/plain"}},
+			"attachments": []any{map[string]any{
+				"blobId": upload["blobId"], "type": "application/pdf", "name": "doc.pdf",
+			}},
+		}}},
+		"Identity/get", map[string]any{"accountId": "me"},
+	)
+	created := res[1].args["created"].(map[string]any)["draft"].(map[string]any)
+	if created == nil || created["threadId"] == nil {
+		t.Fatalf("create: %+v", res[1].args)
+	}
+	identity := list(res[2])[0]
+	sent := res[0].args["created"].(map[string]any)["sent"].(map[string]any)["id"]
+
+	res = api(t, h,
+		"Email/get", map[string]any{"accountId": "me", "ids": []any{created["id"]}, "properties": []string{"subject", "attachments", "keywords"}},
+		"EmailSubmission/set", map[string]any{
+			"accountId": "me",
+			"create": map[string]any{"s": map[string]any{
+				"identityId": identity["id"], "emailId": created["id"],
+			}},
+			"onSuccessUpdateEmail": map[string]any{"#s": map[string]any{"keywords/$draft": nil}},
+		},
+	)
+	email := list(res[0])[0]
+	if email["subject"] != "héllo" {
+		t.Errorf("unexpected subject %v", email["subject"])
+	}
+	attachments := email["attachments"].([]any)
+	if len(attachments) != 1 {
+		t.Fatalf("unexpected attachments %v", attachments)
+	}
+	att := attachments[0].(map[string]any)
+	w = do(h, "GET", fmt.Sprintf("/jmap/download/me/%s/doc.pdf?accept=application/pdf", att["blobId"]), nil)
+	if w.Code != http.StatusOK || w.Body.String() != "%PDF" || w.Header().Get("Content-Security-Policy") != "sandbox" {
+		t.Errorf("download: %d %q %v", w.Code, w.Body, w.Header())
+	}
+
+	if len(res) != 3 || res[2].name != "Email/set" {
+		t.Fatalf("no implicit Email/set: %+v", res)
+	}
+	if len(s.submitted) != 1 {
+		t.Fatalf("unexpected submissions %+v", s.submitted)
+	}
+	sub := s.submitted[0]
+	if sub.from != "me@sif.io" || len(sub.to) != 2 || strings.Contains(sub.data, "secret@") {
+		t.Errorf("unexpected submission %+v", sub)
+	}
+	res = api(t, h, "Email/get", map[string]any{"accountId": "me", "ids": []any{created["id"]}, "properties": []string{"keywords"}})
+	if keywords := list(res[0])[0]["keywords"].(map[string]any); keywords["$draft"] != nil {
+		t.Errorf("draft keyword not removed: %v", keywords)
+	}
+
+	// a message can only be sent from the account's addresses
+	res = api(t, h,
+		"Email/set", map[string]any{"accountId": "me", "create": map[string]any{"forged": map[string]any{
+			"mailboxIds": map[string]any{sent.(string): true},
+			"from":       []any{map[string]any{"email": "boss@sif.io"}},
+			"to":         []any{map[string]any{"email": "bob@example.com"}},
+		}}},
+		"EmailSubmission/set", map[string]any{"accountId": "me", "create": map[string]any{"s": map[string]any{
+			"identityId": identity["id"], "emailId": "#forged",
+		}}},
+	)
+	notCreated := res[1].args["notCreated"].(map[string]any)
+	if e, _ := notCreated["s"].(map[string]any); e["type"] != "forbiddenFrom" {
+		t.Errorf("forged submission: %+v", res)
+	}
+}
+
+func TestHeaderInjection(t *testing.T) {
+	h, _ := newTestHandler()
+	res := api(t, h, "Mailbox/get", map[string]any{"accountId": "me"})
+	inbox := list(res[0])[0]["id"].(string)
+	res = api(t, h, "Email/set", map[string]any{"accountId": "me", "create": map[string]any{"x": map[string]any{
+		"mailboxIds": map[string]bool{inbox: true},
+		"subject":    "hi",
+		"headers":    []any{map[string]any{"name": "X-Test", "value": "a\r\nBcc: victim@example.com"}},
+	}}})
+	if e := res[0].args["notCreated"].(map[string]any); len(e) != 1 {
+		t.Errorf("injected header accepted: %+v", res[0].args)
+	}
+}
+
+func TestDownloadOwnership(t *testing.T) {
+	h, _ := newTestHandler()
+	other := partBlobID("mail/other/1", "1")
+	w := do(h, "GET", "/jmap/download/me/"+other+"/x", nil)
+	if w.Code != http.StatusNotFound {
+		t.Errorf("downloaded another mailbox's blob: %d", w.Code)
+	}
+	w = do(h, "GET", "/jmap/download/me/"+messageBlobID("mail/sif.io/1")+"/m.eml", nil)
+	if body, _ := io.ReadAll(w.Body); w.Code != http.StatusOK || !bytes.Contains(body, []byte("first message")) {
+		t.Errorf("download message: %d %s", w.Code, body)
+	}
+}
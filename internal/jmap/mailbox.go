@@ -0,0 +1,417 @@
+package jmap
+
+import (
+	"encoding/json"
+	"errors"
+	"slices"
+	"strings"
+
+	"github.com/buckelij/sif.io/internal/smtp"
+)
+
+var mailboxProperties = []string{
+	"id", "name", "parentId", "role", "sortOrder", "totalEmails", "unreadEmails",
+	"totalThreads", "unreadThreads", "myRights", "isSubscribed",
+}
+
+// sortOrder puts mailboxes with roles first
+func (m *mailboxView) sortOrder() int {
+	if m.role == "" {
+		return 100
+	}
+	return sortOrders[m.role]
+}
+
+// mailboxObject returns a Mailbox, RFC 8621 section 2. Thread counts need every
+// message read, so they're only counted if threads is set.
+func (v *view) mailboxObject(m *mailboxView, threads bool) map[string]any {
+	name := m.folder.Name
+	if i := strings.LastIndex(name, "/"); i >= 0 {
+		name = name[i+1:]
+	}
+	total, unread := v.counts(m)
+	inbox := m.folder.Name == smtp.InboxFolder
+	o := map[string]any{
+		"id":           m.id,
+		"name":         name,
+		"parentId":     nullable(v.parent(m)),
+		"role":         nullable(m.role),
+		"sortOrder":    m.sortOrder(),
+		"totalEmails":  total,
+		"unreadEmails": unread,
+		"myRights": map[string]bool{
+			"mayReadItems": true, "mayAddItems": true, "mayRemoveItems": true,
+			"maySetSeen": true, "maySetKeywords": true, "mayCreateChild": true,
+			"mayRename": !inbox, "mayDelete": !inbox, "maySubmit": true,
+		},
+		"isSubscribed": m.folder.Subscribed,
+	}
+	if threads {
+		all, unreadThreads := map[string]bool{}, map[string]bool{}
+		for _, e := range v.emails {
+			if !e.mailboxIDs[m.id] {
+				continue
+			}
+			t := v.thread(e)
+			all[t] = true
+			if !keywords(e)["$seen"] {
+				unreadThreads[t] = true
+			}
+		}
+		o["totalThreads"], o["unreadThreads"] = len(all), len(unreadThreads)
+	}
+	return o
+}
+
+func (c *call) mailboxGet(args json.RawMessage) (any, error) {
+	a := getArgs{}
+	if err := c.decode(args, &a, &a.AccountID); err != nil {
+		return nil, err
+	}
+	if err := checkProperties(a.Properties, mailboxProperties); err != nil {
+		return nil, err
+	}
+	if a.IDs != nil && len(*a.IDs) > maxObjectsInGet {
+		return nil, errRequestTooLarge
+	}
+	v, err := c.loadView()
+	if err != nil {
+		return nil, err
+	}
+	threads := a.Properties == nil || slices.Contains(*a.Properties, "totalThreads") || slices.Contains(*a.Properties, "unreadThreads")
+	res := &getResponse{AccountID: c.user, State: v.state("Mailbox"), List: []map[string]any{}, NotFound: []string{}}
+	if a.IDs == nil {
+		for _, m := range v.mailboxes {
+			res.List = append(res.List, pick(v.mailboxObject(m, threads), a.Properties, mailboxProperties))
+		}
+		return res, nil
+	}
+	for _, id := range *a.IDs {
+		m := v.mailbox(c.id(id))
+		if m == nil {
+			res.NotFound = append(res.NotFound, id)
+			continue
+		}
+		res.List = append(res.List, pick(v.mailboxObject(m, threads), a.Properties, mailboxProperties))
+	}
+	return res, nil
+}
+
+func (c *call) mailboxChanges(args json.RawMessage) (any, error) {
+	v, err := c.loadView()
+	if err != nil {
+		return nil, err
+	}
+	res, err := c.changes(args, "Mailbox", v.versions("Mailbox"))
+	if err != nil {
+		return nil, err
+	}
+	// the counts are all that changes for most updates
+	return struct {
+		*changesResponse
+		UpdatedProperties []string `json:"updatedProperties"`
+	}{res, nil}, nil
+}
+
+// mailboxCondition is a Mailbox/query FilterCondition, RFC 8621 section 2.3
+type mailboxCondition struct {
+	ParentID     *string `json:"parentId"`
+	parentIDSet  bool
+	Name         *string `json:"name"`
+	Role         *string `json:"role"`
+	roleSet      bool
+	HasAnyRole   *bool `json:"hasAnyRole"`
+	IsSubscribed *bool `json:"isSubscribed"`
+}
+
+// UnmarshalJSON notes whether parentId and role were given, as null is a
+// value to filter on for them
+func (mc *mailboxCondition) UnmarshalJSON(b []byte) error {
+	type plain mailboxCondition
+	p := plain{}
+	if err := json.Unmarshal(b, &p); err != nil {
+		return err
+	}
+	given := map[string]json.RawMessage{}
+	json.Unmarshal(b, &given)
+	for k := range given {
+		switch k {
+		case "parentId", "name", "role", "hasAnyRole", "isSubscribed":
+		default:
+			return &methodError{Type: "unsupportedFilter", Description: "unknown condition " + k}
+		}
+	}
+	*mc = mailboxCondition(p)
+	_, mc.parentIDSet = given["parentId"]
+	_, mc.roleSet = given["role"]
+	return nil
+}
+
+func (c *call) mailboxQuery(args json.RawMessage) (any, error) {
+	a := queryArgs[mailboxCondition]{}
+	if err := c.decode(args, &a, &a.AccountID); err != nil {
+		return nil, err
+	}
+	v, err := c.loadView()
+	if err != nil {
+		return nil, err
+	}
+	mailboxes := slices.Clone(v.mailboxes)
+	mailboxes = slices.DeleteFunc(mailboxes, func(m *mailboxView) bool {
+		return !a.Filter.matches(func(mc *mailboxCondition) bool {
+			parent := v.parent(m)
+			switch {
+			case mc.parentIDSet && (mc.ParentID == nil) != (parent == "") || mc.ParentID != nil && c.id(*mc.ParentID) != parent:
+				return false
+			case mc.Name != nil && !contains(m.folder.Name[strings.LastIndex(m.folder.Name, "/")+1:], *mc.Name):
+				return false
+			case mc.roleSet && (mc.Role == nil) != (m.role == "") || mc.Role != nil && *mc.Role != m.role:
+				return false
+			case mc.HasAnyRole != nil && *mc.HasAnyRole != (m.role != ""):
+				return false
+			case mc.IsSubscribed != nil && *mc.IsSubscribed != m.folder.Subscribed:
+				return false
+			}
+			return true
+		})
+	})
+	for _, s := range a.Sort {
+		if s.Property != "name" && s.Property != "sortOrder" {
+			return nil, &methodError{Type: "unsupportedSort", Description: s.Property}
+		}
+	}
+	slices.SortStableFunc(mailboxes, func(x, y *mailboxView) int {
+		for _, s := range a.Sort {
+			r := 0
+			switch s.Property {
+			case "name":
+				r = strings.Compare(strings.ToLower(x.folder.Name), strings.ToLower(y.folder.Name))
+			case "sortOrder":
+				r = x.sortOrder() - y.sortOrder()
+			}
+			if !s.ascending() {
+				r = -r
+			}
+			if r != 0 {
+				return r
+			}
+		}
+		// parents come before their children when sorted as a tree
+		if a.SortAsTree {
+			return strings.Compare(x.folder.Name, y.folder.Name)
+		}
+		return 0
+	})
+	ids := []string{}
+	for _, m := range mailboxes {
+		ids = append(ids, m.id)
+	}
+	return window(ids, &a, v.state("Mailbox"))
+}
+
+// contains is a case-insensitive substring match, i;ascii-casemap
+func contains(s, substr string) bool {
+	return strings.Contains(strings.ToLower(s), strings.ToLower(substr))
+}
+
+// mailboxCreate is the settable properties of a Mailbox
+type mailboxCreate struct {
+	Name         *string `json:"name"`
+	ParentID     *string `json:"parentId"`
+	Role         *string `json:"role"`
+	SortOrder    *int    `json:"sortOrder"`
+	IsSubscribed *bool   `json:"isSubscribed"`
+}
+
+func (c *call) mailboxSet(args json.RawMessage) (any, error) {
+	a := setArgs{}
+	if err := c.decode(args, &a, &a.AccountID); err != nil {
+		return nil, err
+	}
+	if a.size() > maxObjectsInSet {
+		return nil, errRequestTooLarge
+	}
+	v, err := c.loadView()
+	if err != nil {
+		return nil, err
+	}
+	res := newSetResponse(c.user, v.state("Mailbox"))
+	if a.IfInState != nil && *a.IfInState != res.OldState {
+		return nil, errStateMismatch
+	}
+	err = v.update(func(idx *smtp.MailboxIndex) error {
+		for cid, raw := range sortedCreates(a.Create) {
+			id, err := v.createMailbox(idx, raw)
+			if err != nil {
+				res.NotCreated[cid] = result(err)
+				continue
+			}
+			c.created[cid] = id
+			m := v.mailbox(id)
+			created := v.mailboxObject(m, true)
+			delete(created, "name")
+			delete(created, "parentId")
+			res.Created[cid] = created
+		}
+		for id, patch := range a.Update {
+			if err := v.updateMailbox(idx, c.id(id), patch); err != nil {
+				res.NotUpdated[id] = result(err)
+				continue
+			}
+			res.Updated[id] = nil
+		}
+		for _, id := range a.Destroy {
+			if err := v.destroyMailbox(idx, c.id(id), a.OnDestroyRemoveEmails); err != nil {
+				res.NotDestroyed[id] = result(err)
+				continue
+			}
+			res.Destroyed = append(res.Destroyed, id)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	res.NewState = v.state("Mailbox")
+	return res, nil
+}
+
+// sortedCreates yields creates in the order of their creation ids, so
+// parents can be created first by giving them earlier ids
+func sortedCreates(create map[string]json.RawMessage) func(yield func(string, json.RawMessage) bool) {
+	return func(yield func(string, json.RawMessage) bool) {
+		cids := make([]string, 0, len(create))
+		for cid := range create {
+			cids = append(cids, cid)
+		}
+		slices.Sort(cids)
+		for _, cid := range cids {
+			if !yield(cid, create[cid]) {
+				return
+			}
+		}
+	}
+}
+
+// folderPath returns the folder name for a mailbox called name under parent
+func (v *view) folderPath(parent *string, name string) (string, error) {
+	if name == "" || strings.Contains(name, "/") || len(name) > 255 {
+		return "", invalidProperties("name must be 1 to 255 characters, without /", "name")
+	}
+	if parent == nil || *parent == "" {
+		return name, nil
+	}
+	p := v.mailbox(v.c.id(*parent))
+	if p == nil {
+		return "", invalidProperties("no such parent", "parentId")
+	}
+	return p.folder.Name + "/" + name, nil
+}
+
+func (v *view) createMailbox(idx *smtp.MailboxIndex, raw json.RawMessage) (string, error) {
+	mc := mailboxCreate{}
+	if err := strictUnmarshal(raw, &mc); err != nil {
+		return "", invalidProperties(err.Error())
+	}
+	if mc.Role != nil {
+		return "", invalidProperties("roles follow from the name", "role")
+	}
+	if mc.Name == nil {
+		return "", invalidProperties("name is required", "name")
+	}
+	name, err := v.folderPath(mc.ParentID, *mc.Name)
+	if err != nil {
+		return "", err
+	}
+	if err := idx.CreateFolder(name); errors.Is(err, smtp.ErrFolderExists) {
+		return "", &setError{Type: "alreadyExists", Description: name}
+	} else if err != nil {
+		return "", err
+	}
+	if mc.IsSubscribed != nil {
+		idx.Folder(name).Subscribed = *mc.IsSubscribed
+	}
+	v.load(idx)
+	return mailboxID(*idx.Folder(name)), nil
+}
+
+func (v *view) updateMailbox(idx *smtp.MailboxIndex, id string, patch map[string]json.RawMessage) error {
+	m := v.mailbox(id)
+	if m == nil {
+		return errNotFound
+	}
+	mc := mailboxCreate{}
+	b, _ := json.Marshal(patch)
+	if err := strictUnmarshal(b, &mc); err != nil {
+		return invalidProperties(err.Error())
+	}
+	if mc.Role != nil && *mc.Role != m.role {
+		return invalidProperties("roles follow from the name", "role")
+	}
+	if mc.Name != nil || patch["parentId"] != nil {
+		name := m.folder.Name[strings.LastIndex(m.folder.Name, "/")+1:]
+		if mc.Name != nil {
+			name = *mc.Name
+		}
+		parent := v.parent(m)
+		if _, ok := patch["parentId"]; ok {
+			parent = ""
+			if mc.ParentID != nil {
+				parent = *mc.ParentID
+			}
+		}
+		to, err := v.folderPath(&parent, name)
+		if err != nil {
+			return err
+		}
+		if to != m.folder.Name {
+			if m.folder.Name == smtp.InboxFolder {
+				return &setError{Type: "forbidden", Description: "INBOX can't be renamed"}
+			}
+			if strings.HasPrefix(to, m.folder.Name+"/") {
+				return invalidProperties("a mailbox can't be moved under itself", "parentId")
+			}
+			if err := idx.RenameFolder(m.folder.Name, to); errors.Is(err, smtp.ErrFolderExists) {
+				return &setError{Type: "alreadyExists", Description: to}
+			} else if err != nil {
+				return err
+			}
+			m.folder.Name = to
+		}
+	}
+	if mc.IsSubscribed != nil {
+		idx.Folder(m.folder.Name).Subscribed = *mc.IsSubscribed
+	}
+	v.load(idx)
+	return nil
+}
+
+func (v *view) destroyMailbox(idx *smtp.MailboxIndex, id string, removeEmails bool) error {
+	m := v.mailbox(id)
+	if m == nil {
+		return errNotFound
+	}
+	if m.folder.Name == smtp.InboxFolder {
+		return &setError{Type: "forbidden", Description: "INBOX can't be destroyed"}
+	}
+	for _, other := range v.mailboxes {
+		if strings.HasPrefix(other.folder.Name, m.folder.Name+"/") {
+			return &setError{Type: "mailboxHasChild"}
+		}
+	}
+	if total, _ := v.counts(m); total > 0 && !removeEmails {
+		return &setError{Type: "mailboxHasEmail"}
+	}
+	if err := idx.DeleteFolder(m.folder.Name); err != nil {
+		return err
+	}
+	v.load(idx)
+	return nil
+}
+
+// strictUnmarshal unmarshals an object, failing on properties v doesn't have
+func strictUnmarshal(b []byte, v any) error {
+	d := json.NewDecoder(strings.NewReader(string(b)))
+	d.DisallowUnknownFields()
+	return d.Decode(v)
+}
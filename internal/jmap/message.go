@@ -0,0 +1,332 @@
+package jmap
+
+import (
+	"mime"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/buckelij/sif.io/internal/smtp"
+)
+
+var wordDecoder = &mime.WordDecoder{CharsetReader: smtp.CharsetReader}
+
+// A bodyPart is a node of an Email's MIME structure, RFC 8621 section 4.1.4
+type bodyPart struct {
+	partID      string // empty for multiparts, which have no content of their own
+	header      []byte // raw, including the blank line that ends it
+	fields      textproto.MIMEHeader
+	part        *smtp.MimePart
+	mediaType   string // lower case, e.g. "text/plain"
+	params      map[string]string
+	disposition string // lower case, e.g. "attachment"
+	name        string
+	subParts    []*bodyPart
+}
+
+// parseMessage returns the MIME structure of a stored message
+func parseMessage(data []byte) *bodyPart {
+	return newBodyPart(smtp.ParseMimePart(data), "")
+}
+
+// newBodyPart converts a parsed part, numbered id, and those below it
+func newBodyPart(mp *smtp.MimePart, id string) *bodyPart {
+	p := &bodyPart{
+		header:      mp.RawHeader,
+		fields:      mp.Header,
+		part:        mp,
+		mediaType:   mp.MediaType,
+		params:      mp.Params,
+		disposition: mp.Disposition,
+		name:        mp.Filename,
+	}
+	if mp.Parts == nil {
+		if id == "" {
+			id = "1"
+		}
+		p.partID = id
+		return p
+	}
+	for i, c := range mp.Parts {
+		n := strconv.Itoa(i + 1)
+		if id != "" {
+			n = id + "." + n
+		}
+		p.subParts = append(p.subParts, newBodyPart(c, n))
+	}
+	return p
+}
+
+// find returns the part numbered id, or nil
+func (p *bodyPart) find(id string) *bodyPart {
+	if p.partID == id {
+		return p
+	}
+	for _, s := range p.subParts {
+		if f := s.find(id); f != nil {
+			return f
+		}
+	}
+	return nil
+}
+
+// decoded returns the body with its transfer encoding undone, or as it is
+// if that can't be
+func (p *bodyPart) decoded() []byte {
+	b, err := p.part.Content()
+	if err != nil {
+		return p.part.RawBody
+	}
+	return b
+}
+
+// text returns the content of a text part in UTF-8, and whether it couldn't
+// be decoded, for EmailBodyValue's isEncodingProblem
+func (p *bodyPart) text() (string, bool) {
+	b, err := p.part.Body()
+	if err != nil {
+		return strings.ToValidUTF8(strings.ReplaceAll(string(p.part.RawBody), "\r\n", "\n"), "�"), true
+	}
+	return strings.ReplaceAll(string(b), "\r\n", "\n"), false
+}
+
+func (p *bodyPart) isInline() bool {
+	return p.disposition != "attachment"
+}
+
+// structure sorts a message's leaf parts into its textBody, htmlBody and
+// attachments, following the algorithm of RFC 8621 section 4.1.4
+func (p *bodyPart) structure() (textBody, htmlBody, attachments []*bodyPart) {
+	textBody, htmlBody, attachments = []*bodyPart{}, []*bodyPart{}, []*bodyPart{}
+	// text and html stop being collected by a walk into an alternative that
+	// is missing one of them
+	var walk func(parts []*bodyPart, multipartType string, inAlternative, text, html bool)
+	walk = func(parts []*bodyPart, multipartType string, inAlternative, text, html bool) {
+		textLength, htmlLength := len(textBody), len(htmlBody)
+		for i, part := range parts {
+			if part.subParts != nil {
+				sub := strings.TrimPrefix(part.mediaType, "multipart/")
+				walk(part.subParts, sub, inAlternative || sub == "alternative", text, html)
+				continue
+			}
+			isText := part.mediaType == "text/plain" || part.mediaType == "text/html"
+			isInline := part.isInline() && (isText || isInlineMediaType(part.mediaType)) &&
+				(i == 0 || (multipartType != "related" && (isInlineMediaType(part.mediaType) || part.name == "")))
+			if !isInline {
+				attachments = append(attachments, part)
+				continue
+			}
+			if multipartType == "alternative" {
+				switch part.mediaType {
+				case "text/plain":
+					textBody = append(textBody, part)
+				case "text/html":
+					htmlBody = append(htmlBody, part)
+				default:
+					attachments = append(attachments, part)
+				}
+				continue
+			}
+			if inAlternative {
+				if part.mediaType == "text/plain" {
+					html = false
+				}
+				if part.mediaType == "text/html" {
+					text = false
+				}
+			}
+			if text {
+				textBody = append(textBody, part)
+			}
+			if html {
+				htmlBody = append(htmlBody, part)
+			}
+			if (!text || !html) && isInlineMediaType(part.mediaType) {
+				attachments = append(attachments, part)
+			}
+		}
+		// an alternative without one of the types uses the other for both
+		if multipartType == "alternative" && text && html {
+			if len(textBody) == textLength && len(htmlBody) > htmlLength {
+				textBody = append(textBody, htmlBody[htmlLength:]...)
+			}
+			if len(htmlBody) == htmlLength && len(textBody) > textLength {
+				htmlBody = append(htmlBody, textBody[textLength:]...)
+			}
+		}
+	}
+	if p.subParts == nil {
+		walk([]*bodyPart{p}, "mixed", false, true, true)
+	} else {
+		sub := strings.TrimPrefix(p.mediaType, "multipart/")
+		walk(p.subParts, sub, sub == "alternative", true, true)
+	}
+	return textBody, htmlBody, attachments
+}
+
+func isInlineMediaType(t string) bool {
+	return strings.HasPrefix(t, "image/") || strings.HasPrefix(t, "audio/") || strings.HasPrefix(t, "video/")
+}
+
+// preview returns the start of a message's text for Email.preview
+func (p *bodyPart) preview() string {
+	textBody, _, _ := p.structure()
+	for _, part := range textBody {
+		if part.mediaType != "text/plain" && part.mediaType != "text/html" {
+			continue
+		}
+		text, _ := part.text()
+		if part.mediaType == "text/html" {
+			text = stripTags(text)
+		}
+		text = strings.Join(strings.Fields(text), " ")
+		if len(text) > 256 {
+			text = text[:256]
+			for !utf8.ValidString(text) {
+				text = text[:len(text)-1]
+			}
+		}
+		return text
+	}
+	return ""
+}
+
+// stripTags removes HTML tags, roughly, for a preview
+func stripTags(s string) string {
+	b := strings.Builder{}
+	inTag := false
+	for _, r := range s {
+		switch {
+		case r == '<':
+			inTag = true
+		case r == '>':
+			inTag = false
+			b.WriteRune(' ')
+		case !inTag:
+			b.WriteRune(r)
+		}
+	}
+	return b.String()
+}
+
+// hasAttachment reports whether the message has parts that aren't its body
+func (p *bodyPart) hasAttachment() bool {
+	_, _, attachments := p.structure()
+	for _, a := range attachments {
+		if !a.isInline() || a.name != "" {
+			return true
+		}
+	}
+	return false
+}
+
+func decodeHeader(v string) string {
+	if d, err := wordDecoder.DecodeHeader(v); err == nil {
+		return d
+	}
+	return v
+}
+
+// headers returns the header fields of a raw header in order, unfolded but
+// otherwise as they are, for the `headers` property and header:Name:all
+func headers(header []byte) []emailHeader {
+	fields := []emailHeader{}
+	for _, line := range strings.SplitAfter(string(header), "\n") {
+		if line == "" {
+			continue
+		}
+		if (line[0] == ' ' || line[0] == '\t') && len(fields) > 0 {
+			fields[len(fields)-1].Value += line
+			continue
+		}
+		name, value, ok := strings.Cut(line, ":")
+		if !ok {
+			continue
+		}
+		fields = append(fields, emailHeader{Name: strings.TrimSpace(name), Value: value})
+	}
+	for i := range fields {
+		fields[i].Value = strings.TrimRight(strings.NewReplacer("\r\n", "", "\n", "").Replace(fields[i].Value), "\r")
+	}
+	return fields
+}
+
+type emailHeader struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+// properties returns the EmailBodyPart properties asked for, RFC 8621 section 4.1.4
+func (p *bodyPart) properties(key string, props []string) map[string]any {
+	m := map[string]any{}
+	for _, prop := range props {
+		switch prop {
+		case "partId":
+			m[prop] = nullable(p.partID)
+		case "blobId":
+			if p.partID == "" {
+				m[prop] = nil
+			} else {
+				m[prop] = partBlobID(key, p.partID)
+			}
+		case "size":
+			if p.subParts != nil {
+				m[prop] = 0
+			} else {
+				m[prop] = len(p.decoded())
+			}
+		case "headers":
+			m[prop] = headers(p.header)
+		case "name":
+			m[prop] = nullable(p.name)
+		case "type":
+			m[prop] = p.mediaType
+		case "charset":
+			charset := p.params["charset"]
+			if charset == "" && strings.HasPrefix(p.mediaType, "text/") {
+				charset = "us-ascii"
+			}
+			m[prop] = nullable(charset)
+		case "disposition":
+			m[prop] = nullable(p.disposition)
+		case "cid":
+			m[prop] = nullable(strings.Trim(p.fields.Get("Content-Id"), "<> "))
+		case "language":
+			if l := p.fields.Get("Content-Language"); l != "" {
+				langs := []string{}
+				for _, lang := range strings.Split(l, ",") {
+					langs = append(langs, strings.TrimSpace(lang))
+				}
+				m[prop] = langs
+			} else {
+				m[prop] = nil
+			}
+		case "location":
+			m[prop] = nullable(p.fields.Get("Content-Location"))
+		case "subParts":
+			if p.subParts == nil {
+				m[prop] = nil
+				continue
+			}
+			subParts := []map[string]any{}
+			for _, s := range p.subParts {
+				subParts = append(subParts, s.properties(key, props))
+			}
+			m[prop] = subParts
+		default:
+			if v, ok := headerProperty(p.header, prop); ok {
+				m[prop] = v
+			}
+		}
+	}
+	return m
+}
+
+// nullable is s, or JSON null if it's empty
+func nullable(s string) any {
+	if s == "" {
+		return nil
+	}
+	return s
+}
@@ -0,0 +1,79 @@
+package jmap
+
+import (
+	"testing"
+)
+
+const multipartMessage = "From: Eli <eli@sif.io>\r\n" +
+	"Subject: =?utf-8?q?h=C3=A9llo?=\r\n" +
+	"Content-Type: multipart/mixed; boundary=b\r\n" +
+	"\r\n" +
+	"--b\r\n" +
+	"Content-Type: multipart/alternative; boundary=a\r\n" +
+	"\r\n" +
+	"--a\r\n" +
+	"Content-Type: text/plain; charset=utf-8\r\n" +
+	"\r\n" +
+	"hello\r\n" +
+	"--a\r\n" +
+	"Content-Type: text/html; charset=utf-8\r\n" +
+	"Content-Transfer-Encoding: quoted-printable\r\n" +
+	"\r\n" +
+	"<p>h=C3=A9llo</p>\r\n" +
+	"--a--\r\n" +
+	"--b\r\n" +
+	"Content-Type: application/pdf; name=a.pdf\r\n" +
+	"Content-Transfer-Encoding: base64\r\n" +
+	"Content-Disposition: attachment; filename=a.pdf\r\n" +
+	"\r\n" +
+	"aGVsbG8=\r\n" +
+	"--b--\r\n"
+
+func TestStructure(t *testing.T) {
+	p := parseMessage([]byte(multipartMessage))
+	if p.partID != "" || len(p.subParts) != 2 || len(p.subParts[0].subParts) != 2 {
+		t.Fatalf("unexpected structure %+v", p)
+	}
+	textBody, htmlBody, attachments := p.structure()
+	if len(textBody) != 1 || textBody[0].partID != "1.1" || bodyValue(textBody[0], 0)["value"] != "hello" {
+		t.Errorf("unexpected textBody %+v", textBody)
+	}
+	if len(htmlBody) != 1 || htmlBody[0].partID != "1.2" || bodyValue(htmlBody[0], 0)["value"] != "<p>héllo</p>" {
+		t.Errorf("unexpected htmlBody %+v", htmlBody)
+	}
+	if len(attachments) != 1 || attachments[0].partID != "2" || attachments[0].name != "a.pdf" || string(attachments[0].decoded()) != "hello" {
+		t.Errorf("unexpected attachments %+v", attachments)
+	}
+	if p.find("1.2") != htmlBody[0] || p.find("3") != nil {
+		t.Error("find didn't return the part")
+	}
+	if s := decodeHeader(p.fields.Get("Subject")); s != "héllo" {
+		t.Errorf("unexpected subject %q", s)
+	}
+}
+
+func TestSinglePart(t *testing.T) {
+	p := parseMessage([]byte("Subject: hi\r\n\r\nfirst line\r\n"))
+	if p.partID != "1" || p.mediaType != "text/plain" || bodyValue(p, 0)["value"] != "first line\n" {
+		t.Errorf("unexpected part %+v", p)
+	}
+	if preview := p.preview(); preview != "first line" {
+		t.Errorf("unexpected preview %q", preview)
+	}
+}
+
+func TestBodyValueCharset(t *testing.T) {
+	for _, tc := range []struct {
+		message, value string
+		problem        bool
+	}{
+		{"Content-Type: text/plain; charset=iso-8859-1\r\n\r\ncaf\xe9\r\n", "café\n", false},
+		{"Content-Type: text/plain; charset=iso-8859-1\r\nContent-Transfer-Encoding: quoted-printable\r\n\r\ncaf=E9\r\n", "café\n", false},
+		{"Content-Type: text/plain\r\nContent-Transfer-Encoding: base64\r\n\r\n!!not base64!!\r\n", "!!not base64!!\n", true},
+	} {
+		v := bodyValue(parseMessage([]byte(tc.message)), 0)
+		if v["value"] != tc.value || v["isEncodingProblem"] != tc.problem {
+			t.Errorf("%q: unexpected body value %v", tc.message, v)
+		}
+	}
+}
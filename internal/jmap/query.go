@@ -0,0 +1,242 @@
+package jmap
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"slices"
+)
+
+// getArgs are the arguments of Foo/get, RFC 8620 section 5.1
+type getArgs struct {
+	AccountID  string    `json:"accountId"`
+	IDs        *[]string `json:"ids"`
+	Properties *[]string `json:"properties"`
+}
+
+type getResponse struct {
+	AccountID string           `json:"accountId"`
+	State     string           `json:"state"`
+	List      []map[string]any `json:"list"`
+	NotFound  []string         `json:"notFound"`
+}
+
+// pick returns the properties asked for of an object, or the defaults if
+// properties is nil. The id is always returned.
+func pick(object map[string]any, properties *[]string, defaults []string) map[string]any {
+	props := defaults
+	if properties != nil {
+		props = *properties
+	}
+	picked := map[string]any{"id": object["id"]}
+	for _, p := range props {
+		if v, ok := object[p]; ok {
+			picked[p] = v
+		}
+	}
+	return picked
+}
+
+// checkProperties returns invalidArguments if properties has any not known
+func checkProperties(properties *[]string, known []string) error {
+	if properties == nil {
+		return nil
+	}
+	for _, p := range *properties {
+		if !slices.Contains(known, p) {
+			return invalidArguments("unknown property %s", p)
+		}
+	}
+	return nil
+}
+
+// setArgs are the arguments of Foo/set, RFC 8620 section 5.3
+type setArgs struct {
+	AccountID string                                `json:"accountId"`
+	IfInState *string                               `json:"ifInState"`
+	Create    map[string]json.RawMessage            `json:"create"`
+	Update    map[string]map[string]json.RawMessage `json:"update"`
+	Destroy   []string                              `json:"destroy"`
+
+	OnDestroyRemoveEmails bool `json:"onDestroyRemoveEmails"` // Mailbox/set only
+}
+
+func (a *setArgs) size() int {
+	return len(a.Create) + len(a.Update) + len(a.Destroy)
+}
+
+type setResponse struct {
+	AccountID    string                    `json:"accountId"`
+	OldState     string                    `json:"oldState"`
+	NewState     string                    `json:"newState"`
+	Created      map[string]map[string]any `json:"created"`
+	Updated      map[string]any            `json:"updated"`
+	Destroyed    []string                  `json:"destroyed"`
+	NotCreated   map[string]*setError      `json:"notCreated"`
+	NotUpdated   map[string]*setError      `json:"notUpdated"`
+	NotDestroyed map[string]*setError      `json:"notDestroyed"`
+}
+
+func newSetResponse(account, oldState string) *setResponse {
+	return &setResponse{
+		AccountID: account, OldState: oldState,
+		Created: map[string]map[string]any{}, Updated: map[string]any{}, Destroyed: []string{},
+		NotCreated: map[string]*setError{}, NotUpdated: map[string]*setError{}, NotDestroyed: map[string]*setError{},
+	}
+}
+
+// result records the outcome of changing one object: a setError, or for
+// any other error, serverFail
+func result(err error) *setError {
+	se := &setError{}
+	if errors.As(err, &se) {
+		return se
+	}
+	return &setError{Type: "serverFail", Description: err.Error()}
+}
+
+// A filter is a FilterOperator or a FilterCondition of type C, RFC 8620 section 5.5
+type filter[C any] struct {
+	Operator   string       `json:"operator"`
+	Conditions []*filter[C] `json:"conditions"`
+	cond       *C
+}
+
+func (f *filter[C]) UnmarshalJSON(b []byte) error {
+	probe := map[string]json.RawMessage{}
+	if err := json.Unmarshal(b, &probe); err != nil {
+		return err
+	}
+	if _, ok := probe["operator"]; ok {
+		op := struct {
+			Operator   string       `json:"operator"`
+			Conditions []*filter[C] `json:"conditions"`
+		}{}
+		if err := json.Unmarshal(b, &op); err != nil {
+			return err
+		}
+		if op.Operator != "AND" && op.Operator != "OR" && op.Operator != "NOT" {
+			return &methodError{Type: "unsupportedFilter", Description: "unknown operator " + op.Operator}
+		}
+		f.Operator, f.Conditions = op.Operator, op.Conditions
+		return nil
+	}
+	d := json.NewDecoder(bytes.NewReader(b))
+	d.DisallowUnknownFields()
+	f.cond = new(C)
+	if err := d.Decode(f.cond); err != nil {
+		return &methodError{Type: "unsupportedFilter", Description: err.Error()}
+	}
+	return nil
+}
+
+// matches evaluates the filter with match for its conditions
+func (f *filter[C]) matches(match func(*C) bool) bool {
+	if f == nil {
+		return true
+	}
+	switch f.Operator {
+	case "AND":
+		for _, c := range f.Conditions {
+			if !c.matches(match) {
+				return false
+			}
+		}
+		return true
+	case "OR":
+		for _, c := range f.Conditions {
+			if c.matches(match) {
+				return true
+			}
+		}
+		return false
+	case "NOT":
+		for _, c := range f.Conditions {
+			if c.matches(match) {
+				return false
+			}
+		}
+		return true
+	}
+	return match(f.cond)
+}
+
+// A comparator is a sort criterion, RFC 8620 section 5.5
+type comparator struct {
+	Property    string `json:"property"`
+	IsAscending *bool  `json:"isAscending"`
+	Collation   string `json:"collation"`
+	Keyword     string `json:"keyword"` // for Email hasKeyword sorts
+}
+
+func (c comparator) ascending() bool {
+	return c.IsAscending == nil || *c.IsAscending
+}
+
+// queryArgs are the arguments of Foo/query, RFC 8620 section 5.5, with
+// those of Mailbox/query and Email/query
+type queryArgs[C any] struct {
+	AccountID      string       `json:"accountId"`
+	Filter         *filter[C]   `json:"filter"`
+	Sort           []comparator `json:"sort"`
+	Position       int          `json:"position"`
+	Anchor         *string      `json:"anchor"`
+	AnchorOffset   int          `json:"anchorOffset"`
+	Limit          *int         `json:"limit"`
+	CalculateTotal bool         `json:"calculateTotal"`
+
+	SortAsTree      bool `json:"sortAsTree"`      // Mailbox/query
+	FilterAsTree    bool `json:"filterAsTree"`    // Mailbox/query
+	CollapseThreads bool `json:"collapseThreads"` // Email/query
+}
+
+type queryResponse struct {
+	AccountID           string   `json:"accountId"`
+	QueryState          string   `json:"queryState"`
+	CanCalculateChanges bool     `json:"canCalculateChanges"`
+	Position            int      `json:"position"`
+	IDs                 []string `json:"ids"`
+	Total               *int     `json:"total,omitempty"`
+	Limit               *int     `json:"limit,omitempty"`
+}
+
+// maxQueryLimit caps the ids returned by a query
+const maxQueryLimit = 1000
+
+// window returns the part of ids a query asks for, RFC 8620 section 5.5
+func window[C any](ids []string, a *queryArgs[C], state string) (*queryResponse, error) {
+	if a.Limit != nil && *a.Limit < 0 {
+		return nil, invalidArguments("limit must not be negative")
+	}
+	res := &queryResponse{AccountID: a.AccountID, QueryState: state}
+	if a.CalculateTotal {
+		total := len(ids)
+		res.Total = &total
+	}
+	start := a.Position
+	if a.Anchor != nil {
+		i := slices.Index(ids, *a.Anchor)
+		if i < 0 {
+			return nil, errAnchorNotFound
+		}
+		start = max(i+a.AnchorOffset, 0)
+	} else if start < 0 {
+		start = max(len(ids)+start, 0)
+	}
+	start = min(start, len(ids))
+	limit := maxQueryLimit
+	if a.Limit != nil && *a.Limit <= limit {
+		limit = *a.Limit
+	} else {
+		res.Limit = &limit
+	}
+	end := min(start+limit, len(ids))
+	res.Position, res.IDs = start, slices.Clone(ids[start:end])
+	return res, nil
+}
+
+// queryChanges answers Foo/queryChanges. Query results aren't kept, so
+// clients must query again.
+func (c *call) queryChanges(args json.RawMessage) (any, error) {
+	return nil, errCannotCalculateChanges
+}
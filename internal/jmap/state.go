@@ -0,0 +1,144 @@
+package jmap
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"slices"
+	"sync"
+)
+
+// snapshots kept per account and type, so clients that poll at least this
+// often can be told what changed rather than resyncing
+const maxSnapshots = 32
+
+// A stateCache gives JMAP state strings for the objects of each type in an
+// account. The index doesn't record a change log, so a state is a hash of
+// the objects' ids and versions, and changes are found by comparing against
+// the snapshot taken when a state was handed out. Snapshots are only kept in
+// memory, so a restart makes clients resync.
+type stateCache struct {
+	mu        sync.Mutex
+	snapshots map[string][]snapshot // by account and type
+}
+
+type snapshot struct {
+	state    string
+	versions map[string]string // by object id
+}
+
+// state returns the state of versions, the objects of typ by id, and keeps
+// a snapshot of them
+func (s *stateCache) state(account, typ string, versions map[string]string) string {
+	state := hashVersions(versions)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.snapshots == nil {
+		s.snapshots = map[string][]snapshot{}
+	}
+	key := account + "\x00" + typ
+	snaps := s.snapshots[key]
+	if len(snaps) > 0 && snaps[len(snaps)-1].state == state {
+		return state
+	}
+	snaps = slices.DeleteFunc(snaps, func(snap snapshot) bool { return snap.state == state })
+	snaps = append(snaps, snapshot{state: state, versions: versions})
+	if len(snaps) > maxSnapshots {
+		snaps = snaps[len(snaps)-maxSnapshots:]
+	}
+	s.snapshots[key] = snaps
+	return state
+}
+
+// changes returns the ids created, updated and destroyed between the
+// snapshot of since and versions
+func (s *stateCache) changes(account, typ, since string, versions map[string]string) (created, updated, destroyed []string, err error) {
+	s.mu.Lock()
+	snaps := s.snapshots[account+"\x00"+typ]
+	i := slices.IndexFunc(snaps, func(snap snapshot) bool { return snap.state == since })
+	var old map[string]string
+	if i >= 0 {
+		old = snaps[i].versions
+	}
+	s.mu.Unlock()
+	if old == nil {
+		return nil, nil, nil, errCannotCalculateChanges
+	}
+	created, updated, destroyed = []string{}, []string{}, []string{}
+	for id, v := range versions {
+		if ov, ok := old[id]; !ok {
+			created = append(created, id)
+		} else if ov != v {
+			updated = append(updated, id)
+		}
+	}
+	for id := range old {
+		if _, ok := versions[id]; !ok {
+			destroyed = append(destroyed, id)
+		}
+	}
+	slices.Sort(created)
+	slices.Sort(updated)
+	slices.Sort(destroyed)
+	return created, updated, destroyed, nil
+}
+
+func hashVersions(versions map[string]string) string {
+	ids := make([]string, 0, len(versions))
+	for id := range versions {
+		ids = append(ids, id)
+	}
+	slices.Sort(ids)
+	h := sha256.New()
+	for _, id := range ids {
+		h.Write([]byte(id + "\x00" + versions[id] + "\x00"))
+	}
+	return hex.EncodeToString(h.Sum(nil))[:16]
+}
+
+// sessionState is the state of the session resource, which only changes
+// with the capabilities the server is built with
+func sessionState(user string) string {
+	return hashVersions(map[string]string{user: capCore + capMail + capSubmission})
+}
+
+// changesResponse is the response to a Foo/changes call, RFC 8620 section 5.2
+type changesResponse struct {
+	AccountID      string   `json:"accountId"`
+	OldState       string   `json:"oldState"`
+	NewState       string   `json:"newState"`
+	HasMoreChanges bool     `json:"hasMoreChanges"`
+	Created        []string `json:"created"`
+	Updated        []string `json:"updated"`
+	Destroyed      []string `json:"destroyed"`
+}
+
+type changesArgs struct {
+	AccountID  string `json:"accountId"`
+	SinceState string `json:"sinceState"`
+	MaxChanges *int   `json:"maxChanges"`
+}
+
+// changes answers a Foo/changes call for typ, where versions are the
+// current objects. More changes than maxChanges can't be split up, as
+// there's no intermediate state to give, so the client must resync.
+func (c *call) changes(args []byte, typ string, versions map[string]string) (*changesResponse, error) {
+	a := changesArgs{}
+	if err := c.decode(args, &a, &a.AccountID); err != nil {
+		return nil, err
+	}
+	if a.MaxChanges != nil && *a.MaxChanges <= 0 {
+		return nil, invalidArguments("maxChanges must be positive")
+	}
+	newState := c.h.states.state(c.user, typ, versions)
+	created, updated, destroyed, err := c.h.states.changes(c.user, typ, a.SinceState, versions)
+	if err != nil {
+		return nil, err
+	}
+	if a.MaxChanges != nil && len(created)+len(updated)+len(destroyed) > *a.MaxChanges {
+		return nil, errCannotCalculateChanges
+	}
+	return &changesResponse{
+		AccountID: c.user, OldState: a.SinceState, NewState: newState,
+		Created: created, Updated: updated, Destroyed: destroyed,
+	}, nil
+}
@@ -0,0 +1,280 @@
+package jmap
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/buckelij/sif.io/internal/smtp"
+	"github.com/google/uuid"
+)
+
+// An account's identities are its addresses, one in each of our domains
+func identityID(addr string) string {
+	h := sha256.Sum256([]byte(strings.ToLower(addr)))
+	return "I" + hex.EncodeToString(h[:8])
+}
+
+func (c *call) identities() map[string]string {
+	ids := map[string]string{}
+	for _, addr := range c.h.Store.Addresses(c.user) {
+		ids[identityID(addr)] = addr
+	}
+	return ids
+}
+
+func (c *call) identityGet(args json.RawMessage) (any, error) {
+	a := getArgs{}
+	if err := c.decode(args, &a, &a.AccountID); err != nil {
+		return nil, err
+	}
+	properties := []string{"id", "name", "email", "replyTo", "bcc", "textSignature", "htmlSignature", "mayDelete"}
+	if err := checkProperties(a.Properties, properties); err != nil {
+		return nil, err
+	}
+	identities := c.identities()
+	res := &getResponse{
+		AccountID: c.user,
+		State:     c.h.states.state(c.user, "Identity", identities),
+		List:      []map[string]any{},
+		NotFound:  []string{},
+	}
+	ids := []string{}
+	if a.IDs != nil {
+		ids = *a.IDs
+	} else {
+		for id := range identities {
+			ids = append(ids, id)
+		}
+		slices.Sort(ids)
+	}
+	for _, id := range ids {
+		addr, ok := identities[id]
+		if !ok {
+			res.NotFound = append(res.NotFound, id)
+			continue
+		}
+		res.List = append(res.List, pick(map[string]any{
+			"id": id, "name": "", "email": addr, "replyTo": nil, "bcc": nil,
+			"textSignature": "", "htmlSignature": "", "mayDelete": false,
+		}, a.Properties, properties))
+	}
+	return res, nil
+}
+
+func (c *call) identityChanges(args json.RawMessage) (any, error) {
+	return c.changes(args, "Identity", c.identities())
+}
+
+// Submissions are sent as they're created, so there are none to get later
+func (c *call) submissionGet(args json.RawMessage) (any, error) {
+	a := getArgs{}
+	if err := c.decode(args, &a, &a.AccountID); err != nil {
+		return nil, err
+	}
+	res := &getResponse{AccountID: c.user, State: c.h.states.state(c.user, "EmailSubmission", nil), List: []map[string]any{}, NotFound: []string{}}
+	if a.IDs != nil {
+		res.NotFound = append(res.NotFound, *a.IDs...)
+	}
+	return res, nil
+}
+
+func (c *call) submissionQuery(args json.RawMessage) (any, error) {
+	a := queryArgs[json.RawMessage]{}
+	if err := c.decode(args, &a, &a.AccountID); err != nil {
+		return nil, err
+	}
+	return window([]string{}, &a, c.h.states.state(c.user, "EmailSubmission", nil))
+}
+
+// submissionSetArgs are the arguments of EmailSubmission/set, RFC 8621 section 7.5
+type submissionSetArgs struct {
+	setArgs
+	OnSuccessUpdateEmail  map[string]map[string]json.RawMessage `json:"onSuccessUpdateEmail"`
+	OnSuccessDestroyEmail []string                              `json:"onSuccessDestroyEmail"`
+}
+
+type submissionCreate struct {
+	IdentityID string    `json:"identityId"`
+	EmailID    string    `json:"emailId"`
+	Envelope   *envelope `json:"envelope"`
+}
+
+type envelope struct {
+	MailFrom address   `json:"mailFrom"`
+	RcptTo   []address `json:"rcptTo"`
+}
+
+type address struct {
+	Email      string         `json:"email"`
+	Parameters map[string]any `json:"parameters"`
+}
+
+func (c *call) submissionSet(args json.RawMessage) (any, error) {
+	a := submissionSetArgs{}
+	if err := c.decode(args, &a, &a.AccountID); err != nil {
+		return nil, err
+	}
+	if a.size() > maxObjectsInSet {
+		return nil, errRequestTooLarge
+	}
+	state := c.h.states.state(c.user, "EmailSubmission", nil)
+	if a.IfInState != nil && *a.IfInState != state {
+		return nil, errStateMismatch
+	}
+	res := newSetResponse(c.user, state)
+	res.NewState = state
+	for id := range a.Update {
+		res.NotUpdated[id] = errNotFound
+	}
+	for _, id := range a.Destroy {
+		res.NotDestroyed[id] = errNotFound
+	}
+	if len(a.Create) == 0 {
+		return res, nil
+	}
+
+	v, err := c.loadView()
+	if err != nil {
+		return nil, err
+	}
+	sent := map[string]string{} // submission creation ids to email ids
+	for cid, raw := range sortedCreates(a.Create) {
+		sc := submissionCreate{}
+		if err := strictUnmarshal(raw, &sc); err != nil {
+			res.NotCreated[cid] = invalidProperties(err.Error())
+			continue
+		}
+		m := v.emails[c.id(sc.EmailID)]
+		if m == nil {
+			res.NotCreated[cid] = invalidProperties("no such email", "emailId")
+			continue
+		}
+		if err := c.submit(&sc, m); err != nil {
+			res.NotCreated[cid] = result(err)
+			continue
+		}
+		id := "S" + strings.ReplaceAll(uuid.NewString(), "-", "")
+		c.created[cid] = id
+		sent[cid] = m.id
+		res.Created[cid] = map[string]any{
+			"id":         id,
+			"threadId":   v.thread(m),
+			"undoStatus": "final",
+			"sendAt":     time.Now().UTC().Format(time.RFC3339),
+		}
+	}
+
+	// changes to the emails sent are made as an implicit Email/set
+	update := &setArgs{AccountID: c.user, Update: map[string]map[string]json.RawMessage{}}
+	for ref, patch := range a.OnSuccessUpdateEmail {
+		if id, ok := successful(ref, sent); ok {
+			update.Update[id] = patch
+		}
+	}
+	for _, ref := range a.OnSuccessDestroyEmail {
+		if id, ok := successful(ref, sent); ok {
+			update.Destroy = append(update.Destroy, id)
+		}
+	}
+	if len(update.Update) > 0 || len(update.Destroy) > 0 {
+		emailRes, err := c.setEmails(update)
+		if err != nil {
+			c.then("Email/set", &methodError{Type: "serverFail", Description: err.Error()})
+		} else {
+			c.then("Email/set", emailRes)
+		}
+	}
+	return res, nil
+}
+
+// successful returns the id of the email a submission sent, if it was sent,
+// for a reference to the submission: `#` and its creation id, or its id
+func successful(ref string, sent map[string]string) (string, bool) {
+	cid, ok := strings.CutPrefix(ref, "#")
+	if !ok {
+		return "", false
+	}
+	id, ok := sent[cid]
+	return id, ok
+}
+
+// submit sends an email as an identity of the account, to the envelope or
+// the email's recipients. The Bcc field isn't sent.
+func (c *call) submit(sc *submissionCreate, m *email) error {
+	from, ok := c.identities()[sc.IdentityID]
+	if !ok {
+		return invalidProperties("no such identity", "identityId")
+	}
+	data, err := c.h.Store.ReadMessage(m.key)
+	if err != nil {
+		return err
+	}
+	p := parseMessage(data)
+	for _, a := range addresses(p.fields.Get("From")) {
+		if !slices.ContainsFunc(c.h.Store.Addresses(c.user), func(addr string) bool { return strings.EqualFold(addr, a.Email) }) {
+			return &setError{Type: "forbiddenFrom", Description: a.Email + " isn't one of the account's addresses"}
+		}
+	}
+
+	mailFrom, rcptTo := from, []string{}
+	if sc.Envelope != nil {
+		mailFrom = sc.Envelope.MailFrom.Email
+		for _, r := range sc.Envelope.RcptTo {
+			rcptTo = append(rcptTo, r.Email)
+		}
+	} else {
+		for _, field := range []string{"To", "Cc", "Bcc"} {
+			for _, a := range addresses(p.fields.Get(field)) {
+				if !slices.ContainsFunc(rcptTo, func(r string) bool { return strings.EqualFold(r, a.Email) }) {
+					rcptTo = append(rcptTo, a.Email)
+				}
+			}
+		}
+	}
+	if len(rcptTo) == 0 {
+		return &setError{Type: "noRecipients"}
+	}
+	err = c.h.Store.Submit(c.user, mailFrom, rcptTo, withoutBcc(data))
+	if errors.Is(err, smtp.ErrSenderNotAllowed) {
+		return &setError{Type: "forbiddenMailFrom", Description: mailFrom}
+	}
+	if errors.Is(err, smtp.ErrQuotaExceeded) {
+		return &setError{Type: "overQuota"}
+	}
+	if err != nil {
+		return err
+	}
+	c.log.Info("jmap submission", "from", mailFrom, "recipients", len(rcptTo))
+	return nil
+}
+
+// withoutBcc removes Bcc fields from a message's header
+func withoutBcc(data []byte) []byte {
+	header, body := smtp.SplitHeader(data)
+	out := bytes.Buffer{}
+	skip := false
+	for _, line := range bytes.SplitAfter(header, []byte("\n")) {
+		if len(line) == 0 {
+			continue
+		}
+		if line[0] != ' ' && line[0] != '\t' {
+			name, _, _ := bytes.Cut(line, []byte(":"))
+			skip = strings.EqualFold(strings.TrimSpace(string(name)), "Bcc")
+		}
+		if !skip {
+			out.Write(line)
+		}
+	}
+	if body == nil {
+		// a header without the blank line that ends it
+		out.WriteString("\r\n")
+	}
+	out.Write(body)
+	return out.Bytes()
+}
@@ -0,0 +1,461 @@
+package jmap
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net/mail"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/buckelij/sif.io/internal/smtp"
+)
+
+// A view is an account's Mailboxes, Emails and Threads as of one load of its
+// index. An Email is a stored message: the entries for its key in each
+// folder, as copies share the stored message, are its mailboxIds.
+type view struct {
+	c         *call
+	idx       *smtp.MailboxIndex
+	mailboxes []*mailboxView
+	emails    map[string]*email // by id
+	byKey     map[string]*email
+	threads   map[string][]*email // by thread id, oldest first
+}
+
+type mailboxView struct {
+	id     string
+	folder smtp.Folder
+	role   string
+}
+
+type email struct {
+	id         string
+	key        string
+	entries    []smtp.IndexEntry
+	size       int64
+	received   time.Time
+	mailboxIDs map[string]bool
+	threadID   string
+}
+
+func mailboxID(f smtp.Folder) string {
+	return "F" + strconv.FormatUint(uint64(f.UIDValidity), 36)
+}
+
+func emailID(key string) string {
+	h := sha256.Sum256([]byte(key))
+	return "M" + hex.EncodeToString(h[:10])
+}
+
+// roles for top level folders, by lower case name, RFC 8621 section 2
+var roles = map[string]string{
+	"inbox":         "inbox",
+	"drafts":        "drafts",
+	"sent":          "sent",
+	"sent messages": "sent",
+	"sent items":    "sent",
+	"trash":         "trash",
+	"deleted items": "trash",
+	"junk":          "junk",
+	"spam":          "junk",
+	"archive":       "archive",
+}
+
+// sortOrders of mailboxes with roles, in the order clients usually show them
+var sortOrders = map[string]int{"inbox": 1, "drafts": 2, "sent": 3, "archive": 4, "junk": 5, "trash": 6}
+
+func (v *view) load(idx *smtp.MailboxIndex) {
+	idx.AssignUIDs()
+	v.idx = idx
+	v.mailboxes = nil
+	folders := map[string]string{} // names to mailbox ids
+	for _, f := range idx.Folders {
+		m := &mailboxView{id: mailboxID(f), folder: f}
+		if !strings.Contains(f.Name, "/") {
+			m.role = roles[strings.ToLower(f.Name)]
+		}
+		v.mailboxes = append(v.mailboxes, m)
+		folders[f.Name] = m.id
+	}
+	sizes := map[string]int64{}
+	for _, e := range idx.Messages {
+		if !e.Linked {
+			sizes[e.Key] = e.Size
+		}
+	}
+	v.emails, v.byKey = map[string]*email{}, map[string]*email{}
+	for _, e := range idx.Messages {
+		m, ok := v.byKey[e.Key]
+		if !ok {
+			m = &email{id: emailID(e.Key), key: e.Key, size: sizes[e.Key], received: e.Received, mailboxIDs: map[string]bool{}}
+			v.byKey[e.Key], v.emails[m.id] = m, m
+		}
+		m.entries = append(m.entries, e)
+		if e.Folder == "" {
+			m.mailboxIDs[folders[smtp.InboxFolder]] = true
+		} else if id, ok := folders[e.Folder]; ok {
+			m.mailboxIDs[id] = true
+		}
+		if e.Received.Before(m.received) {
+			m.received = e.Received
+		}
+	}
+	v.threads = nil
+}
+
+// loadView reads the account's index
+func (c *call) loadView() (*view, error) {
+	idx, err := c.h.Store.MailboxIndex(c.user)
+	if err != nil {
+		return nil, err
+	}
+	v := &view{c: c}
+	v.load(idx)
+	return v, nil
+}
+
+// update changes the account's index, reloading the view with the result
+func (v *view) update(f func(idx *smtp.MailboxIndex) error) error {
+	return v.c.h.Store.UpdateMailbox(v.c.user, func(idx *smtp.MailboxIndex) error {
+		v.load(idx)
+		if err := f(idx); err != nil {
+			return err
+		}
+		v.load(idx)
+		return nil
+	})
+}
+
+func (v *view) mailbox(id string) *mailboxView {
+	for _, m := range v.mailboxes {
+		if m.id == id {
+			return m
+		}
+	}
+	return nil
+}
+
+func (v *view) mailboxByName(name string) *mailboxView {
+	f := v.idx.Folder(name)
+	if f == nil {
+		return nil
+	}
+	return v.mailbox(mailboxID(*f))
+}
+
+// parent returns the id of a folder's parent, or ""
+func (v *view) parent(m *mailboxView) string {
+	i := strings.LastIndex(m.folder.Name, "/")
+	if i < 0 {
+		return ""
+	}
+	if p := v.mailboxByName(m.folder.Name[:i]); p != nil {
+		return p.id
+	}
+	return ""
+}
+
+// keywords of an email are the flags of its first entry, as copies start
+// with the same flags and Email/set changes them all
+func keywords(m *email) map[string]bool {
+	kw := map[string]bool{}
+	for _, f := range m.entries[0].Flags {
+		if k := keyword(f); k != "" {
+			kw[k] = true
+		}
+	}
+	return kw
+}
+
+// keyword returns the JMAP keyword for an IMAP flag, RFC 8621 section 4.1.1,
+// or "" for \Deleted and \Recent, which have none
+func keyword(flag string) string {
+	switch strings.ToLower(flag) {
+	case `\seen`:
+		return "$seen"
+	case `\flagged`:
+		return "$flagged"
+	case `\answered`:
+		return "$answered"
+	case `\draft`:
+		return "$draft"
+	case `\deleted`, `\recent`:
+		return ""
+	}
+	return strings.ToLower(flag)
+}
+
+// flag returns the IMAP flag for a JMAP keyword
+func flag(keyword string) string {
+	switch keyword {
+	case "$seen":
+		return `\Seen`
+	case "$flagged":
+		return `\Flagged`
+	case "$answered":
+		return `\Answered`
+	case "$draft":
+		return `\Draft`
+	}
+	return keyword
+}
+
+// validKeyword reports whether k may be used as a keyword, RFC 8621 section 4.1.1
+func validKeyword(k string) bool {
+	if k == "" || len(k) > 255 {
+		return false
+	}
+	for _, r := range k {
+		if r <= ' ' || r > '~' || strings.ContainsRune(`()[]{}%*"\`, r) {
+			return false
+		}
+	}
+	return true
+}
+
+// A summary is what's needed of a message's header and text for Email/get,
+// Email/query and threading
+type summary struct {
+	messageID     []string
+	inReplyTo     []string
+	references    []string
+	subject       string
+	from          []emailAddress
+	sender        []emailAddress
+	replyTo       []emailAddress
+	to            []emailAddress
+	cc            []emailAddress
+	bcc           []emailAddress
+	sentAt        *time.Time
+	preview       string
+	hasAttachment bool
+}
+
+type emailAddress struct {
+	Name  *string `json:"name"`
+	Email string  `json:"email"`
+}
+
+// maxSummaries bounds the summary cache, which is cleared when it's full
+const maxSummaries = 10000
+
+// summary returns the summary of a stored message, reading it if it isn't
+// cached. Stored messages never change, so summaries don't either.
+func (h *Handler) summary(key string) (*summary, error) {
+	h.mu.Lock()
+	s, ok := h.summaries[key]
+	h.mu.Unlock()
+	if ok {
+		return s, nil
+	}
+	data, err := h.Store.ReadMessage(key)
+	if err != nil {
+		return nil, err
+	}
+	p := parseMessage(data)
+	s = &summary{
+		messageID:     messageIDs(p.fields.Get("Message-Id")),
+		inReplyTo:     messageIDs(p.fields.Get("In-Reply-To")),
+		references:    messageIDs(p.fields.Get("References")),
+		subject:       strings.TrimSpace(decodeHeader(p.fields.Get("Subject"))),
+		from:          addresses(p.fields.Get("From")),
+		sender:        addresses(p.fields.Get("Sender")),
+		replyTo:       addresses(p.fields.Get("Reply-To")),
+		to:            addresses(p.fields.Get("To")),
+		cc:            addresses(p.fields.Get("Cc")),
+		bcc:           addresses(p.fields.Get("Bcc")),
+		preview:       p.preview(),
+		hasAttachment: p.hasAttachment(),
+	}
+	if t, err := mail.ParseDate(p.fields.Get("Date")); err == nil {
+		s.sentAt = &t
+	}
+	h.mu.Lock()
+	if len(h.summaries) >= maxSummaries {
+		h.summaries = map[string]*summary{}
+	}
+	h.summaries[key] = s
+	h.mu.Unlock()
+	return s, nil
+}
+
+// messageIDs returns the ids of a Message-ID, In-Reply-To or References
+// field, without their angle brackets
+func messageIDs(v string) []string {
+	ids := []string{}
+	for _, f := range strings.Fields(v) {
+		for _, id := range strings.Split(f, "><") {
+			if id = strings.Trim(id, "<>,"); id != "" && strings.Contains(id, "@") {
+				ids = append(ids, id)
+			}
+		}
+	}
+	if len(ids) == 0 {
+		return nil
+	}
+	return ids
+}
+
+// addresses parses an address list field, RFC 8621 section 4.1.2.3
+func addresses(v string) []emailAddress {
+	if strings.TrimSpace(v) == "" {
+		return nil
+	}
+	list, err := (&mail.AddressParser{WordDecoder: wordDecoder}).ParseList(v)
+	if err != nil {
+		return nil
+	}
+	addrs := []emailAddress{}
+	for _, a := range list {
+		ea := emailAddress{Email: a.Address}
+		if a.Name != "" {
+			ea.Name = &a.Name
+		}
+		addrs = append(addrs, ea)
+	}
+	return addrs
+}
+
+// summaryOf returns an email's summary, or an empty one if it can't be read
+func (v *view) summaryOf(m *email) *summary {
+	s, err := v.c.h.summary(m.key)
+	if err != nil {
+		v.c.log.Error("failed to read message", "key", m.key, "err", err)
+		return &summary{}
+	}
+	return s
+}
+
+// thread returns the id of an email's thread. Emails are in one thread when
+// their Message-ID, In-Reply-To and References fields connect them; a
+// thread's id is that of its oldest email.
+func (v *view) thread(m *email) string {
+	if v.threads == nil {
+		v.computeThreads()
+	}
+	return m.threadID
+}
+
+func (v *view) threadEmails(id string) []*email {
+	if v.threads == nil {
+		v.computeThreads()
+	}
+	return v.threads[id]
+}
+
+func (v *view) computeThreads() {
+	parent := map[string]string{}
+	var find func(x string) string
+	find = func(x string) string {
+		p, ok := parent[x]
+		if !ok || p == x {
+			return x
+		}
+		r := find(p)
+		parent[x] = r
+		return r
+	}
+	union := func(a, b string) {
+		if ra, rb := find(a), find(b); ra != rb {
+			parent[ra] = rb
+		}
+	}
+	emails := v.sortedEmails()
+	for _, m := range emails {
+		s := v.summaryOf(m)
+		node := "email:" + m.id
+		for _, ids := range [][]string{s.messageID, s.inReplyTo, s.references} {
+			for _, id := range ids {
+				union(node, "id:"+id)
+			}
+		}
+	}
+	v.threads = map[string][]*email{}
+	roots := map[string]string{}
+	for _, m := range emails {
+		root := find("email:" + m.id)
+		id, ok := roots[root]
+		if !ok {
+			id = "T" + m.id[1:]
+			roots[root] = id
+		}
+		m.threadID = id
+		v.threads[id] = append(v.threads[id], m)
+	}
+}
+
+// sortedEmails returns the emails oldest first
+func (v *view) sortedEmails() []*email {
+	emails := make([]*email, 0, len(v.emails))
+	for _, m := range v.emails {
+		emails = append(emails, m)
+	}
+	slices.SortFunc(emails, func(a, b *email) int {
+		if c := a.received.Compare(b.received); c != 0 {
+			return c
+		}
+		return strings.Compare(a.id, b.id)
+	})
+	return emails
+}
+
+// versions of each type's objects, for states and changes
+func (v *view) versions(typ string) map[string]string {
+	versions := map[string]string{}
+	switch typ {
+	case "Mailbox":
+		for _, m := range v.mailboxes {
+			total, unread := v.counts(m)
+			versions[m.id] = strings.Join([]string{
+				m.folder.Name, strconv.FormatBool(m.folder.Subscribed), strconv.Itoa(total), strconv.Itoa(unread),
+			}, "\x00")
+		}
+	case "Email":
+		for _, m := range v.emails {
+			versions[m.id] = strings.Join(append(sortedKeys(m.mailboxIDs), sortedKeys(keywords(m))...), " ")
+		}
+	case "Thread":
+		if v.threads == nil {
+			v.computeThreads()
+		}
+		for id, emails := range v.threads {
+			ids := []string{}
+			for _, m := range emails {
+				ids = append(ids, m.id)
+			}
+			versions[id] = strings.Join(ids, " ")
+		}
+	}
+	return versions
+}
+
+func (v *view) state(typ string) string {
+	return v.c.h.states.state(v.c.user, typ, v.versions(typ))
+}
+
+// counts returns the number of emails in a mailbox and those unread
+func (v *view) counts(m *mailboxView) (total, unread int) {
+	for _, e := range v.emails {
+		if !e.mailboxIDs[m.id] {
+			continue
+		}
+		total++
+		if !keywords(e)["$seen"] {
+			unread++
+		}
+	}
+	return total, unread
+}
+
+func sortedKeys(m map[string]bool) []string {
+	keys := []string{}
+	for k, ok := range m {
+		if ok {
+			keys = append(keys, k)
+		}
+	}
+	slices.Sort(keys)
+	return keys
+}
@@ -0,0 +1,99 @@
+// structured logging with a redaction policy: message contents are never
+// logged, and email addresses can be replaced with a hash
+package logging
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log/slog"
+	"strings"
+)
+
+// redactedKeys are never logged; message data must not end up in container logs
+var redactedKeys = map[string]bool{
+	"body":     true,
+	"data":     true,
+	"password": true,
+}
+
+// addressKeys hold email addresses or mailbox names, hashed with HashAddresses
+var addressKeys = map[string]bool{
+	"from":    true,
+	"rcpt":    true,
+	"to":      true,
+	"user":    true,
+	"mailbox": true,
+	"member":  true, // of a mailing list
+}
+
+type Options struct {
+	Level         slog.Level
+	JSON          bool
+	HashAddresses bool
+}
+
+// ParseOptions reads a level (`debug`, `info`, `warn`, `error`), a format
+// (`text` or `json`) and whether to hash addresses, with info and text by default
+func ParseOptions(level, format string, hashAddresses bool) (Options, error) {
+	o := Options{HashAddresses: hashAddresses}
+	if level != "" {
+		if err := o.Level.UnmarshalText([]byte(level)); err != nil {
+			return o, err
+		}
+	}
+	switch format {
+	case "", "text":
+	case "json":
+		o.JSON = true
+	default:
+		return o, fmt.Errorf("unknown log format %q", format)
+	}
+	return o, nil
+}
+
+// New returns a logger writing to w that applies the redaction policy
+func New(w io.Writer, o Options) *slog.Logger {
+	opts := &slog.HandlerOptions{
+		Level: o.Level,
+		ReplaceAttr: func(groups []string, a slog.Attr) slog.Attr {
+			return redact(a, o.HashAddresses)
+		},
+	}
+	if o.JSON {
+		return slog.New(slog.NewJSONHandler(w, opts))
+	}
+	return slog.New(slog.NewTextHandler(w, opts))
+}
+
+func redact(a slog.Attr, hashAddresses bool) slog.Attr {
+	key := strings.ToLower(a.Key)
+	if redactedKeys[key] {
+		return slog.String(a.Key, "[redacted]")
+	}
+	if !hashAddresses || !addressKeys[key] {
+		return a
+	}
+	switch v := a.Value.Resolve().Any().(type) {
+	case string:
+		return slog.String(a.Key, HashAddress(v))
+	case []string:
+		hashed := make([]string, len(v))
+		for i, s := range v {
+			hashed[i] = HashAddress(s)
+		}
+		return slog.Any(a.Key, hashed)
+	}
+	return a
+}
+
+// HashAddress returns a short stable hash of addr, so log lines for the same
+// address can be correlated without recording it
+func HashAddress(addr string) string {
+	if addr == "" {
+		return ""
+	}
+	sum := sha256.Sum256([]byte(strings.ToLower(addr)))
+	return "sha256:" + hex.EncodeToString(sum[:6])
+}
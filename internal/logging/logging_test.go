@@ -0,0 +1,52 @@
+package logging
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestRedaction(t *testing.T) {
+	var buf bytes.Buffer
+	log := New(&buf, Options{JSON: true, HashAddresses: true})
+	log.Info("delivering", "from", "Sender@example.org", "rcpt", []string{"a@sif.io"}, "member", "b@example.net", "body", "secret mail", "size", 11)
+
+	line := map[string]any{}
+	if err := json.Unmarshal(buf.Bytes(), &line); err != nil {
+		t.Fatal(err)
+	}
+	if line["body"] != "[redacted]" {
+		t.Errorf("body not redacted: %v", line["body"])
+	}
+	if line["from"] != HashAddress("sender@example.org") || strings.Contains(buf.String(), "example.org") {
+		t.Errorf("from not hashed: %v", line["from"])
+	}
+	if rcpt, _ := line["rcpt"].([]any); len(rcpt) != 1 || rcpt[0] != HashAddress("a@sif.io") {
+		t.Errorf("rcpt not hashed: %v", line["rcpt"])
+	}
+	if line["member"] != HashAddress("b@example.net") {
+		t.Errorf("member not hashed: %v", line["member"])
+	}
+	if line["size"] != float64(11) {
+		t.Errorf("unexpected size %v", line["size"])
+	}
+}
+
+func TestParseOptions(t *testing.T) {
+	o, err := ParseOptions("warn", "json", false)
+	if err != nil || !o.JSON || o.Level.String() != "WARN" {
+		t.Errorf("unexpected %+v %v", o, err)
+	}
+	var buf bytes.Buffer
+	New(&buf, o).Info("hidden")
+	if buf.Len() != 0 {
+		t.Errorf("info logged at warn: %v", buf.String())
+	}
+	if _, err := ParseOptions("loud", "", false); err == nil {
+		t.Error("expected level error")
+	}
+	if _, err := ParseOptions("", "xml", false); err == nil {
+		t.Error("expected format error")
+	}
+}
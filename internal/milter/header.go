@@ -0,0 +1,87 @@
+package milter
+
+import (
+	"bytes"
+	"slices"
+	"strings"
+)
+
+// A Field is a single header field of a raw message
+type Field struct {
+	Name  string
+	Value string // with folding kept and the leading space removed
+	raw   []byte
+}
+
+// SplitMessage returns the header fields of a raw message in order, and the body
+func SplitMessage(msg []byte) (fields []Field, body []byte) {
+	rest := msg
+	for len(rest) > 0 {
+		end := bytes.IndexByte(rest, '\n')
+		if end < 0 {
+			end = len(rest) - 1
+		}
+		line := rest[:end+1]
+		if len(bytes.TrimRight(line, "\r\n")) == 0 {
+			return fields, rest[end+1:]
+		}
+		if (line[0] == ' ' || line[0] == '\t') && len(fields) > 0 {
+			f := &fields[len(fields)-1]
+			f.raw = append(f.raw, line...)
+			f.Value += "\r\n" + strings.TrimRight(string(line), "\r\n")
+		} else if name, value, ok := strings.Cut(strings.TrimRight(string(line), "\r\n"), ":"); ok {
+			fields = append(fields, Field{Name: name, Value: strings.TrimPrefix(value, " "), raw: slices.Clone(line)})
+		} else {
+			// not a header; treat the rest as body
+			return fields, rest
+		}
+		rest = rest[end+1:]
+	}
+	return fields, nil
+}
+
+// Apply returns msg with the header modifications applied
+func Apply(msg []byte, mods []Modification) []byte {
+	if len(mods) == 0 {
+		return msg
+	}
+	fields, body := SplitMessage(msg)
+	eol := "\r\n"
+	if !bytes.Contains(msg, []byte("\r\n")) {
+		eol = "\n"
+	}
+	newField := func(name, value string) Field {
+		return Field{Name: name, Value: value, raw: []byte(name + ": " + value + eol)}
+	}
+	for _, m := range mods {
+		switch m.Type {
+		case AddHeader:
+			fields = append(fields, newField(m.Name, m.Value))
+		case InsertHeader:
+			fields = slices.Insert(fields, min(m.Index, len(fields)), newField(m.Name, m.Value))
+		case ChangeHeader:
+			n := 0
+			i := slices.IndexFunc(fields, func(f Field) bool {
+				if strings.EqualFold(f.Name, m.Name) {
+					n++
+				}
+				return n == max(m.Index, 1)
+			})
+			switch {
+			case i < 0 && m.Value != "":
+				fields = append(fields, newField(m.Name, m.Value))
+			case i >= 0 && m.Value == "":
+				fields = slices.Delete(fields, i, i+1)
+			case i >= 0:
+				fields[i] = newField(m.Name, m.Value)
+			}
+		}
+	}
+	out := bytes.Buffer{}
+	for _, f := range fields {
+		out.Write(f.raw)
+	}
+	out.WriteString(eol)
+	out.Write(body)
+	return out.Bytes()
+}
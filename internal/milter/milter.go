@@ -0,0 +1,416 @@
+// Sendmail milter protocol (version 6) client, for running mail through external filters
+// see https://github.com/emersion/go-milter/blob/master/milter-protocol.txt
+package milter
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const protocolVersion = 6
+
+// commands sent to the filter
+const (
+	cmdAbort   = 'A'
+	cmdBody    = 'B'
+	cmdConnect = 'C'
+	cmdBodyEOB = 'E'
+	cmdHelo    = 'H'
+	cmdHeader  = 'L'
+	cmdMail    = 'M'
+	cmdEOH     = 'N'
+	cmdOptNeg  = 'O'
+	cmdQuit    = 'Q'
+	cmdRcpt    = 'R'
+)
+
+// responses from the filter
+const (
+	respAccept     = 'a'
+	respContinue   = 'c'
+	respDiscard    = 'd'
+	respReject     = 'r'
+	respTempFail   = 't'
+	respReplyCode  = 'y'
+	respAddHeader  = 'h'
+	respChgHeader  = 'm'
+	respInsHeader  = 'i'
+	respProgress   = 'p'
+	respQuarantine = 'q'
+	respSkip       = 's'
+)
+
+// actions the filter may take; only header changes are supported
+const (
+	actAddHeaders    = 0x01
+	actChangeHeaders = 0x10
+	actQuarantine    = 0x20
+)
+
+// protocol flags where the filter asks to skip a stage or not reply to it
+const (
+	protoNoConnect  = 0x01
+	protoNoHelo     = 0x02
+	protoNoMail     = 0x04
+	protoNoRcpt     = 0x08
+	protoNoBody     = 0x10
+	protoNoHeaders  = 0x20
+	protoNoEOH      = 0x40
+	protoNoHdrReply = 0x80
+	protoSkip       = 0x400
+	protoNoConnRep  = 0x1000
+	protoNoHeloRep  = 0x2000
+	protoNoMailRep  = 0x4000
+	protoNoRcptRep  = 0x8000
+	protoNoEOHRep   = 0x40000
+	protoNoBodyRep  = 0x80000
+
+	// what this client understands
+	protoSupported = protoNoConnect | protoNoHelo | protoNoMail | protoNoRcpt | protoNoBody |
+		protoNoHeaders | protoNoEOH | protoNoHdrReply | protoSkip | protoNoConnRep | protoNoHeloRep |
+		protoNoMailRep | protoNoRcptRep | protoNoEOHRep | protoNoBodyRep
+)
+
+// maxChunk is the largest body chunk sent in one packet
+const maxChunk = 65535
+
+// Action is a filter's verdict for a stage
+type Action int
+
+const (
+	Continue Action = iota // carry on with the next stage
+	Accept                 // accept the message, skipping the filter's remaining stages
+	Reject                 // reject with 5xx, or Code/Text if set
+	TempFail               // reject with 4xx, or Code/Text if set
+	Discard                // accept the message but drop it silently
+)
+
+func (a Action) String() string {
+	return [...]string{"continue", "accept", "reject", "tempfail", "discard"}[a]
+}
+
+// A Response is the filter's verdict for a stage. Code and Text are set when
+// the filter supplied its own SMTP reply.
+type Response struct {
+	Action       Action
+	Code         int
+	EnhancedCode string
+	Text         string
+
+	skip bool // the filter wants no more body chunks
+}
+
+// ModificationType is the kind of header change a filter requested at end of message
+type ModificationType int
+
+const (
+	AddHeader ModificationType = iota
+	InsertHeader
+	ChangeHeader
+)
+
+// A Modification is a header change requested by the filter. Index is the
+// position for InsertHeader, or the 1-based occurrence of Name for
+// ChangeHeader, where an empty Value deletes the header.
+type Modification struct {
+	Type  ModificationType
+	Index int
+	Name  string
+	Value string
+}
+
+// Client holds the settings for one filter
+type Client struct {
+	Network  string
+	Address  string
+	Timeout  time.Duration // for each command
+	FailOpen bool          // skip the filter on errors instead of failing the message
+}
+
+// NewClient returns a client for a filter at a TCP `host:port` or a `unix:/path/to/socket`
+func NewClient(address string) *Client {
+	c := &Client{Network: "tcp", Address: address, Timeout: 10 * time.Second}
+	if path, ok := strings.CutPrefix(address, "unix:"); ok {
+		c.Network = "unix"
+		c.Address = path
+	}
+	return c
+}
+
+// A Session is a connection to a filter for the duration of one SMTP connection
+type Session struct {
+	conn     net.Conn
+	timeout  time.Duration
+	protocol uint32
+	actions  uint32
+}
+
+// Session connects to the filter and negotiates options
+func (c *Client) Session() (*Session, error) {
+	conn, err := net.DialTimeout(c.Network, c.Address, c.Timeout)
+	if err != nil {
+		return nil, err
+	}
+	s := &Session{conn: conn, timeout: c.Timeout}
+
+	neg := make([]byte, 12)
+	binary.BigEndian.PutUint32(neg, protocolVersion)
+	binary.BigEndian.PutUint32(neg[4:], actAddHeaders|actChangeHeaders|actQuarantine)
+	binary.BigEndian.PutUint32(neg[8:], protoSupported)
+	if err := s.write(cmdOptNeg, neg); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	code, data, err := s.read()
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if code != cmdOptNeg || len(data) < 12 {
+		conn.Close()
+		return nil, fmt.Errorf("milter: unexpected negotiation response %q", code)
+	}
+	if v := binary.BigEndian.Uint32(data); v < 2 || v > protocolVersion {
+		conn.Close()
+		return nil, fmt.Errorf("milter: unsupported protocol version %d", v)
+	}
+	s.actions = binary.BigEndian.Uint32(data[4:])
+	s.protocol = binary.BigEndian.Uint32(data[8:])
+	if s.protocol&^protoSupported != 0 {
+		conn.Close()
+		return nil, fmt.Errorf("milter: unsupported protocol flags %#x", s.protocol&^protoSupported)
+	}
+	return s, nil
+}
+
+// Connect sends the client's hostname and address
+func (s *Session) Connect(hostname string, addr net.Addr) (*Response, error) {
+	if s.protocol&protoNoConnect != 0 {
+		return &Response{}, nil
+	}
+	data := cstring(hostname)
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		family := byte('4')
+		if a.IP.To4() == nil {
+			family = '6'
+		}
+		port := make([]byte, 2)
+		binary.BigEndian.PutUint16(port, uint16(a.Port))
+		data = append(append(append(data, family), port...), cstring(a.IP.String())...)
+	case *net.UnixAddr:
+		data = append(append(data, 'L', 0, 0), cstring(a.Name)...)
+	default:
+		data = append(data, 'U')
+	}
+	return s.command(cmdConnect, data, s.protocol&protoNoConnRep != 0)
+}
+
+// Helo sends the HELO/EHLO hostname
+func (s *Session) Helo(name string) (*Response, error) {
+	if s.protocol&protoNoHelo != 0 {
+		return &Response{}, nil
+	}
+	return s.command(cmdHelo, cstring(name), s.protocol&protoNoHeloRep != 0)
+}
+
+// Mail sends the envelope sender
+func (s *Session) Mail(from string) (*Response, error) {
+	if s.protocol&protoNoMail != 0 {
+		return &Response{}, nil
+	}
+	return s.command(cmdMail, cstring("<"+from+">"), s.protocol&protoNoMailRep != 0)
+}
+
+// Rcpt sends an envelope recipient
+func (s *Session) Rcpt(to string) (*Response, error) {
+	if s.protocol&protoNoRcpt != 0 {
+		return &Response{}, nil
+	}
+	return s.command(cmdRcpt, cstring("<"+to+">"), s.protocol&protoNoRcptRep != 0)
+}
+
+// Header sends a single header field
+func (s *Session) Header(name, value string) (*Response, error) {
+	if s.protocol&protoNoHeaders != 0 {
+		return &Response{}, nil
+	}
+	return s.command(cmdHeader, append(cstring(name), cstring(value)...), s.protocol&protoNoHdrReply != 0)
+}
+
+// EndOfHeaders signals that all header fields have been sent
+func (s *Session) EndOfHeaders() (*Response, error) {
+	if s.protocol&protoNoEOH != 0 {
+		return &Response{}, nil
+	}
+	return s.command(cmdEOH, nil, s.protocol&protoNoEOHRep != 0)
+}
+
+// Body sends the message body in chunks. A filter may answer skip to stop
+// receiving the rest of the body.
+func (s *Session) Body(body []byte) (*Response, error) {
+	if s.protocol&protoNoBody != 0 {
+		return &Response{}, nil
+	}
+	for len(body) > 0 {
+		n := min(len(body), maxChunk)
+		resp, err := s.command(cmdBody, body[:n], s.protocol&protoNoBodyRep != 0)
+		if err != nil || resp.Action != Continue {
+			return resp, err
+		}
+		if resp.skip {
+			break
+		}
+		body = body[n:]
+	}
+	return &Response{}, nil
+}
+
+// EndOfMessage signals the end of the message, returning the verdict and any
+// header changes the filter asked for
+func (s *Session) EndOfMessage() (*Response, []Modification, error) {
+	if err := s.write(cmdBodyEOB, nil); err != nil {
+		return nil, nil, err
+	}
+	mods := []Modification{}
+	for {
+		code, data, err := s.read()
+		if err != nil {
+			return nil, nil, err
+		}
+		switch code {
+		case respAddHeader:
+			f := splitCStrings(data)
+			if len(f) < 2 {
+				return nil, nil, errors.New("milter: malformed add header")
+			}
+			mods = append(mods, Modification{Type: AddHeader, Name: f[0], Value: f[1]})
+		case respInsHeader, respChgHeader:
+			if len(data) < 4 {
+				return nil, nil, errors.New("milter: malformed header change")
+			}
+			f := splitCStrings(data[4:])
+			if len(f) < 2 {
+				return nil, nil, errors.New("milter: malformed header change")
+			}
+			m := Modification{Type: ChangeHeader, Index: int(binary.BigEndian.Uint32(data)), Name: f[0], Value: f[1]}
+			if code == respInsHeader {
+				m.Type = InsertHeader
+			}
+			mods = append(mods, m)
+		case respProgress, respQuarantine:
+		default:
+			resp, err := parseResponse(code, data)
+			return resp, mods, err
+		}
+	}
+}
+
+// Abort ends the current message; the session can be used for another
+func (s *Session) Abort() error {
+	return s.write(cmdAbort, nil)
+}
+
+// Close says goodbye to the filter and closes the connection
+func (s *Session) Close() error {
+	s.write(cmdQuit, nil)
+	return s.conn.Close()
+}
+
+// command sends a command and reads the response unless the filter negotiated no reply
+func (s *Session) command(code byte, data []byte, noReply bool) (*Response, error) {
+	if err := s.write(code, data); err != nil {
+		return nil, err
+	}
+	if noReply {
+		return &Response{}, nil
+	}
+	for {
+		code, data, err := s.read()
+		if err != nil {
+			return nil, err
+		}
+		if code == respProgress {
+			continue
+		}
+		return parseResponse(code, data)
+	}
+}
+
+func parseResponse(code byte, data []byte) (*Response, error) {
+	switch code {
+	case respContinue:
+		return &Response{Action: Continue}, nil
+	case respSkip:
+		return &Response{Action: Continue, skip: true}, nil
+	case respAccept:
+		return &Response{Action: Accept}, nil
+	case respReject:
+		return &Response{Action: Reject}, nil
+	case respTempFail:
+		return &Response{Action: TempFail}, nil
+	case respDiscard:
+		return &Response{Action: Discard}, nil
+	case respReplyCode:
+		reply := strings.TrimRight(string(data), "\x00")
+		if len(reply) < 3 {
+			return nil, fmt.Errorf("milter: malformed reply %q", reply)
+		}
+		smtpCode, err := strconv.Atoi(reply[:3])
+		if err != nil || (reply[0] != '4' && reply[0] != '5') {
+			return nil, fmt.Errorf("milter: malformed reply %q", reply)
+		}
+		resp := &Response{Action: Reject, Code: smtpCode, Text: strings.TrimSpace(reply[3:])}
+		if reply[0] == '4' {
+			resp.Action = TempFail
+		}
+		if enh, text, ok := strings.Cut(resp.Text, " "); ok && strings.Count(enh, ".") == 2 && enh[0] == reply[0] {
+			resp.EnhancedCode = enh
+			resp.Text = text
+		}
+		return resp, nil
+	default:
+		return nil, fmt.Errorf("milter: unexpected response %q", code)
+	}
+}
+
+func (s *Session) write(code byte, data []byte) error {
+	s.conn.SetWriteDeadline(time.Now().Add(s.timeout))
+	pkt := make([]byte, 5, 5+len(data))
+	binary.BigEndian.PutUint32(pkt, uint32(len(data)+1))
+	pkt[4] = code
+	_, err := s.conn.Write(append(pkt, data...))
+	return err
+}
+
+func (s *Session) read() (byte, []byte, error) {
+	s.conn.SetReadDeadline(time.Now().Add(s.timeout))
+	size := make([]byte, 4)
+	if _, err := io.ReadFull(s.conn, size); err != nil {
+		return 0, nil, err
+	}
+	n := binary.BigEndian.Uint32(size)
+	if n == 0 || n > 1<<20 {
+		return 0, nil, fmt.Errorf("milter: invalid packet length %d", n)
+	}
+	pkt := make([]byte, n)
+	if _, err := io.ReadFull(s.conn, pkt); err != nil {
+		return 0, nil, err
+	}
+	return pkt[0], pkt[1:], nil
+}
+
+func cstring(s string) []byte {
+	return append([]byte(s), 0)
+}
+
+func splitCStrings(data []byte) []string {
+	return strings.Split(string(bytes.TrimSuffix(data, []byte{0})), "\x00")
+}
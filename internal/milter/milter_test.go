@@ -0,0 +1,125 @@
+package milter
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// fakeFilter negotiates and answers commands: it rejects recipients starting
+// with "blocked", and at end of message adds a header and deletes Subject
+func fakeFilter(t *testing.T, l net.Listener, protocol uint32) {
+	conn, err := l.Accept()
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+	write := func(code byte, data []byte) {
+		pkt := make([]byte, 5)
+		binary.BigEndian.PutUint32(pkt, uint32(len(data)+1))
+		pkt[4] = code
+		conn.Write(append(pkt, data...))
+	}
+	for {
+		size := make([]byte, 4)
+		if _, err := io.ReadFull(conn, size); err != nil {
+			return
+		}
+		pkt := make([]byte, binary.BigEndian.Uint32(size))
+		io.ReadFull(conn, pkt)
+		switch pkt[0] {
+		case cmdOptNeg:
+			neg := make([]byte, 12)
+			binary.BigEndian.PutUint32(neg, protocolVersion)
+			binary.BigEndian.PutUint32(neg[4:], actAddHeaders|actChangeHeaders)
+			binary.BigEndian.PutUint32(neg[8:], protocol)
+			write(cmdOptNeg, neg)
+		case cmdRcpt:
+			if strings.HasPrefix(string(pkt[1:]), "<blocked") {
+				write(respReplyCode, cstring("550 5.7.1 recipient blocked"))
+			} else {
+				write(respContinue, nil)
+			}
+		case cmdBodyEOB:
+			write(respAddHeader, append(cstring("X-Filtered"), cstring("yes")...))
+			write(respChgHeader, append([]byte{0, 0, 0, 1}, append(cstring("Subject"), cstring("")...)...))
+			write(respAccept, nil)
+		case cmdHeader:
+			if protocol&protoNoHdrReply == 0 {
+				write(respContinue, nil)
+			}
+		case cmdAbort:
+		case cmdQuit:
+			return
+		default:
+			write(respContinue, nil)
+		}
+	}
+}
+
+func TestSession(t *testing.T) {
+	sock := filepath.Join(t.TempDir(), "milter.sock")
+	l, err := net.Listen("unix", sock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go fakeFilter(t, l, protoNoHdrReply)
+
+	s, err := NewClient("unix:" + sock).Session()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	for _, step := range []func() (*Response, error){
+		func() (*Response, error) {
+			return s.Connect("client.example.org", &net.TCPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 25})
+		},
+		func() (*Response, error) { return s.Helo("client.example.org") },
+		func() (*Response, error) { return s.Mail("sender@example.org") },
+		func() (*Response, error) { return s.Rcpt("recipient@sif.io") },
+	} {
+		if resp, err := step(); err != nil || resp.Action != Continue {
+			t.Fatalf("unexpected response %+v %v", resp, err)
+		}
+	}
+
+	resp, err := s.Rcpt("blocked@sif.io")
+	if err != nil || resp.Action != Reject || resp.Code != 550 || resp.EnhancedCode != "5.7.1" || resp.Text != "recipient blocked" {
+		t.Errorf("unexpected rcpt response %+v %v", resp, err)
+	}
+
+	msg := []byte("Subject: hi\r\nFrom: sender@example.org\r\n\r\nbody\r\n")
+	fields, body := SplitMessage(msg)
+	for _, f := range fields {
+		if _, err := s.Header(f.Name, f.Value); err != nil {
+			t.Fatal(err)
+		}
+	}
+	s.EndOfHeaders()
+	s.Body(body)
+	resp, mods, err := s.EndOfMessage()
+	if err != nil || resp.Action != Accept || len(mods) != 2 {
+		t.Fatalf("unexpected end of message %+v %+v %v", resp, mods, err)
+	}
+	if got := string(Apply(msg, mods)); got != "From: sender@example.org\r\nX-Filtered: yes\r\n\r\nbody\r\n" {
+		t.Errorf("unexpected modified message %q", got)
+	}
+}
+
+func TestApply(t *testing.T) {
+	msg := []byte("Received: a\n\tfolded\nSubject: one\nReceived: b\n\nbody")
+	got := string(Apply(msg, []Modification{
+		{Type: InsertHeader, Index: 0, Name: "X-First", Value: "1"},
+		{Type: ChangeHeader, Index: 2, Name: "received", Value: "changed"},
+		{Type: ChangeHeader, Index: 1, Name: "X-Missing", Value: "added"},
+	}))
+	want := "X-First: 1\nReceived: a\n\tfolded\nSubject: one\nreceived: changed\nX-Missing: added\n\nbody"
+	if got != want {
+		t.Errorf("got %q want %q", got, want)
+	}
+}
@@ -0,0 +1,549 @@
+// POP3 server for mail clients, RFC 1939, with the CAPA (RFC 2449), STLS
+// (RFC 2595) and AUTH PLAIN (RFC 5034) extensions
+package pop3
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/buckelij/sif.io/internal/smtp"
+	"github.com/google/uuid"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	sessionsTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "sifio_pop3_sessions_total",
+		Help: "POP3 sessions started.",
+	})
+	loginsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "sifio_pop3_logins_total",
+		Help: "POP3 login attempts, by result.",
+	}, []string{"result"})
+)
+
+// maxLineLength bounds command lines; RFC 2449 allows 255 octets
+const maxLineLength = 512
+
+// A Store is the mail storage sessions read from, e.g. an *smtp.Backend
+type Store interface {
+	Authenticate(user, password string) bool
+	MailboxMessages(mailbox string) ([]smtp.IndexEntry, error)
+	ReadMessage(key string) ([]byte, error)
+	DeleteMessages(mailbox string, entries []smtp.IndexEntry) error
+}
+
+var _ Store = &smtp.Backend{}
+
+// A Server serves POP3 on the listeners passed to Serve. Connections that are
+// already TLS, e.g. from a tls.NewListener on port 995, are implicit TLS.
+type Server struct {
+	Store     Store
+	TLSConfig *tls.Config   // for STLS; logins are refused before TLS unless this is nil
+	Timeout   time.Duration // idle timeout, RFC 1939 asks for at least 10 minutes
+
+	mu        sync.Mutex
+	listeners map[net.Listener]struct{}
+	conns     map[net.Conn]struct{}
+	locked    map[string]bool // mailboxes in a session, RFC 1939 asks for exclusive access
+	sessions  sync.WaitGroup
+	closing   bool
+}
+
+var ErrServerClosed = errors.New("pop3: server closed")
+
+// NewServer returns a server for store
+func NewServer(store Store, tlsConfig *tls.Config) *Server {
+	return &Server{Store: store, TLSConfig: tlsConfig, Timeout: 10 * time.Minute}
+}
+
+// Serve accepts connections on ln until Shutdown, returning ErrServerClosed
+func (s *Server) Serve(ln net.Listener) error {
+	s.mu.Lock()
+	if s.closing {
+		s.mu.Unlock()
+		return ErrServerClosed
+	}
+	if s.listeners == nil {
+		s.listeners = map[net.Listener]struct{}{}
+	}
+	s.listeners[ln] = struct{}{}
+	s.mu.Unlock()
+
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			s.mu.Lock()
+			closing := s.closing
+			s.mu.Unlock()
+			if closing {
+				return ErrServerClosed
+			}
+			var ne net.Error
+			if errors.As(err, &ne) && ne.Timeout() {
+				continue
+			}
+			return err
+		}
+		if !s.track(conn) {
+			conn.Close()
+			return ErrServerClosed
+		}
+		go func() {
+			defer s.sessions.Done()
+			defer s.untrack(conn)
+			s.serveConn(conn)
+		}()
+	}
+}
+
+func (s *Server) track(conn net.Conn) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closing {
+		return false
+	}
+	if s.conns == nil {
+		s.conns = map[net.Conn]struct{}{}
+	}
+	s.conns[conn] = struct{}{}
+	s.sessions.Add(1)
+	return true
+}
+
+func (s *Server) untrack(conn net.Conn) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.conns, conn)
+}
+
+// Shutdown stops accepting connections and waits for sessions to finish, or
+// closes them when ctx is done
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.mu.Lock()
+	s.closing = true
+	for ln := range s.listeners {
+		ln.Close()
+	}
+	s.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		s.sessions.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		s.mu.Lock()
+		for conn := range s.conns {
+			conn.Close()
+		}
+		s.mu.Unlock()
+		return ctx.Err()
+	}
+}
+
+// lock claims exclusive access to mailbox for a session
+func (s *Server) lock(mailbox string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.locked == nil {
+		s.locked = map[string]bool{}
+	}
+	if s.locked[mailbox] {
+		return false
+	}
+	s.locked[mailbox] = true
+	return true
+}
+
+func (s *Server) unlock(mailbox string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.locked, mailbox)
+}
+
+// a session is one client connection
+type session struct {
+	server *Server
+	conn   net.Conn
+	text   *textproto.Conn
+	log    *slog.Logger
+	tls    bool
+
+	user     string // from USER
+	mailbox  string // once authenticated
+	messages []smtp.IndexEntry
+	deleted  map[int]bool
+}
+
+func (s *Server) serveConn(conn net.Conn) {
+	sessionsTotal.Inc()
+	ss := &session{server: s, conn: conn, text: textproto.NewConn(conn)}
+	ss.log = slog.With("session", uuid.NewString(), "remote", remoteIP(conn.RemoteAddr()), "proto", "pop3")
+	defer conn.Close()
+	if tc, ok := conn.(*tls.Conn); ok {
+		if err := tc.Handshake(); err != nil {
+			ss.log.Debug("handshake failed", "err", err)
+			return
+		}
+		ss.tls = true
+	}
+	defer func() {
+		if ss.mailbox != "" {
+			s.unlock(ss.mailbox)
+		}
+	}()
+	ss.log.Debug("session started", "tls", ss.tls)
+
+	ss.reply("+OK POP3 server ready")
+	for {
+		if s.Timeout > 0 {
+			conn.SetDeadline(time.Now().Add(s.Timeout))
+		}
+		line, err := ss.readLine()
+		if err != nil {
+			ss.log.Debug("session ended", "err", err)
+			return
+		}
+		cmd, arg, _ := strings.Cut(line, " ")
+		if quit := ss.handle(strings.ToUpper(cmd), arg); quit {
+			return
+		}
+	}
+}
+
+// readLine reads a command line, refusing overlong lines
+func (ss *session) readLine() (string, error) {
+	line, err := ss.text.ReadLine()
+	if err != nil {
+		return "", err
+	}
+	if len(line) > maxLineLength {
+		return "", errors.New("line too long")
+	}
+	return line, nil
+}
+
+func (ss *session) reply(format string, args ...any) {
+	ss.text.PrintfLine(format, args...)
+}
+
+// loginAllowed reports whether credentials may be sent on this connection
+func (ss *session) loginAllowed() bool {
+	return ss.tls || ss.server.TLSConfig == nil
+}
+
+// handle runs a command, reporting whether the session is over
+func (ss *session) handle(cmd, arg string) (quit bool) {
+	switch cmd {
+	case "CAPA":
+		ss.capa()
+		return false
+	case "NOOP":
+		ss.reply("+OK")
+		return false
+	case "QUIT":
+		ss.quit()
+		return true
+	}
+	if ss.mailbox == "" {
+		ss.handleAuthorization(cmd, arg)
+	} else {
+		ss.handleTransaction(cmd, arg)
+	}
+	return false
+}
+
+func (ss *session) capa() {
+	caps := []string{"TOP", "UIDL", "RESP-CODES", "AUTH-RESP-CODE", "EXPIRE NEVER", "IMPLEMENTATION sifio"}
+	if ss.mailbox == "" {
+		if ss.loginAllowed() {
+			caps = append(caps, "USER", "SASL PLAIN")
+		}
+		if !ss.tls && ss.server.TLSConfig != nil {
+			caps = append(caps, "STLS")
+		}
+	}
+	w := ss.text.DotWriter()
+	fmt.Fprint(w, "+OK Capability list follows\n")
+	for _, c := range caps {
+		fmt.Fprintln(w, c)
+	}
+	w.Close()
+}
+
+func (ss *session) handleAuthorization(cmd, arg string) {
+	switch cmd {
+	case "STLS":
+		if ss.tls || ss.server.TLSConfig == nil {
+			ss.reply("-ERR STLS not available")
+			return
+		}
+		ss.reply("+OK Begin TLS negotiation")
+		tc := tls.Server(ss.conn, ss.server.TLSConfig)
+		if err := tc.Handshake(); err != nil {
+			ss.log.Debug("handshake failed", "err", err)
+			ss.conn.Close()
+			return
+		}
+		ss.conn, ss.text, ss.tls = tc, textproto.NewConn(tc), true
+		ss.user = ""
+	case "USER":
+		if !ss.loginAllowed() {
+			ss.reply("-ERR [AUTH] Use STLS first")
+			return
+		}
+		ss.user = arg
+		ss.reply("+OK")
+	case "PASS":
+		if ss.user == "" {
+			ss.reply("-ERR USER first")
+			return
+		}
+		user := ss.user
+		ss.user = ""
+		ss.login(user, arg)
+	case "AUTH":
+		ss.auth(arg)
+	default:
+		ss.reply("-ERR Unknown command")
+	}
+}
+
+// auth handles SASL PLAIN, with or without an initial response
+func (ss *session) auth(arg string) {
+	mech, initial, _ := strings.Cut(arg, " ")
+	if !strings.EqualFold(mech, "PLAIN") {
+		ss.reply("-ERR Unsupported mechanism")
+		return
+	}
+	if !ss.loginAllowed() {
+		ss.reply("-ERR [AUTH] Use STLS first")
+		return
+	}
+	if initial == "" {
+		ss.reply("+ ")
+		line, err := ss.readLine()
+		if err != nil {
+			return
+		}
+		initial = line
+	}
+	if initial == "*" {
+		ss.reply("-ERR Authentication cancelled")
+		return
+	}
+	b, err := base64.StdEncoding.DecodeString(initial)
+	if err != nil {
+		ss.reply("-ERR Invalid response")
+		return
+	}
+	// authzid NUL authcid NUL password
+	parts := bytes.Split(b, []byte{0})
+	if len(parts) != 3 || (len(parts[0]) > 0 && !bytes.Equal(parts[0], parts[1])) {
+		ss.reply("-ERR Invalid response")
+		return
+	}
+	ss.login(string(parts[1]), string(parts[2]))
+}
+
+func (ss *session) login(user, password string) {
+	if user == "" || !ss.server.Store.Authenticate(user, password) {
+		loginsTotal.WithLabelValues("failure").Inc()
+		ss.log.Warn("login failed", "user", user)
+		ss.reply("-ERR [AUTH] Invalid credentials")
+		return
+	}
+	if !ss.server.lock(user) {
+		ss.reply("-ERR [IN-USE] Mailbox in use")
+		return
+	}
+	messages, err := ss.server.Store.MailboxMessages(user)
+	if err != nil {
+		ss.server.unlock(user)
+		ss.log.Error("failed to load mailbox", "user", user, "err", err)
+		ss.reply("-ERR [SYS/TEMP] Mailbox unavailable")
+		return
+	}
+	loginsTotal.WithLabelValues("success").Inc()
+	ss.log = ss.log.With("user", user)
+	ss.log.Info("login", "messages", len(messages))
+	ss.mailbox, ss.messages, ss.deleted = user, messages, map[int]bool{}
+	ss.reply("+OK %d messages", len(messages))
+}
+
+func (ss *session) handleTransaction(cmd, arg string) {
+	switch cmd {
+	case "STAT":
+		n, size := 0, int64(0)
+		for i, m := range ss.messages {
+			if !ss.deleted[i] {
+				n++
+				size += m.Size
+			}
+		}
+		ss.reply("+OK %d %d", n, size)
+	case "LIST", "UIDL":
+		if arg != "" {
+			i, ok := ss.message(arg)
+			if !ok {
+				return
+			}
+			ss.reply("+OK %d %s", i+1, ss.listing(cmd, i))
+			return
+		}
+		w := ss.text.DotWriter()
+		fmt.Fprint(w, "+OK\n")
+		for i := range ss.messages {
+			if !ss.deleted[i] {
+				fmt.Fprintf(w, "%d %s\n", i+1, ss.listing(cmd, i))
+			}
+		}
+		w.Close()
+	case "RETR":
+		i, ok := ss.message(arg)
+		if !ok {
+			return
+		}
+		ss.send(i, -1)
+	case "TOP":
+		n, lines, _ := strings.Cut(arg, " ")
+		l, err := strconv.Atoi(lines)
+		if err != nil || l < 0 {
+			ss.reply("-ERR Invalid line count")
+			return
+		}
+		i, ok := ss.message(n)
+		if !ok {
+			return
+		}
+		ss.send(i, l)
+	case "DELE":
+		i, ok := ss.message(arg)
+		if !ok {
+			return
+		}
+		ss.deleted[i] = true
+		ss.reply("+OK Message %d deleted", i+1)
+	case "RSET":
+		ss.deleted = map[int]bool{}
+		ss.reply("+OK")
+	default:
+		ss.reply("-ERR Unknown command")
+	}
+}
+
+func (ss *session) listing(cmd string, i int) string {
+	if cmd == "UIDL" {
+		return ss.messages[i].UID()
+	}
+	return strconv.FormatInt(ss.messages[i].Size, 10)
+}
+
+// message returns the index of message number arg, replying with an error
+// if there isn't one
+func (ss *session) message(arg string) (int, bool) {
+	n, err := strconv.Atoi(arg)
+	if err != nil || n < 1 || n > len(ss.messages) {
+		ss.reply("-ERR No such message")
+		return 0, false
+	}
+	if ss.deleted[n-1] {
+		ss.reply("-ERR Message %d already deleted", n)
+		return 0, false
+	}
+	return n - 1, true
+}
+
+// send writes message i, or only its header and the first lines of its body
+// if lines isn't negative
+func (ss *session) send(i, lines int) {
+	data, err := ss.server.Store.ReadMessage(ss.messages[i].Key)
+	if err != nil {
+		ss.log.Error("failed to read message", "key", ss.messages[i].Key, "err", err)
+		ss.reply("-ERR [SYS/TEMP] Message unavailable")
+		return
+	}
+	if lines >= 0 {
+		data = top(data, lines)
+	}
+	w := ss.text.DotWriter()
+	fmt.Fprint(w, "+OK\n")
+	w.Write(data)
+	w.Close()
+}
+
+// top returns the header and the first n lines of the body of data
+func top(data []byte, n int) []byte {
+	r := bufio.NewReader(bytes.NewReader(data))
+	out := bytes.Buffer{}
+	inBody := false
+	for {
+		line, err := r.ReadBytes('\n')
+		if inBody {
+			if n == 0 {
+				break
+			}
+			n--
+		}
+		out.Write(line)
+		if !inBody && len(bytes.TrimRight(line, "\r\n")) == 0 {
+			inBody = true
+		}
+		if err != nil {
+			break
+		}
+	}
+	return out.Bytes()
+}
+
+// quit ends the session, deleting the messages marked for deletion if the
+// client logged in
+func (ss *session) quit() {
+	if ss.mailbox == "" {
+		ss.reply("+OK Bye")
+		return
+	}
+	entries := []smtp.IndexEntry{}
+	for i := range ss.deleted {
+		entries = append(entries, ss.messages[i])
+	}
+	if len(entries) > 0 {
+		if err := ss.server.Store.DeleteMessages(ss.mailbox, entries); err != nil {
+			ss.log.Error("failed to delete messages", "err", err)
+			ss.reply("-ERR [SYS/TEMP] Some deleted messages not removed")
+			return
+		}
+		ss.log.Info("deleted messages", "count", len(entries))
+	}
+	ss.server.unlock(ss.mailbox)
+	ss.mailbox = ""
+	ss.reply("+OK Bye")
+}
+
+// remoteIP is the client's IP, without the port
+func remoteIP(addr net.Addr) string {
+	if tcp, ok := addr.(*net.TCPAddr); ok {
+		return tcp.IP.String()
+	}
+	if addr == nil {
+		return ""
+	}
+	return addr.String()
+}
@@ -0,0 +1,246 @@
+package pop3
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"math/big"
+	"net"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/buckelij/sif.io/internal/smtp"
+)
+
+type testStore struct {
+	mu       sync.Mutex
+	messages []smtp.IndexEntry
+	data     map[string][]byte
+	deleted  []smtp.IndexEntry
+}
+
+func (s *testStore) Authenticate(user, password string) bool {
+	return user == "me" && password == "passw0rd"
+}
+
+func (s *testStore) MailboxMessages(mailbox string) ([]smtp.IndexEntry, error) {
+	return s.messages, nil
+}
+
+func (s *testStore) ReadMessage(key string) ([]byte, error) {
+	if d, ok := s.data[key]; ok {
+		return d, nil
+	}
+	return nil, errors.New("not found")
+}
+
+func (s *testStore) DeleteMessages(mailbox string, entries []smtp.IndexEntry) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.deleted = append(s.deleted, entries...)
+	return nil
+}
+
+func newTestStore() *testStore {
+	first := "Subject: one\r\n\r\nline 1\r\n.dotted\r\nline 3\r\n"
+	second := "Subject: two\n\nunix line endings\n"
+	return &testStore{
+		messages: []smtp.IndexEntry{
+			{Key: "mail/sif.io/1", Size: int64(len(first)), Received: time.Unix(1, 0)},
+			{Key: "mail/sif.io/2", Size: int64(len(second)), Received: time.Unix(2, 0)},
+		},
+		data: map[string][]byte{"mail/sif.io/1": []byte(first), "mail/sif.io/2": []byte(second)},
+	}
+}
+
+// client is a test POP3 client
+type client struct {
+	t    *testing.T
+	conn net.Conn
+	text *textproto.Conn
+}
+
+func dial(t *testing.T, s *Server) *client {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.Serve(ln)
+	t.Cleanup(func() { s.Shutdown(t.Context()) })
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := &client{t: t, conn: conn, text: textproto.NewConn(conn)}
+	c.expect("+OK")
+	return c
+}
+
+func (c *client) cmd(line string) string {
+	c.t.Helper()
+	c.text.PrintfLine("%s", line)
+	reply, err := c.text.ReadLine()
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	return reply
+}
+
+func (c *client) expect(prefix string) string {
+	c.t.Helper()
+	reply, err := c.text.ReadLine()
+	if err != nil || !strings.HasPrefix(reply, prefix) {
+		c.t.Fatalf("expected %q, got %q %v", prefix, reply, err)
+	}
+	return reply
+}
+
+func (c *client) multiline(line string) []string {
+	c.t.Helper()
+	if reply := c.cmd(line); !strings.HasPrefix(reply, "+OK") {
+		c.t.Fatalf("%s: %s", line, reply)
+	}
+	lines, err := c.text.ReadDotLines()
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	return lines
+}
+
+func TestSession(t *testing.T) {
+	store := newTestStore()
+	c := dial(t, NewServer(store, nil))
+
+	if caps := strings.Join(c.multiline("CAPA"), ","); !strings.Contains(caps, "USER") || strings.Contains(caps, "STLS") {
+		t.Errorf("unexpected capabilities %s", caps)
+	}
+	c.cmd("USER me")
+	if reply := c.cmd("PASS wrong"); !strings.HasPrefix(reply, "-ERR [AUTH]") {
+		t.Errorf("bad password accepted: %s", reply)
+	}
+	c.cmd("USER me")
+	if reply := c.cmd("PASS passw0rd"); reply != "+OK 2 messages" {
+		t.Fatalf("login: %s", reply)
+	}
+	first, second := store.messages[0], store.messages[1]
+	if reply := c.cmd("STAT"); reply != "+OK 2 "+itoa(first.Size+second.Size) {
+		t.Errorf("STAT: %s", reply)
+	}
+	if list := c.multiline("LIST"); len(list) != 2 || list[0] != "1 "+itoa(first.Size) {
+		t.Errorf("LIST: %v", list)
+	}
+	if uidl := c.multiline("UIDL"); len(uidl) != 2 || uidl[1] != "2 "+second.UID() {
+		t.Errorf("UIDL: %v", uidl)
+	}
+	if reply := c.cmd("UIDL 1"); reply != "+OK 1 "+first.UID() {
+		t.Errorf("UIDL 1: %s", reply)
+	}
+	if msg := c.multiline("RETR 1"); strings.Join(msg, "|") != "Subject: one||line 1|.dotted|line 3" {
+		t.Errorf("RETR: %q", msg)
+	}
+	if top := c.multiline("TOP 1 1"); strings.Join(top, "|") != "Subject: one||line 1" {
+		t.Errorf("TOP: %q", top)
+	}
+	if top := c.multiline("TOP 2 0"); strings.Join(top, "|") != "Subject: two|" {
+		t.Errorf("TOP: %q", top)
+	}
+	if reply := c.cmd("RETR 3"); !strings.HasPrefix(reply, "-ERR") {
+		t.Errorf("RETR 3: %s", reply)
+	}
+
+	c.cmd("DELE 1")
+	if reply := c.cmd("RETR 1"); !strings.HasPrefix(reply, "-ERR") {
+		t.Errorf("deleted message retrieved: %s", reply)
+	}
+	if reply := c.cmd("STAT"); reply != "+OK 1 "+itoa(second.Size) {
+		t.Errorf("STAT after DELE: %s", reply)
+	}
+	c.cmd("RSET")
+	c.cmd("DELE 2")
+	if reply := c.cmd("QUIT"); reply != "+OK Bye" {
+		t.Errorf("QUIT: %s", reply)
+	}
+	if len(store.deleted) != 1 || store.deleted[0].Key != second.Key {
+		t.Errorf("expected only message 2 deleted, got %v", store.deleted)
+	}
+}
+
+func TestAuthPlainAndLocking(t *testing.T) {
+	s := NewServer(newTestStore(), nil)
+	c := dial(t, s)
+	c.cmd("AUTH PLAIN")
+	if reply := c.cmd(base64.StdEncoding.EncodeToString([]byte("\x00me\x00passw0rd"))); !strings.HasPrefix(reply, "+OK") {
+		t.Fatalf("AUTH PLAIN: %s", reply)
+	}
+
+	conn, _ := net.Dial("tcp", c.conn.RemoteAddr().String())
+	other := &client{t: t, conn: conn, text: textproto.NewConn(conn)}
+	other.expect("+OK")
+	if reply := other.cmd("AUTH PLAIN " + base64.StdEncoding.EncodeToString([]byte("me\x00me\x00passw0rd"))); !strings.HasPrefix(reply, "-ERR [IN-USE]") {
+		t.Errorf("expected the mailbox locked, got %s", reply)
+	}
+	c.cmd("QUIT")
+	if reply := other.cmd("AUTH PLAIN " + base64.StdEncoding.EncodeToString([]byte("\x00me\x00passw0rd"))); !strings.HasPrefix(reply, "+OK") {
+		t.Errorf("expected the lock released, got %s", reply)
+	}
+}
+
+func TestSTLS(t *testing.T) {
+	s := NewServer(newTestStore(), &tls.Config{Certificates: []tls.Certificate{testCertificate(t)}})
+	c := dial(t, s)
+	if caps := strings.Join(c.multiline("CAPA"), ","); !strings.Contains(caps, "STLS") || strings.Contains(caps, "USER") {
+		t.Errorf("unexpected capabilities %s", caps)
+	}
+	if reply := c.cmd("USER me"); !strings.HasPrefix(reply, "-ERR [AUTH]") {
+		t.Errorf("login allowed before TLS: %s", reply)
+	}
+	if reply := c.cmd("STLS"); !strings.HasPrefix(reply, "+OK") {
+		t.Fatalf("STLS: %s", reply)
+	}
+	tc := tls.Client(c.conn, &tls.Config{InsecureSkipVerify: true})
+	if err := tc.Handshake(); err != nil {
+		t.Fatal(err)
+	}
+	c.conn, c.text = tc, textproto.NewConn(tc)
+	if caps := strings.Join(c.multiline("CAPA"), ","); strings.Contains(caps, "STLS") || !strings.Contains(caps, "USER") {
+		t.Errorf("unexpected capabilities after STLS %s", caps)
+	}
+	c.cmd("USER me")
+	if reply := c.cmd("PASS passw0rd"); !strings.HasPrefix(reply, "+OK") {
+		t.Errorf("login after STLS: %s", reply)
+	}
+}
+
+func TestTop(t *testing.T) {
+	if got := string(top([]byte("A: b\r\n\r\n1\r\n2\r\n3"), 2)); got != "A: b\r\n\r\n1\r\n2\r\n" {
+		t.Errorf("got %q", got)
+	}
+	if got := string(top([]byte("A: b\r\n"), 2)); got != "A: b\r\n" {
+		t.Errorf("got %q", got)
+	}
+}
+
+func itoa(n int64) string {
+	return strconv.FormatInt(n, 10)
+}
+
+func testCertificate(t *testing.T) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{SerialNumber: big.NewInt(1), DNSNames: []string{"localhost"}, NotBefore: time.Now(), NotAfter: time.Now().Add(time.Hour)}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
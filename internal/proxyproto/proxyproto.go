@@ -0,0 +1,223 @@
+// HAProxy PROXY protocol v1 and v2 listener
+// see https://www.haproxy.org/download/2.9/doc/proxy-protocol.txt
+package proxyproto
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var v2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// v1 headers are at most 107 bytes including the CRLF
+const v1MaxLength = 107
+
+var ErrInvalidHeader = errors.New("proxyproto: invalid header")
+
+// A Listener reads a PROXY header from connections from Trusted sources and
+// reports the client address it carries as the connection's RemoteAddr.
+// Connections from other sources are passed through untouched.
+type Listener struct {
+	net.Listener
+	Trusted []*net.IPNet
+	Timeout time.Duration
+}
+
+// NewListener wraps l, trusting PROXY headers from the given sources
+func NewListener(l net.Listener, trusted []*net.IPNet) *Listener {
+	return &Listener{Listener: l, Trusted: trusted, Timeout: 10 * time.Second}
+}
+
+// ParseCIDRs parses a comma separated list of CIDRs; bare IPs are single hosts
+func ParseCIDRs(s string) ([]*net.IPNet, error) {
+	nets := []*net.IPNet{}
+	for _, c := range strings.Split(s, ",") {
+		c = strings.TrimSpace(c)
+		if c == "" {
+			continue
+		}
+		if !strings.Contains(c, "/") {
+			ip := net.ParseIP(c)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid address %q", c)
+			}
+			bits := 8 * len(ip)
+			if ip4 := ip.To4(); ip4 != nil {
+				ip, bits = ip4, 32
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, n, err := net.ParseCIDR(c)
+		if err != nil {
+			return nil, err
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+func (l *Listener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	if !l.trusted(c.RemoteAddr()) {
+		return c, nil
+	}
+	return &Conn{Conn: c, r: bufio.NewReader(c), timeout: l.Timeout}, nil
+}
+
+func (l *Listener) trusted(addr net.Addr) bool {
+	tcp, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return false
+	}
+	for _, n := range l.Trusted {
+		if n.Contains(tcp.IP) {
+			return true
+		}
+	}
+	return false
+}
+
+// A Conn is a connection from a trusted proxy. The header is read, within
+// the listener's Timeout, on the first Read, RemoteAddr or LocalAddr, not in
+// Accept. A server only avoids being held up by a slow client if it makes
+// those calls off its accept loop, as net/http and go-smtp do.
+type Conn struct {
+	net.Conn
+	r       *bufio.Reader
+	timeout time.Duration
+	once    sync.Once
+	remote  net.Addr
+	local   net.Addr
+	err     error
+}
+
+func (c *Conn) Read(b []byte) (int, error) {
+	c.once.Do(c.readHeader)
+	if c.err != nil {
+		return 0, c.err
+	}
+	return c.r.Read(b)
+}
+
+// RemoteAddr is the client address from the header, or the proxy's address
+// for LOCAL and UNKNOWN connections
+func (c *Conn) RemoteAddr() net.Addr {
+	c.once.Do(c.readHeader)
+	if c.remote != nil {
+		return c.remote
+	}
+	return c.Conn.RemoteAddr()
+}
+
+func (c *Conn) LocalAddr() net.Addr {
+	c.once.Do(c.readHeader)
+	if c.local != nil {
+		return c.local
+	}
+	return c.Conn.LocalAddr()
+}
+
+func (c *Conn) readHeader() {
+	if c.timeout > 0 {
+		c.Conn.SetReadDeadline(time.Now().Add(c.timeout))
+		defer c.Conn.SetReadDeadline(time.Time{})
+	}
+	sig, err := c.r.Peek(len(v2Signature))
+	if err != nil && len(sig) < 6 {
+		c.err = err
+		return
+	}
+	switch {
+	case bytes.Equal(sig, v2Signature):
+		c.remote, c.local, c.err = readV2(c.r)
+	case bytes.HasPrefix(sig, []byte("PROXY ")):
+		c.remote, c.local, c.err = readV1(c.r)
+	default:
+		c.err = ErrInvalidHeader
+	}
+	if c.err != nil {
+		c.Conn.Close()
+	}
+}
+
+// readV1 reads e.g. `PROXY TCP4 192.0.2.1 198.51.100.1 56324 25\r\n`
+func readV1(r *bufio.Reader) (remote, local net.Addr, err error) {
+	line := []byte{}
+	for !bytes.HasSuffix(line, []byte("\r\n")) {
+		if len(line) >= v1MaxLength {
+			return nil, nil, ErrInvalidHeader
+		}
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, nil, err
+		}
+		line = append(line, b)
+	}
+	fields := strings.Split(strings.TrimSuffix(string(line), "\r\n"), " ")
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, nil, ErrInvalidHeader
+	}
+	src, dst := net.ParseIP(fields[2]), net.ParseIP(fields[3])
+	srcPort, err1 := strconv.ParseUint(fields[4], 10, 16)
+	dstPort, err2 := strconv.ParseUint(fields[5], 10, 16)
+	if src == nil || dst == nil || err1 != nil || err2 != nil {
+		return nil, nil, ErrInvalidHeader
+	}
+	return &net.TCPAddr{IP: src, Port: int(srcPort)}, &net.TCPAddr{IP: dst, Port: int(dstPort)}, nil
+}
+
+// readV2 reads the binary header: signature, version and command, family,
+// length and the addresses, followed by TLVs which are ignored
+func readV2(r *bufio.Reader) (remote, local net.Addr, err error) {
+	hdr := make([]byte, 16)
+	if _, err := io.ReadFull(r, hdr); err != nil {
+		return nil, nil, err
+	}
+	if hdr[12]>>4 != 2 {
+		return nil, nil, ErrInvalidHeader
+	}
+	body := make([]byte, binary.BigEndian.Uint16(hdr[14:16]))
+	if _, err := io.ReadFull(r, body); err != nil {
+		return nil, nil, err
+	}
+	switch hdr[12] & 0xf {
+	case 0: // LOCAL, e.g. health checks from the proxy itself
+		return nil, nil, nil
+	case 1: // PROXY
+	default:
+		return nil, nil, ErrInvalidHeader
+	}
+	var size int
+	switch hdr[13] >> 4 {
+	case 1: // AF_INET
+		size = net.IPv4len
+	case 2: // AF_INET6
+		size = net.IPv6len
+	default: // AF_UNSPEC and AF_UNIX carry no usable address
+		return nil, nil, nil
+	}
+	if len(body) < 2*size+4 {
+		return nil, nil, ErrInvalidHeader
+	}
+	src := net.IP(body[:size])
+	dst := net.IP(body[size : 2*size])
+	srcPort := binary.BigEndian.Uint16(body[2*size:])
+	dstPort := binary.BigEndian.Uint16(body[2*size+2:])
+	return &net.TCPAddr{IP: src, Port: int(srcPort)}, &net.TCPAddr{IP: dst, Port: int(dstPort)}, nil
+}
@@ -0,0 +1,137 @@
+package proxyproto
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+// accept dials l, writes header and payload, and returns the accepted conn
+func accept(t *testing.T, l net.Listener, msg []byte) net.Conn {
+	t.Helper()
+	client, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { client.Close() })
+	client.Write(msg)
+	c, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Close() })
+	return c
+}
+
+func listen(t *testing.T, trusted string) net.Listener {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	nets, err := ParseCIDRs(trusted)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return NewListener(ln, nets)
+}
+
+func expect(t *testing.T, c net.Conn, remote, payload string) {
+	t.Helper()
+	if got := c.RemoteAddr().String(); got != remote {
+		t.Errorf("RemoteAddr %v, expected %v", got, remote)
+	}
+	b := make([]byte, len(payload))
+	if _, err := io.ReadFull(c, b); err != nil || string(b) != payload {
+		t.Errorf("read %q %v, expected %q", b, err, payload)
+	}
+}
+
+func TestV1(t *testing.T) {
+	l := listen(t, "127.0.0.0/8")
+	c := accept(t, l, []byte("PROXY TCP4 192.0.2.1 198.51.100.1 56324 25\r\nEHLO x\r\n"))
+	expect(t, c, "192.0.2.1:56324", "EHLO x\r\n")
+
+	c = accept(t, l, []byte("PROXY TCP6 2001:db8::1 2001:db8::2 56324 25\r\nEHLO x\r\n"))
+	expect(t, c, "[2001:db8::1]:56324", "EHLO x\r\n")
+
+	c = accept(t, l, []byte("PROXY UNKNOWN\r\nEHLO x\r\n"))
+	if _, err := c.Read(make([]byte, 1)); err != nil {
+		t.Errorf("UNKNOWN: %v", err)
+	}
+	if host, _, _ := net.SplitHostPort(c.RemoteAddr().String()); host != "127.0.0.1" {
+		t.Errorf("UNKNOWN RemoteAddr %v", c.RemoteAddr())
+	}
+}
+
+func TestV2(t *testing.T) {
+	l := listen(t, "127.0.0.1")
+	hdr := append([]byte{}, v2Signature...)
+	hdr = append(hdr, 0x21, 0x11, 0, 12)
+	hdr = append(hdr, 192, 0, 2, 1, 198, 51, 100, 1)
+	hdr = binary.BigEndian.AppendUint16(hdr, 56324)
+	hdr = binary.BigEndian.AppendUint16(hdr, 25)
+	c := accept(t, l, append(hdr, []byte("EHLO x\r\n")...))
+	expect(t, c, "192.0.2.1:56324", "EHLO x\r\n")
+}
+
+func TestUntrusted(t *testing.T) {
+	l := listen(t, "10.0.0.0/8")
+	c := accept(t, l, []byte("PROXY TCP4 192.0.2.1 198.51.100.1 56324 25\r\n"))
+	if host, _, _ := net.SplitHostPort(c.RemoteAddr().String()); host != "127.0.0.1" {
+		t.Errorf("untrusted header honored: %v", c.RemoteAddr())
+	}
+
+	l = listen(t, "127.0.0.0/8")
+	c = accept(t, l, []byte("EHLO no header\r\n"))
+	if _, err := c.Read(make([]byte, 1)); err != ErrInvalidHeader {
+		t.Errorf("expected invalid header, got %v", err)
+	}
+}
+
+func TestHTTPServer(t *testing.T) {
+	l := listen(t, "127.0.0.0/8")
+	srv := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, r.RemoteAddr)
+	})}
+	go srv.Serve(l)
+	t.Cleanup(func() { srv.Close() })
+
+	// a client that never sends its header doesn't hold up the next
+	silent, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer silent.Close()
+
+	client, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	client.SetDeadline(time.Now().Add(time.Second))
+	client.Write([]byte("PROXY TCP4 192.0.2.1 198.51.100.1 56324 80\r\nGET / HTTP/1.0\r\n\r\n"))
+	resp, err := io.ReadAll(client)
+	if err != nil || !strings.HasSuffix(string(resp), "\r\n\r\n192.0.2.1:56324") {
+		t.Errorf("unexpected response %q %v", resp, err)
+	}
+}
+
+func TestParseCIDRs(t *testing.T) {
+	nets, err := ParseCIDRs("10.0.0.0/8, 192.0.2.1,2001:db8::/32")
+	if err != nil || len(nets) != 3 {
+		t.Fatalf("%v %v", nets, err)
+	}
+	if !nets[1].Contains(net.ParseIP("192.0.2.1")) || nets[1].Contains(net.ParseIP("192.0.2.2")) {
+		t.Errorf("bare IP parsed as %v", nets[1])
+	}
+	if _, err := ParseCIDRs("nope"); err == nil {
+		t.Error("expected error")
+	}
+}
@@ -0,0 +1,58 @@
+package smtp
+
+import (
+	"errors"
+	"strings"
+	"unicode/utf8"
+
+	smtp "github.com/emersion/go-smtp"
+	"golang.org/x/net/idna"
+	"golang.org/x/text/unicode/norm"
+)
+
+// ErrNonASCIIAddress is returned for internationalized addresses when the
+// client did not request SMTPUTF8
+var ErrNonASCIIAddress = &smtp.SMTPError{
+	Code:         553,
+	EnhancedCode: smtp.EnhancedCode{5, 6, 7},
+	Message:      "Non-ASCII addresses require SMTPUTF8",
+}
+
+// NormalizeAddress returns addr in the form used for recipient resolution and
+// storage keys: the local part in Unicode NFC and the domain lowercased in its
+// ASCII (punycode) form. Local parts keep their case.
+func NormalizeAddress(addr string) (string, error) {
+	local, domain, ok := cutAddress(addr)
+	if !ok {
+		return "", errors.New("invalid address " + addr)
+	}
+	domain, err := NormalizeDomain(domain)
+	if err != nil {
+		return "", err
+	}
+	return norm.NFC.String(local) + "@" + domain, nil
+}
+
+// NormalizeDomain returns the lowercased ASCII (punycode) form of domain
+func NormalizeDomain(domain string) (string, error) {
+	return idna.Lookup.ToASCII(strings.ToLower(norm.NFC.String(strings.TrimSuffix(domain, "."))))
+}
+
+// isASCII reports whether s needs no SMTPUTF8 support
+func isASCII(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] >= utf8.RuneSelf {
+			return false
+		}
+	}
+	return true
+}
+
+// cutAddress splits an address on its last `@`
+func cutAddress(addr string) (local, domain string, ok bool) {
+	i := strings.LastIndex(addr, "@")
+	if i <= 0 || i == len(addr)-1 {
+		return "", "", false
+	}
+	return addr[:i], addr[i+1:], true
+}
@@ -0,0 +1,36 @@
+package smtp
+
+import "testing"
+
+func TestNormalizeAddress(t *testing.T) {
+	for in, want := range map[string]string{
+		"recipient@sif.io":        "recipient@sif.io",
+		"Recipient@SIF.IO.":       "Recipient@sif.io",
+		"用户@例子.广告":                "用户@xn--fsqu00a.xn--4rr70v",
+		"jose\u0301@sif.io":       "jos\u00e9@sif.io",
+		"\"quoted@local\"@Sif.io": "\"quoted@local\"@sif.io",
+		"user@bücher.example":     "user@xn--bcher-kva.example",
+	} {
+		got, err := NormalizeAddress(in)
+		if err != nil {
+			t.Errorf("NormalizeAddress(%q): %v", in, err)
+		}
+		if got != want {
+			t.Errorf("NormalizeAddress(%q) = %q, want %q", in, got, want)
+		}
+	}
+
+	if _, err := NormalizeAddress("nodomain"); err == nil {
+		t.Error("expected error for address without domain")
+	}
+}
+
+func TestResolveRecipient(t *testing.T) {
+	bkd := &Backend{MxDomains: "sif.io, bücher.example"}
+	if _, d, err := bkd.resolveRecipient("user@BÜCHER.example"); err != nil || d != "xn--bcher-kva.example" {
+		t.Errorf("unexpected resolution %q %v", d, err)
+	}
+	if _, _, err := bkd.resolveRecipient("user@notsif.io"); err != ErrNoSuchMailbox {
+		t.Errorf("expected ErrNoSuchMailbox, got %v", err)
+	}
+}
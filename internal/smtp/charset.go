@@ -0,0 +1,64 @@
+package smtp
+
+import (
+	"bytes"
+	"io"
+	"mime"
+	"strings"
+	"unicode/utf8"
+
+	"golang.org/x/net/html/charset"
+)
+
+// wordDecoder decodes RFC 2047 encoded words in any charset we can read
+var wordDecoder = &mime.WordDecoder{CharsetReader: CharsetReader}
+
+// CharsetReader returns a reader converting input in the named charset to UTF-8,
+// for a mime.WordDecoder
+func CharsetReader(label string, input io.Reader) (io.Reader, error) {
+	return charset.NewReaderLabel(label, input)
+}
+
+// textToUTF8 converts the decoded content of a part to UTF-8 if it's text.
+// A byte order mark wins, then the declared charset when we know it and the
+// content is valid in it; otherwise the charset is sniffed from an ISO-2022
+// escape or HTML meta tag, falling back to UTF-8 and then Windows-1252.
+func textToUTF8(data []byte, contentType string) []byte {
+	mediaType, params, err := mime.ParseMediaType(contentType)
+	if contentType == "" {
+		// parts without a Content-Type are US-ASCII text, RFC 2045 section 5.2
+		mediaType, params, err = "text/plain", map[string]string{}, nil
+	}
+	if err != nil || !strings.HasPrefix(mediaType, "text/") {
+		return data
+	}
+	// a byte order mark is certain, whatever's declared
+	if enc, _, certain := charset.DetermineEncoding(data, "text/plain"); certain {
+		if out, err := enc.NewDecoder().Bytes(data); err == nil {
+			return out
+		}
+	}
+	if enc, name := charset.Lookup(params["charset"]); enc != nil {
+		if name == "utf-8" {
+			if utf8.Valid(data) {
+				return data
+			}
+		} else if out, err := enc.NewDecoder().Bytes(data); err == nil && !bytes.ContainsRune(out, utf8.RuneError) {
+			return out
+		}
+	}
+	if bytes.Contains(data, []byte("\x1b$B")) || bytes.Contains(data, []byte("\x1b$@")) {
+		if enc, _ := charset.Lookup("iso-2022-jp"); enc != nil {
+			if out, err := enc.NewDecoder().Bytes(data); err == nil {
+				return out
+			}
+		}
+	}
+	// DetermineEncoding would trust the declared charset we just rejected
+	enc, _, _ := charset.DetermineEncoding(data, mediaType)
+	out, err := enc.NewDecoder().Bytes(data)
+	if err != nil {
+		return []byte(strings.ToValidUTF8(string(data), "�"))
+	}
+	return out
+}
@@ -0,0 +1,116 @@
+package smtp
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/mail"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/buckelij/sif.io/internal/blob"
+)
+
+// DedupeAction is what happens to a message already delivered to a mailbox
+type DedupeAction string
+
+const (
+	DedupeDrop DedupeAction = "drop" // discard the duplicate
+	DedupeLink DedupeAction = "link" // index the earlier copy again instead of storing another
+)
+
+// errDuplicate is returned by store when the message was already delivered
+var errDuplicate = errors.New("duplicate message")
+
+// dedupeState records recent deliveries to a mailbox under `dedupe/<mailbox>`,
+// keyed by a hash of the Message-ID and body
+type dedupeState map[string]dedupeEntry
+
+type dedupeEntry struct {
+	Key  string    `json:"key"`
+	Seen time.Time `json:"seen"`
+}
+
+func dedupeKey(mailbox string) string {
+	return "dedupe/" + url.QueryEscape(mailbox)
+}
+
+// fingerprint identifies a message by its Message-ID and a hash of its body.
+// Messages without a Message-ID are never considered duplicates.
+func fingerprint(data []byte) string {
+	m, err := mail.ReadMessage(bytes.NewReader(data))
+	if err != nil {
+		return ""
+	}
+	id := strings.TrimSpace(m.Header.Get("Message-Id"))
+	if id == "" {
+		return ""
+	}
+	_, body, found := bytes.Cut(data, []byte("\r\n\r\n"))
+	if !found {
+		_, body, _ = bytes.Cut(data, []byte("\n\n"))
+	}
+	h := sha256.New()
+	h.Write([]byte(id))
+	h.Write([]byte{0})
+	h.Write(body)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+func loadDedupeState(c blob.BlobClient, mailbox string) (dedupeState, error) {
+	b, err := c.Get(dedupeKey(mailbox))
+	if errors.Is(err, blob.ErrNotFound) {
+		return dedupeState{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	state := dedupeState{}
+	return state, json.Unmarshal(b, &state)
+}
+
+// checkDuplicate returns the key of an earlier delivery of data to mailbox
+// within the DedupeWindow. Must be called with indexMu held.
+func (bkd *Backend) checkDuplicate(mailbox string, data []byte) (string, error) {
+	fp := fingerprint(data)
+	if bkd.DedupeWindow == 0 || fp == "" {
+		return "", nil
+	}
+	state, err := loadDedupeState(bkd.BlobClient, mailbox)
+	if err != nil {
+		return "", err
+	}
+	if e, ok := state[fp]; ok && time.Since(e.Seen) <= bkd.DedupeWindow {
+		return e.Key, nil
+	}
+	return "", nil
+}
+
+// recordDelivery records key as the delivery of data to mailbox, once it's
+// stored and indexed, so a retry after a failure isn't taken for a duplicate.
+// Must be called with indexMu held.
+func (bkd *Backend) recordDelivery(key, mailbox string, data []byte) error {
+	fp := fingerprint(data)
+	if bkd.DedupeWindow == 0 || fp == "" {
+		return nil
+	}
+	state, err := loadDedupeState(bkd.BlobClient, mailbox)
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	for k, e := range state {
+		if now.Sub(e.Seen) > bkd.DedupeWindow {
+			delete(state, k)
+		}
+	}
+	state[fp] = dedupeEntry{Key: key, Seen: now}
+	b, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	return bkd.BlobClient.Put(dedupeKey(mailbox), b)
+}
@@ -0,0 +1,78 @@
+package smtp
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestStoreDedupe(t *testing.T) {
+	msg := []byte("Message-ID: <1@example.org>\r\nReceived: first\r\n\r\nbody\r\n")
+	retry := []byte("Message-ID: <1@example.org>\r\nReceived: second\r\n\r\nbody\r\n")
+	noID := []byte("Subject: no id\r\n\r\nbody\r\n")
+
+	blobClient := &memBlobClient{}
+	bkd := &Backend{BlobClient: blobClient, DedupeWindow: time.Hour}
+	if err := bkd.store("mail/sif.io/1", "recipient", msg); err != nil {
+		t.Fatal(err)
+	}
+	if err := bkd.store("mail/sif.io/2", "recipient", retry); err != errDuplicate {
+		t.Errorf("expected duplicate, got %v", err)
+	}
+	if err := bkd.store("mail/sif.io/3", "other", retry); err != nil {
+		t.Errorf("duplicate across mailboxes: %v", err)
+	}
+	bkd.store("mail/sif.io/4", "recipient", noID)
+	if err := bkd.store("mail/sif.io/5", "recipient", noID); err != nil {
+		t.Errorf("message without Message-ID deduped: %v", err)
+	}
+	if mails, _ := blobClient.ListMail(); len(mails) != 4 {
+		t.Errorf("unexpected stored mail %v", mails)
+	}
+
+	bkd.DedupeAction = DedupeLink
+	if err := bkd.store("mail/sif.io/6", "recipient", retry); err != errDuplicate {
+		t.Errorf("expected duplicate, got %v", err)
+	}
+	idx, _ := LoadMailboxIndex(blobClient, "recipient")
+	last := idx.Messages[len(idx.Messages)-1]
+	if len(idx.Messages) != 4 || last.Key != "mail/sif.io/1" || !last.Linked {
+		t.Errorf("duplicate not linked: %+v", idx.Messages)
+	}
+
+	bkd.DedupeWindow = time.Nanosecond
+	time.Sleep(time.Millisecond)
+	if err := bkd.store("mail/sif.io/7", "recipient", retry); err != nil {
+		t.Errorf("duplicate outside window: %v", err)
+	}
+}
+
+// failingIndexClient fails to save mailbox indexes
+type failingIndexClient struct{ memBlobClient }
+
+func (c *failingIndexClient) Put(oid string, data []byte) error {
+	if strings.HasPrefix(oid, "index/") {
+		return errors.New("unavailable")
+	}
+	return c.memBlobClient.Put(oid, data)
+}
+
+func TestStoreDedupeRetry(t *testing.T) {
+	msg := []byte("Message-ID: <1@example.org>\r\n\r\nbody\r\n")
+	blobClient := &failingIndexClient{}
+	bkd := &Backend{BlobClient: blobClient, DedupeWindow: time.Hour}
+	if err := bkd.store("mail/sif.io/1", "recipient", msg); err == nil {
+		t.Fatal("expected the index save to fail")
+	}
+
+	// a retry after the failure is delivered rather than dropped
+	bkd.BlobClient = &blobClient.memBlobClient
+	if err := bkd.store("mail/sif.io/2", "recipient", msg); err != nil {
+		t.Fatalf("retry taken for a duplicate: %v", err)
+	}
+	idx, _ := LoadMailboxIndex(bkd.BlobClient, "recipient")
+	if len(idx.Messages) != 1 || idx.Messages[0].Key != "mail/sif.io/2" {
+		t.Errorf("retry not indexed: %+v", idx.Messages)
+	}
+}
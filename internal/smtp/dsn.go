@@ -0,0 +1,217 @@
+package smtp
+
+// delivery status notifications, see RFC 3464 and RFC 3461
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"mime/multipart"
+	"net/textproto"
+	"slices"
+	"strings"
+	"time"
+
+	smtp "github.com/emersion/go-smtp"
+	"github.com/google/uuid"
+)
+
+// DSN actions, RFC 3464 2.3.3
+const (
+	ActionFailed    = "failed"
+	ActionDelayed   = "delayed"
+	ActionDelivered = "delivered"
+	ActionRelayed   = "relayed"
+	ActionExpanded  = "expanded" // delivered to a mailing list
+)
+
+// A RecipientStatus is the outcome for one recipient in a DSN
+type RecipientStatus struct {
+	Recipient  string
+	Action     string
+	Status     string // enhanced status code, e.g. 5.2.2
+	Diagnostic string // the SMTP reply, if there was one
+}
+
+// failedStatus returns a failed RecipientStatus for err, using its enhanced code if it has one
+func failedStatus(rcpt string, err error) RecipientStatus {
+	rs := RecipientStatus{Recipient: rcpt, Action: ActionFailed, Status: "5.0.0", Diagnostic: err.Error()}
+	var smtpErr *smtp.SMTPError
+	var protoErr *textproto.Error
+	switch {
+	case errors.As(err, &smtpErr):
+		if smtpErr.EnhancedCode != smtp.NoEnhancedCode && smtpErr.EnhancedCode[0] != 0 {
+			rs.Status = fmt.Sprintf("%d.%d.%d", smtpErr.EnhancedCode[0], smtpErr.EnhancedCode[1], smtpErr.EnhancedCode[2])
+		}
+		rs.Diagnostic = fmt.Sprintf("%d %s %s", smtpErr.Code, rs.Status, smtpErr.Message)
+	case errors.As(err, &protoErr):
+		// a remote reply like `550 5.1.1 No such user`
+		if code, _, ok := strings.Cut(protoErr.Msg, " "); ok && strings.Count(code, ".") == 2 && (code[0] == '5' || code[0] == '4') {
+			rs.Status = code
+		}
+		rs.Diagnostic = fmt.Sprintf("%d %s", protoErr.Code, protoErr.Msg)
+	}
+	// a failed action always has a permanent status
+	rs.Status = "5" + rs.Status[1:]
+	return rs
+}
+
+// wantsDSN reports whether the sender of m should be told about action for
+// rcpt. Null senders never get DSNs so bounces can't loop. Without NOTIFY,
+// failures and delays are reported.
+func (m Message) wantsDSN(rcpt, action string) bool {
+	if m.From == "" {
+		return false
+	}
+	notify := []smtp.DSNNotify{smtp.DSNNotifyFailure, smtp.DSNNotifyDelayed}
+	if opts, ok := m.RcptOpts[rcpt]; ok && opts != nil && len(opts.Notify) > 0 {
+		notify = opts.Notify
+	}
+	switch action {
+	case ActionFailed:
+		return slices.Contains(notify, smtp.DSNNotifyFailure)
+	case ActionDelayed:
+		return slices.Contains(notify, smtp.DSNNotifyDelayed)
+	case ActionDelivered, ActionRelayed, ActionExpanded:
+		return slices.Contains(notify, smtp.DSNNotifySuccess)
+	}
+	return false
+}
+
+// NewDSN returns a multipart/report delivery status notification for m,
+// returning the full message or only its header according to RET
+func NewDSN(reportingMTA string, m Message, statuses []RecipientStatus) []byte {
+	b := bytes.Buffer{}
+	w := multipart.NewWriter(&b)
+
+	subject := "Delivery Status Notification (Failure)"
+	human := "Your message could not be delivered to:\r\n"
+	if !slices.ContainsFunc(statuses, func(rs RecipientStatus) bool { return rs.Action == ActionFailed }) {
+		subject = "Delivery Status Notification (Success)"
+		human = "Your message was delivered to:\r\n"
+	}
+	fmt.Fprintf(&b, "From: Mail Delivery System <MAILER-DAEMON@%s>\r\n", reportingMTA)
+	fmt.Fprintf(&b, "To: <%s>\r\n", m.From)
+	fmt.Fprintf(&b, "Subject: %s\r\n", subject)
+	fmt.Fprintf(&b, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	fmt.Fprintf(&b, "Message-ID: <%s@%s>\r\n", uuid.NewString(), reportingMTA)
+	fmt.Fprintf(&b, "Auto-Submitted: auto-replied\r\n")
+	fmt.Fprintf(&b, "MIME-Version: 1.0\r\n")
+	fmt.Fprintf(&b, "Content-Type: multipart/report; report-type=delivery-status; boundary=%q\r\n\r\n", w.Boundary())
+
+	text, _ := w.CreatePart(textproto.MIMEHeader{"Content-Type": {"text/plain; charset=utf-8"}})
+	fmt.Fprint(text, human)
+	for _, rs := range statuses {
+		fmt.Fprintf(text, "\r\n  %s: %s %s\r\n", rs.Recipient, rs.Action, rs.Diagnostic)
+	}
+
+	status, _ := w.CreatePart(textproto.MIMEHeader{"Content-Type": {"message/delivery-status"}})
+	fmt.Fprintf(status, "Reporting-MTA: dns; %s\r\n", reportingMTA)
+	if m.EnvelopeID != "" {
+		fmt.Fprintf(status, "Original-Envelope-Id: %s\r\n", m.EnvelopeID)
+	}
+	if !m.Received.IsZero() {
+		fmt.Fprintf(status, "Arrival-Date: %s\r\n", m.Received.Format(time.RFC1123Z))
+	}
+	for _, rs := range statuses {
+		fmt.Fprintf(status, "\r\nFinal-Recipient: %s\r\n", addressType(rs.Recipient))
+		if opts, ok := m.RcptOpts[rs.Recipient]; ok && opts != nil && opts.OriginalRecipient != "" {
+			fmt.Fprintf(status, "Original-Recipient: %s; %s\r\n", strings.ToLower(string(opts.OriginalRecipientType)), opts.OriginalRecipient)
+		}
+		fmt.Fprintf(status, "Action: %s\r\nStatus: %s\r\n", rs.Action, rs.Status)
+		if rs.Diagnostic != "" {
+			fmt.Fprintf(status, "Diagnostic-Code: smtp; %s\r\n", rs.Diagnostic)
+		}
+	}
+
+	if m.Return == smtp.DSNReturnHeaders {
+		orig, _ := w.CreatePart(textproto.MIMEHeader{"Content-Type": {"text/rfc822-headers"}})
+		header, _ := SplitHeader(m.Data)
+		orig.Write(bytes.TrimRight(header, "\r\n"))
+		orig.Write([]byte("\r\n"))
+	} else {
+		orig, _ := w.CreatePart(textproto.MIMEHeader{"Content-Type": {"message/rfc822"}})
+		orig.Write(m.Data)
+	}
+	w.Close()
+	return b.Bytes()
+}
+
+// addressType returns the DSN address form of rcpt, RFC 6533 for non-ASCII
+func addressType(rcpt string) string {
+	if isASCII(rcpt) {
+		return "rfc822; " + rcpt
+	}
+	return "utf-8; " + rcpt
+}
+
+// isFailureReport reports whether data is a DSN with at least one failed
+// recipient, rather than a delay warning, an auto-reply or other mail
+func isFailureReport(data []byte) bool {
+	root := ParseMimePart(data)
+	if root.MediaType != "multipart/report" || !strings.EqualFold(root.Params["report-type"], "delivery-status") {
+		return false
+	}
+	failed := false
+	root.Walk(func(p *MimePart) {
+		if p.MediaType != "message/delivery-status" && p.MediaType != "message/global-delivery-status" {
+			return
+		}
+		status, _ := p.Body()
+		for _, line := range strings.Split(string(status), "\n") {
+			name, value, _ := strings.Cut(line, ":")
+			if strings.EqualFold(strings.TrimSpace(name), "action") && strings.EqualFold(strings.TrimSpace(value), ActionFailed) {
+				failed = true
+			}
+		}
+	})
+	return failed
+}
+
+// sendDSN queues a DSN to the sender of m for the statuses they asked to be told about
+func (bkd *Backend) sendDSN(m Message, statuses []RecipientStatus) {
+	wanted := []RecipientStatus{}
+	for _, rs := range statuses {
+		if m.wantsDSN(rs.Recipient, rs.Action) {
+			wanted = append(wanted, rs)
+		}
+	}
+	if len(wanted) == 0 {
+		return
+	}
+	for _, rs := range wanted {
+		m.logger().Info("sending DSN", "to", m.From, "rcpt", rs.Recipient, "action", rs.Action, "status", rs.Status)
+	}
+	if err := bkd.enqueue("", []string{m.From}, NewDSN(bkd.Domain, m, wanted), nil); err != nil {
+		m.logger().Error("failed to queue DSN", "to", m.From, "err", err)
+	}
+}
+
+// envelope returns the original message a queued message was sent for
+func (om OutboundMessage) envelope() Message {
+	if om.Envelope == nil {
+		return Message{From: om.From, Recipients: om.To, Data: om.Data, Received: om.Queued}
+	}
+	m := *om.Envelope
+	m.Data = om.Data
+	return m
+}
+
+// bounceOutbound reports a queued message that could not be sent
+func (bkd *Backend) bounceOutbound(om OutboundMessage, err error) {
+	statuses := []RecipientStatus{}
+	for _, rcpt := range om.To {
+		statuses = append(statuses, failedStatus(rcpt, err))
+	}
+	bkd.sendDSN(om.envelope(), statuses)
+}
+
+// notifySuccess reports a sent message to senders that asked with NOTIFY=SUCCESS.
+// The next hop isn't asked for DSNs, so the action is relayed.
+func (bkd *Backend) notifySuccess(om OutboundMessage) {
+	statuses := []RecipientStatus{}
+	for _, rcpt := range om.To {
+		statuses = append(statuses, RecipientStatus{Recipient: rcpt, Action: ActionRelayed, Status: "2.0.0"})
+	}
+	bkd.sendDSN(om.envelope(), statuses)
+}
@@ -0,0 +1,102 @@
+package smtp
+
+import (
+	"bytes"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/mail"
+	"strings"
+	"testing"
+
+	smtp "github.com/emersion/go-smtp"
+)
+
+func TestNewDSN(t *testing.T) {
+	m := Message{
+		From:       "sender@example.org",
+		Data:       []byte("Subject: hi\r\nFrom: sender@example.org\r\n\r\nbody\r\n"),
+		Return:     smtp.DSNReturnHeaders,
+		EnvelopeID: "QQ314159",
+		RcptOpts: map[string]*smtp.RcptOptions{
+			"recipient@sif.io": {OriginalRecipientType: smtp.DSNAddressTypeRFC822, OriginalRecipient: "Recipient@sif.io"},
+		},
+	}
+	dsn := NewDSN("mx.sif.io", m, []RecipientStatus{failedStatus("recipient@sif.io", ErrQuotaExceeded)})
+
+	msg, err := mail.ReadMessage(bytes.NewReader(dsn))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg.Header.Get("To") != "<sender@example.org>" || msg.Header.Get("Auto-Submitted") != "auto-replied" {
+		t.Errorf("unexpected header %v", msg.Header)
+	}
+	mediaType, params, _ := mime.ParseMediaType(msg.Header.Get("Content-Type"))
+	if mediaType != "multipart/report" || params["report-type"] != "delivery-status" {
+		t.Fatalf("unexpected content type %v", msg.Header.Get("Content-Type"))
+	}
+	r := multipart.NewReader(msg.Body, params["boundary"])
+	types := []string{}
+	status, headers := "", ""
+	for {
+		p, err := r.NextPart()
+		if err != nil {
+			break
+		}
+		types = append(types, p.Header.Get("Content-Type"))
+		if p.Header.Get("Content-Type") == "message/delivery-status" {
+			b, _ := io.ReadAll(p)
+			status = string(b)
+		}
+		if p.Header.Get("Content-Type") == "text/rfc822-headers" {
+			b, _ := io.ReadAll(p)
+			headers = string(b)
+		}
+	}
+	if headers != "Subject: hi\r\nFrom: sender@example.org\r\n" {
+		t.Errorf("unexpected returned headers %q", headers)
+	}
+	if strings.Join(types, ",") != "text/plain; charset=utf-8,message/delivery-status,text/rfc822-headers" {
+		t.Errorf("unexpected parts %v", types)
+	}
+	for _, field := range []string{
+		"Reporting-MTA: dns; mx.sif.io",
+		"Original-Envelope-Id: QQ314159",
+		"Final-Recipient: rfc822; recipient@sif.io",
+		"Original-Recipient: rfc822; Recipient@sif.io",
+		"Action: failed",
+		"Status: 5.2.2",
+		"Diagnostic-Code: smtp; 552 5.2.2 Mailbox quota exceeded",
+	} {
+		if !strings.Contains(status, field+"\r\n") {
+			t.Errorf("missing %q in\n%s", field, status)
+		}
+	}
+}
+
+func TestWantsDSN(t *testing.T) {
+	m := Message{From: "sender@example.org", RcptOpts: map[string]*smtp.RcptOptions{
+		"never@sif.io":   {Notify: []smtp.DSNNotify{smtp.DSNNotifyNever}},
+		"success@sif.io": {Notify: []smtp.DSNNotify{smtp.DSNNotifySuccess}},
+	}}
+	if !m.wantsDSN("default@sif.io", ActionFailed) || m.wantsDSN("default@sif.io", ActionDelivered) {
+		t.Error("default NOTIFY should be FAILURE,DELAY")
+	}
+	if m.wantsDSN("never@sif.io", ActionFailed) {
+		t.Error("NOTIFY=NEVER got a DSN")
+	}
+	if !m.wantsDSN("success@sif.io", ActionDelivered) || m.wantsDSN("success@sif.io", ActionFailed) {
+		t.Error("NOTIFY=SUCCESS not honoured")
+	}
+	if (Message{}).wantsDSN("default@sif.io", ActionFailed) {
+		t.Error("null sender got a DSN")
+	}
+}
+
+func TestNewDSNHeadersBareLF(t *testing.T) {
+	m := Message{From: "sender@example.org", Data: []byte("Subject: hi\nFrom: sender@example.org\n\nbody\n"), Return: smtp.DSNReturnHeaders}
+	dsn := string(NewDSN("mx.sif.io", m, []RecipientStatus{failedStatus("recipient@sif.io", ErrQuotaExceeded)}))
+	if !strings.Contains(dsn, "Subject: hi\nFrom: sender@example.org\r\n") || strings.Contains(dsn, "body") {
+		t.Errorf("unexpected returned headers in\n%s", dsn)
+	}
+}
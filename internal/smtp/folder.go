@@ -0,0 +1,283 @@
+package smtp
+
+import (
+	"errors"
+	"slices"
+	"strings"
+	"time"
+)
+
+// InboxFolder is the IMAP folder deliveries are added to
+const InboxFolder = "INBOX"
+
+var (
+	ErrNoSuchFolder = errors.New("no such folder")
+	ErrFolderExists = errors.New("folder already exists")
+	ErrInboxFolder  = errors.New("INBOX can't be deleted")
+)
+
+// A Folder groups a mailbox's messages for IMAP clients. Its messages are the
+// index entries with its name. UIDs are given out from UIDNext, so they are
+// never reused while UIDValidity is unchanged.
+type Folder struct {
+	Name        string `json:"name"`
+	UIDValidity uint32 `json:"uidValidity"`
+	UIDNext     uint32 `json:"uidNext"`
+	Subscribed  bool   `json:"subscribed,omitempty"`
+}
+
+// folderName returns the stored name of a folder, matching INBOX in any case
+func folderName(name string) string {
+	if name == "" || strings.EqualFold(name, InboxFolder) {
+		return InboxFolder
+	}
+	return name
+}
+
+// InFolder reports whether the entry is in the named folder
+func (e IndexEntry) InFolder(name string) bool {
+	return folderName(e.Folder) == folderName(name)
+}
+
+// Folder returns the folder called name, or nil if there isn't one
+func (idx *MailboxIndex) Folder(name string) *Folder {
+	name = folderName(name)
+	for i := range idx.Folders {
+		if idx.Folders[i].Name == name {
+			return &idx.Folders[i]
+		}
+	}
+	return nil
+}
+
+func (idx *MailboxIndex) addFolder(name string) *Folder {
+	// a folder created again must not reuse the UIDs of its old incarnation
+	idx.UIDValidity = max(idx.UIDValidity+1, uint32(time.Now().Unix()))
+	idx.Folders = append(idx.Folders, Folder{Name: name, UIDValidity: idx.UIDValidity, UIDNext: 1})
+	return &idx.Folders[len(idx.Folders)-1]
+}
+
+// AssignUIDs gives new deliveries a UID in INBOX, creating it if need be,
+// and reports whether the index changed. Entries are appended in UID order,
+// so a folder's entries stay in UID order as long as UIDs are assigned
+// before the index is otherwise changed for IMAP.
+func (idx *MailboxIndex) AssignUIDs() bool {
+	changed := false
+	if idx.Folder(InboxFolder) == nil {
+		idx.addFolder(InboxFolder)
+		changed = true
+	}
+	for i := range idx.Messages {
+		e := &idx.Messages[i]
+		if e.ImapUID != 0 {
+			continue
+		}
+		f := idx.Folder(e.Folder)
+		if f == nil {
+			e.Folder = ""
+			f = idx.Folder(InboxFolder)
+		}
+		e.ImapUID = f.UIDNext
+		f.UIDNext++
+		changed = true
+	}
+	return changed
+}
+
+// FolderMessages returns the messages in folder, by UID once assigned. Linked
+// duplicates have the size of the message they link to.
+func (idx *MailboxIndex) FolderMessages(folder string) []IndexEntry {
+	sizes := map[string]int64{}
+	for _, e := range idx.Messages {
+		if !e.Linked {
+			sizes[e.Key] = e.Size
+		}
+	}
+	entries := []IndexEntry{}
+	for _, e := range idx.Messages {
+		if !e.InFolder(folder) {
+			continue
+		}
+		if e.Linked {
+			e.Size = sizes[e.Key]
+		}
+		entries = append(entries, e)
+	}
+	return entries
+}
+
+// Entry returns the message in folder with an IMAP uid, or nil
+func (idx *MailboxIndex) Entry(folder string, uid uint32) *IndexEntry {
+	for i := range idx.Messages {
+		if idx.Messages[i].ImapUID == uid && idx.Messages[i].InFolder(folder) {
+			return &idx.Messages[i]
+		}
+	}
+	return nil
+}
+
+// CreateFolder adds a folder, and any missing parents in its `/` hierarchy
+func (idx *MailboxIndex) CreateFolder(name string) error {
+	name = folderName(strings.TrimSuffix(name, "/"))
+	if idx.Folder(name) != nil {
+		return ErrFolderExists
+	}
+	parts := strings.Split(name, "/")
+	for i := range parts {
+		if parent := strings.Join(parts[:i+1], "/"); idx.Folder(parent) == nil {
+			idx.addFolder(parent)
+		}
+	}
+	return nil
+}
+
+// DeleteFolder removes a folder and its messages, but not its subfolders
+func (idx *MailboxIndex) DeleteFolder(name string) error {
+	name = folderName(name)
+	if name == InboxFolder {
+		return ErrInboxFolder
+	}
+	if idx.Folder(name) == nil {
+		return ErrNoSuchFolder
+	}
+	idx.Expunge(func(e IndexEntry) bool { return e.InFolder(name) })
+	idx.Folders = slices.DeleteFunc(idx.Folders, func(f Folder) bool { return f.Name == name })
+	return nil
+}
+
+// RenameFolder renames a folder and its subfolders. Renaming INBOX moves its
+// messages to a new folder instead, as RFC 3501 asks.
+func (idx *MailboxIndex) RenameFolder(from, to string) error {
+	from, to = folderName(from), folderName(strings.TrimSuffix(to, "/"))
+	if idx.Folder(from) == nil {
+		return ErrNoSuchFolder
+	}
+	if idx.Folder(to) != nil {
+		return ErrFolderExists
+	}
+	if from == InboxFolder {
+		if err := idx.CreateFolder(to); err != nil {
+			return err
+		}
+		uids := []uint32{}
+		for _, e := range idx.FolderMessages(InboxFolder) {
+			uids = append(uids, e.ImapUID)
+		}
+		_, _, err := idx.Move(InboxFolder, uids, to)
+		return err
+	}
+	rename := func(name string) (string, bool) {
+		if name == from {
+			return to, true
+		}
+		if rest, ok := strings.CutPrefix(name, from+"/"); ok {
+			return to + "/" + rest, true
+		}
+		return name, false
+	}
+	for i := range idx.Folders {
+		idx.Folders[i].Name, _ = rename(idx.Folders[i].Name)
+	}
+	for i := range idx.Messages {
+		if name, ok := rename(idx.Messages[i].Folder); ok {
+			idx.Messages[i].Folder = name
+		}
+	}
+	// create any missing parents of the new name
+	if i := strings.LastIndex(to, "/"); i > 0 && idx.Folder(to[:i]) == nil {
+		idx.CreateFolder(to[:i])
+	}
+	return nil
+}
+
+// AddToFolder records a message stored by an IMAP client, returning its UID
+func (idx *MailboxIndex) AddToFolder(folder, key string, size int64, flags []string, received time.Time) (uint32, error) {
+	f := idx.Folder(folder)
+	if f == nil {
+		return 0, ErrNoSuchFolder
+	}
+	e := IndexEntry{Key: key, Size: size, Received: received, Folder: f.Name, ImapUID: f.UIDNext, Flags: flags}
+	f.UIDNext++
+	idx.Messages = append(idx.Messages, e)
+	idx.Bytes += size
+	return e.ImapUID, nil
+}
+
+// Copy adds linked copies of the messages with uids in folder to dest,
+// keeping their flags and received time. It returns the UIDs copied and
+// their UIDs in dest.
+func (idx *MailboxIndex) Copy(folder string, uids []uint32, dest string) (src, dst []uint32, err error) {
+	d := idx.Folder(dest)
+	if d == nil {
+		return nil, nil, ErrNoSuchFolder
+	}
+	for _, uid := range uids {
+		e := idx.Entry(folder, uid)
+		if e == nil {
+			continue
+		}
+		c := IndexEntry{Key: e.Key, Received: e.Received, Linked: true, Folder: d.Name, ImapUID: d.UIDNext, Flags: slices.Clone(e.Flags)}
+		d.UIDNext++
+		idx.Messages = append(idx.Messages, c)
+		src, dst = append(src, uid), append(dst, c.ImapUID)
+	}
+	return src, dst, nil
+}
+
+// Move moves the messages with uids in folder to dest, where they get new
+// UIDs. It returns the UIDs moved and their UIDs in dest.
+func (idx *MailboxIndex) Move(folder string, uids []uint32, dest string) (src, dst []uint32, err error) {
+	d := idx.Folder(dest)
+	if d == nil {
+		return nil, nil, ErrNoSuchFolder
+	}
+	for _, uid := range uids {
+		i := slices.IndexFunc(idx.Messages, func(e IndexEntry) bool { return e.ImapUID == uid && e.InFolder(folder) })
+		if i < 0 {
+			continue
+		}
+		e := idx.Messages[i]
+		e.Folder, e.ImapUID = d.Name, d.UIDNext
+		d.UIDNext++
+		// keep dest's entries in UID order
+		idx.Messages = append(slices.Delete(idx.Messages, i, i+1), e)
+		src, dst = append(src, uid), append(dst, e.ImapUID)
+	}
+	return src, dst, nil
+}
+
+// Expunge removes the messages match reports, returning them. A linked
+// duplicate of a removed message takes over its storage.
+func (idx *MailboxIndex) Expunge(match func(IndexEntry) bool) []IndexEntry {
+	removed := []IndexEntry{}
+	kept := idx.Messages[:0]
+	for _, e := range idx.Messages {
+		if match(e) {
+			removed = append(removed, e)
+		} else {
+			kept = append(kept, e)
+		}
+	}
+	idx.Messages = kept
+	for _, r := range removed {
+		if r.Linked {
+			continue
+		}
+		idx.Bytes -= r.Size
+		if j := slices.IndexFunc(idx.Messages, func(m IndexEntry) bool { return m.Key == r.Key && m.Linked }); j >= 0 {
+			idx.Messages[j].Linked = false
+			idx.Messages[j].Size = r.Size
+			idx.Bytes += r.Size
+		}
+	}
+	return removed
+}
+
+// keys returns the stored messages the index refers to
+func (idx *MailboxIndex) keys() map[string]bool {
+	keys := map[string]bool{}
+	for _, e := range idx.Messages {
+		keys[e.Key] = true
+	}
+	return keys
+}
@@ -0,0 +1,121 @@
+package smtp
+
+import (
+	"errors"
+	"slices"
+	"testing"
+	"time"
+)
+
+func folderUIDs(idx *MailboxIndex, folder string) []uint32 {
+	uids := []uint32{}
+	for _, e := range idx.FolderMessages(folder) {
+		uids = append(uids, e.ImapUID)
+	}
+	return uids
+}
+
+func TestAssignUIDs(t *testing.T) {
+	idx := &MailboxIndex{}
+	idx.Add("mail/sif.io/1", 10)
+	idx.Add("mail/sif.io/2", 10)
+	if !idx.AssignUIDs() || idx.AssignUIDs() {
+		t.Error("expected UIDs assigned once")
+	}
+	inbox := idx.Folder("inbox")
+	if inbox == nil || inbox.UIDNext != 3 || inbox.UIDValidity == 0 {
+		t.Fatalf("unexpected INBOX %+v", inbox)
+	}
+	idx.Add("mail/sif.io/3", 10)
+	idx.AssignUIDs()
+	if uids := folderUIDs(idx, InboxFolder); !slices.Equal(uids, []uint32{1, 2, 3}) {
+		t.Errorf("unexpected UIDs %v", uids)
+	}
+}
+
+func TestFolders(t *testing.T) {
+	idx := &MailboxIndex{}
+	idx.Add("mail/sif.io/1", 10)
+	idx.Add("mail/sif.io/2", 20)
+	idx.AssignUIDs()
+
+	if err := idx.CreateFolder("Archive/2026"); err != nil || idx.Folder("Archive") == nil {
+		t.Fatalf("expected parents created: %v", err)
+	}
+	if err := idx.CreateFolder("Archive"); !errors.Is(err, ErrFolderExists) {
+		t.Errorf("expected ErrFolderExists, got %v", err)
+	}
+
+	src, dst, err := idx.Copy(InboxFolder, []uint32{1, 9}, "Archive")
+	if err != nil || !slices.Equal(src, []uint32{1}) || !slices.Equal(dst, []uint32{1}) {
+		t.Fatalf("copy: %v %v %v", src, dst, err)
+	}
+	if copied := idx.FolderMessages("Archive"); len(copied) != 1 || !copied[0].Linked || copied[0].Size != 10 {
+		t.Errorf("expected a linked copy, got %+v", copied)
+	}
+	if _, dst, _ := idx.Move(InboxFolder, []uint32{2}, "Archive"); !slices.Equal(dst, []uint32{2}) {
+		t.Errorf("move: %v", dst)
+	}
+	if uids := folderUIDs(idx, InboxFolder); !slices.Equal(uids, []uint32{1}) {
+		t.Errorf("unexpected INBOX %v", uids)
+	}
+	if idx.Bytes != 30 {
+		t.Errorf("copies shouldn't count toward usage, got %d", idx.Bytes)
+	}
+
+	// expunging the original hands its storage to the copy
+	idx.Expunge(func(e IndexEntry) bool { return e.InFolder(InboxFolder) })
+	if e := idx.Entry("Archive", 1); e == nil || e.Linked || idx.Bytes != 30 {
+		t.Errorf("expected the copy to own the message, got %+v", e)
+	}
+
+	if err := idx.RenameFolder("Archive", "Old"); err != nil {
+		t.Fatal(err)
+	}
+	if idx.Folder("Old/2026") == nil || len(idx.FolderMessages("Old")) != 2 {
+		t.Errorf("expected subfolders and messages renamed, got %+v", idx.Folders)
+	}
+	if err := idx.DeleteFolder("Old"); err != nil || len(idx.Messages) != 0 || idx.Bytes != 0 {
+		t.Errorf("expected messages deleted with the folder: %v %+v", err, idx)
+	}
+	if err := idx.DeleteFolder("INBOX"); !errors.Is(err, ErrInboxFolder) {
+		t.Errorf("expected ErrInboxFolder, got %v", err)
+	}
+
+	// a recreated folder has a new UIDVALIDITY
+	old := idx.Folder("Old/2026").UIDValidity
+	idx.DeleteFolder("Old/2026")
+	idx.CreateFolder("Old/2026")
+	if idx.Folder("Old/2026").UIDValidity <= old {
+		t.Error("expected a new UIDVALIDITY")
+	}
+}
+
+func TestAppendMessage(t *testing.T) {
+	blobClient := &memBlobClient{}
+	bkd := &Backend{Domain: "mx.sif.io", BlobClient: blobClient, Quota: Quota{Bytes: 100}}
+	received := time.Date(2026, 7, 1, 0, 0, 0, 0, time.UTC)
+	validity, uid, err := bkd.AppendMessage("me", "inbox", []string{`\Seen`}, received, []byte("Subject: hi\r\n\r\nhi\r\n"))
+	if err != nil || validity == 0 || uid != 1 {
+		t.Fatalf("append: %v %v %v", validity, uid, err)
+	}
+	idx, _ := bkd.MailboxIndex("me")
+	if e := idx.Entry(InboxFolder, 1); e == nil || !e.Received.Equal(received) || !slices.Equal(e.Flags, []string{`\Seen`}) {
+		t.Errorf("unexpected entry %+v", e)
+	}
+	if _, _, err := bkd.AppendMessage("me", "Sent", nil, received, []byte("x")); !errors.Is(err, ErrNoSuchFolder) {
+		t.Errorf("expected ErrNoSuchFolder, got %v", err)
+	}
+	if _, _, err := bkd.AppendMessage("me", InboxFolder, nil, received, make([]byte, 100)); !errors.Is(err, ErrQuotaExceeded) {
+		t.Errorf("expected ErrQuotaExceeded, got %v", err)
+	}
+
+	// expunging deletes the stored message
+	err = bkd.UpdateMailbox("me", func(idx *MailboxIndex) error {
+		idx.Expunge(func(IndexEntry) bool { return true })
+		return nil
+	})
+	if mails, _ := blobClient.ListMail(); err != nil || len(mails) != 0 {
+		t.Errorf("expected the message deleted, got %v %v", mails, err)
+	}
+}
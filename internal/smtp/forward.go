@@ -0,0 +1,117 @@
+package smtp
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net/mail"
+	"net/url"
+	"strings"
+
+	"github.com/buckelij/sif.io/internal/blob"
+)
+
+// A Forward sends a mailbox's mail on to external addresses. It is stored
+// under `forward/<mailbox>`.
+type Forward struct {
+	To       []string `json:"to"`
+	KeepCopy bool     `json:"keep_copy"` // also store the message in the mailbox
+}
+
+func forwardKey(mailbox string) string {
+	return "forward/" + url.QueryEscape(mailbox)
+}
+
+// LoadForward returns the mailbox's forwarding rule, or nil if it has none
+func LoadForward(c blob.BlobClient, mailbox string) (*Forward, error) {
+	b, err := c.Get(forwardKey(mailbox))
+	if errors.Is(err, blob.ErrNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	f := &Forward{}
+	return f, json.Unmarshal(b, f)
+}
+
+// Save stores the forwarding rule
+func (f *Forward) Save(c blob.BlobClient, mailbox string) error {
+	b, err := json.Marshal(f)
+	if err != nil {
+		return err
+	}
+	return c.Put(forwardKey(mailbox), b)
+}
+
+// forward queues m for rcpt's forwarding addresses with the sender rewritten
+// by SRS, reporting whether a copy should still be stored. Forwarding needs
+// an SRS Rewriter; without one, or if m was already delivered to rcpt once,
+// the message is only stored.
+func (bkd *Backend) forward(m Message, rcpt string) (keep bool, err error) {
+	mailbox := MailboxName(rcpt)
+	f, err := LoadForward(bkd.BlobClient, mailbox)
+	if err != nil {
+		m.logger().Warn("failed to load forward", "mailbox", mailbox, "err", err)
+		return true, nil
+	}
+	if f == nil || len(f.To) == 0 {
+		return true, nil
+	}
+	if bkd.SRS == nil {
+		m.logger().Warn("forwarding needs an SRS secret", "mailbox", mailbox)
+		return true, nil
+	}
+	if deliveredTo(m.Data, rcpt) {
+		m.logger().Warn("not forwarding looped message", "rcpt", rcpt)
+		return true, nil
+	}
+
+	from := m.From
+	if from != "" {
+		if from, err = bkd.SRS.Forward(m.From); err != nil {
+			m.logger().Warn("can't rewrite sender", "from", m.From, "err", err)
+			return true, nil
+		}
+	}
+	to := []string{}
+	for _, addr := range f.To {
+		if _, _, err := bkd.resolveRecipient(addr); err == nil {
+			m.logger().Warn("not forwarding to a local address", "mailbox", mailbox, "to", addr)
+			continue
+		}
+		to = append(to, addr)
+	}
+	if len(to) == 0 {
+		return true, nil
+	}
+	m.logger().Info("forwarding", "rcpt", rcpt, "from", from, "to", to)
+	// Delivered-To lets us spot the message coming back around
+	data := append([]byte("Delivered-To: "+rcpt+"\r\n"), m.Data...)
+	if err := bkd.enqueue(from, to, data, nil); err != nil {
+		return true, err
+	}
+	return f.KeepCopy, nil
+}
+
+// deliveredTo reports whether data has a Delivered-To header for rcpt
+func deliveredTo(data []byte, rcpt string) bool {
+	msg, err := mail.ReadMessage(bytes.NewReader(data))
+	if err != nil {
+		return false
+	}
+	for _, v := range msg.Header["Delivered-To"] {
+		if strings.EqualFold(strings.TrimSpace(v), rcpt) {
+			return true
+		}
+	}
+	return false
+}
+
+// returnToSender relays a message sent to one of our SRS addresses, a bounce
+// of forwarded mail, to the address it was decoded to at RCPT
+func (bkd *Backend) returnToSender(m Message, rcpt, orig string) error {
+	m.logger().Info("returning SRS bounce", "rcpt", rcpt, "to", orig)
+	// a null sender, so a failure here can't bounce back to us
+	return bkd.enqueue("", []string{orig}, m.Data, nil)
+}
@@ -0,0 +1,162 @@
+package smtp
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/buckelij/sif.io/internal/srs"
+	"golang.org/x/net/xsrftoken"
+)
+
+func queuedMessages(t *testing.T, c *memBlobClient) []OutboundMessage {
+	keys, _ := c.List("outbound/")
+	queued := []OutboundMessage{}
+	for _, k := range keys {
+		b, _ := c.Get(k)
+		om := OutboundMessage{}
+		if err := json.Unmarshal(b, &om); err != nil {
+			t.Fatal(err)
+		}
+		queued = append(queued, om)
+	}
+	return queued
+}
+
+func TestForward(t *testing.T) {
+	blobClient := &memBlobClient{}
+	bkd := &Backend{Domain: "mx.sif.io", MxDomains: "sif.io", BlobClient: blobClient, SRS: srs.NewRewriter("0123456789abcdef", "mx.sif.io")}
+	(&Forward{To: []string{"me@example.net", "other@sif.io"}}).Save(blobClient, "me")
+	m := Message{From: "a@example.org", Data: []byte("Subject: hi\r\n\r\nbody\r\n")}
+
+	if err := bkd.deliver(m, "me@sif.io", true); err != nil {
+		t.Fatal(err)
+	}
+	queued := queuedMessages(t, blobClient)
+	if len(queued) != 1 || len(queued[0].To) != 1 || queued[0].To[0] != "me@example.net" {
+		t.Fatalf("expected only the external address queued, got %+v", queued)
+	}
+	if orig, err := bkd.SRS.Reverse(queued[0].From); err != nil || orig != "a@example.org" {
+		t.Errorf("sender not SRS rewritten: %q %v", queued[0].From, err)
+	}
+	if !strings.HasPrefix(string(queued[0].Data), "Delivered-To: me@sif.io\r\n") {
+		t.Errorf("expected Delivered-To, got %s", queued[0].Data)
+	}
+	if mails, _ := blobClient.ListMail(); len(mails) != 0 {
+		t.Errorf("expected no copy kept, got %v", mails)
+	}
+
+	// the forwarded copy coming back is stored rather than forwarded again
+	looped := Message{From: "a@example.org", Data: queued[0].Data}
+	bkd.deliver(looped, "me@sif.io", true)
+	if mails, _ := blobClient.ListMail(); len(mails) != 1 || len(queuedMessages(t, blobClient)) != 1 {
+		t.Errorf("looped message forwarded again")
+	}
+
+	(&Forward{To: []string{"me@example.net"}, KeepCopy: true}).Save(blobClient, "me")
+	bkd.deliver(m, "me@sif.io", true)
+	if mails, _ := blobClient.ListMail(); len(mails) != 2 || len(queuedMessages(t, blobClient)) != 2 {
+		t.Errorf("expected a copy kept and forwarded")
+	}
+
+	// without SRS, mail is only stored
+	bkd.SRS = nil
+	bkd.deliver(m, "me@sif.io", true)
+	if mails, _ := blobClient.ListMail(); len(mails) != 3 || len(queuedMessages(t, blobClient)) != 2 {
+		t.Errorf("forwarded without SRS")
+	}
+}
+
+func TestSRSBounce(t *testing.T) {
+	blobClient := &memBlobClient{}
+	bkd := &Backend{Domain: "mx.sif.io", MxDomains: "sif.io", BlobClient: blobClient, SRS: srs.NewRewriter("0123456789abcdef", "mx.sif.io")}
+	addr, _ := bkd.SRS.Forward("a@example.org")
+
+	s := &Session{Backend: bkd, Messages: []Message{}, log: slog.Default()}
+	s.Mail("", nil)
+	if err := s.Rcpt("SRS0=xxxx=AA=example.org=a@mx.sif.io", nil); err != ErrNoSuchMailbox {
+		t.Errorf("forged SRS address accepted: %v", err)
+	}
+	if err := s.Rcpt(addr, nil); err != nil {
+		t.Fatal(err)
+	}
+	s.Data(strings.NewReader("Subject: Delivery Status Notification (Failure)\r\n\r\nfailed\r\n"))
+	s.Logout()
+	bkd.Drain(t.Context())
+
+	queued := queuedMessages(t, blobClient)
+	if len(queued) != 1 || queued[0].From != "" || queued[0].To[0] != "a@example.org" {
+		t.Errorf("bounce not returned to the original sender: %+v", queued)
+	}
+	if mails, _ := blobClient.ListMail(); len(mails) != 0 {
+		t.Errorf("bounce stored: %v", mails)
+	}
+}
+
+func TestForwardForm(t *testing.T) {
+	form := func(values url.Values) *Forward {
+		r := httptest.NewRequest("POST", "/forward", strings.NewReader(values.Encode()))
+		r.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+		f, err := forwardForm(r)
+		if err != nil {
+			return nil
+		}
+		return f
+	}
+	f := form(url.Values{"to": {"me@Example.NET,\r\nother@example.org me@example.net"}, "keep_copy": {"on"}})
+	if f == nil || !f.KeepCopy || strings.Join(f.To, ",") != "me@example.net,other@example.org" {
+		t.Fatalf("unexpected %+v", f)
+	}
+	if f := form(url.Values{}); f == nil || len(f.To) != 0 || f.KeepCopy {
+		t.Errorf("expected forwarding off, got %+v", f)
+	}
+	for _, to := range []string{"me", "Me <me@example.net>", "me@", "me@exa mple.net"} {
+		if form(url.Values{"to": {to}}) != nil {
+			t.Errorf("expected %q to be rejected", to)
+		}
+	}
+}
+
+func TestForwardHandler(t *testing.T) {
+	blobClient := &memBlobClient{}
+	wm := NewWebMailer("0123456789abcdef", blobClient, false, Quota{}, nil)
+	request := func(method string, values url.Values, xsrf bool) *httptest.ResponseRecorder {
+		if xsrf {
+			values.Set("xsrftoken", xsrftoken.Generate(wm.xsrfSecret, "", ""))
+		}
+		r := httptest.NewRequest(method, "/forward", strings.NewReader(values.Encode()))
+		r.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+		r.AddCookie(&http.Cookie{Name: "session", Value: xsrftoken.Generate(wm.xsrfSecret, "me", "session")})
+		r.AddCookie(&http.Cookie{Name: "user", Value: "me"})
+		r.AddCookie(&http.Cookie{Name: "xsrftoken", Value: values.Get("xsrftoken")})
+		w := httptest.NewRecorder()
+		wm.forwardHandler(w, r)
+		return w
+	}
+
+	if w := request("GET", url.Values{}, false); w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `name="keep_copy" checked`) {
+		t.Errorf("unexpected form %d %s", w.Code, w.Body)
+	}
+	if w := request("POST", url.Values{"to": {"me@example.net"}}, false); w.Code != http.StatusForbidden {
+		t.Errorf("saved without an XSRF token: %d", w.Code)
+	}
+	if w := request("POST", url.Values{"to": {"not an address"}}, true); w.Code != http.StatusBadRequest {
+		t.Errorf("saved an invalid address: %d", w.Code)
+	}
+	if f, _ := LoadForward(blobClient, "me"); f != nil {
+		t.Fatalf("unexpected forward saved %+v", f)
+	}
+	if w := request("POST", url.Values{"to": {"me@example.net"}}, true); w.Code != http.StatusFound {
+		t.Errorf("unexpected save %d %s", w.Code, w.Body)
+	}
+	if f, _ := LoadForward(blobClient, "me"); f == nil || strings.Join(f.To, ",") != "me@example.net" || f.KeepCopy {
+		t.Errorf("unexpected forward %+v", f)
+	}
+	if w := request("GET", url.Values{}, false); !strings.Contains(w.Body.String(), "me@example.net\n") || strings.Contains(w.Body.String(), `name="keep_copy" checked`) {
+		t.Errorf("saved forward not shown %s", w.Body)
+	}
+}
@@ -0,0 +1,137 @@
+package smtp
+
+import (
+	"bytes"
+	"net/mail"
+	"net/textproto"
+	"strings"
+	"time"
+)
+
+// MailHeader is a message's header with its common fields parsed. Values are
+// RFC 2047 decoded.
+type MailHeader struct {
+	Date       time.Time // zero when missing or unparseable
+	From       []mail.Address
+	Sender     []mail.Address
+	ReplyTo    []mail.Address
+	To         []mail.Address
+	Cc         []mail.Address
+	Bcc        []mail.Address
+	MessageID  string   // without the angle brackets
+	InReplyTo  []string // message ids, without the angle brackets
+	References []string
+	List       map[string]string // the List-* fields, RFC 2369 and 2919, e.g. "List-Unsubscribe"
+	Fields     []HeaderField     // every field, in order
+}
+
+// A HeaderField is one field of a header
+type HeaderField struct {
+	Name  string // as it's written, e.g. "Message-ID"
+	Value string // unfolded and decoded
+	Raw   string // unfolded, without the name
+}
+
+// ParseMailHeader parses the header at the start of a message
+func ParseMailHeader(message []byte) MailHeader {
+	h := MailHeader{List: map[string]string{}, Fields: headerFields(message)}
+	fields := textproto.MIMEHeader{}
+	for _, f := range h.Fields {
+		key := textproto.CanonicalMIMEHeaderKey(f.Name)
+		fields[key] = append(fields[key], f.Raw)
+		if strings.HasPrefix(key, "List-") {
+			if _, ok := h.List[key]; !ok {
+				h.List[key] = f.Value
+			}
+		}
+	}
+	if date, err := mail.ParseDate(fields.Get("Date")); err == nil {
+		h.Date = date
+	}
+	h.From = parseAddressList(fields.Get("From"))
+	h.Sender = parseAddressList(fields.Get("Sender"))
+	h.ReplyTo = parseAddressList(fields.Get("Reply-To"))
+	h.To = parseAddressList(fields.Get("To"))
+	h.Cc = parseAddressList(fields.Get("Cc"))
+	h.Bcc = parseAddressList(fields.Get("Bcc"))
+	if ids := parseMessageIDs(fields.Get("Message-Id")); len(ids) > 0 {
+		h.MessageID = ids[0]
+	}
+	h.InReplyTo = parseMessageIDs(fields.Get("In-Reply-To"))
+	h.References = parseMessageIDs(fields.Get("References"))
+	return h
+}
+
+// headerFields returns the fields of the header at the start of a message.
+// Lines that aren't a field or its continuation are skipped.
+func headerFields(message []byte) []HeaderField {
+	fields := []HeaderField{}
+	for _, line := range bytes.SplitAfter(message, []byte("\n")) {
+		l := strings.TrimRight(string(line), "\r\n")
+		if l == "" {
+			break
+		}
+		if l[0] == ' ' || l[0] == '\t' {
+			if len(fields) > 0 {
+				fields[len(fields)-1].Raw += l
+			}
+			continue
+		}
+		name, value, ok := strings.Cut(l, ":")
+		if !ok || strings.TrimSpace(name) == "" {
+			continue
+		}
+		fields = append(fields, HeaderField{Name: strings.TrimSpace(name), Raw: value})
+	}
+	for i, f := range fields {
+		fields[i].Raw = strings.TrimSpace(f.Raw)
+		fields[i].Value = fields[i].Raw
+		if v, err := wordDecoder.DecodeHeader(fields[i].Raw); err == nil {
+			fields[i].Value = v
+		}
+	}
+	return fields
+}
+
+// parseAddressList parses a list of addresses, or returns nil
+func parseAddressList(v string) []mail.Address {
+	if strings.TrimSpace(v) == "" {
+		return nil
+	}
+	list, err := (&mail.AddressParser{WordDecoder: wordDecoder}).ParseList(v)
+	if err != nil {
+		return nil
+	}
+	addrs := []mail.Address{}
+	for _, a := range list {
+		addrs = append(addrs, *a)
+	}
+	return addrs
+}
+
+// parseMessageIDs returns the ids in a field of message ids. Ids without
+// angle brackets are taken as separated by white space.
+func parseMessageIDs(v string) []string {
+	ids := []string{}
+	for rest := v; ; {
+		start := strings.IndexByte(rest, '<')
+		if start < 0 {
+			break
+		}
+		end := strings.IndexByte(rest[start+1:], '>')
+		if end < 0 {
+			break
+		}
+		if id := strings.TrimSpace(rest[start+1 : start+1+end]); id != "" {
+			ids = append(ids, id)
+		}
+		rest = rest[start+1+end+1:]
+	}
+	if len(ids) == 0 {
+		ids = strings.Fields(v)
+	}
+	if len(ids) == 0 {
+		return nil
+	}
+	return ids
+}
@@ -0,0 +1,76 @@
+package smtp
+
+import (
+	"net/mail"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestParseMailHeader(t *testing.T) {
+	message := "Received: from mx.example.com\r\n" +
+		"\tby mx.sif.io; Wed, 1 Jul 2026 10:00:01 +0000\r\n" +
+		"Date: Wed, 1 Jul 2026 12:00:00 +0200 (CEST)\r\n" +
+		"From: =?utf-8?q?B=C3=B8b?= <bob@example.com>\r\n" +
+		"Sender: list-bounces@example.com\r\n" +
+		"Reply-To: team@example.com\r\n" +
+		"To: me@sif.io, \"Eli\" <eli@sif.io>\r\n" +
+		"Cc: =?iso-8859-1?q?Andr=E9?= <andre@example.com>\r\n" +
+		"Subject: =?iso-2022-jp?B?GyRCRnxLXBsoQg==?=\r\n" +
+		"Message-ID: <2@example.com>\r\n" +
+		"In-Reply-To: <1@sif.io>\r\n" +
+		"References: <0@sif.io>\r\n" +
+		" <1@sif.io>\r\n" +
+		"List-Id: Team <team.example.com>\r\n" +
+		"List-Unsubscribe: <mailto:team-leave@example.com>\r\n" +
+		"\r\n" +
+		"Not-A-Header: body\r\n"
+	h := ParseMailHeader([]byte(message))
+	if !h.Date.Equal(time.Date(2026, 7, 1, 10, 0, 0, 0, time.UTC)) {
+		t.Errorf("unexpected date %v", h.Date)
+	}
+	if !slices.Equal(h.From, []mail.Address{{Name: "Bøb", Address: "bob@example.com"}}) {
+		t.Errorf("unexpected from %v", h.From)
+	}
+	if !slices.Equal(h.To, []mail.Address{{Address: "me@sif.io"}, {Name: "Eli", Address: "eli@sif.io"}}) {
+		t.Errorf("unexpected to %v", h.To)
+	}
+	if !slices.Equal(h.Cc, []mail.Address{{Name: "André", Address: "andre@example.com"}}) {
+		t.Errorf("unexpected cc %v", h.Cc)
+	}
+	if len(h.Sender) != 1 || len(h.ReplyTo) != 1 || h.Bcc != nil {
+		t.Errorf("unexpected sender %v reply-to %v bcc %v", h.Sender, h.ReplyTo, h.Bcc)
+	}
+	if h.MessageID != "2@example.com" || !slices.Equal(h.InReplyTo, []string{"1@sif.io"}) || !slices.Equal(h.References, []string{"0@sif.io", "1@sif.io"}) {
+		t.Errorf("unexpected threading %q %v %v", h.MessageID, h.InReplyTo, h.References)
+	}
+	if h.List["List-Id"] != "Team <team.example.com>" || h.List["List-Unsubscribe"] != "<mailto:team-leave@example.com>" {
+		t.Errorf("unexpected list fields %v", h.List)
+	}
+
+	names := []string{}
+	for _, f := range h.Fields {
+		names = append(names, f.Name)
+	}
+	if !slices.Equal(names, []string{"Received", "Date", "From", "Sender", "Reply-To", "To", "Cc", "Subject", "Message-ID", "In-Reply-To", "References", "List-Id", "List-Unsubscribe"}) {
+		t.Errorf("unexpected fields %v", names)
+	}
+	if f := h.Fields[0]; f.Value != "from mx.example.com\tby mx.sif.io; Wed, 1 Jul 2026 10:00:01 +0000" {
+		t.Errorf("unexpected unfolded field %q", f.Value)
+	}
+	if f := h.Fields[7]; f.Value != "日本" || f.Raw != "=?iso-2022-jp?B?GyRCRnxLXBsoQg==?=" {
+		t.Errorf("unexpected decoded field %+v", f)
+	}
+}
+
+func TestParseMailHeaderMissingFields(t *testing.T) {
+	h := ParseMailHeader([]byte("Date: not a date\r\nMessage-ID: bare@example.com\r\nFrom: not an address\r\n\r\n"))
+	if !h.Date.IsZero() || h.From != nil || h.MessageID != "bare@example.com" || h.InReplyTo != nil || len(h.List) != 0 {
+		t.Errorf("unexpected header %+v", h)
+	}
+
+	mm, err := ParseMimeMessage([]byte("Date: Wed, 1 Jul 2026 10:00:00 +0000\r\nCc: a@example.com\r\n\r\nhi\r\n"), nil)
+	if err != nil || mm.Date.IsZero() || !mm.Date.Equal(mm.Header.Date) || len(mm.Header.Cc) != 1 {
+		t.Errorf("unexpected message %+v %v", mm, err)
+	}
+}
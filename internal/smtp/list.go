@@ -0,0 +1,415 @@
+package smtp
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/mail"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/buckelij/sif.io/internal/blob"
+	smtp "github.com/emersion/go-smtp"
+	"github.com/google/uuid"
+)
+
+// ErrListPostDenied is returned at RCPT when the sender may not post to a list
+var ErrListPostDenied = &smtp.SMTPError{
+	Code:         550,
+	EnhancedCode: smtp.EnhancedCode{5, 7, 1},
+	Message:      "Not permitted to post to this list",
+}
+
+// listMaxBounces is how many bounces unsubscribe a member
+const listMaxBounces = 5
+
+// verpHashLength is the number of hex characters of the HMAC in a VERP address
+const verpHashLength = 8
+
+// confirmations of list commands are valid for listConfirmAge, and carry
+// listTokenLength hex characters of HMAC
+const (
+	listConfirmAge  = 72 * time.Hour
+	listTokenLength = 16
+)
+
+// ListPolicy is who may post to a mailing list
+type ListPolicy string
+
+const (
+	ListOpen       ListPolicy = "open"       // anyone
+	ListMembers    ListPolicy = "members"    // members and moderators, the default
+	ListModerators ListPolicy = "moderators" // moderators only, for announcements
+)
+
+// A MailingList is stored under `lists/<name>` and receives mail for
+// `<name>@<mx domain>`. `<name>-request` takes subscribe, unsubscribe and help
+// commands in the subject or first line of the body; subscribing and
+// unsubscribing take effect once the sender echoes back a confirmation
+// token, as `confirm <command> <token>`, so they can't be forged. `<name>-bounces`
+// receives bounces, with the member encoded VERP style as
+// `<name>-bounces+<hash>=<local>=<domain>`. The hash stops anyone else
+// getting a member unsubscribed with forged bounces.
+type MailingList struct {
+	Name        string         `json:"name"`
+	Description string         `json:"description,omitempty"`
+	Members     []string       `json:"members"`
+	Moderators  []string       `json:"moderators,omitempty"`
+	Policy      ListPolicy     `json:"policy,omitempty"`
+	Closed      bool           `json:"closed,omitempty"`  // subscribe commands are refused; moderators edit Members
+	Bounces     map[string]int `json:"bounces,omitempty"` // bounces by member, see listMaxBounces
+}
+
+// list address roles
+const (
+	listPost    = ""
+	listRequest = "-request"
+	listBounces = "-bounces"
+)
+
+func listKey(name string) string {
+	return "lists/" + url.QueryEscape(name)
+}
+
+// LoadList returns the list called name, or nil if there isn't one
+func LoadList(c blob.BlobClient, name string) (*MailingList, error) {
+	b, err := c.Get(listKey(name))
+	if errors.Is(err, blob.ErrNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	l := &MailingList{}
+	if err := json.Unmarshal(b, l); err != nil {
+		return nil, err
+	}
+	l.Name = name
+	return l, nil
+}
+
+// Save stores the list definition
+func (l *MailingList) Save(c blob.BlobClient) error {
+	b, err := json.Marshal(l)
+	if err != nil {
+		return err
+	}
+	return c.Put(listKey(l.Name), b)
+}
+
+// IsMember reports whether addr is subscribed
+func (l *MailingList) IsMember(addr string) bool {
+	return slices.ContainsFunc(l.Members, func(m string) bool { return strings.EqualFold(m, addr) })
+}
+
+// IsModerator reports whether addr moderates the list
+func (l *MailingList) IsModerator(addr string) bool {
+	return slices.ContainsFunc(l.Moderators, func(m string) bool { return strings.EqualFold(m, addr) })
+}
+
+// MayPost reports whether sender may post under the list's policy
+func (l *MailingList) MayPost(sender string) bool {
+	switch l.Policy {
+	case ListOpen:
+		return true
+	case ListModerators:
+		return l.IsModerator(sender)
+	default:
+		return l.IsMember(sender) || l.IsModerator(sender)
+	}
+}
+
+// unsubscribe removes addr, reporting whether it was a member
+func (l *MailingList) unsubscribe(addr string) bool {
+	n := len(l.Members)
+	l.Members = slices.DeleteFunc(l.Members, func(m string) bool { return strings.EqualFold(m, addr) })
+	delete(l.Bounces, strings.ToLower(addr))
+	return len(l.Members) < n
+}
+
+// listHash returns n hex characters of the HMAC of fields. Fields are
+// lowercased, as they are when they come back in a recipient address.
+func (bkd *Backend) listHash(n int, fields ...string) string {
+	mac := hmac.New(sha256.New, bkd.ListSecret)
+	for _, f := range fields {
+		mac.Write([]byte(strings.ToLower(f)))
+		mac.Write([]byte{0})
+	}
+	return hex.EncodeToString(mac.Sum(nil))[:n]
+}
+
+// verp returns the return path for mail to member, so its bounces identify them
+func (bkd *Backend) verp(list, domain, member string) string {
+	if len(bkd.ListSecret) == 0 {
+		return list + listBounces + "@" + domain
+	}
+	local, memberDomain, _ := cutAddress(member)
+	hash := bkd.listHash(verpHashLength, "verp", list, member)
+	return list + listBounces + "+" + hash + "=" + local + "=" + memberDomain + "@" + domain
+}
+
+// verpMember returns the member encoded in the local part of a VERP address
+// after `<list>-bounces+`, or "" if it's malformed or its hash doesn't match
+func (bkd *Backend) verpMember(list, encoded string) string {
+	hash, addr, ok := strings.Cut(encoded, "=")
+	i := strings.LastIndex(addr, "=")
+	if !ok || i <= 0 || len(bkd.ListSecret) == 0 {
+		return ""
+	}
+	member := addr[:i] + "@" + addr[i+1:]
+	if !hmac.Equal([]byte(hash), []byte(bkd.listHash(verpHashLength, "verp", list, member))) {
+		return ""
+	}
+	return member
+}
+
+// listToken returns the token confirming command, for addr's subscription
+// to list, issued at t
+func (bkd *Backend) listToken(list, command, addr string, t time.Time) string {
+	ts := strconv.FormatInt(t.Unix(), 36)
+	return ts + "-" + bkd.listHash(listTokenLength, "confirm", list, command, addr, ts)
+}
+
+// validListToken reports whether token confirms command for addr, and hasn't expired
+func (bkd *Backend) validListToken(list, command, addr, token string) bool {
+	token = strings.ToLower(token)
+	ts, _, _ := strings.Cut(token, "-")
+	sec, err := strconv.ParseInt(ts, 36, 64)
+	if err != nil || len(bkd.ListSecret) == 0 || time.Since(time.Unix(sec, 0)) > listConfirmAge {
+		return false
+	}
+	return hmac.Equal([]byte(token), []byte(bkd.listToken(list, command, addr, time.Unix(sec, 0))))
+}
+
+// lookupList returns the list rcpt is an address of, its role and, for VERP
+// bounces, the member. The list is nil if rcpt isn't a list address.
+func (bkd *Backend) lookupList(rcpt string) (l *MailingList, role, member string, err error) {
+	name := MailboxName(rcpt)
+	role = listPost
+	if base, encoded, ok := strings.Cut(name, listBounces+"+"); ok {
+		name, role, member = base, listBounces, bkd.verpMember(base, encoded)
+	} else if base, ok := strings.CutSuffix(name, listBounces); ok {
+		name, role = base, listBounces
+	} else if base, ok := strings.CutSuffix(name, listRequest); ok {
+		name, role = base, listRequest
+	}
+	if name == "" {
+		return nil, "", "", nil
+	}
+	l, err = LoadList(bkd.BlobClient, name)
+	return l, role, member, err
+}
+
+// checkListPost returns ErrListPostDenied if rcpt is a list that sender may
+// not post to. Lists that can't be loaded are checked again at delivery.
+func (bkd *Backend) checkListPost(sender, rcpt string) error {
+	if _, _, err := bkd.resolveRecipient(rcpt); err != nil {
+		return nil
+	}
+	l, role, _, err := bkd.lookupList(rcpt)
+	if err != nil || l == nil || role != listPost {
+		return nil
+	}
+	if addr, err := NormalizeAddress(sender); err == nil {
+		sender = addr
+	}
+	if !l.MayPost(sender) {
+		return ErrListPostDenied
+	}
+	return nil
+}
+
+// deliverList handles a message to one of a list's addresses
+func (bkd *Backend) deliverList(m Message, l *MailingList, role, member, domain string) error {
+	bkd.listMu.Lock()
+	defer bkd.listMu.Unlock()
+	// reload under the lock so concurrent bounces and commands aren't lost
+	l, err := LoadList(bkd.BlobClient, l.Name)
+	if err != nil {
+		return err
+	}
+	if l == nil {
+		return ErrNoSuchMailbox
+	}
+	switch role {
+	case listRequest:
+		return bkd.listCommand(m, l, domain)
+	case listBounces:
+		return bkd.listBounce(m, l, member)
+	}
+	return bkd.expandList(m, l, domain)
+}
+
+// expandList sends a copy of m to each member with list headers added
+func (bkd *Backend) expandList(m Message, l *MailingList, domain string) error {
+	sender := m.From
+	if addr, err := NormalizeAddress(sender); err == nil {
+		sender = addr
+	}
+	if !l.MayPost(sender) {
+		return ErrListPostDenied
+	}
+	listID := "<" + l.Name + "." + domain + ">"
+	if orig, err := mail.ReadMessage(bytes.NewReader(m.Data)); err == nil && strings.Contains(orig.Header.Get("List-Id"), listID) {
+		m.logger().Warn("dropping looped list message", "list", l.Name)
+		return nil
+	}
+
+	b := bytes.Buffer{}
+	if l.Description != "" {
+		fmt.Fprintf(&b, "List-Id: %s %s\r\n", l.Description, listID)
+	} else {
+		fmt.Fprintf(&b, "List-Id: %s\r\n", listID)
+	}
+	fmt.Fprintf(&b, "List-Post: <mailto:%s@%s>\r\n", l.Name, domain)
+	fmt.Fprintf(&b, "List-Help: <mailto:%s%s@%s?subject=help>\r\n", l.Name, listRequest, domain)
+	fmt.Fprintf(&b, "List-Unsubscribe: <mailto:%s%s@%s?subject=unsubscribe>\r\n", l.Name, listRequest, domain)
+	fmt.Fprintf(&b, "Precedence: list\r\n")
+	b.Write(m.Data)
+	data := b.Bytes()
+
+	m.logger().Info("expanding list", "list", l.Name, "from", m.From, "members", len(l.Members))
+	for _, member := range l.Members {
+		from := bkd.verp(l.Name, domain, member)
+		if _, _, err := bkd.resolveRecipient(member); err == nil {
+			bkd.deliver(Message{From: from, Recipients: []string{member}, Data: data, Received: m.Received, log: m.log}, member, false)
+			continue
+		}
+		if err := bkd.enqueue(from, []string{member}, data, nil); err != nil {
+			m.logger().Error("failed to queue list message", "list", l.Name, "rcpt", member, "err", err)
+		}
+	}
+	return nil
+}
+
+// listBounce counts a bounce for member, unsubscribing them after
+// listMaxBounces. Only DSNs reporting a failure count, and they have a null
+// sender.
+func (bkd *Backend) listBounce(m Message, l *MailingList, member string) error {
+	if member == "" || !l.IsMember(member) || m.From != "" || !isFailureReport(m.Data) {
+		m.logger().Info("ignoring list bounce", "list", l.Name, "member", member)
+		return nil
+	}
+	if l.Bounces == nil {
+		l.Bounces = map[string]int{}
+	}
+	key := strings.ToLower(member)
+	l.Bounces[key]++
+	m.logger().Info("list bounce", "list", l.Name, "member", member, "bounces", l.Bounces[key])
+	if l.Bounces[key] >= listMaxBounces {
+		m.logger().Info("unsubscribing bouncing member", "list", l.Name, "member", member)
+		l.unsubscribe(member)
+	}
+	return l.Save(bkd.BlobClient)
+}
+
+// listCommand runs the subscribe, unsubscribe, confirm or help command in m
+// for its sender, and replies with the result. Subscribe and unsubscribe are
+// answered with a token to confirm them.
+func (bkd *Backend) listCommand(m Message, l *MailingList, domain string) error {
+	requestAddr := l.Name + listRequest + "@" + domain
+	if !bkd.shouldAutoreply(m.From, requestAddr, m.Data) {
+		return nil
+	}
+	sender, err := NormalizeAddress(m.From)
+	if err != nil {
+		return nil
+	}
+	listAddr := l.Name + "@" + domain
+
+	subject, reply := listAddr, ""
+	confirm := func(command, action string) {
+		subject = "confirm " + command + " " + bkd.listToken(l.Name, command, sender, time.Now())
+		reply = "We received a request to " + action + ". To confirm it, reply to this message " +
+			"keeping the subject, or send mail to " + requestAddr + " with the subject \"" + subject + "\". " +
+			"If you didn't ask for this, ignore this message."
+	}
+	words := listCommandWords(m.Data)
+	command, confirmed := "", false
+	if len(words) > 0 {
+		command = words[0]
+	}
+	if command == "confirm" && len(words) >= 3 && bkd.validListToken(l.Name, words[1], sender, words[2]) {
+		command, confirmed = words[1], true
+	}
+	switch command {
+	case "subscribe":
+		switch {
+		case l.IsMember(sender):
+			reply = "You are already subscribed to " + listAddr + "."
+		case l.Closed || len(bkd.ListSecret) == 0:
+			reply = "Subscriptions to " + listAddr + " are closed. Ask a list moderator to add you."
+		case !confirmed:
+			confirm("subscribe", "subscribe "+sender+" to "+listAddr)
+		default:
+			l.Members = append(l.Members, sender)
+			if err := l.Save(bkd.BlobClient); err != nil {
+				return err
+			}
+			m.logger().Info("list subscribe", "list", l.Name, "member", sender)
+			reply = "You are now subscribed to " + listAddr + "."
+		}
+	case "unsubscribe":
+		switch {
+		case !l.IsMember(sender):
+			reply = "You are not subscribed to " + listAddr + "."
+		case len(bkd.ListSecret) == 0:
+			reply = "Ask a list moderator to unsubscribe you from " + listAddr + "."
+		case !confirmed:
+			confirm("unsubscribe", "unsubscribe "+sender+" from "+listAddr)
+		default:
+			l.unsubscribe(sender)
+			if err := l.Save(bkd.BlobClient); err != nil {
+				return err
+			}
+			m.logger().Info("list unsubscribe", "list", l.Name, "member", sender)
+			reply = "You are now unsubscribed from " + listAddr + "."
+		}
+	case "confirm":
+		reply = "That confirmation is invalid or has expired. Send the subscribe or unsubscribe command to " + requestAddr + " again."
+	default:
+		reply = "Send mail to " + requestAddr + " with the subject \"subscribe\" or \"unsubscribe\"."
+	}
+
+	b := bytes.Buffer{}
+	fmt.Fprintf(&b, "From: <%s>\r\n", requestAddr)
+	fmt.Fprintf(&b, "To: <%s>\r\n", m.From)
+	fmt.Fprintf(&b, "Subject: %s\r\n", subject)
+	fmt.Fprintf(&b, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	fmt.Fprintf(&b, "Message-ID: <%s@%s>\r\n", uuid.NewString(), bkd.Domain)
+	fmt.Fprintf(&b, "Auto-Submitted: auto-replied\r\n")
+	fmt.Fprintf(&b, "Content-Type: text/plain; charset=utf-8\r\n\r\n")
+	fmt.Fprintf(&b, "%s\r\n", reply)
+	return bkd.enqueue("", []string{m.From}, b.Bytes(), nil)
+}
+
+// listCommandWords returns the words of the subject, after any "Re:", or
+// else of the first non-blank line of the body, lowercased
+func listCommandWords(data []byte) []string {
+	msg, err := mail.ReadMessage(bytes.NewReader(data))
+	if err != nil {
+		return nil
+	}
+	words := strings.Fields(strings.ToLower(msg.Header.Get("Subject")))
+	for len(words) > 0 && words[0] == "re:" {
+		words = words[1:]
+	}
+	if len(words) > 0 {
+		return words
+	}
+	body := bytes.Buffer{}
+	body.ReadFrom(msg.Body)
+	for _, line := range strings.Split(body.String(), "\n") {
+		if words := strings.Fields(strings.ToLower(line)); len(words) > 0 {
+			return words
+		}
+	}
+	return nil
+}
@@ -0,0 +1,247 @@
+package smtp
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/mail"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newListBackend(t *testing.T, l *MailingList) (*Backend, *memBlobClient) {
+	blobClient := &memBlobClient{}
+	if err := l.Save(blobClient); err != nil {
+		t.Fatal(err)
+	}
+	return &Backend{Domain: "mx.sif.io", MxDomains: "sif.io", BlobClient: blobClient, ListSecret: []byte("list secret")}, blobClient
+}
+
+func TestLookupList(t *testing.T) {
+	bkd, _ := newListBackend(t, &MailingList{Name: "team"})
+	bounces := bkd.verp("team", "sif.io", "A.b@example.org")
+	tests := []struct {
+		rcpt, role, member string
+		found              bool
+	}{
+		{"team@sif.io", listPost, "", true},
+		{"Team@sif.io", listPost, "", true},
+		{"team-request@sif.io", listRequest, "", true},
+		{"team-bounces@sif.io", listBounces, "", true},
+		{bounces, listBounces, "a.b@example.org", true},
+		{strings.ToUpper(bounces), listBounces, "a.b@example.org", true},
+		{"team-bounces+a.b=example.org@sif.io", listBounces, "", true},
+		{"team-bounces+00000000=a.b=example.org@sif.io", listBounces, "", true},
+		{"other@sif.io", listPost, "", false},
+		{"-request@sif.io", "", "", false},
+	}
+	for _, tt := range tests {
+		l, role, member, err := bkd.lookupList(tt.rcpt)
+		if err != nil || (l != nil) != tt.found || (tt.found && (role != tt.role || member != tt.member)) {
+			t.Errorf("%s: got %v %q %q %v", tt.rcpt, l, role, member, err)
+		}
+	}
+}
+
+func TestCheckListPost(t *testing.T) {
+	l := &MailingList{Name: "team", Members: []string{"a@example.org"}, Moderators: []string{"mod@sif.io"}}
+	bkd, blobClient := newListBackend(t, l)
+	if err := bkd.checkListPost("a@EXAMPLE.org", "team@sif.io"); err != nil {
+		t.Errorf("member rejected: %v", err)
+	}
+	if err := bkd.checkListPost("mod@sif.io", "team@sif.io"); err != nil {
+		t.Errorf("moderator rejected: %v", err)
+	}
+	if err := bkd.checkListPost("x@example.org", "team@sif.io"); err != ErrListPostDenied {
+		t.Errorf("non-member accepted: %v", err)
+	}
+	if err := bkd.checkListPost("x@example.org", "team-request@sif.io"); err != nil {
+		t.Errorf("request address rejected: %v", err)
+	}
+
+	l.Policy = ListModerators
+	l.Save(blobClient)
+	if err := bkd.checkListPost("a@example.org", "team@sif.io"); err != ErrListPostDenied {
+		t.Errorf("member posted to announce list: %v", err)
+	}
+	l.Policy = ListOpen
+	l.Save(blobClient)
+	if err := bkd.checkListPost("x@example.org", "team@sif.io"); err != nil {
+		t.Errorf("open list rejected: %v", err)
+	}
+}
+
+func TestExpandList(t *testing.T) {
+	bkd, blobClient := newListBackend(t, &MailingList{Name: "team", Description: "The team", Members: []string{"me@sif.io", "a@example.org"}})
+	m := Message{From: "a@example.org", Data: []byte("From: a@example.org\r\nTo: team@sif.io\r\nSubject: hi\r\n\r\nbody\r\n")}
+	if err := bkd.deliver(m, "team@sif.io", true); err != nil {
+		t.Fatal(err)
+	}
+	bkd.Drain(t.Context())
+
+	queued, _ := blobClient.List("outbound/")
+	if len(queued) != 1 {
+		t.Fatalf("expected the remote member queued, got %v", queued)
+	}
+	om := OutboundMessage{}
+	b, _ := blobClient.Get(queued[0])
+	json.Unmarshal(b, &om)
+	if om.From != bkd.verp("team", "sif.io", "a@example.org") || om.To[0] != "a@example.org" {
+		t.Errorf("unexpected envelope %v %v", om.From, om.To)
+	}
+	for _, want := range []string{"List-Id: The team <team.sif.io>\r\n", "List-Unsubscribe: <mailto:team-request@sif.io?subject=unsubscribe>\r\n", "Precedence: list\r\n", "Subject: hi\r\n"} {
+		if !strings.Contains(string(om.Data), want) {
+			t.Errorf("expected %q in %s", want, om.Data)
+		}
+	}
+
+	mails, _ := blobClient.ListMail()
+	if len(mails) != 1 {
+		t.Fatalf("expected the local member delivered, got %v", mails)
+	}
+	idx, _ := LoadMailboxIndex(blobClient, "me")
+	if len(idx.Messages) != 1 {
+		t.Errorf("local member not indexed %+v", idx)
+	}
+
+	// the list's own copy coming back is dropped
+	looped := Message{From: "a@example.org", Data: om.Data}
+	bkd.deliver(looped, "team@sif.io", true)
+	if queued, _ := blobClient.List("outbound/"); len(queued) != 1 {
+		t.Errorf("looped message expanded again: %v", queued)
+	}
+}
+
+func TestListBounces(t *testing.T) {
+	bkd, blobClient := newListBackend(t, &MailingList{Name: "team", Members: []string{"a@example.org", "b@example.org"}})
+	sent := Message{From: "team-bounces@sif.io", Data: []byte("Subject: hi\r\n\r\nhi\r\n")}
+	dsn := Message{Data: NewDSN("mx.example.org", sent, []RecipientStatus{{Recipient: "a@example.org", Action: ActionFailed, Status: "5.1.1"}})}
+	delayed := Message{Data: NewDSN("mx.example.org", sent, []RecipientStatus{{Recipient: "a@example.org", Action: ActionDelayed, Status: "4.4.1"}})}
+	forged := Message{From: "x@example.net", Data: dsn.Data}
+	bounces := bkd.verp("team", "sif.io", "a@example.org")
+	for _, m := range []Message{delayed, forged, {Data: sent.Data}} {
+		for range listMaxBounces {
+			bkd.deliver(m, bounces, true)
+		}
+	}
+	for range listMaxBounces {
+		bkd.deliver(dsn, "team-bounces+b=example.org@sif.io", true)
+	}
+	if l, _ := LoadList(blobClient, "team"); len(l.Bounces) != 0 {
+		t.Errorf("counted bounces that aren't failure DSNs to a VERP address: %v", l.Bounces)
+	}
+
+	for range listMaxBounces {
+		if err := bkd.deliver(dsn, bounces, true); err != nil {
+			t.Fatal(err)
+		}
+	}
+	l, _ := LoadList(blobClient, "team")
+	if l.IsMember("a@example.org") || !l.IsMember("b@example.org") {
+		t.Errorf("expected only the bouncing member removed: %v", l.Members)
+	}
+	if mails, _ := blobClient.ListMail(); len(mails) != 0 {
+		t.Errorf("bounces stored as mail: %v", mails)
+	}
+}
+
+func TestListCommands(t *testing.T) {
+	bkd, blobClient := newListBackend(t, &MailingList{Name: "team"})
+	// command sends subject from sender and returns the subject of the reply
+	command := func(sender, subject string) string {
+		t.Helper()
+		data := "From: " + sender + "\r\nTo: team-request@sif.io\r\nSubject: " + subject + "\r\n\r\n\r\n"
+		if err := bkd.deliver(Message{From: sender, Data: []byte(data), Received: time.Now()}, "team-request@sif.io", true); err != nil {
+			t.Fatal(err)
+		}
+		queued, _ := blobClient.List("outbound/")
+		if len(queued) != 1 {
+			t.Fatalf("expected a reply, got %v", queued)
+		}
+		om := OutboundMessage{}
+		b, _ := blobClient.Get(queued[0])
+		blobClient.Delete(queued[0])
+		json.Unmarshal(b, &om)
+		msg, err := mail.ReadMessage(bytes.NewReader(om.Data))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return msg.Header.Get("Subject")
+	}
+	member := func(addr string) bool {
+		l, _ := LoadList(blobClient, "team")
+		return l.IsMember(addr)
+	}
+
+	confirm := command("c@example.org", "subscribe")
+	if !strings.HasPrefix(confirm, "confirm subscribe ") || member("c@example.org") {
+		t.Fatalf("subscribed without confirmation: %q", confirm)
+	}
+	command("x@example.org", confirm)
+	command("c@example.org", "confirm subscribe 0-0000000000000000")
+	command("c@example.org", strings.Replace(confirm, "subscribe", "unsubscribe", 1))
+	if member("c@example.org") || member("x@example.org") {
+		t.Fatal("subscribed with someone else's or a forged confirmation")
+	}
+	command("c@example.org", "Re: "+confirm)
+	if !member("c@example.org") {
+		t.Errorf("not subscribed after confirming")
+	}
+
+	confirm = command("c@example.org", "Unsubscribe please")
+	if !member("c@example.org") {
+		t.Fatalf("unsubscribed without confirmation")
+	}
+	command("c@example.org", confirm)
+	if member("c@example.org") {
+		t.Errorf("not unsubscribed after confirming")
+	}
+
+	l, _ := LoadList(blobClient, "team")
+	l.Closed = true
+	l.Save(blobClient)
+	confirm = command("c@example.org", "subscribe")
+	if strings.HasPrefix(confirm, "confirm") {
+		t.Errorf("confirmation sent for a closed list")
+	}
+
+	if got := listCommandWords([]byte("To: x@sif.io\r\n\r\n\r\n  subscribe\r\n")); len(got) != 1 || got[0] != "subscribe" {
+		t.Errorf("expected the command from the body, got %q", got)
+	}
+}
+
+func TestListToken(t *testing.T) {
+	bkd := &Backend{ListSecret: []byte("list secret")}
+	token := bkd.listToken("team", "subscribe", "c@example.org", time.Now())
+	if !bkd.validListToken("team", "subscribe", "C@example.org", strings.ToUpper(token)) {
+		t.Error("token not valid")
+	}
+	if bkd.validListToken("other", "subscribe", "c@example.org", token) {
+		t.Error("token valid for another list")
+	}
+	old := bkd.listToken("team", "subscribe", "c@example.org", time.Now().Add(-listConfirmAge-time.Minute))
+	if bkd.validListToken("team", "subscribe", "c@example.org", old) {
+		t.Error("expired token valid")
+	}
+}
+
+func TestListWithoutSecret(t *testing.T) {
+	bkd, blobClient := newListBackend(t, &MailingList{Name: "team", Members: []string{"a@example.org"}})
+	bkd.ListSecret = nil
+	if from := bkd.verp("team", "sif.io", "a@example.org"); from != "team-bounces@sif.io" {
+		t.Errorf("unexpected return path %q", from)
+	}
+	if _, _, member, _ := bkd.lookupList("team-bounces+00000000=a=example.org@sif.io"); member != "" {
+		t.Errorf("bounce attributed without a secret: %q", member)
+	}
+	if bkd.validListToken("team", "subscribe", "c@example.org", bkd.listToken("team", "subscribe", "c@example.org", time.Now())) {
+		t.Error("token valid without a secret")
+	}
+	data := "From: c@example.org\r\nTo: team-request@sif.io\r\nSubject: subscribe\r\n\r\n"
+	bkd.deliver(Message{From: "c@example.org", Data: []byte(data), Received: time.Now()}, "team-request@sif.io", true)
+	queued, _ := blobClient.List("outbound/")
+	b, _ := blobClient.Get(queued[0])
+	if len(queued) != 1 || strings.Contains(string(b), "confirm subscribe") {
+		t.Errorf("confirmation sent without a secret: %s", b)
+	}
+}
@@ -1,16 +1,37 @@
 package smtp
 
 import (
+	"context"
+	"errors"
 	"io"
-	"log"
+	"log/slog"
+	"net"
 	"net/url"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/buckelij/sif.io/internal/blob"
+	"github.com/buckelij/sif.io/internal/milter"
+	"github.com/buckelij/sif.io/internal/srs"
 	smtp "github.com/emersion/go-smtp"
+	"github.com/google/uuid"
 )
 
+// ErrNoSuchMailbox is returned when a recipient is not in one of our MxDomains
+var ErrNoSuchMailbox = &smtp.SMTPError{
+	Code:         550,
+	EnhancedCode: smtp.EnhancedCode{5, 1, 1},
+	Message:      "No such mailbox",
+}
+
+// ErrStorageFailed is reported when an accepted message can't be stored
+var ErrStorageFailed = &smtp.SMTPError{
+	Code:         550,
+	EnhancedCode: smtp.EnhancedCode{5, 3, 0},
+	Message:      "Message could not be stored",
+}
+
 // The Backend implements SMTP server methods
 type Backend struct {
 	ListenAddress string
@@ -20,30 +41,312 @@ type Backend struct {
 	BlobContainer string
 	BlobKey       string
 	BlobClient    blob.BlobClient
+	Quota         Quota        // default per-mailbox quota
+	Scanner       VirusScanner // optional, e.g. clamd
+	ScanAction    ScanAction   // what to do with infected messages, reject by default
+	Milters       []*milter.Client
+	Webhooks      []Webhook     // notified of each stored message
+	Relay         string        // optional smarthost `host:port` for outbound mail
+	DedupeWindow  time.Duration // how long to remember deliveries for duplicate suppression, 0 disables
+	DedupeAction  DedupeAction  // drop by default
+	SRS           *srs.Rewriter // rewrites the sender of forwarded mail; forwarding is off without it
+	ListSecret    []byte        // keys list bounce addresses and confirmations; without it bounces and subscribe commands are ignored
+	TLSRPTAddress string        // where TLS reports are sent, the rua of our TLS-RPT record; they're only stored from mail to it
+
+	indexMu    sync.Mutex     // serializes mailbox index updates
+	vacationMu sync.Mutex     // serializes vacation reply records
+	listMu     sync.Mutex     // serializes mailing list updates
+	pending    sync.WaitGroup // background deliveries, uploads and webhooks
+}
+
+// background runs f in a goroutine that Drain waits for
+func (bkd *Backend) background(f func()) {
+	bkd.pending.Add(1)
+	go func() {
+		defer bkd.pending.Done()
+		f()
+	}()
+}
+
+// Drain waits for background work to finish, or for ctx to be done. Call it
+// once the servers have stopped accepting sessions.
+func (bkd *Backend) Drain(ctx context.Context) error {
+	done := make(chan struct{})
+	go func() {
+		bkd.pending.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
 }
 
 func (bkd *Backend) NewSession(c *smtp.Conn) (smtp.Session, error) {
-	return &Session{Backend: bkd, Messages: []Message{}}, nil
+	sessionsTotal.Inc()
+	s := &Session{Backend: bkd, Messages: []Message{}}
+	s.log = slog.With("session", uuid.NewString(), "remote", remoteIP(c.Conn().RemoteAddr()), "helo", c.Hostname())
+	s.log.Debug("session started")
+	if err := s.milterConnect(c); err != nil {
+		return nil, s.rejected(err)
+	}
+	return s, nil
+}
+
+// resolveRecipient returns the normalized recipient address and the MxDomain
+// it is stored under, or ErrNoSuchMailbox if it is not one of ours
+func (bkd *Backend) resolveRecipient(rcpt string) (addr, domain string, err error) {
+	addr, err = NormalizeAddress(rcpt)
+	if err != nil {
+		return "", "", ErrNoSuchMailbox
+	}
+	_, rcptDomain, _ := cutAddress(addr)
+	for _, d := range strings.Split(bkd.MxDomains, ",") {
+		d, err := NormalizeDomain(strings.TrimSpace(d))
+		if err != nil || d == "" {
+			continue
+		}
+		if rcptDomain == d || strings.HasSuffix(rcptDomain, "."+d) {
+			return addr, d, nil
+		}
+	}
+	return "", "", ErrNoSuchMailbox
+}
+
+// deliver stores the message data for a single recipient. The data is stored
+// byte-exact. The blob upload is done in the background unless wait is set,
+// in which case the upload error is returned.
+func (bkd *Backend) deliver(m Message, rcpt string, wait bool) error {
+	if orig, ok := m.Reversed[rcpt]; ok {
+		return bkd.returnToSender(m, rcpt, orig)
+	}
+	rcpt, domain, err := bkd.resolveRecipient(rcpt)
+	if err != nil {
+		return err
+	}
+	if m.Quarantine == "" {
+		if l, role, member, err := bkd.lookupList(rcpt); err != nil {
+			m.logger().Warn("failed to load list", "rcpt", rcpt, "err", err)
+		} else if l != nil {
+			return bkd.deliverToList(m, l, role, member, rcpt, domain, wait)
+		}
+	}
+	key := "mail/" + url.QueryEscape(domain) + "/" + url.QueryEscape(time.Now().String())
+	m.logger().Info("delivering", "from", m.From, "rcpt", rcpt, "key", key, "size", len(m.Data))
+	store := func() error {
+		if m.Quarantine != "" {
+			// quarantined mail is kept out of the mailbox, its index and webhooks
+			key = "quarantine/" + url.QueryEscape(domain) + "/" + url.QueryEscape(time.Now().String())
+			return bkd.BlobClient.Put(key, m.Data)
+		}
+		if keep, err := bkd.forward(m, rcpt); err != nil || !keep {
+			return err
+		}
+		if err := bkd.store(key, MailboxName(rcpt), m.Data); errors.Is(err, errDuplicate) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if len(bkd.Webhooks) > 0 {
+			e := newDeliveryEvent(key, m.From, rcpt, m.Data)
+			bkd.background(func() { bkd.notify(e) })
+		}
+		bkd.background(func() { bkd.autoreply(m, rcpt) })
+		if bkd.TLSRPTAddress != "" && strings.EqualFold(rcpt, bkd.TLSRPTAddress) && isTLSReport(m.Data) {
+			bkd.background(func() { bkd.ingestTLSReports(m.Data) })
+		}
+		return nil
+	}
+	if !wait {
+		bkd.background(func() {
+			if err := bkd.checkQuota(rcpt, int64(len(m.Data))); err != nil {
+				bkd.sendDSN(m, []RecipientStatus{failedStatus(rcpt, err)})
+				return
+			}
+			if err := store(); err != nil {
+				bkd.sendDSN(m, []RecipientStatus{failedStatus(rcpt, ErrStorageFailed)})
+				return
+			}
+			bkd.sendDSN(m, []RecipientStatus{{Recipient: rcpt, Action: ActionDelivered, Status: "2.0.0"}})
+		})
+		return nil
+	}
+	if err := store(); err != nil {
+		return err
+	}
+	bkd.sendDSN(m, []RecipientStatus{{Recipient: rcpt, Action: ActionDelivered, Status: "2.0.0"}})
+	return nil
+}
+
+// deliverToList expands or handles a message to a list address, in the
+// background unless wait is set
+func (bkd *Backend) deliverToList(m Message, l *MailingList, role, member, rcpt, domain string, wait bool) error {
+	handle := func() error {
+		err := bkd.deliverList(m, l, role, member, domain)
+		if err != nil {
+			m.logger().Error("list delivery failed", "list", l.Name, "rcpt", rcpt, "err", err)
+			return err
+		}
+		bkd.sendDSN(m, []RecipientStatus{{Recipient: rcpt, Action: ActionExpanded, Status: "2.0.0"}})
+		return nil
+	}
+	if wait {
+		return handle()
+	}
+	bkd.background(func() {
+		if err := handle(); err != nil {
+			if !errors.Is(err, ErrListPostDenied) {
+				err = ErrStorageFailed
+			}
+			bkd.sendDSN(m, []RecipientStatus{failedStatus(rcpt, err)})
+		}
+	})
+	return nil
+}
+
+// store uploads the message and adds it to the mailbox index. Duplicates of
+// a recent delivery are dropped or linked to it, returning errDuplicate.
+func (bkd *Backend) store(key, mailbox string, data []byte) error {
+	bkd.indexMu.Lock()
+	defer bkd.indexMu.Unlock()
+	original, err := bkd.checkDuplicate(mailbox, data)
+	if err != nil {
+		// failing to dedupe shouldn't lose mail
+		slog.Warn("failed to check duplicates", "mailbox", mailbox, "err", err)
+	}
+	if original != "" && bkd.DedupeAction != DedupeLink {
+		slog.Info("dropping duplicate", "original", original, "mailbox", mailbox)
+		return errDuplicate
+	}
+	if original == "" {
+		if err := bkd.BlobClient.Put(key, data); err != nil {
+			return err
+		}
+	}
+	idx, err := LoadMailboxIndex(bkd.BlobClient, mailbox)
+	if err != nil {
+		slog.Error("failed to load index", "mailbox", mailbox, "err", err)
+		return err
+	}
+	if original != "" {
+		slog.Info("linking duplicate", "original", original, "mailbox", mailbox)
+		idx.Link(original)
+		if err := idx.Save(bkd.BlobClient, mailbox); err != nil {
+			slog.Error("failed to save index", "mailbox", mailbox, "err", err)
+			return err
+		}
+		return errDuplicate
+	}
+	idx.Add(key, int64(len(data)))
+	if err := idx.Save(bkd.BlobClient, mailbox); err != nil {
+		return err
+	}
+	if err := bkd.recordDelivery(key, mailbox, data); err != nil {
+		slog.Warn("failed to record delivery for dedupe", "mailbox", mailbox, "err", err)
+	}
+	return nil
+}
+
+// checkQuota returns ErrMailboxFull or ErrQuotaExceeded if a message of size
+// can't be delivered to rcpt. Recipients that aren't ours aren't checked, and
+// an unreadable index doesn't block delivery.
+func (bkd *Backend) checkQuota(rcpt string, size int64) error {
+	addr, _, err := bkd.resolveRecipient(rcpt)
+	if err != nil {
+		return nil
+	}
+	idx, err := LoadMailboxIndex(bkd.BlobClient, MailboxName(addr))
+	if err != nil {
+		slog.Warn("failed to load index", "mailbox", MailboxName(addr), "err", err)
+		return nil
+	}
+	if idx.Full(bkd.Quota) {
+		return ErrMailboxFull
+	}
+	if !idx.Fits(bkd.Quota, size) {
+		return ErrQuotaExceeded
+	}
+	return nil
 }
 
 // A Session is returned after EHLO
 type Session struct {
 	Backend  *Backend
 	Messages []Message
+
+	log       *slog.Logger // with the session ID and remote IP
+	filters   []*filter
+	inMessage bool // filters have seen MAIL for a message that isn't finished
+	discard   bool // a filter asked for the current message to be dropped
 }
 
+var _ smtp.LMTPSession = &Session{}
+
 func (s *Session) AuthPlain(_, _ string) error {
 	return smtp.ErrAuthUnsupported
 }
 
-func (s *Session) Mail(from string, _ *smtp.MailOptions) error {
-	s.Messages = append(s.Messages, Message{From: from})
+func (s *Session) Mail(from string, opts *smtp.MailOptions) error {
+	msg := Message{From: from, log: s.log}
+	if opts != nil {
+		msg.UTF8 = opts.UTF8
+		msg.Body = opts.Body
+		msg.Size = opts.Size
+		msg.Return = opts.Return
+		msg.EnvelopeID = opts.EnvelopeID
+	}
+	if !msg.UTF8 && !isASCII(from) {
+		return s.rejected(ErrNonASCIIAddress)
+	}
+	s.inMessage = true
+	if err := s.milterStep(func(m *milter.Session) (*milter.Response, error) { return m.Mail(from) }); err != nil {
+		return s.rejected(err)
+	}
+	s.Messages = append(s.Messages, msg)
 	return nil
 }
 
-func (s *Session) Rcpt(to string, _ *smtp.RcptOptions) error {
+func (s *Session) Rcpt(to string, opts *smtp.RcptOptions) error {
 	msg := s.Messages[len(s.Messages)-1]
-	msg.Recipient = to
+	if !msg.UTF8 && !isASCII(to) {
+		return s.rejected(ErrNonASCIIAddress)
+	}
+	arg := to
+	if addr, err := NormalizeAddress(to); err == nil {
+		to = addr
+	}
+	if s.Backend.SRS != nil && srs.IsSRS(to) {
+		if _, _, err := s.Backend.resolveRecipient(to); err == nil {
+			orig, err := s.Backend.SRS.Reverse(to)
+			if err != nil {
+				s.log.Info("invalid SRS address", "rcpt", to, "err", err)
+				return s.rejected(ErrNoSuchMailbox)
+			}
+			if msg.Reversed == nil {
+				msg.Reversed = map[string]string{}
+			}
+			msg.Reversed[to] = orig
+		}
+	}
+	if err := s.Backend.checkQuota(to, msg.Size); err != nil {
+		return s.rejected(err)
+	}
+	if err := s.Backend.checkListPost(msg.From, to); err != nil {
+		return s.rejected(err)
+	}
+	if err := s.milterStep(func(m *milter.Session) (*milter.Response, error) { return m.Rcpt(to) }); err != nil {
+		return s.rejected(err)
+	}
+	msg.Recipients = append(msg.Recipients, to)
+	msg.RcptArgs = append(msg.RcptArgs, arg)
+	if opts != nil {
+		if msg.RcptOpts == nil {
+			msg.RcptOpts = map[string]*smtp.RcptOptions{}
+		}
+		msg.RcptOpts[to] = opts
+	}
 	s.Messages[len(s.Messages)-1] = msg
 	return nil
 }
@@ -53,32 +356,124 @@ func (s *Session) Data(r io.Reader) error {
 		return err
 	} else {
 		msg := s.Messages[len(s.Messages)-1]
+		for _, rcpt := range msg.Recipients {
+			if err := s.Backend.checkQuota(rcpt, int64(len(b))); err != nil {
+				return s.rejected(err)
+			}
+		}
 		msg.Data = b
+		msg.Received = time.Now()
+		if err := s.filterData(&msg); err != nil {
+			return s.rejected(err)
+		}
 		s.Messages[len(s.Messages)-1] = msg
+		accepted(len(b))
+		s.log.Info("accepted", "from", msg.From, "rcpt", msg.Recipients, "size", len(b))
+	}
+	return nil
+}
+
+// LMTPData delivers the message immediately, reporting a status for each
+// recipient. The message is not kept for Logout.
+func (s *Session) LMTPData(r io.Reader, status smtp.StatusCollector) error {
+	b, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	msg := s.Messages[len(s.Messages)-1]
+	if len(b) == 0 {
+		return errors.New("empty message")
+	}
+	msg.Data = b
+	msg.Received = time.Now()
+	if err := s.filterData(&msg); err != nil {
+		return s.rejected(err)
+	}
+	accepted(len(b))
+	s.log.Info("accepted", "from", msg.From, "rcpt", msg.Recipients, "size", len(b))
+	if msg.Discard {
+		// dropped messages are reported as delivered to every recipient
+		for _, arg := range msg.RcptArgs {
+			status.SetStatus(arg, nil)
+		}
+		return nil
+	}
+	for i, rcpt := range msg.Recipients {
+		// statuses are for recipients as they were given, not normalized
+		if err := s.Backend.checkQuota(rcpt, int64(len(b))); err != nil {
+			status.SetStatus(msg.RcptArgs[i], s.rejected(err))
+			continue
+		}
+		status.SetStatus(msg.RcptArgs[i], s.rejected(s.Backend.deliver(msg, rcpt, true)))
 	}
 	return nil
 }
 
-func (s *Session) Reset() {}
+// filterData runs the message data through the filters and virus scanner
+func (s *Session) filterData(m *Message) error {
+	s.inMessage = false
+	if err := s.milterData(m); err != nil {
+		return err
+	}
+	return s.Backend.scan(m)
+}
+
+func (s *Session) Reset() {
+	if s.inMessage {
+		s.milterAbort()
+		s.inMessage = false
+	}
+}
 
 func (s *Session) Logout() error {
+	s.milterClose()
 	for _, m := range s.Messages {
-		for _, domain := range strings.Split(s.Backend.MxDomains, ",") {
-			if len(m.Data) == 0 {
-				return nil
-			}
-			if strings.HasSuffix(m.Recipient, domain) {
-				log.Printf("FROM: %v TO: %v MESSSAGE: %v\n", m.From, m.Recipient, string(m.Data))
-				go s.Backend.BlobClient.Put("mail/"+url.QueryEscape(domain)+"/"+url.QueryEscape(time.Now().String()), m.Data)
-			}
+		if len(m.Data) == 0 || m.Discard {
+			continue
+		}
+		for _, rcpt := range m.Recipients {
+			s.Backend.deliver(m, rcpt, false)
 		}
 	}
 	return nil
 }
 
+// remoteIP is the client's IP, without the port
+func remoteIP(addr net.Addr) string {
+	if tcp, ok := addr.(*net.TCPAddr); ok {
+		return tcp.IP.String()
+	}
+	if addr == nil {
+		return ""
+	}
+	return addr.String()
+}
+
 // A Message is a single message to be stored
 type Message struct {
-	Recipient string
-	From      string
-	Data      []byte
+	Recipients []string
+	RcptArgs   []string // each of Recipients as it was given in RCPT, before normalizing
+	From       string
+	Data       []byte
+	UTF8       bool              // SMTPUTF8 was requested
+	Body       smtp.BodyType     // BODY= parameter, e.g. 8BITMIME or BINARYMIME
+	Size       int64             // SIZE= parameter, 0 if not given
+	Quarantine string            // virus signature if the message is quarantined
+	Discard    bool              // a filter asked for the message to be dropped
+	Reversed   map[string]string // SRS recipients and the addresses they were decoded to
+	Received   time.Time
+	log        *slog.Logger // the session's logger
+
+	// DSN parameters, RFC 3461
+	Return     smtp.DSNReturn
+	EnvelopeID string
+	RcptOpts   map[string]*smtp.RcptOptions
+}
+
+// logger returns the logger of the session the message came in on
+func (m Message) logger() *slog.Logger {
+	if m.log == nil {
+		return slog.Default()
+	}
+	return m.log
 }
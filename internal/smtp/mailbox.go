@@ -0,0 +1,153 @@
+package smtp
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/buckelij/sif.io/internal/blob"
+	smtp "github.com/emersion/go-smtp"
+)
+
+var (
+	// ErrMailboxFull is returned at RCPT when a mailbox is already at its quota
+	ErrMailboxFull = &smtp.SMTPError{
+		Code:         452,
+		EnhancedCode: smtp.EnhancedCode{4, 2, 2},
+		Message:      "Mailbox full",
+	}
+	// ErrQuotaExceeded is returned when a message would put a mailbox over its quota
+	ErrQuotaExceeded = &smtp.SMTPError{
+		Code:         552,
+		EnhancedCode: smtp.EnhancedCode{5, 2, 2},
+		Message:      "Mailbox quota exceeded",
+	}
+)
+
+// A Quota limits the storage and message count of a mailbox. Zero is unlimited.
+type Quota struct {
+	Bytes    int64 `json:"bytes,omitempty"`
+	Messages int   `json:"messages,omitempty"`
+}
+
+// A MailboxIndex lists the messages stored for a mailbox under `index/<mailbox>`
+// and keeps a running total of their size
+type MailboxIndex struct {
+	Messages []IndexEntry `json:"messages"`
+	Bytes    int64        `json:"bytes"`
+	Quota    Quota        `json:"quota"` // per-user override of the default quota
+
+	Folders     []Folder `json:"folders,omitempty"`     // IMAP folders, see AssignUIDs
+	UIDValidity uint32   `json:"uidValidity,omitempty"` // the last UIDVALIDITY given to a folder
+}
+
+// An IndexEntry is a single stored message
+type IndexEntry struct {
+	Key      string    `json:"key"`
+	Size     int64     `json:"size"`
+	Received time.Time `json:"received"`
+	Linked   bool      `json:"linked,omitempty"` // a duplicate delivery of Key, not counted in usage
+
+	Folder  string   `json:"folder,omitempty"`  // IMAP folder, InboxFolder when empty
+	ImapUID uint32   `json:"imapUid,omitempty"` // UID within Folder, 0 until assigned
+	Flags   []string `json:"flags,omitempty"`   // IMAP flags, e.g. \Seen
+}
+
+// UID identifies the entry to mail clients. It is unique within a mailbox,
+// including linked duplicates, and stable while the entry is in the index.
+func (e IndexEntry) UID() string {
+	h := sha256.Sum256([]byte(e.Key + "\x00" + e.Received.UTC().Format(time.RFC3339Nano)))
+	return hex.EncodeToString(h[:12])
+}
+
+// MailboxName returns the mailbox a normalized address is delivered to
+func MailboxName(addr string) string {
+	local, _, _ := cutAddress(addr)
+	return strings.ToLower(local)
+}
+
+func indexKey(mailbox string) string {
+	return "index/" + url.QueryEscape(mailbox)
+}
+
+// LoadMailboxIndex returns the index for mailbox, or an empty index if it has none yet
+func LoadMailboxIndex(c blob.BlobClient, mailbox string) (*MailboxIndex, error) {
+	b, err := c.Get(indexKey(mailbox))
+	if errors.Is(err, blob.ErrNotFound) {
+		return &MailboxIndex{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	idx := &MailboxIndex{}
+	if err := json.Unmarshal(b, idx); err != nil {
+		return nil, err
+	}
+	return idx, nil
+}
+
+// Save writes the index for mailbox
+func (idx *MailboxIndex) Save(c blob.BlobClient, mailbox string) error {
+	b, err := json.Marshal(idx)
+	if err != nil {
+		return err
+	}
+	return c.Put(indexKey(mailbox), b)
+}
+
+// Add records a stored message
+func (idx *MailboxIndex) Add(key string, size int64) {
+	idx.Messages = append(idx.Messages, IndexEntry{Key: key, Size: size, Received: time.Now()})
+	idx.Bytes += size
+}
+
+// Link records another delivery of an already stored message
+func (idx *MailboxIndex) Link(key string) {
+	idx.Messages = append(idx.Messages, IndexEntry{Key: key, Received: time.Now(), Linked: true})
+}
+
+// Remove forgets a stored message, returning false if it was not in the
+// index. A linked duplicate of it takes over its storage.
+func (idx *MailboxIndex) Remove(key string) bool {
+	return len(idx.Expunge(func(e IndexEntry) bool { return e.Key == key && !e.Linked })) > 0
+}
+
+// stored counts the entries that aren't linked duplicates
+func (idx *MailboxIndex) stored() int {
+	n := 0
+	for _, e := range idx.Messages {
+		if !e.Linked {
+			n++
+		}
+	}
+	return n
+}
+
+// Limit returns the quota for the mailbox, using def where there is no override
+func (idx *MailboxIndex) Limit(def Quota) Quota {
+	q := def
+	if idx.Quota.Bytes != 0 {
+		q.Bytes = idx.Quota.Bytes
+	}
+	if idx.Quota.Messages != 0 {
+		q.Messages = idx.Quota.Messages
+	}
+	return q
+}
+
+// Full reports whether the mailbox can take no more messages. Linked
+// duplicates don't count towards the message quota.
+func (idx *MailboxIndex) Full(def Quota) bool {
+	q := idx.Limit(def)
+	return (q.Messages > 0 && idx.stored() >= q.Messages) || (q.Bytes > 0 && idx.Bytes >= q.Bytes)
+}
+
+// Fits reports whether a message of size fits in the mailbox
+func (idx *MailboxIndex) Fits(def Quota, size int64) bool {
+	q := idx.Limit(def)
+	return !idx.Full(def) && (q.Bytes == 0 || idx.Bytes+size <= q.Bytes)
+}
@@ -0,0 +1,48 @@
+package smtp
+
+import "testing"
+
+func TestMailboxIndexQuota(t *testing.T) {
+	idx := &MailboxIndex{}
+	def := Quota{Bytes: 100, Messages: 2}
+	if idx.Full(def) || !idx.Fits(def, 100) || idx.Fits(def, 101) {
+		t.Fatal("empty mailbox quota wrong")
+	}
+	idx.Add("mail/sif.io/1", 60)
+	if idx.Fits(def, 50) {
+		t.Error("message over byte quota fits")
+	}
+	idx.Add("mail/sif.io/2", 10)
+	if !idx.Full(def) {
+		t.Error("mailbox at message quota is not full")
+	}
+	idx.Quota = Quota{Messages: 10}
+	if idx.Full(def) || idx.Limit(def).Bytes != 100 {
+		t.Error("per-user override not applied")
+	}
+	if !idx.Remove("mail/sif.io/1") || idx.Bytes != 10 || len(idx.Messages) != 1 {
+		t.Errorf("remove did not update usage: %+v", idx)
+	}
+	if idx.Remove("mail/sif.io/1") {
+		t.Error("removed a message twice")
+	}
+
+	idx.Quota = Quota{}
+	idx.Link("mail/sif.io/2")
+	if idx.Full(def) {
+		t.Error("linked duplicate counted towards the message quota")
+	}
+	if !idx.Remove("mail/sif.io/2") || len(idx.Messages) != 1 || idx.Messages[0].Linked || idx.Bytes != 10 {
+		t.Errorf("linked duplicate not kept when its original was removed: %+v", idx)
+	}
+}
+
+func TestUsagePercent(t *testing.T) {
+	u := Usage{Bytes: 50, Messages: 3, Quota: Quota{Bytes: 200, Messages: 4}}
+	if u.Percent() != 75 {
+		t.Errorf("unexpected percent %d", u.Percent())
+	}
+	if (Usage{Bytes: 50}).Percent() != 0 {
+		t.Error("unlimited usage should be 0%")
+	}
+}
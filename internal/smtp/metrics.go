@@ -0,0 +1,106 @@
+package smtp
+
+import (
+	"errors"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+
+	smtp "github.com/emersion/go-smtp"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	sessionsTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "sifio_smtp_sessions_total",
+		Help: "SMTP and LMTP sessions started.",
+	})
+	messagesTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "sifio_smtp_messages_total",
+		Help: "Messages accepted after DATA.",
+	})
+	rejectionsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "sifio_smtp_rejections_total",
+		Help: "Commands rejected, by reason.",
+	}, []string{"reason"})
+	messageBytes = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name:    "sifio_smtp_message_size_bytes",
+		Help:    "Size of accepted messages.",
+		Buckets: prometheus.ExponentialBuckets(1024, 4, 8), // 1KiB to 16MiB
+	})
+	webmailRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "sifio_webmail_requests_total",
+		Help: "Webmail requests, by route and status.",
+	}, []string{"route", "status"})
+	loginsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "sifio_webmail_logins_total",
+		Help: "Webmail login attempts, by result.",
+	}, []string{"result"})
+)
+
+// rejected counts and logs err, if any, as a rejection and returns it
+func (s *Session) rejected(err error) error {
+	if err != nil {
+		reason := rejectReason(err)
+		rejectionsTotal.WithLabelValues(reason).Inc()
+		s.log.Info("rejected", "reason", reason, "err", err)
+	}
+	return err
+}
+
+func rejectReason(err error) string {
+	switch {
+	case errors.Is(err, ErrNoSuchMailbox):
+		return "no_such_mailbox"
+	case errors.Is(err, ErrMailboxFull):
+		return "mailbox_full"
+	case errors.Is(err, ErrQuotaExceeded):
+		return "quota_exceeded"
+	case errors.Is(err, ErrNonASCIIAddress):
+		return "non_ascii_address"
+	case errors.Is(err, ErrInfected):
+		return "virus"
+	case errors.Is(err, ErrScanFailed):
+		return "scan_failed"
+	case errors.Is(err, ErrFilterUnavailable):
+		return "filter_unavailable"
+	case errors.Is(err, ErrStorageFailed):
+		return "storage_failed"
+	case errors.Is(err, ErrListPostDenied):
+		return "list_post_denied"
+	}
+	var smtpErr *smtp.SMTPError
+	if errors.As(err, &smtpErr) {
+		return "filter" // milter rejections are built from the filter's reply
+	}
+	return "other"
+}
+
+// accepted records a message accepted after DATA
+func accepted(size int) {
+	messagesTotal.Inc()
+	messageBytes.Observe(float64(size))
+}
+
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
+
+// instrument counts and logs requests to h under route
+func instrument(route string, h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		start := time.Now()
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		h(rec, req)
+		webmailRequests.WithLabelValues(route, strconv.Itoa(rec.status)).Inc()
+		slog.Info("request", "path", req.URL.Path, "status", rec.status, "remote", req.RemoteAddr, "duration", time.Since(start))
+	}
+}
@@ -0,0 +1,46 @@
+package smtp
+
+import (
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/buckelij/sif.io/internal/milter"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestRejectReason(t *testing.T) {
+	for err, reason := range map[error]string{
+		ErrNoSuchMailbox: "no_such_mailbox",
+		ErrQuotaExceeded: "quota_exceeded",
+		ErrInfected:      "virus",
+		milterError(&milter.Response{Action: milter.Reject}): "filter",
+		fmt.Errorf("wrapped: %w", ErrMailboxFull):            "mailbox_full",
+		fmt.Errorf("io"): "other",
+	} {
+		if got := rejectReason(err); got != reason {
+			t.Errorf("%v: got %q, expected %q", err, got, reason)
+		}
+	}
+
+	before := testutil.ToFloat64(rejectionsTotal.WithLabelValues("virus"))
+	s := &Session{log: slog.Default()}
+	if s.rejected(nil) != nil || s.rejected(ErrInfected) != ErrInfected {
+		t.Error("rejected should return its error")
+	}
+	if got := testutil.ToFloat64(rejectionsTotal.WithLabelValues("virus")); got != before+1 {
+		t.Errorf("rejection not counted: %v", got)
+	}
+}
+
+func TestInstrument(t *testing.T) {
+	h := instrument("/test", func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(http.StatusForbidden)
+	})
+	h(httptest.NewRecorder(), httptest.NewRequest("GET", "/test", nil))
+	if got := testutil.ToFloat64(webmailRequests.WithLabelValues("/test", "403")); got != 1 {
+		t.Errorf("request not counted: %v", got)
+	}
+}
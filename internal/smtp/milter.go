@@ -0,0 +1,163 @@
+package smtp
+
+import (
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/buckelij/sif.io/internal/milter"
+	smtp "github.com/emersion/go-smtp"
+)
+
+// ErrFilterUnavailable is returned when a fail-closed filter can't be reached
+var ErrFilterUnavailable = &smtp.SMTPError{
+	Code:         451,
+	EnhancedCode: smtp.EnhancedCode{4, 7, 1},
+	Message:      "Filter unavailable, try again later",
+}
+
+// A filter is a milter connection for the duration of an SMTP session
+type filter struct {
+	client   *milter.Client
+	session  *milter.Session
+	accepted bool // the filter accepted the current message and wants no more of it
+}
+
+// milterConnect connects to the Backend's filters and sends the connect and helo stages
+func (s *Session) milterConnect(c *smtp.Conn) error {
+	for _, client := range s.Backend.Milters {
+		session, err := client.Session()
+		if err != nil {
+			s.log.Error("milter", "milter", client.Address, "err", err)
+			if client.FailOpen {
+				continue
+			}
+			s.milterClose()
+			return ErrFilterUnavailable
+		}
+		s.filters = append(s.filters, &filter{client: client, session: session})
+	}
+	addr := c.Conn().RemoteAddr()
+	hostname := addr.String()
+	if tcp, ok := addr.(*net.TCPAddr); ok {
+		hostname = "[" + tcp.IP.String() + "]"
+	}
+	err := s.milterStep(func(m *milter.Session) (*milter.Response, error) { return m.Connect(hostname, addr) })
+	if err == nil {
+		err = s.milterStep(func(m *milter.Session) (*milter.Response, error) { return m.Helo(c.Hostname()) })
+	}
+	if err != nil {
+		s.milterClose()
+	}
+	return err
+}
+
+// milterStep runs a stage against each filter still taking part in the
+// message, returning the SMTP error for the first reject or tempfail. A
+// filter that errors is dropped from the session if it fails open.
+func (s *Session) milterStep(stage func(*milter.Session) (*milter.Response, error)) error {
+	for _, f := range s.filters {
+		if f.session == nil || f.accepted {
+			continue
+		}
+		resp, err := stage(f.session)
+		if err != nil {
+			s.log.Error("milter", "milter", f.client.Address, "err", err)
+			f.session.Close()
+			f.session = nil
+			if f.client.FailOpen {
+				continue
+			}
+			return ErrFilterUnavailable
+		}
+		switch resp.Action {
+		case milter.Accept:
+			f.accepted = true
+		case milter.Discard:
+			f.accepted = true
+			s.discard = true
+		case milter.Reject, milter.TempFail:
+			s.log.Info("milter verdict", "milter", f.client.Address, "action", resp.Action, "code", resp.Code, "text", resp.Text)
+			return milterError(resp)
+		}
+	}
+	return nil
+}
+
+// milterData sends the message header and body to the filters and applies
+// their header changes to m
+func (s *Session) milterData(m *Message) error {
+	if len(s.filters) == 0 {
+		return nil
+	}
+	fields, body := milter.SplitMessage(m.Data)
+	for _, field := range fields {
+		err := s.milterStep(func(ms *milter.Session) (*milter.Response, error) { return ms.Header(field.Name, field.Value) })
+		if err != nil {
+			return err
+		}
+	}
+	if err := s.milterStep((*milter.Session).EndOfHeaders); err != nil {
+		return err
+	}
+	if err := s.milterStep(func(ms *milter.Session) (*milter.Response, error) { return ms.Body(body) }); err != nil {
+		return err
+	}
+	err := s.milterStep(func(ms *milter.Session) (*milter.Response, error) {
+		resp, mods, err := ms.EndOfMessage()
+		if err == nil && resp.Action != milter.Reject && resp.Action != milter.TempFail {
+			m.Data = milter.Apply(m.Data, mods)
+		}
+		return resp, err
+	})
+	for _, f := range s.filters {
+		f.accepted = false
+	}
+	m.Discard = s.discard
+	s.discard = false
+	return err
+}
+
+// milterAbort tells the filters the current message is abandoned
+func (s *Session) milterAbort() {
+	for _, f := range s.filters {
+		if f.session != nil {
+			f.session.Abort()
+		}
+		f.accepted = false
+	}
+	s.discard = false
+}
+
+func (s *Session) milterClose() {
+	for _, f := range s.filters {
+		if f.session != nil {
+			f.session.Close()
+		}
+	}
+	s.filters = nil
+}
+
+// milterError converts a filter's reject or tempfail into an SMTP error
+func milterError(resp *milter.Response) *smtp.SMTPError {
+	err := &smtp.SMTPError{
+		Code:         550,
+		EnhancedCode: smtp.EnhancedCode{5, 7, 1},
+		Message:      "Message rejected by filter",
+	}
+	if resp.Action == milter.TempFail {
+		err.Code = 451
+		err.EnhancedCode = smtp.EnhancedCode{4, 7, 1}
+		err.Message = "Message temporarily rejected by filter"
+	}
+	if resp.Code != 0 {
+		err.Code = resp.Code
+		err.Message = resp.Text
+	}
+	if parts := strings.Split(resp.EnhancedCode, "."); len(parts) == 3 {
+		for i, p := range parts {
+			err.EnhancedCode[i], _ = strconv.Atoi(p)
+		}
+	}
+	return err
+}
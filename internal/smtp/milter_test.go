@@ -0,0 +1,26 @@
+package smtp
+
+import (
+	"testing"
+
+	"github.com/buckelij/sif.io/internal/milter"
+)
+
+func TestMilterError(t *testing.T) {
+	for _, tc := range []struct {
+		resp milter.Response
+		want string
+	}{
+		{milter.Response{Action: milter.Reject}, "SMTP error 550: Message rejected by filter"},
+		{milter.Response{Action: milter.TempFail}, "SMTP error 451: Message temporarily rejected by filter"},
+		{milter.Response{Action: milter.Reject, Code: 554, EnhancedCode: "5.7.0", Text: "spam"}, "SMTP error 554: spam"},
+	} {
+		err := milterError(&tc.resp)
+		if err.Error() != tc.want {
+			t.Errorf("got %q want %q", err.Error(), tc.want)
+		}
+	}
+	if err := milterError(&milter.Response{Action: milter.Reject, Code: 554, EnhancedCode: "5.7.0", Text: "spam"}); err.EnhancedCode != [3]int{5, 7, 0} {
+		t.Errorf("unexpected enhanced code %v", err.EnhancedCode)
+	}
+}
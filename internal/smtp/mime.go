@@ -3,34 +3,57 @@ package smtp
 // adapted from https://github.com/kirabou/parseMIMEemail.go
 
 import (
+	"bufio"
 	"bytes"
 	"encoding/base64"
-	"errors"
 	"fmt"
 	"html/template"
 	"io"
 	"mime"
-	"mime/multipart"
 	"mime/quotedprintable"
 	"net/mail"
+	"net/textproto"
+	"path"
 	"strings"
+	"time"
 
-	"github.com/google/uuid"
 	"github.com/microcosm-cc/bluemonday"
 )
 
 type MimeMail struct {
 	From              string
 	To                string
-	Date              string
+	Date              time.Time // zero when missing or unparseable
 	Subject           string
+	Header            MailHeader
 	RawContent        []byte
-	TextContent       []byte
-	HtmlContent       []byte
+	Root              *MimePart // the message's MIME tree
+	TextContent       []byte    // the first inline text/plain part
+	HtmlContent       []byte    // the first inline text/html part
 	AttachedMimeParts map[string][]byte
 	sanitizer         *bluemonday.Policy
 }
 
+// A MimePart is a node of a message's MIME tree. Multiparts have Parts;
+// other parts have a body. The raw header and body are slices of the parsed
+// message, so IMAP sections and sizes can be given in its octets.
+type MimePart struct {
+	Header            textproto.MIMEHeader
+	MediaType         string // lower case, e.g. "text/plain"
+	Params            map[string]string
+	Disposition       string // lower case, e.g. "attachment", or empty
+	DispositionParams map[string]string
+	ContentID         string // without the angle brackets
+	Filename          string // from the disposition, or the type's name
+	Parts             []*MimePart
+	Message           *MimePart // the message a message/rfc822 part encloses
+	RawHeader         []byte    // including the blank line that ends it
+	RawBody           []byte    // still transfer encoded
+}
+
+// multiparts nested deeper than this are kept as a single part
+const maxMimeDepth = 20
+
 func ParseMimeMessage(message []byte, sanitizer *bluemonday.Policy) (*MimeMail, error) {
 	messageReader := bytes.NewReader(message)
 	//  Parse the message to separate the Header and the Body with mail.ReadMessage()
@@ -42,24 +65,23 @@ func ParseMimeMessage(message []byte, sanitizer *bluemonday.Policy) (*MimeMail,
 
 	// Record only the main headers of the message. The "From","To" and "Subject" headers
 	// have to be decoded if they were encoded using RFC 2047 to allow non ASCII characters.
-	// We use a mime.WordDecode for that.
-	dec := new(mime.WordDecoder)
-	mm.From, _ = dec.DecodeHeader(m.Header.Get("From"))
-	mm.To, _ = dec.DecodeHeader(m.Header.Get("To"))
-	mm.Subject, _ = dec.DecodeHeader(m.Header.Get("Subject"))
-
-	mediaType, params, err := mime.ParseMediaType(m.Header.Get("Content-Type"))
-	if err != nil {
-		return nil, err
-	}
+	// We use a mime.WordDecoder that can read any charset for that.
+	mm.From, _ = wordDecoder.DecodeHeader(m.Header.Get("From"))
+	mm.To, _ = wordDecoder.DecodeHeader(m.Header.Get("To"))
+	mm.Subject, _ = wordDecoder.DecodeHeader(m.Header.Get("Subject"))
+	mm.Header = ParseMailHeader(message)
+	mm.Date = mm.Header.Date
 
-	if !strings.HasPrefix(mediaType, "multipart/") {
-		return nil, errors.New("not multipart mime")
+	if contentType := m.Header.Get("Content-Type"); contentType != "" {
+		if _, _, err := mime.ParseMediaType(contentType); err != nil {
+			return nil, err
+		}
 	}
 
-	// Recursivey parse the MIME parts of the Body, starting with the first
-	// level where the MIME parts are separated with params["boundary"].
-	err = mm.parsePart(m.Body, params["boundary"], 1)
+	// parse the MIME parts into a tree, then pick out the text and the
+	// attached parts
+	mm.Root = ParseMimePart(message)
+	err = mm.addPart(mm.Root, "message", 1)
 	return &mm, err
 }
 
@@ -70,93 +92,223 @@ func (mm *MimeMail) SanitizedHtmlContent() template.HTML {
 	return template.HTML(mm.sanitizer.Sanitize(string(mm.HtmlContent)))
 }
 
-// parsePart parses the MIME part from mime_data, each part being separated by
-// boundary. If one of the part read is itself a multipart MIME part, the
-// function calls itself to recursively parse all the parts. The parts read
-// are decoded and written to separate files, named uppon their Content-Description
-// (or boundary if no Content-Description available) with the appropriate
-// file extension. Index is incremented at each recursive level and is used in
-// building the filename under which the part is stored.
-func (mm *MimeMail) parsePart(mime_data io.Reader, boundary string, index int) error {
-	reader := multipart.NewReader(mime_data, boundary)
-	if reader == nil {
-		return nil
-	}
+// ParseMimePart returns the MIME tree of a message. It doesn't fail: what
+// can't be parsed is left as text.
+func ParseMimePart(data []byte) *MimePart {
+	return parseMimePart(data, "text/plain", 0)
+}
 
-	// Go through each of the MIME part of the message Body with NextPart(),
-	// and read the content of the MIME part with ioutil.ReadAll()
-	for {
-		new_part, err := reader.NextPart()
-		if err != nil {
-			if err == io.EOF {
-				break
-			} else {
-				return fmt.Errorf("error going through the MIME parts: %v", err)
-			}
+// parseMimePart parses data, using defaultType when there's no usable
+// Content-Type. Multiparts and enclosed messages are parsed recursively.
+func parseMimePart(data []byte, defaultType string, depth int) *MimePart {
+	header, body := SplitHeader(data)
+	// the header shares data's array, so reading it mustn't append to it
+	fields, _ := textproto.NewReader(bufio.NewReader(io.MultiReader(bytes.NewReader(header), strings.NewReader("\r\n\r\n")))).ReadMIMEHeader()
+	if fields == nil {
+		fields = textproto.MIMEHeader{}
+	}
+	p := newMimePart(fields, defaultType)
+	p.RawHeader, p.RawBody = header, body
+	if depth >= maxMimeDepth {
+		return p.asText()
+	}
+	switch {
+	case strings.HasPrefix(p.MediaType, "multipart/"):
+		partType := "text/plain"
+		if p.MediaType == "multipart/digest" {
+			partType = "message/rfc822"
 		}
-		mediaType, params, err := mime.ParseMediaType(new_part.Header.Get("Content-Type"))
-		if err == nil && strings.HasPrefix(mediaType, "multipart/") {
-			err = mm.parsePart(new_part, params["boundary"], index+1)
-			if err != nil {
-				return err
-			}
-		} else {
-			filename, mediaType := mm.buildFileName(new_part, boundary, 1)
-			data, err := mm.decodePart(new_part)
-			if err != nil {
-				return err
+		if p.Params["boundary"] != "" {
+			for _, b := range splitMultipart(body, p.Params["boundary"]) {
+				p.Parts = append(p.Parts, parseMimePart(b, partType, depth+1))
 			}
-			mm.AttachedMimeParts[filename] = data
-			if strings.HasPrefix(mediaType, "text/plain") && mm.TextContent == nil {
-				mm.TextContent = data
+		}
+		if p.Parts == nil {
+			// a multipart without parts can't be described, so it's text
+			return p.asText()
+		}
+	case p.MediaType == "message/rfc822":
+		p.Message = parseMimePart(body, "text/plain", depth+1)
+	}
+	return p
+}
+
+// asText makes a part that can't be what it says plain text
+func (p *MimePart) asText() *MimePart {
+	if strings.HasPrefix(p.MediaType, "multipart/") || p.MediaType == "message/rfc822" {
+		p.MediaType, p.Params = "text/plain", map[string]string{}
+	}
+	return p
+}
+
+// SplitHeader splits data after the first empty line, which the header
+// keeps. The header is all of data if there isn't one.
+func SplitHeader(data []byte) (header, body []byte) {
+	for pos := 0; pos < len(data); {
+		end := bytes.IndexByte(data[pos:], '\n')
+		if end < 0 {
+			break
+		}
+		line := data[pos : pos+end+1]
+		pos += end + 1
+		if len(bytes.TrimRight(line, "\r\n")) == 0 {
+			return data[:pos], data[pos:]
+		}
+	}
+	return data, nil
+}
+
+// splitMultipart returns the parts of a multipart body. The line break before
+// a delimiter belongs to the delimiter, RFC 2046 section 5.1.1.
+func splitMultipart(body []byte, boundary string) [][]byte {
+	delimiter := []byte("--" + boundary)
+	parts := [][]byte{}
+	start := -1
+	for pos := 0; pos < len(body); {
+		next := len(body)
+		if end := bytes.IndexByte(body[pos:], '\n'); end >= 0 {
+			next = pos + end + 1
+		}
+		line := bytes.TrimRight(body[pos:next], " \t\r\n")
+		if rest, ok := bytes.CutPrefix(line, delimiter); ok && (len(rest) == 0 || string(rest) == "--") {
+			if start >= 0 {
+				p := bytes.TrimSuffix(body[start:pos], []byte("\n"))
+				parts = append(parts, bytes.TrimSuffix(p, []byte("\r")))
 			}
-			if strings.HasPrefix(mediaType, "text/html") && mm.HtmlContent == nil {
-				mm.HtmlContent = data
+			if len(rest) > 0 {
+				return parts
 			}
+			start = next
 		}
+		pos = next
+	}
+	// a missing close delimiter ends the last part at the end of the body
+	if start >= 0 && start < len(body) {
+		parts = append(parts, body[start:])
 	}
+	return parts
+}
 
+// newMimePart describes a part from its header. A part without a usable
+// Content-Type is defaultType, plain text outside a digest, RFC 2045 section
+// 5.2.
+func newMimePart(header textproto.MIMEHeader, defaultType string) *MimePart {
+	p := &MimePart{Header: header, DispositionParams: map[string]string{}}
+	p.MediaType, p.Params, _ = mime.ParseMediaType(defaultType)
+	if mediaType, params, err := mime.ParseMediaType(header.Get("Content-Type")); err == nil && strings.Contains(mediaType, "/") {
+		p.MediaType, p.Params = mediaType, params
+	}
+	if disposition, params, err := mime.ParseMediaType(header.Get("Content-Disposition")); err == nil {
+		p.Disposition, p.DispositionParams = disposition, params
+	}
+	p.ContentID = strings.Trim(strings.TrimSpace(header.Get("Content-Id")), "<>")
+	p.Filename = p.DispositionParams["filename"]
+	if p.Filename == "" {
+		p.Filename = p.Params["name"]
+	}
+	if name, err := wordDecoder.DecodeHeader(p.Filename); err == nil {
+		p.Filename = name
+	}
+	return p
+}
+
+// Content returns the content of a part that isn't a multipart, without its
+// transfer encoding but otherwise as it was sent
+func (p *MimePart) Content() ([]byte, error) {
+	return decodeContent(p.RawBody, p.Header.Get("Content-Transfer-Encoding"))
+}
+
+// Body returns the content of a part that isn't a multipart, without its
+// transfer encoding. Text is converted to UTF-8.
+func (p *MimePart) Body() ([]byte, error) {
+	data, err := p.Content()
+	if err != nil {
+		return nil, err
+	}
+	return textToUTF8(data, p.Header.Get("Content-Type")), nil
+}
+
+// Size is the size of the part's body as it's sent, transfer encoded
+func (p *MimePart) Size() int {
+	return len(p.RawBody)
+}
+
+// Walk calls fn for the part and then each part below it, depth first
+func (p *MimePart) Walk(fn func(*MimePart)) {
+	fn(p)
+	for _, c := range p.Parts {
+		c.Walk(fn)
+	}
+}
+
+// addPart adds a part's content to the convenience views: the first inline
+// text and html, and every part by file name. Parts without a file name are
+// named for the boundary they're within and their position.
+func (mm *MimeMail) addPart(p *MimePart, radix string, index int) error {
+	if p.Parts != nil {
+		for i, c := range p.Parts {
+			if err := mm.addPart(c, p.Params["boundary"], i+1); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	data, err := p.Body()
+	if err != nil {
+		return err
+	}
+	inline := p.Filename == "" && p.Disposition != "attachment"
+	if inline && p.MediaType == "text/plain" && mm.TextContent == nil {
+		mm.TextContent = data
+	}
+	if inline && p.MediaType == "text/html" && mm.HtmlContent == nil {
+		mm.HtmlContent = data
+	}
+	// a message that's only text has nothing attached
+	if p == mm.Root && inline && (p.MediaType == "text/plain" || p.MediaType == "text/html") {
+		return nil
+	}
+	mm.AttachedMimeParts[mm.uniqueName(p.fileName(radix, index))] = data
 	return nil
 }
 
-// buildFileName builds a file name for a MIME part, using information extracted from
-// the part itself, as well as a radix and an index given as parameters.
-func (mm *MimeMail) buildFileName(part *multipart.Part, radix string, index int) (fileName, mediaType string) {
-	if part.FileName() != "" {
-		return part.FileName(), ""
+// fileName returns the part's file name, or builds one from a radix and
+// index with an extension for its type
+func (p *MimePart) fileName(radix string, index int) string {
+	if p.Filename != "" {
+		return p.Filename
 	}
-	contentTypeHeader := part.Header.Get("Content-Type")
+	ext := ""
 	// some systems don't have a mimetype database; infer most common types
-	switch {
-	case strings.HasPrefix(contentTypeHeader, "text/plain"):
-		return fmt.Sprintf("%s-%d%s", radix, index, ".txt"), contentTypeHeader
-	case strings.HasPrefix(mediaType, "text/html"):
-		return fmt.Sprintf("%s-%d%s", radix, index, ".html"), contentTypeHeader
+	switch p.MediaType {
+	case "text/plain":
+		ext = ".txt"
+	case "text/html":
+		ext = ".html"
 	default:
-		mediaType, _, err := mime.ParseMediaType(part.Header.Get("Content-Type"))
-		if err != nil {
-			return uuid.NewString(), ""
-		}
-		mime_type, err := mime.ExtensionsByType(mediaType)
-		if err != nil {
-			return uuid.NewString(), ""
-		}
-		if len(mime_type) == 0 {
-			return uuid.NewString(), ""
+		if exts, err := mime.ExtensionsByType(p.MediaType); err == nil && len(exts) > 0 {
+			ext = exts[0]
 		}
-		return fmt.Sprintf("%s-%d%s", radix, index, mime_type[0]), mediaType
 	}
+	return fmt.Sprintf("%s-%d%s", radix, index, ext)
 }
 
-// decodePart decodes the data of MIME part
-func (mm *MimeMail) decodePart(part *multipart.Part) ([]byte, error) {
-	// Read the data for this MIME part
-	part_data, err := io.ReadAll(part)
-	if err != nil {
-		return nil, err
+// uniqueName numbers a name that's already attached, e.g. image-2.png
+func (mm *MimeMail) uniqueName(name string) string {
+	ext := path.Ext(name)
+	base := strings.TrimSuffix(name, ext)
+	unique := name
+	for n := 2; ; n++ {
+		if _, ok := mm.AttachedMimeParts[unique]; !ok {
+			return unique
+		}
+		unique = fmt.Sprintf("%s-%d%s", base, n, ext)
 	}
+}
 
-	content_transfer_encoding := strings.ToUpper(part.Header.Get("Content-Transfer-Encoding"))
+// decodeContent decodes data with its Content-Transfer-Encoding
+func decodeContent(part_data []byte, encoding string) ([]byte, error) {
+	content_transfer_encoding := strings.ToUpper(strings.TrimSpace(encoding))
 
 	switch {
 	case strings.Compare(content_transfer_encoding, "BASE64") == 0:
@@ -1,6 +1,7 @@
 package smtp
 
 import (
+	"strings"
 	"testing"
 
 	"github.com/microcosm-cc/bluemonday"
@@ -43,3 +44,196 @@ func TestParseMimeMessage(t *testing.T) {
 		t.Errorf("Unexpected TextContent: wanted '<p><b>hi!</b></p>' got '%v'", string(mm.HtmlContent))
 	}
 }
+
+func TestParseSinglePartMessage(t *testing.T) {
+	mm, err := ParseMimeMessage([]byte("Subject: plain\r\nFrom: sender@example.com\r\n\r\nno content type\r\n"), bluemonday.UGCPolicy())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mm.Subject != "plain" || string(mm.TextContent) != "no content type\r\n" || mm.HtmlContent != nil {
+		t.Errorf("unexpected message %+v", mm)
+	}
+
+	mm, err = ParseMimeMessage([]byte("Content-Type: text/html; charset=utf-8\r\nContent-Transfer-Encoding: quoted-printable\r\n\r\n<p>h=C3=A9llo</p>\r\n"), bluemonday.UGCPolicy())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(mm.HtmlContent) != "<p>héllo</p>\r\n" || mm.TextContent != nil {
+		t.Errorf("unexpected html %q", mm.HtmlContent)
+	}
+
+	mm, err = ParseMimeMessage([]byte("Content-Type: text/plain\r\nContent-Transfer-Encoding: base64\r\n\r\naGVsbG8=\r\n"), nil)
+	if err != nil || string(mm.TextContent) != "hello" {
+		t.Errorf("unexpected base64 text %q %v", mm.TextContent, err)
+	}
+
+	mm, err = ParseMimeMessage([]byte("Content-Type: application/pdf; name=a.pdf\r\nContent-Transfer-Encoding: base64\r\n\r\naGVsbG8=\r\n"), nil)
+	if err != nil || string(mm.AttachedMimeParts["a.pdf"]) != "hello" {
+		t.Errorf("unexpected attachment %v %v", mm.AttachedMimeParts, err)
+	}
+}
+
+func TestTextToUTF8(t *testing.T) {
+	for _, tc := range []struct {
+		data, contentType, want string
+	}{
+		{"caf\xe9", "text/plain; charset=iso-8859-1", "café"},
+		{"\x93hi\x94", "text/plain; charset=windows-1252", "“hi”"},
+		{"\x93\xfa\x96{", "text/plain; charset=Shift_JIS", "日本"},
+		{"\x1b$BF|K\\\x1b(B", "text/plain; charset=iso-2022-jp", "日本"},
+		// sniffed when the charset is missing, unknown or wrong
+		{"\x1b$BF|K\\\x1b(B", "text/plain", "日本"},
+		{"caf\xe9", "", "café"},
+		{"caf\xe9", "text/plain; charset=utf-8", "café"},
+		{"caf\xe9", "text/plain; charset=x-unknown", "café"},
+		{"\xef\xbb\xbfcafé", "text/plain; charset=iso-8859-1", "\xef\xbb\xbfcafé"},
+		{"<meta charset=\"iso-8859-1\"><p>caf\xe9</p>", "text/html", "<meta charset=\"iso-8859-1\"><p>café</p>"},
+		{"café", "text/plain; charset=utf-8", "café"},
+		// only text is converted
+		{"caf\xe9", "application/octet-stream", "caf\xe9"},
+	} {
+		if got := string(textToUTF8([]byte(tc.data), tc.contentType)); got != tc.want {
+			t.Errorf("%q as %q: got %q, wanted %q", tc.data, tc.contentType, got, tc.want)
+		}
+	}
+}
+
+func TestParseMimeMessageCharsets(t *testing.T) {
+	message := "Subject: =?iso-2022-jp?B?GyRCRnxLXBsoQg==?=\r\n" +
+		"From: =?shift_jis?B?k/qWew==?= <sender@example.com>\r\n" +
+		"Content-Type: multipart/alternative; boundary=b\r\n" +
+		"\r\n" +
+		"--b\r\n" +
+		"Content-Type: text/plain; charset=iso-8859-1\r\n" +
+		"Content-Transfer-Encoding: quoted-printable\r\n" +
+		"\r\n" +
+		"caf=E9\r\n" +
+		"--b\r\n" +
+		"Content-Type: text/html; charset=windows-1252\r\n" +
+		"\r\n" +
+		"<p>\x93hi\x94</p>\r\n" +
+		"--b--\r\n"
+	mm, err := ParseMimeMessage([]byte(message), bluemonday.UGCPolicy())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mm.Subject != "日本" || mm.From != "日本 <sender@example.com>" {
+		t.Errorf("unexpected headers %q %q", mm.Subject, mm.From)
+	}
+	if string(mm.TextContent) != "café" || string(mm.HtmlContent) != "<p>“hi”</p>" {
+		t.Errorf("unexpected content %q %q", mm.TextContent, mm.HtmlContent)
+	}
+
+	mm, err = ParseMimeMessage([]byte("Content-Type: text/plain; charset=iso-8859-1\r\n\r\ncaf\xe9"), nil)
+	if err != nil || string(mm.TextContent) != "café" {
+		t.Errorf("unexpected single part %q %v", mm.TextContent, err)
+	}
+}
+
+func TestMimeTree(t *testing.T) {
+	message := "Subject: tree\r\n" +
+		"Content-Type: multipart/mixed; boundary=b\r\n" +
+		"\r\n" +
+		"--b\r\n" +
+		"Content-Type: multipart/related; boundary=r\r\n" +
+		"\r\n" +
+		"--r\r\n" +
+		"Content-Type: text/html; charset=utf-8\r\n" +
+		"\r\n" +
+		"<img src=\"cid:logo@sif.io\">\r\n" +
+		"--r\r\n" +
+		"Content-Type: image/png\r\n" +
+		"Content-Id: <logo@sif.io>\r\n" +
+		"Content-Disposition: inline; filename=image.png\r\n" +
+		"Content-Transfer-Encoding: base64\r\n" +
+		"\r\n" +
+		"bG9nbw==\r\n" +
+		"--r--\r\n" +
+		"--b\r\n" +
+		"Content-Type: image/png; name=image.png\r\n" +
+		"Content-Disposition: attachment\r\n" +
+		"Content-Transfer-Encoding: quoted-printable\r\n" +
+		"\r\n" +
+		"photo=\r\n" +
+		"\r\n" +
+		"--b--\r\n"
+	mm, err := ParseMimeMessage([]byte(message), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	root := mm.Root
+	if root.MediaType != "multipart/mixed" || len(root.Parts) != 2 || len(root.Parts[0].Parts) != 2 {
+		t.Fatalf("unexpected tree %+v", root)
+	}
+	logo := root.Parts[0].Parts[1]
+	if logo.ContentID != "logo@sif.io" || logo.Disposition != "inline" || logo.Filename != "image.png" || logo.Size() != 8 {
+		t.Errorf("unexpected inline image %+v", logo)
+	}
+	if body, err := logo.Body(); err != nil || string(body) != "logo" {
+		t.Errorf("unexpected inline image body %q %v", body, err)
+	}
+	photo := root.Parts[1]
+	if photo.Disposition != "attachment" || photo.Filename != "image.png" || photo.Header.Get("Content-Transfer-Encoding") != "quoted-printable" {
+		t.Errorf("unexpected attachment %+v", photo)
+	}
+	walked := []string{}
+	root.Walk(func(p *MimePart) { walked = append(walked, p.MediaType) })
+	if strings.Join(walked, " ") != "multipart/mixed multipart/related text/html image/png image/png" {
+		t.Errorf("unexpected walk %v", walked)
+	}
+
+	if string(mm.HtmlContent) != "<img src=\"cid:logo@sif.io\">" || mm.TextContent != nil {
+		t.Errorf("unexpected content %q %q", mm.HtmlContent, mm.TextContent)
+	}
+	if len(mm.AttachedMimeParts) != 3 || string(mm.AttachedMimeParts["image.png"]) != "logo" || string(mm.AttachedMimeParts["image-2.png"]) != "photo" {
+		t.Errorf("unexpected attached parts %v", mm.AttachedMimeParts)
+	}
+	if _, ok := mm.AttachedMimeParts["r-1.html"]; !ok {
+		t.Errorf("html part not attached: %v", mm.AttachedMimeParts)
+	}
+}
+
+func TestParseMimePart(t *testing.T) {
+	message := "Content-Type: multipart/mixed; boundary=b\r\n" +
+		"\r\n" +
+		"--b\r\n" +
+		"Content-Type: message/rfc822\r\n" +
+		"\r\n" +
+		"Subject: inner\r\n" +
+		"\r\n" +
+		"inner body\r\n" +
+		"--b\r\n" +
+		"Content-Type: multipart/digest; boundary=d\r\n" +
+		"\r\n" +
+		"--d\r\n" +
+		"\r\n" +
+		"Subject: digested\r\n" +
+		"\r\n" +
+		"hi\r\n" +
+		"--d--\r\n" +
+		"--b\r\n" +
+		"Content-Type: multipart/alternative; boundary=missing\r\n" +
+		"\r\n" +
+		"no parts\r\n" +
+		"--b--\r\n"
+	data := []byte(message)
+	root := ParseMimePart(data)
+	if len(root.Parts) != 3 || string(root.RawHeader) != "Content-Type: multipart/mixed; boundary=b\r\n\r\n" {
+		t.Fatalf("unexpected tree %+v", root)
+	}
+	// raw header and body are slices of the message, without the line break
+	// before the next delimiter
+	enclosing := root.Parts[0]
+	if got := string(enclosing.RawBody); got != "Subject: inner\r\n\r\ninner body" || &enclosing.RawBody[0] != &data[strings.Index(message, "Subject: inner")] {
+		t.Errorf("unexpected enclosing body %q", got)
+	}
+	if enclosing.Message == nil || enclosing.Message.Header.Get("Subject") != "inner" || string(enclosing.Message.RawBody) != "inner body" {
+		t.Errorf("enclosed message not parsed: %+v", enclosing.Message)
+	}
+	if digested := root.Parts[1].Parts[0]; digested.MediaType != "message/rfc822" || digested.Message.Header.Get("Subject") != "digested" {
+		t.Errorf("digest part not a message: %+v", digested)
+	}
+	if empty := root.Parts[2]; empty.MediaType != "text/plain" || empty.Parts != nil || string(empty.RawBody) != "no parts" {
+		t.Errorf("multipart without parts not text: %+v", empty)
+	}
+}
@@ -0,0 +1,244 @@
+package smtp
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	netsmtp "net/smtp"
+	"net/textproto"
+	"net/url"
+	"strings"
+	"time"
+
+	smtp "github.com/emersion/go-smtp"
+)
+
+// outboundMaxAttempts bounds retries of temporary failures before giving up,
+// about 34 hours with the doubling retry delay
+const outboundMaxAttempts = 12
+
+// outboundRetry is the delay after the first failed attempt, doubling on each attempt
+var outboundRetry = time.Minute
+
+// An OutboundMessage is queued under `outbound/` for delivery to remote MXs.
+// All recipients share a domain so they are sent in one transaction.
+type OutboundMessage struct {
+	From        string    `json:"from"`
+	To          []string  `json:"to"`
+	Data        []byte    `json:"data"`
+	Queued      time.Time `json:"queued"`
+	Attempts    int       `json:"attempts"`
+	NextAttempt time.Time `json:"next_attempt"`
+	LastError   string    `json:"last_error,omitempty"`
+	Envelope    *Message  `json:"envelope,omitempty"` // the original message, for bounces
+}
+
+// enqueue queues data from `from` for each recipient domain
+func (bkd *Backend) enqueue(from string, to []string, data []byte, envelope *Message) error {
+	byDomain := map[string][]string{}
+	domains := []string{}
+	for _, rcpt := range to {
+		_, domain, ok := cutAddress(rcpt)
+		if !ok {
+			return fmt.Errorf("invalid recipient %v", rcpt)
+		}
+		if domain, err := NormalizeDomain(domain); err == nil {
+			if _, ok := byDomain[domain]; !ok {
+				domains = append(domains, domain)
+			}
+			byDomain[domain] = append(byDomain[domain], rcpt)
+		}
+	}
+	for _, domain := range domains {
+		now := time.Now()
+		b, err := json.Marshal(OutboundMessage{From: from, To: byDomain[domain], Data: data, Queued: now, NextAttempt: now, Envelope: envelope})
+		if err != nil {
+			return err
+		}
+		if err := bkd.BlobClient.Put("outbound/"+url.QueryEscape(domain)+"/"+url.QueryEscape(now.String()), b); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// RunOutbound processes the outbound queue every interval until stop is closed
+func (bkd *Backend) RunOutbound(interval time.Duration, stop <-chan struct{}) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		bkd.ProcessOutbound()
+		select {
+		case <-stop:
+			return
+		case <-t.C:
+		}
+	}
+}
+
+// ProcessOutbound attempts each queued message that is due. Delivered messages
+// are removed from the queue; permanent failures and messages out of attempts
+// are removed and bounced.
+func (bkd *Backend) ProcessOutbound() {
+	keys, err := bkd.BlobClient.List("outbound/")
+	if err != nil {
+		slog.Error("outbound list", "err", err)
+		return
+	}
+	for _, key := range keys {
+		b, err := bkd.BlobClient.Get(key)
+		if err != nil {
+			slog.Error("outbound", "key", key, "err", err)
+			continue
+		}
+		om := OutboundMessage{}
+		if err := json.Unmarshal(b, &om); err != nil {
+			slog.Error("outbound", "key", key, "err", err)
+			continue
+		}
+		if time.Now().Before(om.NextAttempt) {
+			continue
+		}
+
+		err = bkd.send(om.From, om.To, om.Data)
+		om.Attempts++
+		if err == nil {
+			slog.Info("outbound delivered", "key", key, "to", om.To, "attempts", om.Attempts)
+			bkd.BlobClient.Delete(key)
+			bkd.notifySuccess(om)
+			continue
+		}
+		slog.Warn("outbound failed", "key", key, "to", om.To, "attempts", om.Attempts, "err", err)
+		om.LastError = err.Error()
+		if permanent(err) || om.Attempts >= outboundMaxAttempts {
+			bkd.BlobClient.Delete(key)
+			bkd.bounceOutbound(om, err)
+			continue
+		}
+		om.NextAttempt = time.Now().Add(outboundRetry << (om.Attempts - 1))
+		if b, err := json.Marshal(om); err == nil {
+			bkd.BlobClient.Put(key, b)
+		}
+	}
+}
+
+// permanent reports whether a send error is a 5xx rejection
+func permanent(err error) bool {
+	var smtpErr *smtp.SMTPError
+	var protoErr *textproto.Error
+	return (errors.As(err, &smtpErr) && smtpErr.Code >= 500) || (errors.As(err, &protoErr) && protoErr.Code >= 500)
+}
+
+// send delivers to recipients sharing a domain, through the Relay if set or
+// else the domain's MXs in preference order
+func (bkd *Backend) send(from string, to []string, data []byte) error {
+	hosts := []string{}
+	if bkd.Relay != "" {
+		hosts = append(hosts, bkd.Relay)
+	} else {
+		_, domain, _ := cutAddress(to[0])
+		mxs, err := net.LookupMX(domain)
+		if err != nil || len(mxs) == 0 {
+			// RFC 5321 5.1: fall back to the domain itself as an implicit MX
+			hosts = append(hosts, net.JoinHostPort(domain, "25"))
+		}
+		for _, mx := range mxs {
+			hosts = append(hosts, net.JoinHostPort(strings.TrimSuffix(mx.Host, "."), "25"))
+		}
+	}
+	var err error
+	for _, host := range hosts {
+		if err = bkd.sendTo(host, from, to, data); err == nil || permanent(err) {
+			return err
+		}
+	}
+	return err
+}
+
+// sendTo delivers in a single SMTP transaction. TLS is opportunistic, RFC
+// 7435: it's used when offered even if the certificate can't be verified,
+// and a host whose STARTTLS fails is retried in plaintext. Verification
+// would only be required by MTA-STS or DANE, which we don't look up.
+func (bkd *Backend) sendTo(host, from string, to []string, data []byte) error {
+	err := bkd.sendOnce(host, from, to, data, true)
+	var tlsErr *startTLSError
+	if errors.As(err, &tlsErr) {
+		slog.Warn("STARTTLS failed, retrying without TLS", "host", host, "err", tlsErr.err)
+		return bkd.sendOnce(host, from, to, data, false)
+	}
+	return err
+}
+
+// a startTLSError is a failed STARTTLS, after which the connection is unusable
+type startTLSError struct{ err error }
+
+func (e *startTLSError) Error() string { return "STARTTLS: " + e.err.Error() }
+func (e *startTLSError) Unwrap() error { return e.err }
+
+func (bkd *Backend) sendOnce(host, from string, to []string, data []byte, startTLS bool) error {
+	conn, err := net.DialTimeout("tcp", host, 30*time.Second)
+	if err != nil {
+		return err
+	}
+	serverName, _, _ := net.SplitHostPort(host)
+	c, err := netsmtp.NewClient(conn, serverName)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer c.Close()
+	if err := c.Hello(bkd.Domain); err != nil {
+		return err
+	}
+	if ok, _ := c.Extension("STARTTLS"); ok && startTLS {
+		if err := c.StartTLS(opportunisticTLS(serverName)); err != nil {
+			return &startTLSError{err}
+		}
+	}
+	// net/smtp adds SMTPUTF8 and BODY=8BITMIME when the server supports them
+	if err := c.Mail(from); err != nil {
+		return err
+	}
+	for _, rcpt := range to {
+		if err := c.Rcpt(rcpt); err != nil {
+			return err
+		}
+	}
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(data); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return c.Quit()
+}
+
+// opportunisticTLS accepts any certificate, logging those that don't verify
+// for serverName
+func opportunisticTLS(serverName string) *tls.Config {
+	return &tls.Config{
+		ServerName:         serverName,
+		InsecureSkipVerify: true,
+		VerifyConnection: func(cs tls.ConnectionState) error {
+			if len(cs.PeerCertificates) == 0 {
+				return nil
+			}
+			opts := x509.VerifyOptions{DNSName: serverName, Intermediates: x509.NewCertPool()}
+			for _, cert := range cs.PeerCertificates[1:] {
+				opts.Intermediates.AddCert(cert)
+			}
+			if _, err := cs.PeerCertificates[0].Verify(opts); err != nil {
+				slog.Info("sending over unverified TLS", "host", serverName, "err", err)
+			}
+			return nil
+		},
+	}
+}
@@ -0,0 +1,177 @@
+package smtp
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"io"
+	"math/big"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/buckelij/sif.io/internal/blob"
+	smtp "github.com/emersion/go-smtp"
+)
+
+// memBlobClient is an in-memory BlobClient
+type memBlobClient struct {
+	mu    sync.Mutex
+	blobs map[string][]byte
+}
+
+func (c *memBlobClient) Put(oid string, data []byte) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.blobs == nil {
+		c.blobs = map[string][]byte{}
+	}
+	c.blobs[oid] = data
+	return nil
+}
+
+func (c *memBlobClient) Get(oid string) ([]byte, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if v, ok := c.blobs[oid]; ok {
+		return v, nil
+	}
+	return nil, blob.ErrNotFound
+}
+
+func (c *memBlobClient) Delete(oid string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.blobs, oid)
+	return nil
+}
+
+func (c *memBlobClient) List(prefix string) ([]string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	names := []string{}
+	for name := range c.blobs {
+		if strings.HasPrefix(name, prefix) {
+			names = append(names, name)
+		}
+	}
+	return names, nil
+}
+
+func (c *memBlobClient) ListMail() ([]string, error) {
+	return c.List("mail/")
+}
+
+// relayBackend is a remote MTA that rejects recipients starting with "reject"
+type relayBackend struct {
+	mu       sync.Mutex
+	received []string
+}
+
+func (r *relayBackend) NewSession(c *smtp.Conn) (smtp.Session, error) {
+	return &relaySession{r}, nil
+}
+
+type relaySession struct{ r *relayBackend }
+
+func (s *relaySession) Reset()                                      {}
+func (s *relaySession) Logout() error                               { return nil }
+func (s *relaySession) Mail(from string, _ *smtp.MailOptions) error { return nil }
+func (s *relaySession) Rcpt(to string, _ *smtp.RcptOptions) error {
+	if strings.HasPrefix(to, "reject") {
+		return &smtp.SMTPError{Code: 550, EnhancedCode: smtp.EnhancedCode{5, 1, 1}, Message: "No such user"}
+	}
+	return nil
+}
+func (s *relaySession) Data(r io.Reader) error {
+	b, _ := io.ReadAll(r)
+	s.r.mu.Lock()
+	s.r.received = append(s.r.received, string(b))
+	s.r.mu.Unlock()
+	return nil
+}
+
+func TestProcessOutbound(t *testing.T) {
+	relay := &relayBackend{}
+	srv := smtp.NewServer(relay)
+	srv.Domain = "relay.example.org"
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go srv.Serve(l)
+	defer srv.Close()
+
+	blobClient := &memBlobClient{}
+	bkd := &Backend{Domain: "mx.sif.io", BlobClient: blobClient, Relay: l.Addr().String()}
+
+	bkd.enqueue("sender@sif.io", []string{"someone@example.org"}, []byte("Subject: hi\r\n\r\nhello\r\n"), nil)
+	bkd.enqueue("sender@sif.io", []string{"rejected@example.net"}, []byte("Subject: hi\r\n\r\nhello\r\n"), nil)
+	bkd.ProcessOutbound()
+
+	if len(relay.received) != 1 || !strings.Contains(relay.received[0], "hello") {
+		t.Fatalf("message not relayed: %v", relay.received)
+	}
+	queued, _ := blobClient.List("outbound/")
+	if len(queued) != 1 {
+		t.Fatalf("expected only the bounce to be queued, got %v", queued)
+	}
+	b, _ := blobClient.Get(queued[0])
+	om := OutboundMessage{}
+	json.Unmarshal(b, &om)
+	if om.From != "" || om.To[0] != "sender@sif.io" || !strings.Contains(string(om.Data), "Status: 5.1.1") {
+		t.Errorf("unexpected bounce %+v", om)
+	}
+
+	// the bounce is delivered and, with a null sender, is not itself bounced
+	bkd.ProcessOutbound()
+	if queued, _ := blobClient.List("outbound/"); len(queued) != 0 || len(relay.received) != 2 {
+		t.Errorf("bounce not sent: %v", queued)
+	}
+}
+
+func TestOpportunisticTLS(t *testing.T) {
+	cert := testCertificate(t)
+	for name, config := range map[string]*tls.Config{
+		// self-signed, and not for the 127.0.0.1 we connect to
+		"unverified": {Certificates: []tls.Certificate{cert}},
+		// the handshake fails, so the message goes in plaintext
+		"broken": {Certificates: []tls.Certificate{cert}, MaxVersion: tls.VersionTLS10},
+	} {
+		relay := &relayBackend{}
+		srv := smtp.NewServer(relay)
+		srv.TLSConfig = config
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		go srv.Serve(l)
+		defer srv.Close()
+
+		bkd := &Backend{Domain: "mx.sif.io", Relay: l.Addr().String()}
+		if err := bkd.send("sender@sif.io", []string{"someone@example.org"}, []byte("Subject: hi\r\n\r\nhello\r\n")); err != nil {
+			t.Errorf("%s: %v", name, err)
+		}
+		if len(relay.received) != 1 {
+			t.Errorf("%s: message not relayed", name)
+		}
+	}
+}
+
+func testCertificate(t *testing.T) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{SerialNumber: big.NewInt(1), DNSNames: []string{"localhost"}, NotBefore: time.Now(), NotAfter: time.Now().Add(time.Hour)}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
@@ -0,0 +1,101 @@
+package smtp
+
+import (
+	"bytes"
+	"strings"
+
+	"github.com/buckelij/sif.io/internal/clamd"
+	smtp "github.com/emersion/go-smtp"
+)
+
+// A VirusScanner checks message data for malware, e.g. a *clamd.Client
+type VirusScanner interface {
+	Scan([]byte) (clamd.Result, error)
+}
+
+// ScanAction is what happens to an infected message
+type ScanAction string
+
+const (
+	ScanReject     ScanAction = "reject"     // refuse the message at DATA
+	ScanQuarantine ScanAction = "quarantine" // store under `quarantine/` instead of `mail/`
+	ScanTag        ScanAction = "tag"        // deliver with an X-Virus-Status header
+)
+
+var (
+	// ErrInfected is returned at DATA when the scanner finds malware and the action is reject
+	ErrInfected = &smtp.SMTPError{
+		Code:         554,
+		EnhancedCode: smtp.EnhancedCode{5, 7, 1},
+		Message:      "Message rejected: virus detected",
+	}
+	// ErrScanFailed is returned at DATA when the scanner can't be reached
+	ErrScanFailed = &smtp.SMTPError{
+		Code:         451,
+		EnhancedCode: smtp.EnhancedCode{4, 3, 0},
+		Message:      "Virus scan failed, try again later",
+	}
+)
+
+// scan runs the Backend's scanner over the message data, if one is configured.
+// Scanned messages get an X-Virus-Status header, replacing any the sender
+// added so it can't be mistaken for ours; infected messages are rejected
+// with ErrInfected or marked for quarantine according to ScanAction.
+func (bkd *Backend) scan(m *Message) error {
+	if bkd.Scanner == nil {
+		return nil
+	}
+	res, err := bkd.Scanner.Scan(m.Data)
+	if err != nil {
+		m.logger().Error("virus scan failed", "err", err)
+		return ErrScanFailed
+	}
+	if !res.Infected {
+		m.Data = prependHeader(removeHeader(m.Data, "X-Virus-Status"), "X-Virus-Status", "Clean")
+		return nil
+	}
+	m.logger().Warn("virus detected", "from", m.From, "signature", res.Signature, "action", bkd.ScanAction)
+	switch bkd.ScanAction {
+	case ScanQuarantine:
+		m.Quarantine = res.Signature
+	case ScanTag:
+	default:
+		return ErrInfected
+	}
+	m.Data = prependHeader(removeHeader(m.Data, "X-Virus-Status"), "X-Virus-Status", "Infected ("+res.Signature+")")
+	return nil
+}
+
+// prependHeader adds a header field before the existing message header
+func prependHeader(data []byte, key, value string) []byte {
+	return append([]byte(key+": "+value+"\r\n"), data...)
+}
+
+// removeHeader removes every field named key, and its continuation lines,
+// from the message header. The rest of the message is left byte for byte.
+func removeHeader(data []byte, key string) []byte {
+	out := make([]byte, 0, len(data))
+	skip := false
+	for pos := 0; pos < len(data); {
+		end := bytes.IndexByte(data[pos:], '\n')
+		if end < 0 {
+			end = len(data)
+		} else {
+			end += pos + 1
+		}
+		line := data[pos:end]
+		if len(bytes.TrimRight(line, "\r\n")) == 0 {
+			// the blank line ends the header
+			return append(out, data[pos:]...)
+		}
+		if line[0] != ' ' && line[0] != '\t' {
+			name, _, _ := bytes.Cut(line, []byte(":"))
+			skip = strings.EqualFold(string(bytes.TrimSpace(name)), key)
+		}
+		if !skip {
+			out = append(out, line...)
+		}
+		pos = end
+	}
+	return out
+}
@@ -0,0 +1,57 @@
+package smtp
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/buckelij/sif.io/internal/clamd"
+)
+
+type testScanner struct {
+	res clamd.Result
+	err error
+}
+
+func (s testScanner) Scan([]byte) (clamd.Result, error) {
+	return s.res, s.err
+}
+
+func TestScan(t *testing.T) {
+	infected := testScanner{res: clamd.Result{Infected: true, Signature: "Eicar-Test-Signature"}}
+	for _, tc := range []struct {
+		scanner    VirusScanner
+		action     ScanAction
+		err        error
+		header     string
+		quarantine bool
+	}{
+		{nil, "", nil, "", false},
+		{testScanner{}, ScanReject, nil, "X-Virus-Status: Clean", false},
+		{infected, "", ErrInfected, "", false},
+		{infected, ScanQuarantine, nil, "X-Virus-Status: Infected (Eicar-Test-Signature)", true},
+		{infected, ScanTag, nil, "X-Virus-Status: Infected (Eicar-Test-Signature)", false},
+		{testScanner{err: errors.New("down")}, ScanTag, ErrScanFailed, "", false},
+	} {
+		bkd := &Backend{Scanner: tc.scanner, ScanAction: tc.action}
+		// a sender's own status is replaced
+		input := "X-Virus-Status: Clean\r\nSubject: hi\r\nx-virus-status: Clean,\r\n still\r\n\r\nX-Virus-Status: body"
+		m := Message{Data: []byte(input)}
+		if err := bkd.scan(&m); err != tc.err {
+			t.Errorf("%v: expected %v got %v", tc.action, tc.err, err)
+			continue
+		}
+		if tc.scanner == nil && string(m.Data) != input {
+			t.Errorf("message changed without a scanner: %q", m.Data)
+		}
+		if tc.err == nil && !strings.HasPrefix(string(m.Data), tc.header) {
+			t.Errorf("%v: expected header %q in %q", tc.action, tc.header, m.Data)
+		}
+		if tc.scanner != nil && tc.err == nil && (strings.Count(strings.ToLower(string(m.Data)), "x-virus-status") != 2 || strings.Contains(string(m.Data), "still")) {
+			t.Errorf("%v: sender's status not removed: %q", tc.action, m.Data)
+		}
+		if (m.Quarantine != "") != tc.quarantine {
+			t.Errorf("%v: unexpected quarantine %q", tc.action, m.Quarantine)
+		}
+	}
+}
@@ -0,0 +1,117 @@
+package smtp
+
+import (
+	"net/url"
+	"time"
+
+	"github.com/buckelij/sif.io/internal/blob"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// ValidCredentials compares password to the bcrypt hash under `bcrypt/<user>`
+func ValidCredentials(c blob.BlobClient, user, password string) bool {
+	hsh, err := c.Get("bcrypt/" + user)
+	if err != nil {
+		return false
+	}
+	return bcrypt.CompareHashAndPassword(hsh, []byte(password)) == nil
+}
+
+// Authenticate checks a mail client's login; the user name is the mailbox name
+func (bkd *Backend) Authenticate(user, password string) bool {
+	return ValidCredentials(bkd.BlobClient, user, password)
+}
+
+// MailboxMessages returns the messages in the mailbox's INBOX, oldest
+// first. Linked duplicates have the size of the message they link to.
+func (bkd *Backend) MailboxMessages(mailbox string) ([]IndexEntry, error) {
+	idx, err := LoadMailboxIndex(bkd.BlobClient, mailbox)
+	if err != nil {
+		return nil, err
+	}
+	return idx.FolderMessages(InboxFolder), nil
+}
+
+// ReadMessage returns a stored message
+func (bkd *Backend) ReadMessage(key string) ([]byte, error) {
+	return bkd.BlobClient.Get(key)
+}
+
+// DeleteMessages removes INBOX entries from the mailbox index, and deletes
+// the stored messages no other entry still refers to
+func (bkd *Backend) DeleteMessages(mailbox string, entries []IndexEntry) error {
+	uids := map[string]bool{}
+	for _, e := range entries {
+		uids[e.UID()] = true
+	}
+	return bkd.UpdateMailbox(mailbox, func(idx *MailboxIndex) error {
+		idx.Expunge(func(e IndexEntry) bool { return e.InFolder(InboxFolder) && uids[e.UID()] })
+		return nil
+	})
+}
+
+// MailboxIndex returns the mailbox's index with UIDs assigned to new deliveries
+func (bkd *Backend) MailboxIndex(mailbox string) (*MailboxIndex, error) {
+	idx, err := LoadMailboxIndex(bkd.BlobClient, mailbox)
+	if err != nil || !idx.AssignUIDs() {
+		return idx, err
+	}
+	// save the new UIDs under the lock, reloading in case of a delivery since
+	err = bkd.UpdateMailbox(mailbox, func(locked *MailboxIndex) error {
+		idx = locked
+		return nil
+	})
+	return idx, err
+}
+
+// UpdateMailbox applies f to the mailbox's index under the index lock, after
+// assigning UIDs, and saves it. Stored messages the index no longer refers to
+// are deleted.
+func (bkd *Backend) UpdateMailbox(mailbox string, f func(idx *MailboxIndex) error) error {
+	bkd.indexMu.Lock()
+	defer bkd.indexMu.Unlock()
+	idx, err := LoadMailboxIndex(bkd.BlobClient, mailbox)
+	if err != nil {
+		return err
+	}
+	before := idx.keys()
+	idx.AssignUIDs()
+	if err := f(idx); err != nil {
+		return err
+	}
+	if err := idx.Save(bkd.BlobClient, mailbox); err != nil {
+		return err
+	}
+	after := idx.keys()
+	for key := range before {
+		if after[key] {
+			continue
+		}
+		if err := bkd.BlobClient.Delete(key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// AppendMessage stores a message from a mail client in folder, returning the
+// folder's UIDVALIDITY and the message's UID
+func (bkd *Backend) AppendMessage(mailbox, folder string, flags []string, received time.Time, data []byte) (uidValidity, uid uint32, err error) {
+	key := "mail/" + url.QueryEscape(bkd.Domain) + "/" + url.QueryEscape(time.Now().String())
+	err = bkd.UpdateMailbox(mailbox, func(idx *MailboxIndex) error {
+		f := idx.Folder(folder)
+		if f == nil {
+			return ErrNoSuchFolder
+		}
+		if !idx.Fits(bkd.Quota, int64(len(data))) {
+			return ErrQuotaExceeded
+		}
+		if err := bkd.BlobClient.Put(key, data); err != nil {
+			return err
+		}
+		uidValidity = f.UIDValidity
+		uid, err = idx.AddToFolder(folder, key, int64(len(data)), flags, received)
+		return err
+	})
+	return uidValidity, uid, err
+}
@@ -0,0 +1,46 @@
+package smtp
+
+import (
+	"testing"
+	"time"
+)
+
+func TestDeleteMessages(t *testing.T) {
+	msg := []byte("Message-ID: <1@example.org>\r\n\r\nbody\r\n")
+	other := []byte("Subject: other\r\n\r\nbody\r\n")
+	blobClient := &memBlobClient{}
+	bkd := &Backend{BlobClient: blobClient, DedupeWindow: time.Hour, DedupeAction: DedupeLink}
+	bkd.store("mail/sif.io/1", "me", msg)
+	bkd.store("mail/sif.io/2", "me", msg) // linked to 1
+	bkd.store("mail/sif.io/3", "me", other)
+
+	entries, _ := bkd.MailboxMessages("me")
+	if len(entries) != 3 || entries[1].Size != int64(len(msg)) {
+		t.Fatalf("expected linked entries sized, got %+v", entries)
+	}
+	if entries[0].UID() == entries[1].UID() {
+		t.Error("linked duplicates share a UID")
+	}
+
+	// deleting the original keeps the blob for its duplicate
+	if err := bkd.DeleteMessages("me", entries[:1]); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := blobClient.Get("mail/sif.io/1"); err != nil {
+		t.Errorf("blob deleted while still linked: %v", err)
+	}
+	idx, _ := LoadMailboxIndex(blobClient, "me")
+	if len(idx.Messages) != 2 || idx.Messages[0].Linked || idx.Bytes != int64(len(msg)+len(other)) {
+		t.Errorf("unexpected index %+v", idx)
+	}
+
+	if err := bkd.DeleteMessages("me", entries[1:]); err != nil {
+		t.Fatal(err)
+	}
+	if mails, _ := blobClient.ListMail(); len(mails) != 0 {
+		t.Errorf("expected all blobs deleted, got %v", mails)
+	}
+	if idx, _ := LoadMailboxIndex(blobClient, "me"); len(idx.Messages) != 0 || idx.Bytes != 0 {
+		t.Errorf("unexpected index %+v", idx)
+	}
+}
@@ -0,0 +1,54 @@
+package smtp
+
+import (
+	"strings"
+	"time"
+
+	smtp "github.com/emersion/go-smtp"
+)
+
+// ErrSenderNotAllowed is returned when a mail client sends from an address
+// that isn't one of its mailbox's
+var ErrSenderNotAllowed = &smtp.SMTPError{
+	Code:         550,
+	EnhancedCode: smtp.EnhancedCode{5, 7, 1},
+	Message:      "Sender address not allowed",
+}
+
+// Addresses returns the addresses mailbox receives mail at, one per MxDomain
+func (bkd *Backend) Addresses(mailbox string) []string {
+	addrs := []string{}
+	for _, d := range strings.Split(bkd.MxDomains, ",") {
+		d, err := NormalizeDomain(strings.TrimSpace(d))
+		if err != nil || d == "" {
+			continue
+		}
+		addrs = append(addrs, mailbox+"@"+d)
+	}
+	return addrs
+}
+
+// Submit sends a message from a mail client logged in to mailbox. Recipients
+// in our MxDomains are delivered to directly and the rest are queued, with
+// failures reported to from as for relayed mail.
+func (bkd *Backend) Submit(mailbox, from string, to []string, data []byte) error {
+	addr, _, err := bkd.resolveRecipient(from)
+	if err != nil || MailboxName(addr) != strings.ToLower(mailbox) {
+		return ErrSenderNotAllowed
+	}
+	m := Message{From: addr, Recipients: to, Data: data, UTF8: !isASCII(addr), Received: time.Now()}
+	remote := []string{}
+	for _, rcpt := range to {
+		if _, _, err := bkd.resolveRecipient(rcpt); err != nil {
+			remote = append(remote, rcpt)
+			continue
+		}
+		if err := bkd.deliver(m, rcpt, false); err != nil {
+			return err
+		}
+	}
+	if len(remote) == 0 {
+		return nil
+	}
+	return bkd.enqueue(addr, remote, data, &m)
+}
@@ -0,0 +1,35 @@
+package smtp
+
+import (
+	"errors"
+	"slices"
+	"testing"
+)
+
+func TestSubmit(t *testing.T) {
+	blobClient := &memBlobClient{}
+	bkd := &Backend{Domain: "mx.sif.io", MxDomains: "sif.io, example.com", BlobClient: blobClient}
+	if addrs := bkd.Addresses("me"); !slices.Equal(addrs, []string{"me@sif.io", "me@example.com"}) {
+		t.Errorf("unexpected addresses %v", addrs)
+	}
+
+	data := []byte("Subject: hi\r\n\r\nbody\r\n")
+	if err := bkd.Submit("me", "you@sif.io", []string{"a@example.org"}, data); !errors.Is(err, ErrSenderNotAllowed) {
+		t.Errorf("expected ErrSenderNotAllowed for another mailbox, got %v", err)
+	}
+	if err := bkd.Submit("me", "me@example.org", []string{"a@example.org"}, data); !errors.Is(err, ErrSenderNotAllowed) {
+		t.Errorf("expected ErrSenderNotAllowed for another domain, got %v", err)
+	}
+
+	if err := bkd.Submit("me", "Me@sif.io", []string{"a@example.org", "b@example.org", "you@sif.io"}, data); err != nil {
+		t.Fatal(err)
+	}
+	bkd.Drain(t.Context())
+	queued := queuedMessages(t, blobClient)
+	if len(queued) != 1 || len(queued[0].To) != 2 || queued[0].From != "Me@sif.io" {
+		t.Errorf("expected the remote recipients queued, got %+v", queued)
+	}
+	if idx, _ := LoadMailboxIndex(blobClient, "you"); len(idx.Messages) != 1 {
+		t.Errorf("expected the local recipient delivered to, got %+v", idx)
+	}
+}
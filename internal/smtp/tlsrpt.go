@@ -0,0 +1,133 @@
+package smtp
+
+// SMTP TLS reports, see RFC 8460
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"mime"
+	"net/mail"
+	"strings"
+	"time"
+)
+
+// A TLSReport is a report of TLS failures sending mail to our MXs
+type TLSReport struct {
+	OrganizationName string            `json:"organization-name"`
+	DateRange        TLSReportRange    `json:"date-range"`
+	ContactInfo      string            `json:"contact-info"`
+	ReportID         string            `json:"report-id"`
+	Policies         []TLSReportPolicy `json:"policies"`
+}
+
+type TLSReportRange struct {
+	Start time.Time `json:"start-datetime"`
+	End   time.Time `json:"end-datetime"`
+}
+
+type TLSReportPolicy struct {
+	Policy struct {
+		Type   string   `json:"policy-type"`
+		String []string `json:"policy-string"`
+		Domain string   `json:"policy-domain"`
+		MxHost []string `json:"mx-host"`
+	} `json:"policy"`
+	Summary struct {
+		Successful int `json:"total-successful-session-count"`
+		Failed     int `json:"total-failure-session-count"`
+	} `json:"summary"`
+	FailureDetails []TLSReportFailure `json:"failure-details"`
+}
+
+type TLSReportFailure struct {
+	ResultType          string `json:"result-type"`
+	SendingMtaIP        string `json:"sending-mta-ip"`
+	ReceivingMxHostname string `json:"receiving-mx-hostname"`
+	ReceivingIP         string `json:"receiving-ip"`
+	FailedSessionCount  int    `json:"failed-session-count"`
+	FailureReasonCode   string `json:"failure-reason-code"`
+}
+
+// Successful is the total successful session count across policies
+func (r TLSReport) Successful() int {
+	n := 0
+	for _, p := range r.Policies {
+		n += p.Summary.Successful
+	}
+	return n
+}
+
+// Failed is the total failed session count across policies
+func (r TLSReport) Failed() int {
+	n := 0
+	for _, p := range r.Policies {
+		n += p.Summary.Failed
+	}
+	return n
+}
+
+// isTLSReport reports whether the message is a multipart/report of type
+// tlsrpt, RFC 8460 section 5.3
+func isTLSReport(data []byte) bool {
+	m, err := mail.ReadMessage(bytes.NewReader(data))
+	if err != nil {
+		return false
+	}
+	mediaType, params, err := mime.ParseMediaType(m.Header.Get("Content-Type"))
+	return err == nil && mediaType == "multipart/report" && params["report-type"] == "tlsrpt"
+}
+
+// ParseTLSReports returns the reports attached to a TLS-RPT message, which
+// are JSON, usually gzipped
+func ParseTLSReports(data []byte) ([]TLSReport, error) {
+	mm, err := ParseMimeMessage(data, nil)
+	if err != nil {
+		return nil, err
+	}
+	reports := []TLSReport{}
+	for name, part := range mm.AttachedMimeParts {
+		if bytes.HasPrefix(part, []byte{0x1f, 0x8b}) {
+			zr, err := gzip.NewReader(bytes.NewReader(part))
+			if err != nil {
+				return nil, err
+			}
+			if part, err = io.ReadAll(zr); err != nil {
+				return nil, err
+			}
+		} else if !strings.HasSuffix(name, ".json") {
+			continue
+		}
+		report := TLSReport{}
+		if err := json.Unmarshal(part, &report); err != nil {
+			return nil, err
+		}
+		reports = append(reports, report)
+	}
+	return reports, nil
+}
+
+// ingestTLSReports stores the reports in a TLS-RPT message under
+// `tlsrpt/<sha256>`. Report IDs are the sender's choice, so they'd let one
+// report replace another; the same report sent twice is stored once.
+func (bkd *Backend) ingestTLSReports(data []byte) {
+	reports, err := ParseTLSReports(data)
+	if err != nil {
+		slog.Warn("failed to parse TLS report", "err", err)
+		return
+	}
+	for _, r := range reports {
+		b, err := json.Marshal(r)
+		if err != nil {
+			continue
+		}
+		sum := sha256.Sum256(b)
+		if err := bkd.BlobClient.Put("tlsrpt/"+hex.EncodeToString(sum[:]), b); err != nil {
+			slog.Error("failed to store TLS report", "report", r.ReportID, "err", err)
+		}
+	}
+}
@@ -0,0 +1,126 @@
+package smtp
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+
+	"golang.org/x/net/xsrftoken"
+)
+
+const testTLSReport = `{
+	"organization-name": "Company-X",
+	"date-range": {"start-datetime": "2016-04-01T00:00:00Z", "end-datetime": "2016-04-01T23:59:59Z"},
+	"contact-info": "sts-reporting@company-x.example",
+	"report-id": "5065427c-23d3-47ca-b6e0-946ea0e8c4be",
+	"policies": [{
+		"policy": {"policy-type": "sts", "policy-domain": "sif.io", "mx-host": ["mx.sif.io"]},
+		"summary": {"total-successful-session-count": 5326, "total-failure-session-count": 303},
+		"failure-details": [{
+			"result-type": "certificate-expired",
+			"sending-mta-ip": "2001:db8:abcd:0012::1",
+			"receiving-mx-hostname": "mx.sif.io",
+			"failed-session-count": 100
+		}]
+	}]
+}`
+
+// tlsReportMessage returns a TLS-RPT message with the report gzipped
+func tlsReportMessage(report string) []byte {
+	var gz bytes.Buffer
+	zw := gzip.NewWriter(&gz)
+	zw.Write([]byte(report))
+	zw.Close()
+	return []byte("From: tlsrpt@company-x.example\r\n" +
+		"To: tlsrpt@sif.io\r\n" +
+		"TLS-Report-Domain: sif.io\r\n" +
+		"TLS-Report-Submitter: company-x.example\r\n" +
+		"MIME-Version: 1.0\r\n" +
+		"Content-Type: multipart/report; report-type=\"tlsrpt\"; boundary=\"b\"\r\n" +
+		"\r\n" +
+		"--b\r\n" +
+		"Content-Type: text/plain\r\n" +
+		"\r\n" +
+		"This is an aggregate TLS report from company-x.example\r\n" +
+		"--b\r\n" +
+		"Content-Type: application/tlsrpt+gzip\r\n" +
+		"Content-Disposition: attachment; filename=\"company-x.example!sif.io!1459468800!1459555199.json.gz\"\r\n" +
+		"Content-Transfer-Encoding: base64\r\n" +
+		"\r\n" +
+		base64.StdEncoding.EncodeToString(gz.Bytes()) + "\r\n" +
+		"--b--\r\n")
+}
+
+func TestTLSReport(t *testing.T) {
+	msg := tlsReportMessage(testTLSReport)
+	if !isTLSReport(msg) {
+		t.Fatal("not detected as a TLS report")
+	}
+	if isTLSReport([]byte("Subject: hi\r\n\r\nbody\r\n")) {
+		t.Error("plain message detected as a TLS report")
+	}
+	if isTLSReport([]byte("TLS-Report-Domain: sif.io\r\nSubject: hi\r\n\r\nbody\r\n")) {
+		t.Error("message with only a TLS-Report-Domain detected as a TLS report")
+	}
+
+	blobClient := &memBlobClient{}
+	bkd := &Backend{Domain: "mx.sif.io", MxDomains: "sif.io", BlobClient: blobClient, TLSRPTAddress: "tlsrpt@sif.io"}
+	bkd.deliver(Message{From: "tlsrpt@company-x.example", Data: msg}, "eli@sif.io", true)
+	bkd.Drain(context.Background())
+	if keys, _ := blobClient.List("tlsrpt/"); len(keys) != 0 {
+		t.Fatalf("report to another mailbox stored: %v", keys)
+	}
+	// a resent report is stored once, and another reusing its ID doesn't replace it
+	forged := tlsReportMessage(strings.Replace(testTLSReport, "Company-X", "Mallory", 1))
+	for _, data := range [][]byte{msg, msg, forged} {
+		bkd.deliver(Message{From: "tlsrpt@company-x.example", Data: data}, "TLSRPT@sif.io", true)
+	}
+	bkd.Drain(context.Background())
+	keys, _ := blobClient.List("tlsrpt/")
+	if len(keys) != 2 {
+		t.Fatalf("expected 2 reports, got %v", keys)
+	}
+	reports := []TLSReport{}
+	for _, k := range keys {
+		b, _ := blobClient.Get(k)
+		r := TLSReport{}
+		if err := json.Unmarshal(b, &r); err != nil {
+			t.Fatal(err)
+		}
+		reports = append(reports, r)
+	}
+	r := reports[slices.IndexFunc(reports, func(r TLSReport) bool { return r.OrganizationName == "Company-X" })]
+	if r.Successful() != 5326 || r.Failed() != 303 {
+		t.Errorf("unexpected report %+v", r)
+	}
+	if d := r.Policies[0].FailureDetails; len(d) != 1 || d[0].ResultType != "certificate-expired" {
+		t.Errorf("unexpected failure details %+v", d)
+	}
+}
+
+func TestTLSReportsHandler(t *testing.T) {
+	blobClient := &memBlobClient{}
+	(&Backend{BlobClient: blobClient}).ingestTLSReports(tlsReportMessage(testTLSReport))
+	wm := NewWebMailer("0123456789abcdef", blobClient, false, Quota{}, nil)
+	wm.AdminUser = "eli"
+	for user, want := range map[string]int{"eli": http.StatusOK, "bob": http.StatusForbidden} {
+		r := httptest.NewRequest("GET", "/tlsrpt", nil)
+		r.AddCookie(&http.Cookie{Name: "session", Value: xsrftoken.Generate(wm.xsrfSecret, user, "session")})
+		r.AddCookie(&http.Cookie{Name: "user", Value: user})
+		w := httptest.NewRecorder()
+		wm.tlsReportsHandler(w, r)
+		if w.Code != want {
+			t.Errorf("%s: expected %d, got %d", user, want, w.Code)
+		}
+		if shown := strings.Contains(w.Body.String(), "Company-X"); shown != (want == http.StatusOK) {
+			t.Errorf("%s: report shown %v", user, shown)
+		}
+	}
+}
@@ -0,0 +1,227 @@
+package smtp
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"mime"
+	"mime/quotedprintable"
+	"net/mail"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/buckelij/sif.io/internal/blob"
+	"github.com/google/uuid"
+)
+
+// vacationDays is how often a sender is replied to when Days isn't set, the
+// RFC 5230 default
+const vacationDays = 7
+
+// A Vacation is an out-of-office reply for a mailbox, stored under
+// `vacation/<mailbox>` and edited from the webmail
+type Vacation struct {
+	Enabled bool      `json:"enabled"`
+	Subject string    `json:"subject"` // "Auto: <original subject>" if empty
+	Body    string    `json:"body"`
+	Start   time.Time `json:"start,omitempty"` // replies are sent from Start, if set
+	End     time.Time `json:"end,omitempty"`   // until End, if set
+	Days    int       `json:"days,omitempty"`  // minimum days between replies to a sender
+}
+
+// vacationReplies records when each sender was last replied to, under
+// `vacation-replies/<mailbox>`. It is reset when the Vacation is saved.
+type vacationReplies map[string]time.Time
+
+func vacationKey(mailbox string) string {
+	return "vacation/" + url.QueryEscape(mailbox)
+}
+
+func vacationRepliesKey(mailbox string) string {
+	return "vacation-replies/" + url.QueryEscape(mailbox)
+}
+
+// LoadVacation returns the mailbox's vacation settings, disabled if there are none
+func LoadVacation(c blob.BlobClient, mailbox string) (*Vacation, error) {
+	b, err := c.Get(vacationKey(mailbox))
+	if errors.Is(err, blob.ErrNotFound) {
+		return &Vacation{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	v := &Vacation{}
+	return v, json.Unmarshal(b, v)
+}
+
+// Save stores the settings and forgets who has been replied to, so senders
+// get the new message
+func (v *Vacation) Save(c blob.BlobClient, mailbox string) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	if err := c.Put(vacationKey(mailbox), b); err != nil {
+		return err
+	}
+	return c.Delete(vacationRepliesKey(mailbox))
+}
+
+// Active reports whether replies should be sent at t
+func (v *Vacation) Active(t time.Time) bool {
+	return v.Enabled && (v.Start.IsZero() || !t.Before(v.Start)) && (v.End.IsZero() || t.Before(v.End))
+}
+
+func (v *Vacation) interval() time.Duration {
+	days := v.Days
+	if days <= 0 {
+		days = vacationDays
+	}
+	return time.Duration(days) * 24 * time.Hour
+}
+
+// listHeaders mark mail from mailing lists, RFC 2369 and RFC 2919
+var listHeaders = []string{"List-Id", "List-Help", "List-Unsubscribe", "List-Subscribe", "List-Post", "List-Owner", "List-Archive", "Mailing-List", "X-Mailing-List"}
+
+// automatedSenders are local parts that are never replied to, RFC 5230 4.6
+var automatedSenders = []string{"mailer-daemon", "postmaster", "listserv", "majordomo", "noreply", "no-reply"}
+
+// shouldAutoreply reports whether a message from sender to rcpt may be
+// answered automatically, following RFC 3834 section 2
+func (bkd *Backend) shouldAutoreply(sender, rcpt string, data []byte) bool {
+	if sender == "" {
+		return false
+	}
+	local, _, ok := cutAddress(sender)
+	if !ok {
+		return false
+	}
+	local = strings.ToLower(local)
+	for _, a := range automatedSenders {
+		if local == a {
+			return false
+		}
+	}
+	if strings.HasPrefix(local, "owner-") || strings.HasSuffix(local, "-request") {
+		return false
+	}
+	if addr, _, err := bkd.resolveRecipient(sender); err == nil && MailboxName(addr) == MailboxName(rcpt) {
+		return false
+	}
+
+	m, err := mail.ReadMessage(bytes.NewReader(data))
+	if err != nil {
+		return false
+	}
+	if a := strings.ToLower(strings.TrimSpace(m.Header.Get("Auto-Submitted"))); a != "" && a != "no" {
+		return false
+	}
+	switch strings.ToLower(strings.TrimSpace(m.Header.Get("Precedence"))) {
+	case "bulk", "list", "junk":
+		return false
+	}
+	for _, h := range listHeaders {
+		if m.Header.Get(h) != "" {
+			return false
+		}
+	}
+	if s := strings.ToLower(m.Header.Get("X-Auto-Response-Suppress")); strings.Contains(s, "oof") || strings.Contains(s, "all") {
+		return false
+	}
+	// only reply to mail addressed to the recipient, not to a list or Bcc they're on
+	for _, h := range []string{"To", "Cc"} {
+		addrs, _ := m.Header.AddressList(h)
+		for _, a := range addrs {
+			if addr, _, err := bkd.resolveRecipient(a.Address); err == nil && MailboxName(addr) == MailboxName(rcpt) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// autoreply queues the recipient's vacation reply to the sender of m, at most
+// once per sender in the vacation's interval
+func (bkd *Backend) autoreply(m Message, rcpt string) {
+	mailbox := MailboxName(rcpt)
+	v, err := LoadVacation(bkd.BlobClient, mailbox)
+	if err != nil {
+		m.logger().Warn("failed to load vacation", "mailbox", mailbox, "err", err)
+		return
+	}
+	now := time.Now()
+	if !v.Active(now) || !bkd.shouldAutoreply(m.From, rcpt, m.Data) {
+		return
+	}
+	sender := strings.ToLower(m.From)
+
+	bkd.vacationMu.Lock()
+	defer bkd.vacationMu.Unlock()
+	replies := vacationReplies{}
+	if b, err := bkd.BlobClient.Get(vacationRepliesKey(mailbox)); err == nil {
+		json.Unmarshal(b, &replies)
+	} else if !errors.Is(err, blob.ErrNotFound) {
+		m.logger().Warn("failed to load vacation replies", "mailbox", mailbox, "err", err)
+		return
+	}
+	if last, ok := replies[sender]; ok && now.Sub(last) < v.interval() {
+		return
+	}
+	for s, last := range replies {
+		if now.Sub(last) >= v.interval() {
+			delete(replies, s)
+		}
+	}
+	replies[sender] = now
+	b, _ := json.Marshal(replies)
+	if err := bkd.BlobClient.Put(vacationRepliesKey(mailbox), b); err != nil {
+		m.logger().Warn("failed to save vacation replies", "mailbox", mailbox, "err", err)
+		return
+	}
+
+	m.logger().Info("sending vacation reply", "to", m.From, "rcpt", rcpt)
+	// RFC 3834 3.3: auto-replies are sent with a null return path so they can't bounce back
+	if err := bkd.enqueue("", []string{m.From}, NewVacationReply(bkd.Domain, rcpt, m, v), nil); err != nil {
+		m.logger().Error("failed to queue vacation reply", "to", m.From, "err", err)
+	}
+}
+
+// NewVacationReply returns the reply from rcpt to the sender of m
+func NewVacationReply(domain, rcpt string, m Message, v *Vacation) []byte {
+	subject, messageID, references := "", "", ""
+	if orig, err := mail.ReadMessage(bytes.NewReader(m.Data)); err == nil {
+		subject, err = wordDecoder.DecodeHeader(orig.Header.Get("Subject"))
+		if err != nil {
+			subject = orig.Header.Get("Subject")
+		}
+		messageID = strings.TrimSpace(orig.Header.Get("Message-Id"))
+		references = strings.TrimSpace(orig.Header.Get("References"))
+	}
+	if v.Subject != "" {
+		subject = v.Subject
+	} else {
+		subject = "Auto: " + subject
+	}
+
+	b := bytes.Buffer{}
+	fmt.Fprintf(&b, "From: <%s>\r\n", rcpt)
+	fmt.Fprintf(&b, "To: <%s>\r\n", m.From)
+	fmt.Fprintf(&b, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", subject))
+	fmt.Fprintf(&b, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	fmt.Fprintf(&b, "Message-ID: <%s@%s>\r\n", uuid.NewString(), domain)
+	if messageID != "" {
+		fmt.Fprintf(&b, "In-Reply-To: %s\r\n", messageID)
+		fmt.Fprintf(&b, "References: %s\r\n", strings.TrimSpace(references+" "+messageID))
+	}
+	fmt.Fprintf(&b, "Auto-Submitted: auto-replied\r\n")
+	fmt.Fprintf(&b, "MIME-Version: 1.0\r\n")
+	fmt.Fprintf(&b, "Content-Type: text/plain; charset=utf-8\r\n")
+	fmt.Fprintf(&b, "Content-Transfer-Encoding: quoted-printable\r\n\r\n")
+	qp := quotedprintable.NewWriter(&b)
+	qp.Write([]byte(v.Body)) // line breaks are written as CRLF
+	qp.Close()
+	b.WriteString("\r\n")
+	return b.Bytes()
+}
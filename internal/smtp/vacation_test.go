@@ -0,0 +1,137 @@
+package smtp
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestShouldAutoreply(t *testing.T) {
+	bkd := &Backend{MxDomains: "sif.io"}
+	personal := "From: a@example.org\r\nTo: Me <me@sif.io>\r\nSubject: hi\r\n\r\nbody\r\n"
+	tests := []struct {
+		name   string
+		sender string
+		data   string
+		want   bool
+	}{
+		{"personal", "a@example.org", personal, true},
+		{"cc", "a@example.org", "To: b@example.org\r\nCc: me@sif.io\r\n\r\nbody\r\n", true},
+		{"null sender", "", personal, false},
+		{"mailer daemon", "MAILER-DAEMON@example.org", personal, false},
+		{"list owner", "owner-list@example.org", personal, false},
+		{"list request", "list-request@example.org", personal, false},
+		{"self", "me@sif.io", personal, false},
+		{"auto submitted", "a@example.org", "Auto-Submitted: auto-replied\r\n" + personal, false},
+		{"auto submitted no", "a@example.org", "Auto-Submitted: no\r\n" + personal, true},
+		{"bulk", "a@example.org", "Precedence: bulk\r\n" + personal, false},
+		{"list", "a@example.org", "Precedence: list\r\n" + personal, false},
+		{"list id", "a@example.org", "List-Id: <list.example.org>\r\n" + personal, false},
+		{"list unsubscribe", "a@example.org", "List-Unsubscribe: <mailto:u@example.org>\r\n" + personal, false},
+		{"suppressed", "a@example.org", "X-Auto-Response-Suppress: OOF, AutoReply\r\n" + personal, false},
+		{"bcc", "a@example.org", "To: list@example.org\r\n\r\nbody\r\n", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := bkd.shouldAutoreply(tt.sender, "me@sif.io", []byte(tt.data)); got != tt.want {
+				t.Errorf("expected %v", tt.want)
+			}
+		})
+	}
+}
+
+func TestVacationActive(t *testing.T) {
+	now := time.Date(2026, 7, 1, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name string
+		v    Vacation
+		want bool
+	}{
+		{"disabled", Vacation{}, false},
+		{"open ended", Vacation{Enabled: true}, true},
+		{"not started", Vacation{Enabled: true, Start: now.Add(time.Hour)}, false},
+		{"started", Vacation{Enabled: true, Start: now.Add(-time.Hour)}, true},
+		{"ended", Vacation{Enabled: true, End: now}, false},
+		{"in range", Vacation{Enabled: true, Start: now.Add(-time.Hour), End: now.Add(time.Hour)}, true},
+	}
+	for _, tt := range tests {
+		if got := tt.v.Active(now); got != tt.want {
+			t.Errorf("%s: expected %v", tt.name, tt.want)
+		}
+	}
+}
+
+func TestAutoreply(t *testing.T) {
+	blobClient := &memBlobClient{}
+	bkd := &Backend{Domain: "mx.sif.io", MxDomains: "sif.io", BlobClient: blobClient}
+	v := &Vacation{Enabled: true, Body: "Away until Monday.\nRegards", Days: 1}
+	if err := v.Save(blobClient, "me"); err != nil {
+		t.Fatal(err)
+	}
+	m := Message{From: "a@example.org", Data: []byte("From: a@example.org\r\nTo: me@sif.io\r\nSubject: lunch?\r\nMessage-ID: <1@example.org>\r\n\r\nbody\r\n")}
+
+	bkd.autoreply(m, "me@sif.io")
+	bkd.autoreply(m, "me@sif.io")
+	queued, _ := blobClient.List("outbound/")
+	if len(queued) != 1 {
+		t.Fatalf("expected one reply, got %v", queued)
+	}
+	om := OutboundMessage{}
+	b, _ := blobClient.Get(queued[0])
+	json.Unmarshal(b, &om)
+	reply := string(om.Data)
+	if om.From != "" || len(om.To) != 1 || om.To[0] != "a@example.org" {
+		t.Errorf("unexpected envelope %v %v", om.From, om.To)
+	}
+	for _, want := range []string{"From: <me@sif.io>\r\n", "Subject: Auto: lunch?\r\n", "In-Reply-To: <1@example.org>\r\n", "Auto-Submitted: auto-replied\r\n", "Away until Monday.\r\nRegards"} {
+		if !strings.Contains(reply, want) {
+			t.Errorf("expected %q in reply:\n%s", want, reply)
+		}
+	}
+
+	// another sender gets their own reply
+	other := m
+	other.From = "b@example.org"
+	bkd.autoreply(other, "me@sif.io")
+	if queued, _ := blobClient.List("outbound/"); len(queued) != 2 {
+		t.Errorf("expected a reply to the second sender, got %v", queued)
+	}
+
+	// saving the vacation again resets who has been replied to
+	v.Save(blobClient, "me")
+	bkd.autoreply(m, "me@sif.io")
+	if queued, _ := blobClient.List("outbound/"); len(queued) != 3 {
+		t.Errorf("expected a reply after saving, got %v", queued)
+	}
+}
+
+func TestVacationForm(t *testing.T) {
+	form := func(values url.Values) *Vacation {
+		r := httptest.NewRequest("POST", "/vacation", strings.NewReader(values.Encode()))
+		r.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+		v, err := vacationForm(r)
+		if err != nil {
+			return nil
+		}
+		return v
+	}
+	v := form(url.Values{"enabled": {"on"}, "body": {"away"}, "start": {"2026-07-01"}, "end": {"2026-07-14"}, "days": {"3"}})
+	if v == nil || !v.Enabled || v.Days != 3 {
+		t.Fatalf("unexpected %+v", v)
+	}
+	if !v.Active(time.Date(2026, 7, 14, 23, 0, 0, 0, time.UTC)) || v.Active(time.Date(2026, 7, 15, 0, 0, 0, 0, time.UTC)) {
+		t.Error("expected the end date to be inclusive")
+	}
+	if form(url.Values{"enabled": {"on"}}) != nil {
+		t.Error("expected a message to be required")
+	}
+	if form(url.Values{"body": {"away"}, "start": {"2026-07-14"}, "end": {"2026-07-01"}}) != nil {
+		t.Error("expected the end to be after the start")
+	}
+	if form(url.Values{"body": {"away"}, "days": {"0"}}) != nil {
+		t.Error("expected days to be positive")
+	}
+}
@@ -0,0 +1,145 @@
+package smtp
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"maps"
+	"net/http"
+	"net/mail"
+	"net/url"
+	"slices"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// webhookBackoff is the delay before the first retry, doubling on each attempt
+var webhookBackoff = 2 * time.Second
+
+// A Webhook is a URL that is POSTed a DeliveryEvent for each stored message.
+// Requests carry an `X-Sifio-Signature-256: sha256=<hex>` HMAC of the body
+// keyed with Secret.
+type Webhook struct {
+	URL     string
+	Secret  string
+	Retries int // attempts after the first, 3 if zero and none if negative
+}
+
+// A DeliveryEvent summarizes a stored message
+type DeliveryEvent struct {
+	Key         string    `json:"key"`
+	Mailbox     string    `json:"mailbox"`
+	Recipient   string    `json:"recipient"`
+	Sender      string    `json:"sender"`
+	From        string    `json:"from"`
+	To          string    `json:"to"`
+	Subject     string    `json:"subject"`
+	Snippet     string    `json:"snippet"`
+	Attachments []string  `json:"attachments"`
+	Size        int       `json:"size"`
+	Received    time.Time `json:"received"`
+}
+
+// a deadLetter is stored under `webhooks/dead/` when a webhook can't be delivered
+type deadLetter struct {
+	URL      string        `json:"url"`
+	Attempts int           `json:"attempts"`
+	Error    string        `json:"error"`
+	Event    DeliveryEvent `json:"event"`
+}
+
+// newDeliveryEvent parses the message for the event summary. Messages that
+// can't be parsed as MIME still get their headers summarized.
+func newDeliveryEvent(key, sender, rcpt string, data []byte) DeliveryEvent {
+	e := DeliveryEvent{
+		Key:         key,
+		Mailbox:     MailboxName(rcpt),
+		Recipient:   rcpt,
+		Sender:      sender,
+		Attachments: []string{},
+		Size:        len(data),
+		Received:    time.Now().UTC(),
+	}
+	if mm, err := ParseMimeMessage(data, nil); err == nil {
+		e.From, e.To, e.Subject = mm.From, mm.To, mm.Subject
+		e.Snippet = snippet(string(mm.TextContent), 200)
+		// sorted, so deliveries of the same message have the same payload
+		e.Attachments = slices.Sorted(maps.Keys(mm.AttachedMimeParts))
+	} else if m, err := mail.ReadMessage(bytes.NewReader(data)); err == nil {
+		e.From, e.To, e.Subject = m.Header.Get("From"), m.Header.Get("To"), m.Header.Get("Subject")
+	}
+	return e
+}
+
+// snippet returns the first n runes of s with whitespace collapsed
+func snippet(s string, n int) string {
+	s = strings.Join(strings.Fields(s), " ")
+	if utf8.RuneCountInString(s) <= n {
+		return s
+	}
+	return string([]rune(s)[:n])
+}
+
+// notify POSTs the event to each webhook, retrying with backoff. Webhooks
+// that still fail are recorded in blob storage.
+func (bkd *Backend) notify(e DeliveryEvent) {
+	body, err := json.Marshal(e)
+	if err != nil {
+		slog.Error("webhook", "err", err)
+		return
+	}
+	for _, wh := range bkd.Webhooks {
+		bkd.background(func() { bkd.post(wh, e, body) })
+	}
+}
+
+func (bkd *Backend) post(wh Webhook, e DeliveryEvent, body []byte) {
+	retries := wh.Retries
+	switch {
+	case retries == 0:
+		retries = 3
+	case retries < 0:
+		retries = 0
+	}
+	client := &http.Client{Timeout: 10 * time.Second}
+	mac := hmac.New(sha256.New, []byte(wh.Secret))
+	mac.Write(body)
+	signature := "sha256=" + hex.EncodeToString(mac.Sum(nil))
+
+	var err error
+	backoff := webhookBackoff
+	for attempt := 0; attempt <= retries; attempt++ {
+		if attempt > 0 {
+			time.Sleep(backoff)
+			backoff *= 2
+		}
+		var req *http.Request
+		req, err = http.NewRequest(http.MethodPost, wh.URL, bytes.NewReader(body))
+		if err != nil {
+			break
+		}
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("X-Sifio-Event", "delivery")
+		req.Header.Set("X-Sifio-Signature-256", signature)
+		var resp *http.Response
+		resp, err = client.Do(req)
+		if err == nil {
+			resp.Body.Close()
+			if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+				return
+			}
+			err = fmt.Errorf("status %d", resp.StatusCode)
+		}
+		slog.Warn("webhook failed", "url", wh.URL, "key", e.Key, "attempt", attempt+1, "err", err)
+	}
+
+	dead, _ := json.Marshal(deadLetter{URL: wh.URL, Attempts: retries + 1, Error: err.Error(), Event: e})
+	if err := bkd.BlobClient.Put("webhooks/dead/"+url.QueryEscape(time.Now().String()), dead); err != nil {
+		slog.Error("webhook dead letter", "url", wh.URL, "key", e.Key, "err", err)
+	}
+}
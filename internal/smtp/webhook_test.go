@@ -0,0 +1,88 @@
+package smtp
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestNotifyRetriesAndSigns(t *testing.T) {
+	webhookBackoff = time.Millisecond
+	var attempts atomic.Int32
+	received := make(chan DeliveryEvent, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if attempts.Add(1) == 1 {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		body, _ := io.ReadAll(r.Body)
+		mac := hmac.New(sha256.New, []byte("s3cret"))
+		mac.Write(body)
+		if r.Header.Get("X-Sifio-Signature-256") != "sha256="+hex.EncodeToString(mac.Sum(nil)) {
+			t.Error("invalid signature")
+		}
+		e := DeliveryEvent{}
+		json.Unmarshal(body, &e)
+		received <- e
+	}))
+	defer srv.Close()
+
+	bkd := &Backend{Webhooks: []Webhook{{URL: srv.URL, Secret: "s3cret"}}}
+	bkd.notify(newDeliveryEvent("mail/sif.io/1", "sender@example.org", "recipient@sif.io", simpleEmail))
+
+	select {
+	case e := <-received:
+		if e.Key != "mail/sif.io/1" || e.Mailbox != "recipient" || e.Subject != "test html mail" || e.Snippet != "*hi!*" {
+			t.Errorf("unexpected event %+v", e)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("webhook not delivered")
+	}
+}
+
+func TestNotifyDeadLetter(t *testing.T) {
+	webhookBackoff = time.Millisecond
+	for _, tc := range []struct{ retries, attempts int }{{1, 2}, {-1, 1}} {
+		var attempts atomic.Int32
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			attempts.Add(1)
+			w.WriteHeader(http.StatusInternalServerError)
+		}))
+		defer srv.Close()
+
+		testBlobClient := &TestBlobClient{}
+		testBlobClient.wg.Add(1)
+		bkd := &Backend{BlobClient: testBlobClient, Webhooks: []Webhook{{URL: srv.URL, Retries: tc.retries}}}
+		bkd.notify(newDeliveryEvent("mail/sif.io/1", "sender@example.org", "recipient@sif.io", []byte("Subject: plain\r\n\r\nhi")))
+		testBlobClient.wg.Wait()
+
+		if len(testBlobClient.uploaded) != 1 || !strings.HasPrefix(testBlobClient.uploaded[0], "webhooks/dead/") {
+			t.Errorf("retries %d: dead letter not stored: %v", tc.retries, testBlobClient.uploaded)
+		}
+		if int(attempts.Load()) != tc.attempts {
+			t.Errorf("retries %d: expected %d attempts, got %d", tc.retries, tc.attempts, attempts.Load())
+		}
+	}
+}
+
+func TestDeliveryEventAttachments(t *testing.T) {
+	message := "Content-Type: multipart/mixed; boundary=b\r\n\r\n"
+	for _, name := range []string{"c.pdf", "a.pdf", "b.pdf"} {
+		message += "--b\r\nContent-Type: application/pdf; name=" + name + "\r\n\r\n" + name + "\r\n"
+	}
+	message += "--b--\r\n"
+	for range 5 {
+		e := newDeliveryEvent("mail/sif.io/1", "sender@example.org", "recipient@sif.io", []byte(message))
+		if strings.Join(e.Attachments, ",") != "a.pdf,b.pdf,c.pdf" {
+			t.Fatalf("unexpected attachments %v", e.Attachments)
+		}
+	}
+}
@@ -1,43 +1,89 @@
 package smtp
 
 import (
+	"context"
 	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"html/template"
-	"log"
+	"log/slog"
+	"net"
 	"net/http"
+	"net/mail"
+	"os"
 	"slices"
+	"strconv"
 	"strings"
+	"time"
+	"unicode"
 
 	"github.com/buckelij/sif.io/internal/blob"
+	"github.com/buckelij/sif.io/internal/health"
+	"github.com/buckelij/sif.io/internal/proxyproto"
 	"github.com/buckelij/sif.io/internal/ssl"
 	"github.com/microcosm-cc/bluemonday"
-	"golang.org/x/crypto/bcrypt"
 	"golang.org/x/net/xsrftoken"
 )
 
 type Webmail struct {
+	Addr      string   // listen address, `0.0.0.0:8443` by default
+	TLSHosts  []string // hosts autocert may get certificates for
+	AdminUser string   // the user who may see TLS reports, nobody if empty
+
 	xsrfSecret string
 	blobClient blob.BlobClient
 	sanitizer  *bluemonday.Policy
 	noTls      bool
+	quota      Quota
+	proxies    []*net.IPNet
+	server     *http.Server
+	listening  health.Serving
 }
 
-func NewWebMailer(xsrfSecret string, blobClient blob.BlobClient, noTls bool) *Webmail {
+// NewWebMailer returns a webmail server. PROXY protocol headers are accepted
+// from connections from proxies.
+func NewWebMailer(xsrfSecret string, blobClient blob.BlobClient, noTls bool, quota Quota, proxies []*net.IPNet) *Webmail {
 	return &Webmail{
+		Addr:       "0.0.0.0:8443",
+		TLSHosts:   []string{"www.sif.io", "webmail.sif.io"},
 		xsrfSecret: xsrfSecret,
 		blobClient: blobClient,
 		sanitizer:  bluemonday.UGCPolicy(),
 		noTls:      noTls,
+		quota:      quota,
+		proxies:    proxies,
+		server:     &http.Server{},
+	}
+}
+
+// Usage is a mailbox's storage and message count against its quota
+type Usage struct {
+	Bytes    int64
+	Messages int
+	Quota    Quota
+}
+
+// Percent is the larger of the storage and message count usage, 0-100
+func (u Usage) Percent() int {
+	p := 0
+	if u.Quota.Bytes > 0 {
+		p = int(100 * u.Bytes / u.Quota.Bytes)
 	}
+	if u.Quota.Messages > 0 {
+		p = max(p, 100*u.Messages/u.Quota.Messages)
+	}
+	return min(p, 100)
 }
 
 func (wm *Webmail) ListenAndServeWebmail() {
-	http.HandleFunc("/", func(w http.ResponseWriter, req *http.Request) {
+	http.HandleFunc("/", instrument("/", func(w http.ResponseWriter, req *http.Request) {
 		if req.URL.Path != "/" {
 			http.NotFound(w, req)
 			return
 		}
 		mails := []string{}
+		var usage *Usage
 		if wm.validSession(req) {
 			var err error
 			mails, err = wm.blobClient.ListMail()
@@ -46,22 +92,57 @@ func (wm *Webmail) ListenAndServeWebmail() {
 				return
 			}
 			slices.Reverse(mails)
+			usage = wm.usage(req)
 		}
-		wm.page(wm.indexTmpl(), struct{ Mails []string }{Mails: mails})(w, req)
-	})
-	http.HandleFunc("/login", wm.loginFormHandler)
-	http.HandleFunc("/mail/", wm.showMailHandler)
+		wm.page(wm.indexTmpl(), struct {
+			Mails []string
+			Usage *Usage
+		}{Mails: mails, Usage: usage})(w, req)
+	}))
+	http.HandleFunc("/login", instrument("/login", wm.loginFormHandler))
+	http.HandleFunc("/mail/", instrument("/mail/", wm.showMailHandler))
+	http.HandleFunc("/tlsrpt", instrument("/tlsrpt", wm.tlsReportsHandler))
+	http.HandleFunc("/vacation", instrument("/vacation", wm.vacationHandler))
+	http.HandleFunc("/forward", instrument("/forward", wm.forwardHandler))
 
-	log.Println("Starting webmail server at", "0.0.0.0:8443")
+	slog.Info("starting webmail server", "addr", wm.Addr)
+	wm.server.Addr = wm.Addr
+	ln, err := net.Listen("tcp", wm.Addr)
+	if err != nil {
+		slog.Error("webmail listen", "err", err)
+		os.Exit(1)
+	}
+	if len(wm.proxies) > 0 {
+		ln = proxyproto.NewListener(ln, wm.proxies)
+	}
+	wm.listening.Set(true)
+	defer wm.listening.Set(false)
 	if wm.noTls {
-		log.Fatal(http.ListenAndServe("0.0.0.0:8443", nil))
+		err = wm.server.Serve(ln)
 	} else {
-		s := &http.Server{
-			Addr:      "0.0.0.0:8443",
-			TLSConfig: ssl.NewSSLmanager(wm.blobClient).TLSConfig(),
-		}
-		log.Fatal(s.ListenAndServeTLS("", ""))
+		wm.server.TLSConfig = ssl.NewSSLmanager(wm.blobClient, wm.TLSHosts...).TLSConfig()
+		err = wm.server.ServeTLS(ln, "", "")
 	}
+	if err != http.ErrServerClosed {
+		slog.Error("webmail server", "err", err)
+		os.Exit(1)
+	}
+}
+
+// Handle serves another handler, e.g. an API, alongside webmail. It must be
+// called before ListenAndServeWebmail.
+func (wm *Webmail) Handle(pattern string, h http.Handler) {
+	http.HandleFunc(pattern, instrument(pattern, h.ServeHTTP))
+}
+
+// Listening is a health check for the webmail listener
+func (wm *Webmail) Listening(ctx context.Context) error {
+	return wm.listening.Check(ctx)
+}
+
+// Shutdown stops accepting connections and waits for active requests
+func (wm *Webmail) Shutdown(ctx context.Context) error {
+	return wm.server.Shutdown(ctx)
 }
 
 // checks session, sets cors xsrf and other headers, renders page
@@ -76,10 +157,8 @@ func (wm *Webmail) page(content string, data any) func(http.ResponseWriter, *htt
 			Data       any
 		}{formToken, styleNonce, wm.validSession(req), data})
 		if err != nil {
-			log.Printf("failed render: %v", err)
+			slog.Error("failed render", "path", req.URL.Path, "err", err)
 		}
-
-		log.Printf("path=%q ip=%q", req.URL.Path, req.RemoteAddr)
 	}
 }
 
@@ -109,6 +188,8 @@ func (wm *Webmail) loginFormHandler(w http.ResponseWriter, req *http.Request) {
 		return
 	}
 	if wm.validCredentials(req.FormValue("user"), req.FormValue("password")) {
+		loginsTotal.WithLabelValues("success").Inc()
+		slog.Info("login", "user", req.FormValue("user"), "remote", req.RemoteAddr)
 		sessionCookie := xsrftoken.Generate(wm.xsrfSecret, req.FormValue("user"), "session")
 		http.SetCookie(w, &http.Cookie{
 			Name:     "user",
@@ -131,6 +212,8 @@ func (wm *Webmail) loginFormHandler(w http.ResponseWriter, req *http.Request) {
 		http.Redirect(w, req, "/", http.StatusFound)
 		return
 	} else {
+		loginsTotal.WithLabelValues("failure").Inc()
+		slog.Warn("login failed", "user", req.FormValue("user"), "remote", req.RemoteAddr)
 		http.Redirect(w, req, "/", http.StatusForbidden)
 		return
 	}
@@ -138,7 +221,6 @@ func (wm *Webmail) loginFormHandler(w http.ResponseWriter, req *http.Request) {
 
 // Shows a mail
 func (wm *Webmail) showMailHandler(w http.ResponseWriter, req *http.Request) {
-	defer log.Printf("path=%q ip=%q", req.URL.Path, req.RemoteAddr)
 	if !wm.validSession(req) {
 		w.WriteHeader(http.StatusForbidden)
 		return
@@ -146,7 +228,7 @@ func (wm *Webmail) showMailHandler(w http.ResponseWriter, req *http.Request) {
 
 	b, err := wm.blobClient.Get(strings.TrimPrefix(req.URL.EscapedPath(), "/mail/"))
 	if err != nil {
-		log.Printf("showMailHandler %v: %v", req.URL.EscapedPath(), err)
+		slog.Error("showMailHandler", "path", req.URL.EscapedPath(), "err", err)
 		return
 	}
 
@@ -159,6 +241,177 @@ func (wm *Webmail) showMailHandler(w http.ResponseWriter, req *http.Request) {
 	}
 }
 
+// Shows the admin user a summary of stored TLS reports, newest first
+func (wm *Webmail) tlsReportsHandler(w http.ResponseWriter, req *http.Request) {
+	if !wm.validSession(req) {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	if user, _ := req.Cookie("user"); wm.AdminUser == "" || user.Value != wm.AdminUser {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	keys, err := wm.blobClient.List("tlsrpt/")
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	reports := []TLSReport{}
+	for _, k := range keys {
+		b, err := wm.blobClient.Get(k)
+		if err != nil {
+			slog.Error("tlsReportsHandler", "key", k, "err", err)
+			continue
+		}
+		r := TLSReport{}
+		if err := json.Unmarshal(b, &r); err != nil {
+			slog.Error("tlsReportsHandler", "key", k, "err", err)
+			continue
+		}
+		reports = append(reports, r)
+	}
+	slices.SortFunc(reports, func(a, b TLSReport) int { return b.DateRange.Start.Compare(a.DateRange.Start) })
+	wm.page(wm.tlsReportsTmpl(), reports)(w, req)
+}
+
+// Shows and saves the logged in user's vacation reply
+func (wm *Webmail) vacationHandler(w http.ResponseWriter, req *http.Request) {
+	if !wm.validSession(req) {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	user, _ := req.Cookie("user")
+	if req.Method == http.MethodPost {
+		if !wm.validXsrf(req) {
+			http.Redirect(w, req, "/vacation", http.StatusForbidden)
+			return
+		}
+		v, err := vacationForm(req)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := v.Save(wm.blobClient, user.Value); err != nil {
+			slog.Error("vacationHandler", "user", user.Value, "err", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		http.Redirect(w, req, "/vacation", http.StatusFound)
+		return
+	}
+	v, err := LoadVacation(wm.blobClient, user.Value)
+	if err != nil {
+		slog.Error("vacationHandler", "user", user.Value, "err", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	wm.page(wm.vacationTmpl(), v)(w, req)
+}
+
+// vacationForm parses the vacation form. Dates are whole days in UTC, the
+// end date inclusive.
+func vacationForm(req *http.Request) (*Vacation, error) {
+	v := &Vacation{
+		Enabled: req.FormValue("enabled") != "",
+		Subject: strings.TrimSpace(req.FormValue("subject")),
+		Body:    req.FormValue("body"),
+	}
+	var err error
+	if s := req.FormValue("start"); s != "" {
+		if v.Start, err = time.Parse(time.DateOnly, s); err != nil {
+			return nil, fmt.Errorf("invalid start date %q", s)
+		}
+	}
+	if s := req.FormValue("end"); s != "" {
+		if v.End, err = time.Parse(time.DateOnly, s); err != nil {
+			return nil, fmt.Errorf("invalid end date %q", s)
+		}
+		v.End = v.End.AddDate(0, 0, 1)
+	}
+	if !v.Start.IsZero() && !v.End.IsZero() && !v.Start.Before(v.End) {
+		return nil, errors.New("the end date is before the start date")
+	}
+	if s := req.FormValue("days"); s != "" {
+		if v.Days, err = strconv.Atoi(s); err != nil || v.Days < 1 {
+			return nil, fmt.Errorf("invalid number of days %q", s)
+		}
+	}
+	if v.Enabled && strings.TrimSpace(v.Body) == "" {
+		return nil, errors.New("a message is required")
+	}
+	return v, nil
+}
+
+// Shows and saves the logged in user's forwarding addresses
+func (wm *Webmail) forwardHandler(w http.ResponseWriter, req *http.Request) {
+	if !wm.validSession(req) {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	user, _ := req.Cookie("user")
+	if req.Method == http.MethodPost {
+		if !wm.validXsrf(req) {
+			http.Redirect(w, req, "/forward", http.StatusForbidden)
+			return
+		}
+		f, err := forwardForm(req)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := f.Save(wm.blobClient, user.Value); err != nil {
+			slog.Error("forwardHandler", "user", user.Value, "err", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		http.Redirect(w, req, "/forward", http.StatusFound)
+		return
+	}
+	f, err := LoadForward(wm.blobClient, user.Value)
+	if err != nil {
+		slog.Error("forwardHandler", "user", user.Value, "err", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if f == nil {
+		f = &Forward{KeepCopy: true}
+	}
+	wm.page(wm.forwardTmpl(), f)(w, req)
+}
+
+// forwardForm parses the forwarding form. Addresses are separated by commas
+// or white space; none turns forwarding off.
+func forwardForm(req *http.Request) (*Forward, error) {
+	f := &Forward{To: []string{}, KeepCopy: req.FormValue("keep_copy") != ""}
+	for _, a := range strings.FieldsFunc(req.FormValue("to"), func(r rune) bool { return r == ',' || unicode.IsSpace(r) }) {
+		if parsed, err := mail.ParseAddress(a); err != nil || parsed.Address != a {
+			return nil, fmt.Errorf("invalid address %q", a)
+		}
+		addr, err := NormalizeAddress(a)
+		if err != nil {
+			return nil, fmt.Errorf("invalid address %q", a)
+		}
+		if !slices.Contains(f.To, addr) {
+			f.To = append(f.To, addr)
+		}
+	}
+	return f, nil
+}
+
+// usage returns the logged in user's mailbox usage, or nil if it can't be read
+func (wm *Webmail) usage(req *http.Request) *Usage {
+	user, err := req.Cookie("user")
+	if err != nil {
+		return nil
+	}
+	idx, err := LoadMailboxIndex(wm.blobClient, user.Value)
+	if err != nil {
+		slog.Warn("usage", "user", user.Value, "err", err)
+		return nil
+	}
+	return &Usage{Bytes: idx.Bytes, Messages: idx.stored(), Quota: idx.Limit(wm.quota)}
+}
+
 func (wm *Webmail) setSecurityHeaders(w http.ResponseWriter) (styleNonce string) {
 	styleNonce = base64.StdEncoding.EncodeToString([]byte(xsrftoken.Generate(wm.xsrfSecret, "", "style")))
 	w.Header().Set("X-Frame-Options", "DENY")
@@ -192,11 +445,7 @@ func (wm *Webmail) validXsrf(req *http.Request) bool {
 
 // auth handler, comparing to a bcrypt in blob storage
 func (wm *Webmail) validCredentials(user string, password string) bool {
-	hsh, err := wm.blobClient.Get("bcrypt/" + user)
-	if err != nil {
-		return false
-	}
-	return (bcrypt.CompareHashAndPassword(hsh, []byte(password)) == nil)
+	return ValidCredentials(wm.blobClient, user, password)
 }
 
 // HTML
@@ -205,6 +454,14 @@ func (wm *Webmail) indexTmpl() string {
 		<div class="flex-container">
 		<header><h2>Webmail</h2></header>
 			{{if .LoggedIn}}
+				{{with .Data.Usage}}
+					<div>
+						<meter min="0" max="100" high="90" value="{{ .Percent }}">{{ .Percent }}%</meter>
+						{{ .Bytes }}{{if .Quota.Bytes}} of {{ .Quota.Bytes }}{{end}} bytes,
+						{{ .Messages }}{{if .Quota.Messages}} of {{ .Quota.Messages }}{{end}} messages
+					</div>
+				{{end}}
+				<div><a href="/vacation">Vacation reply</a> <a href="/forward">Forwarding</a></div>
 				<ul>
 				{{ range .Data.Mails}}
 					<li><a href="/mail/{{.}}">{{.}}</a></li>
@@ -230,11 +487,12 @@ func (wm *Webmail) showMailTmpl() string {
 		<ul>
 		  <li><strong>From</strong>: {{ .Data.From }}</li>
 		  <li><strong>To</strong>: {{ .Data.To }}</li>
-		  <li><strong>Date</strong>: {{ .Data.Date }}</li>
+		  {{ if .Data.Header.Cc }}<li><strong>Cc</strong>: {{ range $i, $a := .Data.Header.Cc }}{{ if $i }}, {{ end }}{{ if $a.Name }}{{ $a.Name }} {{ end }}&lt;{{ $a.Address }}&gt;{{ end }}</li>{{ end }}
+		  {{ if not .Data.Date.IsZero }}<li><strong>Date</strong>: {{ .Data.Date.Format "Mon, 2 Jan 2006 15:04:05 -0700" }}</li>{{ end }}
 		  <li><strong>Subject</strong>: {{ .Data.Subject }}</li>
 		</ul>
 		{{if eq .Data.SanitizedHtmlContent ""}}
-			{{.RawContent}}
+			<pre>{{printf "%s" .Data.TextContent}}</pre>
 		{{else}}
 			{{.Data.SanitizedHtmlContent}}
 		{{end}}
@@ -249,6 +507,62 @@ func (wm *Webmail) showMailTmpl() string {
 	</div>`
 }
 
+func (wm *Webmail) tlsReportsTmpl() string {
+	return `<div>
+		<h3>TLS reports</h3>
+		<table>
+		<tr><th>Start</th><th>End</th><th>Organization</th><th>Successful</th><th>Failed</th><th>Failures</th></tr>
+		{{ range .Data }}
+			<tr>
+				<td>{{ .DateRange.Start.Format "2006-01-02" }}</td>
+				<td>{{ .DateRange.End.Format "2006-01-02" }}</td>
+				<td>{{ .OrganizationName }}</td>
+				<td>{{ .Successful }}</td>
+				<td>{{ .Failed }}</td>
+				<td>{{ range .Policies }}{{ range .FailureDetails }}{{ .ResultType }} {{ .ReceivingMxHostname }} ({{ .FailedSessionCount }})<br />{{ end }}{{ end }}</td>
+			</tr>
+		{{ end }}
+		</table>
+	</div>`
+}
+
+func (wm *Webmail) vacationTmpl() string {
+	return `<div>
+		<h3>Vacation reply</h3>
+		<form method="POST" action="/vacation">
+			<label><input type="checkbox" name="enabled" {{if .Data.Enabled}}checked{{end}}> Send replies</label><br />
+			<label>From:</label><br />
+			<input type="date" name="start" value="{{if not .Data.Start.IsZero}}{{ .Data.Start.Format "2006-01-02" }}{{end}}"><br />
+			<label>Until:</label><br />
+			<input type="date" name="end" value="{{if not .Data.End.IsZero}}{{ (.Data.End.AddDate 0 0 -1).Format "2006-01-02" }}{{end}}"><br />
+			<label>Subject:</label><br />
+			<input type="text" name="subject" value="{{ .Data.Subject }}" placeholder="Auto: original subject"><br />
+			<label>Message:</label><br />
+			<textarea name="body" rows="8" cols="60">{{ .Data.Body }}</textarea><br />
+			<label>Days between replies to the same sender:</label><br />
+			<input type="number" name="days" min="1" value="{{if .Data.Days}}{{ .Data.Days }}{{end}}" placeholder="7"><br />
+			<input type="hidden" name="xsrftoken" value="{{ .XsrfToken }}">
+			<input type="submit" value="Save">
+		</form>
+		<a href="/">Back</a>
+	</div>`
+}
+
+func (wm *Webmail) forwardTmpl() string {
+	return `<div>
+		<h3>Forwarding</h3>
+		<form method="POST" action="/forward">
+			<label>Forward to, one address per line:</label><br />
+			<textarea name="to" rows="4" cols="60">{{ range .Data.To }}{{ . }}
+{{ end }}</textarea><br />
+			<label><input type="checkbox" name="keep_copy" {{if .Data.KeepCopy}}checked{{end}}> Keep a copy</label><br />
+			<input type="hidden" name="xsrftoken" value="{{ .XsrfToken }}">
+			<input type="submit" value="Save">
+		</form>
+		<a href="/">Back</a>
+	</div>`
+}
+
 func (wm *Webmail) header() string {
 	return `<!DOCTYPE html>
 	<html>
@@ -30,13 +30,21 @@ func (c *TestBlobClient) Get(oid string) ([]byte, error) {
 	return v, nil
 }
 
+func (c *TestBlobClient) Delete(oid string) error {
+	return nil
+}
+
+func (c *TestBlobClient) List(prefix string) ([]string, error) {
+	return []string{}, nil
+}
+
 func (c *TestBlobClient) ListMail() ([]string, error) {
 	return []string{}, nil
 }
 
 func TestValidXsrf(t *testing.T) {
 	testBlobClient := &TestBlobClient{}
-	wm := NewWebMailer("123", testBlobClient, false)
+	wm := NewWebMailer("123", testBlobClient, false, Quota{}, nil)
 
 	formToken := xsrftoken.Generate(wm.xsrfSecret, "", "")
 	data := url.Values{}
@@ -53,7 +61,7 @@ func TestValidXsrf(t *testing.T) {
 
 func TestSetSecurityHeaders(t *testing.T) {
 	testBlobClient := &TestBlobClient{}
-	wm := NewWebMailer("123", testBlobClient, false)
+	wm := NewWebMailer("123", testBlobClient, false, Quota{}, nil)
 
 	rr := httptest.NewRecorder()
 	styleNonce := wm.setSecurityHeaders(rr)
@@ -64,7 +72,7 @@ func TestSetSecurityHeaders(t *testing.T) {
 
 func TestValidSession(t *testing.T) {
 	testBlobClient := &TestBlobClient{}
-	wm := NewWebMailer("123", testBlobClient, false)
+	wm := NewWebMailer("123", testBlobClient, false, Quota{}, nil)
 
 	formToken := xsrftoken.Generate(wm.xsrfSecret, "buckelij", "session")
 	data := url.Values{}
@@ -85,7 +93,7 @@ func TestValidCredentials(t *testing.T) {
 	gets = append(gets, hsh)
 	gets = append(gets, hsh)
 	testBlobClient := &TestBlobClient{gets: gets}
-	wm := NewWebMailer("123", testBlobClient, false)
+	wm := NewWebMailer("123", testBlobClient, false, Quota{}, nil)
 	if !wm.validCredentials("testuser", "testpass") {
 		t.Fatal()
 	}
@@ -0,0 +1,177 @@
+// Sender Rewriting Scheme, so forwarded mail passes SPF at the next hop and
+// its bounces find their way back to the original sender
+// see https://www.libsrs2.org/srs/srs.pdf
+package srs
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/base64"
+	"errors"
+	"strings"
+	"time"
+)
+
+var (
+	ErrNotSRS    = errors.New("srs: not an SRS address")
+	ErrInvalid   = errors.New("srs: invalid address")
+	ErrBadHash   = errors.New("srs: hash mismatch")
+	ErrExpired   = errors.New("srs: address expired")
+	errNoAddress = errors.New("srs: missing local part or domain")
+)
+
+// hashLength is the number of base64 characters of the HMAC kept
+const hashLength = 4
+
+// timestamps are days, base32 encoded in two characters, so they wrap every 1024 days
+const (
+	timeBase32    = "ABCDEFGHIJKLMNOPQRSTUVWXYZ234567"
+	timePrecision = 24 * time.Hour
+	timeSlots     = 1024
+)
+
+// A Rewriter rewrites envelope senders to addresses at Domain and reverses them
+type Rewriter struct {
+	Secret []byte
+	Domain string
+	MaxAge time.Duration // how long reversed addresses are accepted, 21 days if zero
+
+	now func() time.Time
+}
+
+// NewRewriter returns a Rewriter for addresses at domain
+func NewRewriter(secret, domain string) *Rewriter {
+	return &Rewriter{Secret: []byte(secret), Domain: domain}
+}
+
+// IsSRS reports whether an address or its local part looks like an SRS address
+func IsSRS(local string) bool {
+	local = strings.ToUpper(local)
+	return len(local) > 5 && (strings.HasPrefix(local, "SRS0") || strings.HasPrefix(local, "SRS1")) && strings.ContainsRune("=+-", rune(local[4]))
+}
+
+// Forward returns the address to use as the envelope sender when forwarding
+// mail from addr. Addresses already at Domain are returned unchanged, and
+// SRS addresses from other forwarders are rewritten as SRS1 so bounces go
+// straight back to the first forwarder.
+func (r *Rewriter) Forward(addr string) (string, error) {
+	local, domain, ok := cutAddress(addr)
+	if !ok {
+		return "", errNoAddress
+	}
+	if strings.EqualFold(domain, r.Domain) {
+		return addr, nil
+	}
+	switch strings.ToUpper(local[:min(len(local), 4)]) {
+	case "SRS0":
+		if len(local) < 5 {
+			break
+		}
+		// SRS1=HHHH=forwarder==HHHH=TT=domain=local
+		rest := local[4:]
+		return "SRS1=" + r.hash(domain, rest) + "=" + domain + "=" + rest + "@" + r.Domain, nil
+	case "SRS1":
+		if len(local) < 5 {
+			break
+		}
+		fields := strings.SplitN(local[5:], "=", 3)
+		if len(fields) < 3 {
+			break
+		}
+		// keep the first forwarder, with our own hash
+		return "SRS1=" + r.hash(fields[1], fields[2]) + "=" + fields[1] + "=" + fields[2] + "@" + r.Domain, nil
+	}
+	ts := r.timestamp()
+	return "SRS0=" + r.hash(ts, domain, local) + "=" + ts + "=" + domain + "=" + local + "@" + r.Domain, nil
+}
+
+// Reverse returns the address an SRS address at Domain was rewritten from:
+// the original sender for SRS0 and the first forwarder's SRS0 address for
+// SRS1. The hash and, for SRS0, the age are checked.
+func (r *Rewriter) Reverse(addr string) (string, error) {
+	local, _, ok := cutAddress(addr)
+	if !ok || !IsSRS(local) {
+		return "", ErrNotSRS
+	}
+	switch strings.ToUpper(local[:4]) {
+	case "SRS0":
+		fields := strings.SplitN(local[5:], "=", 4)
+		if len(fields) < 4 || fields[2] == "" || fields[3] == "" {
+			return "", ErrInvalid
+		}
+		hash, ts, domain, user := fields[0], fields[1], fields[2], fields[3]
+		if !r.validHash(hash, ts, domain, user) {
+			return "", ErrBadHash
+		}
+		if err := r.checkTimestamp(ts); err != nil {
+			return "", err
+		}
+		return user + "@" + domain, nil
+	default:
+		fields := strings.SplitN(local[5:], "=", 3)
+		if len(fields) < 3 || fields[1] == "" || fields[2] == "" {
+			return "", ErrInvalid
+		}
+		hash, forwarder, rest := fields[0], fields[1], fields[2]
+		if !r.validHash(hash, forwarder, rest) {
+			return "", ErrBadHash
+		}
+		return "SRS0" + rest + "@" + forwarder, nil
+	}
+}
+
+func (r *Rewriter) hash(parts ...string) string {
+	mac := hmac.New(sha1.New, r.Secret)
+	for _, p := range parts {
+		mac.Write([]byte(strings.ToLower(p)))
+	}
+	return base64.StdEncoding.EncodeToString(mac.Sum(nil))[:hashLength]
+}
+
+// validHash compares case-insensitively, as some MTAs change the case of local parts
+func (r *Rewriter) validHash(hash string, parts ...string) bool {
+	return hmac.Equal([]byte(strings.ToLower(hash)), []byte(strings.ToLower(r.hash(parts...))))
+}
+
+func (r *Rewriter) clock() time.Time {
+	if r.now != nil {
+		return r.now()
+	}
+	return time.Now()
+}
+
+func (r *Rewriter) timestamp() string {
+	day := int(r.clock().Unix()/int64(timePrecision/time.Second)) % timeSlots
+	return string([]byte{timeBase32[day>>5], timeBase32[day&31]})
+}
+
+func (r *Rewriter) checkTimestamp(ts string) error {
+	ts = strings.ToUpper(ts)
+	if len(ts) != 2 {
+		return ErrInvalid
+	}
+	hi, lo := strings.IndexByte(timeBase32, ts[0]), strings.IndexByte(timeBase32, ts[1])
+	if hi < 0 || lo < 0 {
+		return ErrInvalid
+	}
+	then := hi<<5 | lo
+	today := int(r.clock().Unix()/int64(timePrecision/time.Second)) % timeSlots
+	age := (today - then + timeSlots) % timeSlots
+	maxAge := r.MaxAge
+	if maxAge == 0 {
+		maxAge = 21 * timePrecision
+	}
+	if time.Duration(age)*timePrecision > maxAge {
+		return ErrExpired
+	}
+	return nil
+}
+
+// cutAddress splits an address on its last `@`
+func cutAddress(addr string) (local, domain string, ok bool) {
+	i := strings.LastIndex(addr, "@")
+	if i <= 0 || i == len(addr)-1 {
+		return "", "", false
+	}
+	return addr[:i], addr[i+1:], true
+}
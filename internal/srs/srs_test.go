@@ -0,0 +1,87 @@
+package srs
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRoundTrip(t *testing.T) {
+	r := NewRewriter("secret", "sif.io")
+	fwd, err := r.Forward("alice=x@example.org")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(fwd, "SRS0=") || !strings.HasSuffix(fwd, "=example.org=alice=x@sif.io") {
+		t.Errorf("unexpected %q", fwd)
+	}
+	orig, err := r.Reverse(fwd)
+	if err != nil || orig != "alice=x@example.org" {
+		t.Errorf("got %q %v", orig, err)
+	}
+	// MTAs may change the case of the local part
+	if orig, err := r.Reverse(strings.ToLower(fwd)); err != nil || orig != "alice=x@example.org" {
+		t.Errorf("lowercased: got %q %v", orig, err)
+	}
+	if same, _ := r.Forward("bob@SIF.io"); same != "bob@SIF.io" {
+		t.Errorf("local sender rewritten: %q", same)
+	}
+}
+
+func TestSRS1(t *testing.T) {
+	first := NewRewriter("first", "forwarder.example")
+	r := NewRewriter("secret", "sif.io")
+	srs0, _ := first.Forward("alice@example.org")
+	srs1, err := r.Forward(srs0)
+	if err != nil || !strings.HasPrefix(srs1, "SRS1=") || !strings.Contains(srs1, "=forwarder.example==") {
+		t.Fatalf("got %q %v", srs1, err)
+	}
+	back, err := r.Reverse(srs1)
+	if err != nil || back != srs0 {
+		t.Errorf("expected %q, got %q %v", srs0, back, err)
+	}
+	if orig, err := first.Reverse(back); err != nil || orig != "alice@example.org" {
+		t.Errorf("got %q %v", orig, err)
+	}
+
+	// another hop keeps the first forwarder
+	again, _ := NewRewriter("third", "third.example").Forward(srs1)
+	if !strings.Contains(again, "=forwarder.example==") || !strings.HasSuffix(again, "@third.example") {
+		t.Errorf("unexpected %q", again)
+	}
+}
+
+func TestReverseErrors(t *testing.T) {
+	r := NewRewriter("secret", "sif.io")
+	fwd, _ := r.Forward("alice@example.org")
+	tests := []struct {
+		name, addr string
+		want       error
+	}{
+		{"not srs", "alice@sif.io", ErrNotSRS},
+		{"wrong secret", mustForward(NewRewriter("other", "sif.io"), "alice@example.org"), ErrBadHash},
+		{"tampered", strings.Replace(fwd, "alice", "mallory", 1), ErrBadHash},
+		{"truncated", "SRS0=abcd=AA@sif.io", ErrInvalid},
+	}
+	for _, tt := range tests {
+		if _, err := r.Reverse(tt.addr); err != tt.want {
+			t.Errorf("%s: expected %v, got %v", tt.name, tt.want, err)
+		}
+	}
+
+	now := time.Now()
+	r.now = func() time.Time { return now.Add(-30 * 24 * time.Hour) }
+	old := mustForward(r, "alice@example.org")
+	r.now = nil
+	if _, err := r.Reverse(old); err != ErrExpired {
+		t.Errorf("expected expired, got %v", err)
+	}
+}
+
+func mustForward(r *Rewriter, addr string) string {
+	fwd, err := r.Forward(addr)
+	if err != nil {
+		panic(err)
+	}
+	return fwd
+}
@@ -0,0 +1,39 @@
+package ssl
+
+import (
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var certExpiry = promauto.NewGaugeVec(prometheus.GaugeOpts{
+	Name: "sifio_certificate_expiry_timestamp_seconds",
+	Help: "NotAfter of the cached certificate for each host.",
+}, []string{"host"})
+
+// recordExpiry sets the expiry gauge from an autocert cache entry. Other
+// entries, like the ACME account key, are ignored.
+func recordExpiry(key string, data []byte) {
+	if cert, err := leafCertificate(data); err == nil {
+		certExpiry.WithLabelValues(strings.TrimSuffix(key, "+rsa")).Set(float64(cert.NotAfter.Unix()))
+	}
+}
+
+// leafCertificate parses a certificate cache entry, which is a PEM private
+// key followed by the chain, leaf first
+func leafCertificate(data []byte) (*x509.Certificate, error) {
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			return nil, errors.New("no certificate")
+		}
+		if block.Type == "CERTIFICATE" {
+			return x509.ParseCertificate(block.Bytes)
+		}
+	}
+}
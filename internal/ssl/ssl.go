@@ -2,21 +2,39 @@ package ssl
 
 import (
 	"context"
-	"log"
+	"crypto/tls"
+	"fmt"
+	"log/slog"
 	"net/url"
+	"time"
 
 	"github.com/buckelij/sif.io/internal/blob"
 	"golang.org/x/crypto/acme/autocert"
 )
 
-func NewSSLmanager(c blob.BlobClient) *autocert.Manager {
+// NewSSLmanager returns an autocert manager for hosts
+func NewSSLmanager(c blob.BlobClient, hosts ...string) *autocert.Manager {
 	return &autocert.Manager{
 		Prompt:     autocert.AcceptTOS,
 		Cache:      SSLblobCache{c},
-		HostPolicy: autocert.HostWhitelist("www.sif.io", "webmail.sif.io"),
+		HostPolicy: autocert.HostWhitelist(hosts...),
 	}
 }
 
+// DefaultHost returns a copy of c that uses the certificate for host when the
+// client doesn't send a server name, as some mail clients don't
+func DefaultHost(c *tls.Config, host string) *tls.Config {
+	c = c.Clone()
+	getCertificate := c.GetCertificate
+	c.GetCertificate = func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+		if hello.ServerName == "" {
+			hello.ServerName = host
+		}
+		return getCertificate(hello)
+	}
+	return c
+}
+
 type SSLblobCache struct {
 	BlobClient blob.BlobClient
 }
@@ -29,15 +47,33 @@ func (s SSLblobCache) Get(ctx context.Context, key string) ([]byte, error) {
 	if err != nil {
 		return []byte{}, autocert.ErrCacheMiss
 	}
+	recordExpiry(key, d)
 
 	return d, err
 }
 
 func (s SSLblobCache) Put(ctx context.Context, key string, data []byte) error {
-	log.Println("saving certificate")
+	slog.Info("saving certificate", "key", key)
+	recordExpiry(key, data)
 	return s.BlobClient.Put("certs/"+url.QueryEscape(key), data)
 }
 
 func (s SSLblobCache) Delete(ctx context.Context, key string) error {
 	return nil
 }
+
+// CertificateValid returns an error unless the cache has an unexpired certificate for host
+func CertificateValid(ctx context.Context, cache autocert.Cache, host string) error {
+	data, err := cache.Get(ctx, host)
+	if err != nil {
+		return err
+	}
+	cert, err := leafCertificate(data)
+	if err != nil {
+		return err
+	}
+	if time.Now().After(cert.NotAfter) {
+		return fmt.Errorf("certificate for %v expired %v", host, cert.NotAfter)
+	}
+	return nil
+}
@@ -0,0 +1,31 @@
+package www
+
+import (
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+)
+
+// MtaStsPolicy returns an RFC 8461 policy file listing the MX hosts
+func MtaStsPolicy(mode string, mxs []string, maxAge int) string {
+	policy := fmt.Sprintf("version: STSv1\r\nmode: %s\r\n", mode)
+	for _, mx := range mxs {
+		policy += fmt.Sprintf("mx: %s\r\n", mx)
+	}
+	return policy + fmt.Sprintf("max_age: %d\r\n", maxAge)
+}
+
+// MtaSts serves the policy at /.well-known/mta-sts.txt on `mta-sts.` hosts
+func MtaSts(policy string) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, req *http.Request) {
+		if !strings.HasPrefix(req.Host, "mta-sts.") {
+			slog.Info("request", "path", req.URL.Path, "status", http.StatusNotFound, "remote", req.RemoteAddr)
+			http.NotFound(w, req)
+			return
+		}
+		slog.Info("request", "path", req.URL.Path, "status", http.StatusOK, "remote", req.RemoteAddr)
+		w.Header().Set("Content-Type", "text/plain")
+		fmt.Fprint(w, policy)
+	}
+}
@@ -3,14 +3,14 @@ package www
 
 import (
 	"fmt"
-	"log"
+	"log/slog"
 	"net/http"
 )
 
 func Index(i string) func(http.ResponseWriter, *http.Request) {
 	return func(w http.ResponseWriter, req *http.Request) {
 		if req.URL.Path != "/" {
-			log.Printf("path=%q ip=%q status=404", req.URL.Path, req.RemoteAddr)
+			slog.Info("request", "path", req.URL.Path, "status", http.StatusNotFound, "remote", req.RemoteAddr)
 			http.NotFound(w, req)
 			return
 		}
@@ -20,7 +20,7 @@ func Index(i string) func(http.ResponseWriter, *http.Request) {
 
 func Page(page string) func(http.ResponseWriter, *http.Request) {
 	return func(w http.ResponseWriter, req *http.Request) {
-		log.Printf("path=%q ip=%q status=200", req.URL.Path, req.RemoteAddr)
+		slog.Info("request", "path", req.URL.Path, "status", http.StatusOK, "remote", req.RemoteAddr)
 		fmt.Fprint(w, page)
 	}
 }
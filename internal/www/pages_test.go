@@ -68,3 +68,25 @@ func TestPage(t *testing.T) {
 		t.Error("unexpected response body")
 	}
 }
+
+func TestMtaSts(t *testing.T) {
+	policy := MtaStsPolicy("enforce", []string{"mx.sif.io"}, 604800)
+	if policy != "version: STSv1\r\nmode: enforce\r\nmx: mx.sif.io\r\nmax_age: 604800\r\n" {
+		t.Errorf("unexpected policy %q", policy)
+	}
+
+	req := httptest.NewRequest("GET", "https://mta-sts.sif.io/.well-known/mta-sts.txt", nil)
+	w := httptest.NewRecorder()
+	MtaSts(policy)(w, req)
+	body, _ := io.ReadAll(w.Result().Body)
+	if w.Result().Header.Get("Content-Type") != "text/plain" || string(body) != policy {
+		t.Errorf("unexpected response %v %q", w.Result().Header, body)
+	}
+
+	req = httptest.NewRequest("GET", "https://www.sif.io/.well-known/mta-sts.txt", nil)
+	w = httptest.NewRecorder()
+	MtaSts(policy)(w, req)
+	if w.Result().StatusCode != 404 {
+		t.Error("policy served on a non mta-sts host")
+	}
+}